@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/urfave/cli/v2"
+)
+
+// pluginPrefix is the prefix of the executables on PATH that are exposed as commands, e.g. protos-foo as 'protos foo'
+const pluginPrefix = "protos-"
+
+var cmdAlias *cli.Command = &cli.Command{
+	Name:  "alias",
+	Usage: "Manage command aliases",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List aliases",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listAliases()
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<name> <command>",
+			Usage:     "Create or update an alias, e.g. protos alias set up \"instance start\"",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				command := strings.Join(c.Args().Tail(), " ")
+				if name == "" || command == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				// subcommands run in their own app, so the builtin commands are looked up in the root one
+				lineage := c.Lineage()
+				if lineage[len(lineage)-1].App.Command(name) != nil || name == "help" || name == "h" {
+					return errors.Errorf("Alias '%s' would shadow the '%s' command", name, name)
+				}
+				return setAlias(name, command)
+			},
+		},
+		{
+			Name:      "delete",
+			ArgsUsage: "<name>",
+			Usage:     "Delete an alias",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return deleteAlias(name)
+			},
+		},
+	},
+}
+
+//
+// Alias methods
+//
+
+func listAliases() error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range cfg.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliases := cfg.Aliases
+	if aliases == nil {
+		aliases = map[string]string{}
+	}
+	return printOutput(aliases, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Alias", "Command")
+		for _, name := range names {
+			fmt.Fprintf(w, "\n %s\t%s\t", name, cfg.Aliases[name])
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+func setAlias(name string, command string) error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	if cfg.Aliases == nil {
+		cfg.Aliases = map[string]string{}
+	}
+	cfg.Aliases[name] = command
+	err = userconfig.Save(configPath(), cfg)
+	if err != nil {
+		return err
+	}
+	log.Infof("Alias '%s' set to '%s'", name, command)
+	return nil
+}
+
+func deleteAlias(name string) error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	if _, found := cfg.Aliases[name]; !found {
+		return notFoundError(fmt.Sprintf("Alias '%s' not found", name))
+	}
+	delete(cfg.Aliases, name)
+	return userconfig.Save(configPath(), cfg)
+}
+
+// expandArgs replaces a user defined alias in args with the command it stands for. If the command is neither a
+// builtin command nor an alias, but a plugin executable named protos-<command> is found on PATH, the plugin is run
+// and the process exits with its exit code. Aliases are split on spaces, and can't refer to other aliases
+func expandArgs(app *cli.App, args []string) ([]string, error) {
+	// the command is the first argument that is not a global flag or the value of one
+	valueFlags := map[string]bool{}
+	for _, flag := range app.Flags {
+		if _, isBool := flag.(*cli.BoolFlag); isBool {
+			continue
+		}
+		for _, name := range flag.Names() {
+			valueFlags["-"+name] = true
+			valueFlags["--"+name] = true
+		}
+	}
+	i := 1
+	for i < len(args) && strings.HasPrefix(args[i], "-") {
+		if valueFlags[args[i]] {
+			i++
+		}
+		i++
+	}
+	if i >= len(args) {
+		return args, nil
+	}
+	name := args[i]
+	if app.Command(name) != nil || name == "help" || name == "h" {
+		return args, nil
+	}
+
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return nil, err
+	}
+	if command, found := cfg.Aliases[name]; found {
+		expanded := append([]string{}, args[:i]...)
+		expanded = append(expanded, strings.Fields(command)...)
+		return append(expanded, args[i+1:]...), nil
+	}
+
+	plugin, err := exec.LookPath(pluginPrefix + name)
+	if err != nil {
+		// not a plugin either, which is reported by the regular command handling
+		return args, nil
+	}
+	cmd := exec.Command(plugin, args[i+1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to run plugin '%s'", plugin)
+	}
+	os.Exit(0)
+	return nil, nil
+}
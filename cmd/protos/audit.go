@@ -0,0 +1,447 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Results of the audit checks
+const (
+	auditPass = "pass"
+	auditWarn = "warn" // counts for half of the weight of the check
+	auditFail = "fail"
+	auditSkip = "skip" // the check doesn't apply or couldn't run, and doesn't count towards the score
+)
+
+// auditPublicPorts are the TCP ports expected to be reachable on an instance, besides its SSH port
+var auditPublicPorts = []int{80, 443}
+
+var cmdInstanceAudit *cli.Command = &cli.Command{
+	Name:      "audit",
+	ArgsUsage: "<name>",
+	Usage:     "Check the security of an instance over SSH: open ports, Protos version, default credentials, data volume encryption and firewall. Prints a score out of 100 and the commands fixing the issues found",
+	Flags: []cli.Flag{
+		&cli.IntFlag{
+			Name:  "min-score",
+			Usage: "Exit with an error if the score is under `SCORE`, e.g. in scheduled checks",
+		},
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		name := c.Args().Get(0)
+		if name == "" {
+			cli.ShowSubcommandHelp(c)
+			return cli.Exit("", 1)
+		}
+		name, err := resolveInstanceName(name)
+		if err != nil {
+			return err
+		}
+		return auditInstance(name, c.Int("min-score"))
+	},
+}
+
+// auditCheck is the result of one of the security checks of an instance
+type auditCheck struct {
+	Name        string
+	Weight      int // points of the score the check is worth
+	Status      string
+	Detail      string
+	Remediation []string `json:",omitempty"` // commands fixing the issue, or instructions when there are none
+}
+
+type auditReport struct {
+	Instance string
+	Score    int // out of 100, over the checks that weren't skipped
+	Checks   []auditCheck
+}
+
+//
+// Instance audit methods
+//
+
+func auditInstance(name string, minScore int) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return err
+	}
+
+	report := auditReport{Instance: name}
+	report.Checks = append(report.Checks,
+		auditOpenPorts(instance, sshClient),
+		auditVersion(instance),
+		auditCredentials(instance, sshClient),
+		auditEncryption(instance, sshClient),
+		auditFirewall(instance, sshClient),
+	)
+	report.Score = auditScore(report.Checks)
+
+	err = printOutput(report, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "Check", "Result", "Points", "Detail")
+		for _, check := range report.Checks {
+			points := "-"
+			if check.Status != auditSkip {
+				points = fmt.Sprintf("%d/%d", auditPoints(check), check.Weight)
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t", check.Name, formatAuditStatus(check.Status), points, check.Detail)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+
+		fmt.Printf("\nScore: %d/100\n", report.Score)
+		for _, check := range report.Checks {
+			if len(check.Remediation) == 0 {
+				continue
+			}
+			fmt.Printf("\nTo fix '%s':\n", check.Name)
+			for _, step := range check.Remediation {
+				fmt.Printf("  %s\n", step)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if minScore > 0 && report.Score < minScore {
+		return errors.Errorf("Instance '%s' scored %d, under the minimum of %d", name, report.Score, minScore)
+	}
+	return nil
+}
+
+// auditScore returns the points earned by the checks that weren't skipped, out of 100
+func auditScore(checks []auditCheck) int {
+	earned, total := 0, 0
+	for _, check := range checks {
+		if check.Status == auditSkip {
+			continue
+		}
+		earned += auditPoints(check)
+		total += check.Weight
+	}
+	if total == 0 {
+		return 0
+	}
+	return earned * 100 / total
+}
+
+func auditPoints(check auditCheck) int {
+	switch check.Status {
+	case auditPass:
+		return check.Weight
+	case auditWarn:
+		return check.Weight / 2
+	}
+	return 0
+}
+
+// auditOpenPorts lists the TCP ports listening on other addresses than the loopback, and reports the ones besides SSH
+// and the web ports. Providers may filter them further, but the instance should not rely on it
+func auditOpenPorts(instance cloud.InstanceInfo, sshClient *gossh.Client) auditCheck {
+	check := auditCheck{Name: "Open ports", Weight: 25}
+	out, err := ssh.ExecuteCommand("ss -tln 2>/dev/null || netstat -tln", sshClient)
+	if err != nil {
+		check.Status = auditSkip
+		check.Detail = "Failed to list the listening ports: " + err.Error()
+		return check
+	}
+	allowed := map[int]bool{instanceSSHPort(instance): true}
+	for _, port := range auditPublicPorts {
+		allowed[port] = true
+	}
+	unexpected := []int{}
+	for _, port := range parseListeningPorts(out) {
+		if !allowed[port] {
+			unexpected = append(unexpected, port)
+		}
+	}
+	if len(unexpected) == 0 {
+		check.Status = auditPass
+		check.Detail = "Only the SSH and web ports are open"
+		return check
+	}
+	check.Status = auditFail
+	ports := []string{}
+	for _, port := range unexpected {
+		ports = append(ports, strconv.Itoa(port))
+		check.Remediation = append(check.Remediation, fmt.Sprintf("protos instance ssh %s -- iptables -A INPUT -p tcp --dport %d -j DROP", instance.Name, port))
+	}
+	check.Detail = "Unexpected ports open on public addresses: " + strings.Join(ports, ", ")
+	check.Remediation = append([]string{fmt.Sprintf("Stop the services listening on them, or bind them to 127.0.0.1. Find them using: protos instance ssh %s -- ss -tlnp", instance.Name)}, check.Remediation...)
+	return check
+}
+
+// parseListeningPorts returns the ports listening on non loopback addresses, from the output of 'ss -tln' or
+// 'netstat -tln', which both have the local address in the fourth column
+func parseListeningPorts(output string) []int {
+	seen := map[int]bool{}
+	ports := []int{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		i := strings.LastIndex(fields[3], ":")
+		if i < 0 {
+			continue
+		}
+		port, err := strconv.Atoi(fields[3][i+1:])
+		if err != nil {
+			continue
+		}
+		host := strings.Trim(fields[3][:i], "[]")
+		if j := strings.Index(host, "%"); j >= 0 {
+			host = host[:j]
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			continue
+		}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// instanceSSHPort returns the port SSH listens on, part of the instance address when it's not the default one
+func instanceSSHPort(instance cloud.InstanceInfo) int {
+	if _, port, err := net.SplitHostPort(instance.PublicIP); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	return 22
+}
+
+// auditVersion compares the Protos version of the instance with the latest release, or with the one it is pinned to
+func auditVersion(instance cloud.InstanceInfo) auditCheck {
+	check := auditCheck{Name: "Protos version", Weight: 15, Status: auditSkip}
+	if instance.Version == "" {
+		check.Detail = "Unknown, the instance was deployed by an older CLI"
+		return check
+	}
+	if _, err := semver.NewVersion(instance.Version); err != nil {
+		check.Detail = fmt.Sprintf("'%s' is not a Protos release", instance.Version)
+		return check
+	}
+	releases, err := getProtosReleases()
+	if err != nil {
+		check.Detail = "Failed to retrieve the releases: " + err.Error()
+		return check
+	}
+	target := instance.PinnedVersion
+	if target == "" {
+		latest, err := releases.GetLatest()
+		if err != nil {
+			check.Detail = "Failed to retrieve the latest release: " + err.Error()
+			return check
+		}
+		target = latest.Version
+	}
+	missing, err := releases.Between(instance.Version, target)
+	if err != nil {
+		check.Detail = "Failed to compare the versions: " + err.Error()
+		return check
+	}
+	if len(missing) == 0 {
+		check.Status = auditPass
+		check.Detail = fmt.Sprintf("Runs %s, its target version", instance.Version)
+		return check
+	}
+	// a single missed release is common between upgrades, more suggests the instance is forgotten
+	check.Status = auditWarn
+	if len(missing) > 1 {
+		check.Status = auditFail
+	}
+	check.Detail = fmt.Sprintf("Runs %s, %d release(s) behind %s", instance.Version, len(missing), target)
+	check.Remediation = []string{
+		"See what changed using: protos instance outdated",
+		fmt.Sprintf("Back up the instance, then deploy a replacement from the backup: protos instance deploy --cloud %s --location %s --version %s --from-snapshot <snapshot id> <name>", instance.CloudName, instance.Location, target),
+	}
+	return check
+}
+
+// auditCredentials checks that root can't log in without a key: it should have no usable password, and SSH should not
+// accept passwords
+func auditCredentials(instance cloud.InstanceInfo, sshClient *gossh.Client) auditCheck {
+	check := auditCheck{Name: "Default credentials", Weight: 25}
+	out, err := ssh.ExecuteCommand(`awk -F: '$1 == "root" { print "password=" $2 }' /etc/shadow; sshd -T 2>/dev/null | grep -i -E '^(passwordauthentication|permitemptypasswords) '; true`, sshClient)
+	if err != nil {
+		check.Status = auditSkip
+		check.Detail = "Failed to read the credentials settings: " + err.Error()
+		return check
+	}
+	settings := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "password=") {
+			settings["password"] = strings.TrimPrefix(line, "password=")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			settings[strings.ToLower(fields[0])] = strings.ToLower(fields[1])
+		}
+	}
+
+	password, found := settings["password"]
+	// locked accounts have a password field starting with ! or *, which can't match any password
+	hasPassword := found && !strings.HasPrefix(password, "!") && !strings.HasPrefix(password, "*")
+	sshPasswords := settings["passwordauthentication"] == "yes"
+	problems := []string{}
+	if found && password == "" {
+		problems = append(problems, "root has an empty password")
+		check.Remediation = append(check.Remediation, fmt.Sprintf("protos instance ssh %s -- passwd -l root", instance.Name))
+	} else if hasPassword {
+		problems = append(problems, "root has a password")
+		check.Remediation = append(check.Remediation, fmt.Sprintf("protos instance ssh %s -- passwd -l root", instance.Name))
+	}
+	if sshPasswords || settings["permitemptypasswords"] == "yes" {
+		problems = append(problems, "SSH accepts passwords")
+		check.Remediation = append(check.Remediation, fmt.Sprintf(`protos instance ssh %s -- "sed -i -E 's/^#?(PasswordAuthentication|PermitEmptyPasswords).*/\1 no/' /etc/ssh/sshd_config && (systemctl reload sshd || systemctl reload ssh)"`, instance.Name))
+	}
+
+	switch {
+	case len(problems) == 0:
+		check.Status = auditPass
+		check.Detail = "root can only log in using a key"
+	case (found && password == "") || (hasPassword && sshPasswords):
+		check.Status = auditFail
+		check.Detail = strings.Join(problems, ", ")
+	default:
+		// a password that can't be used over SSH, or SSH passwords without any password set, are only a risk later
+		check.Status = auditWarn
+		check.Detail = strings.Join(problems, ", ")
+	}
+	if !found {
+		check.Detail += ". root is not in /etc/shadow"
+	}
+	return check
+}
+
+// auditEncryption checks that the data volume of the instance is encrypted with LUKS, so that the data can't be read
+// from the provider side, e.g. from a leaked snapshot
+func auditEncryption(instance cloud.InstanceInfo, sshClient *gossh.Client) auditCheck {
+	check := auditCheck{Name: "Data volume encryption", Weight: 15, Status: auditSkip}
+	volume, err := dataVolume(instance.Name)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	if !volumeIDRegexp.MatchString(volume.VolumeID) {
+		check.Detail = fmt.Sprintf("Volume ID '%s' contains unexpected characters", volume.VolumeID)
+		return check
+	}
+	out, err := ssh.ExecuteCommand(fmt.Sprintf(`for link in /dev/disk/by-id/*%s*; do if [ -e "$link" ]; then device=$(readlink -f "$link"); echo "device=$device"; lsblk -n -r -o TYPE "$device"; break; fi; done`, volume.VolumeID), sshClient)
+	if err != nil {
+		check.Detail = "Failed to inspect the data volume: " + err.Error()
+		return check
+	}
+	device := ""
+	encrypted := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "device=") {
+			device = strings.TrimPrefix(line, "device=")
+		} else if line == "crypt" {
+			encrypted = true
+		}
+	}
+	if device == "" {
+		check.Detail = fmt.Sprintf("Volume '%s' (%s) was not found on the instance", volume.Name, volume.VolumeID)
+		return check
+	}
+	if encrypted {
+		check.Status = auditPass
+		check.Detail = fmt.Sprintf("Volume '%s' (%s) is encrypted", volume.Name, device)
+		return check
+	}
+	check.Status = auditFail
+	check.Detail = fmt.Sprintf("Volume '%s' (%s) is not encrypted", volume.Name, device)
+	check.Remediation = []string{
+		"Encrypting a volume erases it, so the data has to be moved: back up the instance, create a new volume, format it using 'cryptsetup luksFormat', then copy the data to it",
+		fmt.Sprintf("protos volume create --cloud %s --location %s <name>", instance.CloudName, instance.Location),
+		fmt.Sprintf("protos volume attach <volume id> %s", instance.Name),
+	}
+	return check
+}
+
+// auditFirewall checks that the instance drops incoming traffic by default, using iptables or nftables
+func auditFirewall(instance cloud.InstanceInfo, sshClient *gossh.Client) auditCheck {
+	check := auditCheck{Name: "Firewall", Weight: 20}
+	out, err := ssh.ExecuteCommand("{ iptables -S INPUT || nft list chain inet filter input; } 2>/dev/null; true", sshClient)
+	if err != nil {
+		check.Status = auditSkip
+		check.Detail = "Failed to read the firewall rules: " + err.Error()
+		return check
+	}
+	rules := strings.TrimSpace(out)
+	lower := strings.ToLower(rules)
+	dropsByDefault := strings.Contains(rules, "-P INPUT DROP") || strings.Contains(lower, "policy drop")
+	dropRules := strings.Contains(lower, "-j drop") || strings.Contains(lower, "-j reject") || strings.Contains(lower, " drop") || strings.Contains(lower, " reject")
+
+	sshPort := instanceSSHPort(instance)
+	fix := []string{
+		fmt.Sprintf("protos instance ssh %s -- iptables -A INPUT -i lo -j ACCEPT", instance.Name),
+		fmt.Sprintf("protos instance ssh %s -- iptables -A INPUT -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT", instance.Name),
+	}
+	for _, port := range append([]int{sshPort}, auditPublicPorts...) {
+		fix = append(fix, fmt.Sprintf("protos instance ssh %s -- iptables -A INPUT -p tcp --dport %d -j ACCEPT", instance.Name, port))
+	}
+	fix = append(fix, fmt.Sprintf("protos instance ssh %s -- iptables -P INPUT DROP", instance.Name))
+
+	switch {
+	case rules == "":
+		check.Status = auditFail
+		check.Detail = "No firewall rules found (iptables and nftables are missing or empty)"
+		check.Remediation = fix
+	case dropsByDefault:
+		check.Status = auditPass
+		check.Detail = "Incoming traffic is dropped by default"
+	case dropRules:
+		check.Status = auditWarn
+		check.Detail = "Some incoming traffic is dropped, but everything else is accepted by default"
+		check.Remediation = fix[len(fix)-1:]
+	default:
+		check.Status = auditFail
+		check.Detail = "All incoming traffic is accepted"
+		check.Remediation = fix
+	}
+	return check
+}
+
+// formatAuditStatus colors the result of a check, unless plain output is requested
+func formatAuditStatus(status string) string {
+	if plainOutput {
+		return status
+	}
+	color := "\x1b[39m"
+	switch status {
+	case auditPass:
+		color = "\x1b[32m"
+	case auditWarn:
+		color = "\x1b[33m"
+	case auditFail:
+		color = "\x1b[31m"
+	}
+	return color + status + "\x1b[0m"
+}
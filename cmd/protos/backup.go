@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/urfave/cli/v2"
+)
+
+// backupScheduleSlack is subtracted from the time between backups when checking if one is due, so that a scheduler
+// running 'protos backup run' at a slightly irregular pace doesn't skip a run
+const backupScheduleSlack = 10 * time.Minute
+
+var backupIntervals = map[string]time.Duration{
+	"@hourly":  time.Hour,
+	"@daily":   24 * time.Hour,
+	"@weekly":  7 * 24 * time.Hour,
+	"@monthly": 30 * 24 * time.Hour,
+}
+
+var cmdBackup *cli.Command = &cli.Command{
+	Name:  "backup",
+	Usage: "Back up instances on a schedule, by snapshotting their volumes, and prune the old backups",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "schedule",
+			ArgsUsage: "<instance>",
+			Usage:     "Set when an instance is backed up and how many backups are kept. The backups are taken by 'protos backup run'",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "every",
+					Usage: "`SCHEDULE` of the backups: @hourly, @daily, @weekly, @monthly, or the time between backups, e.g. 12h",
+					Value: "@daily",
+				},
+				&cli.IntFlag{
+					Name:  "keep-daily",
+					Usage: "Keep the newest backup of each of the last `N` days",
+				},
+				&cli.IntFlag{
+					Name:  "keep-weekly",
+					Usage: "Keep the newest backup of each of the last `N` weeks",
+				},
+				&cli.IntFlag{
+					Name:  "keep-monthly",
+					Usage: "Keep the newest backup of each of the last `N` months",
+				},
+				&cli.BoolFlag{
+					Name:  "disable",
+					Usage: "Stop backing up the instance. Its existing backups are kept",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				if c.Bool("disable") {
+					return disableBackups(name)
+				}
+				policy := cloud.BackupPolicy{Schedule: c.String("every"), KeepDaily: c.Int("keep-daily"), KeepWeekly: c.Int("keep-weekly"), KeepMonthly: c.Int("keep-monthly")}
+				return scheduleBackups(name, policy)
+			},
+		},
+		{
+			Name:      "run",
+			ArgsUsage: "[instance]",
+			Usage:     "Back up the instances whose backup is due, or only the given one, then prune their old backups. Meant to be run hourly by a scheduler, see 'protos backup cron'",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Back up the instances even if their backup is not due yet",
+				},
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name != "" {
+					var err error
+					name, err = resolveInstanceName(name)
+					if err != nil {
+						return err
+					}
+				}
+				return withTimeout(c, func() error {
+					return runBackups(name, c.Bool("force"))
+				})
+			},
+		},
+		{
+			Name:  "status",
+			Usage: "Show the backup schedule of the instances, their last successful backup and when the next one is due",
+			Flags: []cli.Flag{outputFlag()},
+			Action: func(c *cli.Context) error {
+				return backupStatus()
+			},
+		},
+		{
+			Name:  "cron",
+			Usage: "Print a crontab entry that runs the scheduled backups every hour. Install it using 'crontab -e'",
+			Action: func(c *cli.Context) error {
+				return printBackupCron()
+			},
+		},
+	},
+}
+
+//
+// Backup methods
+//
+
+// backupInterval returns the time between the backups of a schedule
+func backupInterval(schedule string) (time.Duration, error) {
+	if interval, found := backupIntervals[schedule]; found {
+		return interval, nil
+	}
+	interval, err := time.ParseDuration(schedule)
+	if err != nil {
+		return 0, errors.Errorf("Invalid backup schedule '%s'. Use @hourly, @daily, @weekly, @monthly or a duration like 12h", schedule)
+	}
+	if interval < time.Hour {
+		return 0, errors.Errorf("Invalid backup schedule '%s'. Backups can be taken at most every hour", schedule)
+	}
+	return interval, nil
+}
+
+// nextBackup returns when the next backup of an instance is due. A zero time means it's due now
+func nextBackup(policy cloud.BackupPolicy) time.Time {
+	interval, err := backupInterval(policy.Schedule)
+	if err != nil || policy.LastSuccess.IsZero() {
+		return time.Time{}
+	}
+	return policy.LastSuccess.Add(interval)
+}
+
+func scheduleBackups(name string, policy cloud.BackupPolicy) error {
+	_, err := backupInterval(policy.Schedule)
+	if err != nil {
+		return err
+	}
+	if policy.KeepDaily < 0 || policy.KeepWeekly < 0 || policy.KeepMonthly < 0 {
+		return errors.New("The number of backups kept can't be negative")
+	}
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	client, _, err := initCloudClient(instance.CloudName, instance.Location)
+	if err != nil {
+		return err
+	}
+	if !client.Capabilities().Snapshots {
+		return cloud.NotSupported(client, "volume snapshots")
+	}
+
+	// the state of the previous schedule is kept, so that changing the schedule doesn't trigger a backup
+	if instance.BackupPolicy != nil {
+		policy.LastAttempt = instance.BackupPolicy.LastAttempt
+		policy.LastSuccess = instance.BackupPolicy.LastSuccess
+		policy.LastError = instance.BackupPolicy.LastError
+	}
+	instance.BackupPolicy = &policy
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Instance '%s' is backed up %s, keeping %s. Make sure 'protos backup run' is run regularly, e.g. using 'protos backup cron'", name, formatSchedule(policy.Schedule), formatRetention(policy))
+	return nil
+}
+
+func disableBackups(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if instance.BackupPolicy == nil {
+		log.Infof("Instance '%s' has no backup schedule", name)
+		return nil
+	}
+	instance.BackupPolicy = nil
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Instance '%s' is not backed up anymore. Its existing backups are listed by 'protos instance backups %s'", name, name)
+	return nil
+}
+
+// runBackups backs up the instances whose backup is due, or only instance name if not empty, and prunes their old
+// backups. The result of every backup is recorded on the instance, and a failure doesn't prevent backing up the other
+// instances
+func runBackups(name string, force bool) error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	failed := 0
+	for _, instance := range instances {
+		if name != "" && instance.Name != name {
+			continue
+		}
+		if instance.BackupPolicy == nil {
+			if name != "" {
+				return errors.Errorf("Instance '%s' has no backup schedule. Set one using 'protos backup schedule %s'", name, name)
+			}
+			continue
+		}
+		next := nextBackup(*instance.BackupPolicy)
+		if !force && time.Now().Before(next.Add(-backupScheduleSlack)) {
+			log.Debugf("Backup of instance '%s' is not due until %s", instance.Name, formatTime(next))
+			continue
+		}
+
+		err = backupInstance(&instance)
+		instance.BackupPolicy.LastAttempt = time.Now()
+		if err != nil {
+			log.Errorf("Backup of instance '%s' failed: %s", instance.Name, err.Error())
+			instance.BackupPolicy.LastError = err.Error()
+			failed++
+		} else {
+			instance.BackupPolicy.LastSuccess = instance.BackupPolicy.LastAttempt
+			instance.BackupPolicy.LastError = ""
+		}
+		saveErr := dbp.SaveInstance(instance)
+		if saveErr != nil {
+			return errors.Wrapf(saveErr, "Failed to save instance '%s'", instance.Name)
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed to back up %d instance(s). See 'protos backup status'", failed)
+	}
+	return nil
+}
+
+// backupInstance snapshots the volumes of a running instance, then prunes its scheduled backups according to its
+// policy. The snapshots are taken while the instance runs, so they are crash consistent
+func backupInstance(instance *cloud.InstanceInfo) error {
+	client, _, err := initCloudClient(instance.CloudName, instance.Location)
+	if err != nil {
+		return err
+	}
+	if !client.Capabilities().Snapshots {
+		return cloud.NotSupported(client, "volume snapshots")
+	}
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get details for instance '%s'", instance.Name)
+	}
+	if len(vmInfo.Volumes) == 0 {
+		return errors.Errorf("Instance '%s' has no volumes to back up", instance.Name)
+	}
+	log.Infof("Backing up instance '%s'", instance.Name)
+	err = backupInstanceVolumes(client, *instance, vmInfo.Volumes, true)
+	if err != nil {
+		return err
+	}
+	return pruneBackups(client, *instance)
+}
+
+// pruneBackups deletes the scheduled backups of an instance that its policy doesn't keep
+func pruneBackups(client cloud.Provider, instance cloud.InstanceInfo) error {
+	all, err := dbp.GetAllBackups()
+	if err != nil {
+		return err
+	}
+	backups := []cloud.BackupInfo{}
+	for _, backup := range all {
+		if backup.Instance == instance.Name && backup.Scheduled {
+			backups = append(backups, backup)
+		}
+	}
+
+	for _, backup := range expiredBackups(backups, *instance.BackupPolicy) {
+		log.Infof("Pruning backup '%s' (%s) of instance '%s', taken %s", backup.Name, backup.SnapshotID, instance.Name, formatTime(backup.Created))
+		err = client.DeleteSnapshot(backup.SnapshotID)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to prune backup '%s'", backup.Name)
+		}
+		err = dbp.DeleteBackup(backup.SnapshotID)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove backup '%s' from the db", backup.Name)
+		}
+	}
+	return nil
+}
+
+// expiredBackups returns the backups not kept by the policy. The snapshots of the volumes of an instance taken
+// together share their creation time, and are kept or expired together. The newest backup is always kept
+func expiredBackups(backups []cloud.BackupInfo, policy cloud.BackupPolicy) []cloud.BackupInfo {
+	if policy.KeepDaily == 0 && policy.KeepWeekly == 0 && policy.KeepMonthly == 0 {
+		return []cloud.BackupInfo{}
+	}
+	times := []time.Time{}
+	seen := map[time.Time]bool{}
+	for _, backup := range backups {
+		if !seen[backup.Created] {
+			seen[backup.Created] = true
+			times = append(times, backup.Created)
+		}
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].After(times[j]) })
+
+	keep := map[time.Time]bool{}
+	if len(times) > 0 {
+		keep[times[0]] = true
+	}
+	periods := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{policy.KeepWeekly, func(t time.Time) string { year, week := t.ISOWeek(); return fmt.Sprintf("%d-%d", year, week) }},
+		{policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		kept := map[string]bool{}
+		for _, t := range times {
+			if len(kept) >= p.count {
+				break
+			}
+			period := p.period(t.Local())
+			if !kept[period] {
+				kept[period] = true
+				keep[t] = true
+			}
+		}
+	}
+
+	expired := []cloud.BackupInfo{}
+	for _, backup := range backups {
+		if !keep[backup.Created] {
+			expired = append(expired, backup)
+		}
+	}
+	return expired
+}
+
+// instanceBackupStatus summarizes the backups of an instance
+type instanceBackupStatus struct {
+	Instance    string
+	Schedule    string
+	Retention   string
+	LastSuccess time.Time
+	LastError   string
+	NextBackup  time.Time // zero if due now
+	Backups     int       // number of backups kept, counting the final ones
+}
+
+func backupStatus() error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	backups, err := dbp.GetAllBackups()
+	if err != nil {
+		return err
+	}
+	counts := map[string]map[time.Time]bool{}
+	for _, backup := range backups {
+		if counts[backup.Instance] == nil {
+			counts[backup.Instance] = map[time.Time]bool{}
+		}
+		counts[backup.Instance][backup.Created] = true
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	statuses := []instanceBackupStatus{}
+	for _, instance := range instances {
+		status := instanceBackupStatus{Instance: instance.Name, Backups: len(counts[instance.Name])}
+		if instance.BackupPolicy != nil {
+			status.Schedule = instance.BackupPolicy.Schedule
+			status.Retention = formatRetention(*instance.BackupPolicy)
+			status.LastSuccess = instance.BackupPolicy.LastSuccess
+			status.LastError = instance.BackupPolicy.LastError
+			status.NextBackup = nextBackup(*instance.BackupPolicy)
+		}
+		statuses = append(statuses, status)
+	}
+
+	return printOutput(statuses, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Instance", "Schedule", "Retention", "Backups", "Last success", "Next backup", "Last error")
+		for _, s := range statuses {
+			if s.Schedule == "" {
+				fmt.Fprintf(w, "\n %s\t-\t-\t%d\t-\t-\t\t", s.Instance, s.Backups)
+				continue
+			}
+			lastSuccess, next := "never", "now"
+			if !s.LastSuccess.IsZero() {
+				lastSuccess = formatTime(s.LastSuccess)
+			}
+			if s.NextBackup.After(time.Now()) {
+				next = formatTime(s.NextBackup)
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%d\t%s\t%s\t%s\t", s.Instance, s.Schedule, s.Retention, s.Backups, lastSuccess, next, s.LastError)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// printBackupCron prints a crontab entry running the scheduled backups every hour, logging to the CLI log file
+func printBackupCron() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Failed to find the path of the CLI")
+	}
+	// a minute derived from the user name spreads the runs of several users of the same cloud account
+	minute := 0
+	for _, c := range os.Getenv("USER") {
+		minute += int(c)
+	}
+	fmt.Printf("# Run the scheduled Protos backups every hour. Logs are written to %s\n", filepath.Join(dirs.Logs(), "protos.log"))
+	fmt.Printf("%d * * * * %s --log-file backup run >/dev/null 2>&1\n", minute%60, shellQuote(executable))
+	return nil
+}
+
+func formatSchedule(schedule string) string {
+	if strings.HasPrefix(schedule, "@") {
+		return strings.TrimPrefix(schedule, "@")
+	}
+	return "every " + schedule
+}
+
+func formatRetention(policy cloud.BackupPolicy) string {
+	parts := []string{}
+	if policy.KeepDaily > 0 {
+		parts = append(parts, fmt.Sprintf("%d daily", policy.KeepDaily))
+	}
+	if policy.KeepWeekly > 0 {
+		parts = append(parts, fmt.Sprintf("%d weekly", policy.KeepWeekly))
+	}
+	if policy.KeepMonthly > 0 {
+		parts = append(parts, fmt.Sprintf("%d monthly", policy.KeepMonthly))
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, ", ")
+}
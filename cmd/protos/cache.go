@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/protosio/cli/internal/release"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// defaultCacheMaxSize is the size the cache is kept under, unless the cache-max-size setting is used
+	defaultCacheMaxSize = 5 << 30
+	// releaseIndexCacheFile is the copy of the last release index retrieved, used when it can't be retrieved
+	releaseIndexCacheFile = "release-index.json"
+)
+
+var cmdCache *cli.Command = &cli.Command{
+	Name:  "cache",
+	Usage: "Manage the cached downloads, like release images. They are pruned automatically, the least recently used first, once the cache grows over the cache-max-size setting (5G by default)",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List the cached downloads and the directories used by the CLI",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listCache()
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "Remove the least recently used downloads until the cache is under the maximum size",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "max-size",
+					Usage: "Prune the cache down to `SIZE`, e.g. 5GB, instead of the cache-max-size setting",
+				},
+				&cli.BoolFlag{
+					Name:  "all",
+					Usage: "Remove all the cached downloads",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				var maxSize int64
+				if !c.Bool("all") {
+					var err error
+					maxSize, err = cacheMaxSize(c.String("max-size"))
+					if err != nil {
+						return err
+					}
+				} else if c.IsSet("max-size") {
+					return errors.New("--max-size and --all can't be used together")
+				}
+				removed, freed, err := pruneCache(maxSize, "")
+				if err != nil {
+					return err
+				}
+				log.Infof("Removed %d cached download(s), freeing %s", removed, formatSize(uint64(freed)))
+				return nil
+			},
+		},
+	},
+}
+
+// cacheEntry is a download in the cache, removed as a whole when pruning: the images of a release, or the release index
+type cacheEntry struct {
+	Name     string
+	Path     string
+	Size     int64
+	LastUsed time.Time
+}
+
+type cacheListing struct {
+	CacheDir string
+	StateDir string
+	LogDir   string
+	Size     int64
+	MaxSize  int64
+	LogSize  int64
+	Entries  []cacheEntry
+}
+
+// cachedReleaseIndex is the last release index retrieved from URL
+type cachedReleaseIndex struct {
+	URL      string
+	Time     time.Time
+	Releases release.Releases
+}
+
+//
+// Cache methods
+//
+
+// cacheMaxSize returns the size given, the cache-max-size setting if empty, or the default size
+func cacheMaxSize(size string) (int64, error) {
+	if size == "" {
+		cfg, err := userconfig.Load(configPath())
+		if err != nil {
+			return 0, err
+		}
+		if cfg.CacheMaxSize == "" {
+			return defaultCacheMaxSize, nil
+		}
+		size = cfg.CacheMaxSize
+	}
+	maxSize, err := parseSize(size)
+	if err != nil {
+		return 0, err
+	}
+	if maxSize == 0 {
+		return 0, errors.New("The maximum cache size must be greater than 0. Use --all to empty the cache")
+	}
+	return maxSize, nil
+}
+
+// cacheEntries returns the downloads in the cache, least recently used first. Release images are grouped by version
+func cacheEntries() ([]cacheEntry, error) {
+	dir := dirs.Cache()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []cacheEntry{}, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read cache directory '%s'", dir)
+	}
+	paths := []string{}
+	for _, f := range files {
+		if f.IsDir() && f.Name() == "images" {
+			versions, err := ioutil.ReadDir(filepath.Join(dir, "images"))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to read cache directory '%s'", filepath.Join(dir, "images"))
+			}
+			for _, version := range versions {
+				paths = append(paths, filepath.Join(dir, "images", version.Name()))
+			}
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, f.Name()))
+	}
+
+	entries := []cacheEntry{}
+	for _, path := range paths {
+		entry := cacheEntry{Path: path}
+		entry.Name, _ = filepath.Rel(dir, path)
+		// the last use of an entry is the most recent modification of its files, which are touched when reused
+		err = filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				entry.Size += info.Size()
+			}
+			if info.ModTime().After(entry.LastUsed) {
+				entry.LastUsed = info.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read cache entry '%s'", path)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastUsed.Before(entries[j].LastUsed) })
+	return entries, nil
+}
+
+// dirSize returns the size of the files in dir, 0 if it doesn't exist
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func listCache() error {
+	entries, err := cacheEntries()
+	if err != nil {
+		return err
+	}
+	maxSize, err := cacheMaxSize("")
+	if err != nil {
+		return err
+	}
+	listing := cacheListing{CacheDir: dirs.Cache(), StateDir: protosDir(), LogDir: dirs.Logs(), MaxSize: maxSize, LogSize: dirSize(dirs.Logs()), Entries: entries}
+	for _, entry := range entries {
+		listing.Size += entry.Size
+	}
+
+	return printOutput(listing, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "Entry", "Size", "Last used")
+		// most recently used first, like the other lists
+		for i := len(entries) - 1; i >= 0; i-- {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t", entries[i].Name, formatSize(uint64(entries[i].Size)), formatTime(entries[i].LastUsed))
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		fmt.Printf("\nCache: %s (%s of %s)\n", listing.CacheDir, formatSize(uint64(listing.Size)), formatSize(uint64(listing.MaxSize)))
+		fmt.Printf("Logs: %s (%s)\n", listing.LogDir, formatSize(uint64(listing.LogSize)))
+		fmt.Printf("State: %s\n", listing.StateDir)
+	})
+}
+
+// pruneCache removes the least recently used entries until the cache is under maxSize, all of them if it's 0. The entry
+// at keep, if any, is never removed. It returns the number of entries removed and the space freed
+func pruneCache(maxSize int64, keep string) (int, int64, error) {
+	entries, err := cacheEntries()
+	if err != nil {
+		return 0, 0, err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	removed := 0
+	var freed int64
+	for _, entry := range entries {
+		if size <= maxSize && maxSize > 0 {
+			break
+		}
+		if entry.Path == keep {
+			continue
+		}
+		err = os.RemoveAll(entry.Path)
+		if err != nil {
+			return removed, freed, errors.Wrapf(err, "Failed to remove cache entry '%s'", entry.Path)
+		}
+		log.Debugf("Removed cache entry '%s' (%s)", entry.Name, formatSize(uint64(entry.Size)))
+		size -= entry.Size
+		freed += entry.Size
+		removed++
+	}
+	return removed, freed, nil
+}
+
+// enforceCacheLimit prunes the cache if it grew over the maximum size, keeping the entry at keep, which was just used.
+// Failures are only logged, since the download that triggered it succeeded
+func enforceCacheLimit(keep string) {
+	maxSize, err := cacheMaxSize("")
+	if err != nil {
+		log.Warnf("Failed to prune the cache: %s", err.Error())
+		return
+	}
+	removed, freed, err := pruneCache(maxSize, keep)
+	if err != nil {
+		log.Warnf("Failed to prune the cache: %s", err.Error())
+	}
+	if removed > 0 {
+		log.Infof("Removed %d least recently used download(s) from the cache, freeing %s, to keep it under %s", removed, formatSize(uint64(freed)), formatSize(uint64(maxSize)))
+	}
+}
+
+// cacheReleaseIndex saves the release index retrieved from indexURL, so that it can be used when offline
+func cacheReleaseIndex(indexURL string, releases release.Releases) {
+	data, err := json.Marshal(cachedReleaseIndex{URL: indexURL, Time: time.Now().UTC(), Releases: releases})
+	if err == nil {
+		err = os.MkdirAll(dirs.Cache(), os.FileMode(0700))
+	}
+	if err == nil {
+		path := filepath.Join(dirs.Cache(), releaseIndexCacheFile)
+		err = ioutil.WriteFile(path+".tmp", data, os.FileMode(0600))
+		if err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		log.Debugf("Failed to cache the release index: %s", err.Error())
+	}
+}
+
+// loadCachedReleaseIndex returns the cached release index, if it was retrieved from indexURL
+func loadCachedReleaseIndex(indexURL string) (cachedReleaseIndex, error) {
+	cached := cachedReleaseIndex{}
+	data, err := ioutil.ReadFile(filepath.Join(dirs.Cache(), releaseIndexCacheFile))
+	if err != nil {
+		return cached, err
+	}
+	err = json.Unmarshal(data, &cached)
+	if err != nil {
+		return cached, err
+	}
+	if cached.URL != indexURL || len(cached.Releases.Releases) == 0 {
+		return cached, errors.Errorf("No release index cached for '%s'", indexURL)
+	}
+	return cached, nil
+}
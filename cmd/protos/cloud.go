@@ -1,10 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"sort"
 	"strings"
 	"text/tabwriter"
+	"time"
 
 	survey "github.com/AlecAivazis/survey/v2"
 	"github.com/pkg/errors"
@@ -19,6 +25,9 @@ var cmdCloud *cli.Command = &cli.Command{
 		{
 			Name:  "ls",
 			Usage: "List existing cloud provider accounts",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
 			Action: func(c *cli.Context) error {
 				return listCloudProviders()
 			},
@@ -27,11 +36,12 @@ var cmdCloud *cli.Command = &cli.Command{
 			Name:      "add",
 			ArgsUsage: "<name>",
 			Usage:     "Add a new cloud provider account",
+			Before:    snapshotDB,
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
 				_, err := addCloudProvider(name)
 				return err
@@ -41,26 +51,133 @@ var cmdCloud *cli.Command = &cli.Command{
 			Name:      "delete",
 			ArgsUsage: "<name>",
 			Usage:     "Delete an existing cloud provider account",
+			Before:    snapshotDB,
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
 				return deleteCloudProvider(name)
 			},
 		},
+		{
+			Name:      "rename",
+			ArgsUsage: "<name> <new name>",
+			Usage:     "Rename a cloud provider account, updating the instances, volumes and backups that use it",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				newName := c.Args().Get(1)
+				if name == "" || newName == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return renameCloudProvider(name, newName)
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<name>",
+			Usage:     "Change the API rate limit used for a cloud provider account",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:  "max-concurrent-requests",
+					Usage: "Maximum `NUMBER` of API requests in flight at the same time. Use 0 for the provider default",
+				},
+				&cli.DurationFlag{
+					Name:  "request-interval",
+					Usage: "Minimum `DURATION` between two API requests, e.g. 200ms. Use 0 for the provider default",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return setCloudProvider(name, c)
+			},
+		},
 		{
 			Name:      "info",
 			ArgsUsage: "<name>",
 			Usage:     "Prints info about cloud provider account and checks if the API is reachable",
+			Flags: []cli.Flag{
+				outputFlag(),
+				&cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Only print the locally stored information, without contacting the provider API",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				return infoCloudProvider(name)
+				return infoCloudProvider(name, c.Bool("offline"))
+			},
+		},
+		{
+			Name:      "usage",
+			ArgsUsage: "<name>",
+			Usage:     "Show the resources used by a cloud provider account and an estimate of the monthly spend",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Only show the usage in `LOCATION`. By default all the supported locations are queried",
+					Destination: &cloudLocation,
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return usageCloudProvider(name, cloudLocation)
+			},
+		},
+		{
+			Name:      "api",
+			ArgsUsage: "<name> [--] <method> <path>",
+			Usage:     "Send a raw request to the API of a cloud provider, authenticated using the stored credentials, and print the response. Useful to debug provider specific issues",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Send the request for `LOCATION`. By default the first supported location is used",
+					Destination: &cloudLocation,
+				},
+				&cli.StringFlag{
+					Name:  "data",
+					Usage: "Send `DATA` as the request body. Use @file to read it from a file, or - to read it from stdin",
+				},
+				&cli.BoolFlag{
+					Name:  "include",
+					Usage: "Print the status and the headers of the response before its body",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				args := c.Args().Slice()
+				if len(args) > 1 && args[1] == "--" {
+					args = append(args[:1], args[2:]...)
+				}
+				if len(args) != 3 {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				method := strings.ToUpper(args[1])
+				// only requests that read the cloud account are allowed to read-only members of a shared database
+				if method != "GET" && method != "HEAD" {
+					err := authorizeChange()
+					if err != nil {
+						return err
+					}
+				}
+				return apiCloudProvider(args[0], cloudLocation, method, args[2], c.String("data"), c.Bool("include"))
 			},
 		},
 	},
@@ -75,29 +192,32 @@ func listCloudProviders() error {
 	if err != nil {
 		return err
 	}
+	for i := range clouds {
+		clouds[i].Auth = nil
+	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 16, 16, 0, '\t', 0)
+	return printOutput(clouds, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 16, 16, 0, '\t', 0)
 
-	defer w.Flush()
+		defer w.Flush()
 
-	fmt.Fprintf(w, " %s\t%s\t", "Name", "Type")
-	fmt.Fprintf(w, "\n %s\t%s\t", "----", "----")
-	for _, cl := range clouds {
-		fmt.Fprintf(w, "\n %s\t%s\t", cl.Name, cl.Type)
-	}
-	fmt.Fprint(w, "\n")
-	return nil
+		printTableHeader(w, "Name", "Type")
+		for _, cl := range clouds {
+			fmt.Fprintf(w, "\n %s\t%s\t", cl.Name, cl.Type)
+		}
+		fmt.Fprint(w, "\n")
+	})
 }
 
 func addCloudProvider(cloudName string) (cloud.Provider, error) {
 	// select cloud provider
-	var cloudType string
-	cloudProviderSelect := surveySelect(cloud.SupportedProviders(), "Choose one of the following supported cloud providers:")
-	err := survey.AskOne(cloudProviderSelect, &cloudType)
+	providers := cloud.SupportedProviders()
+	selected, err := selectOption("Choose one of the following supported cloud providers:", providers, nil)
 	if err != nil {
 		return nil, err
 	}
+	cloudType := providers[selected]
 
 	// create new cloud provider
 	client, err := cloud.NewProvider(cloudName, cloudType)
@@ -124,6 +244,7 @@ func addCloudProvider(cloudName string) (cloud.Provider, error) {
 
 	// save the cloud provider in the db
 	cloudProviderInfo := client.GetInfo()
+	cloudProviderInfo.CredentialsAdded = time.Now()
 	err = dbp.SaveCloud(cloudProviderInfo)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to save cloud provider info")
@@ -132,28 +253,268 @@ func addCloudProvider(cloudName string) (cloud.Provider, error) {
 	return client, nil
 }
 
+func renameCloudProvider(name string, newName string) error {
+	provider, err := dbp.GetCloud(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	if _, err := dbp.GetCloud(newName); err == nil {
+		return errors.Errorf("Cloud '%s' already exists", newName)
+	}
+	client := provider.Client()
+	err = cloud.RenameResources(client, newName)
+	if err != nil {
+		return err
+	}
+	err = dbp.RenameCloud(name, newName)
+	if err != nil {
+		// the resources are moved back, so that they match the name still in the database
+		if undoErr := cloud.RenameResources(client, name); undoErr != nil {
+			log.Warnf("Failed to restore the resources of cloud '%s': %s", name, undoErr.Error())
+		}
+		return errors.Wrapf(err, "Failed to rename cloud '%s'", name)
+	}
+	log.Infof("Cloud '%s' renamed to '%s'", name, newName)
+	return nil
+}
+
 func deleteCloudProvider(name string) error {
 	return dbp.DeleteCloud(name)
 }
 
-func infoCloudProvider(name string) error {
-	cloud, err := dbp.GetCloud(name)
+func setCloudProvider(name string, c *cli.Context) error {
+	provider, err := dbp.GetCloud(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
 	}
-	client := cloud.Client()
-	locations := client.SupportedLocations()
-	err = client.Init(cloud.Auth, locations[0])
+	if !c.IsSet("max-concurrent-requests") && !c.IsSet("request-interval") {
+		return errors.New("Nothing to change. Use --max-concurrent-requests or --request-interval")
+	}
+	if c.IsSet("max-concurrent-requests") {
+		if c.Int("max-concurrent-requests") < 0 {
+			return errors.Errorf("Invalid number of concurrent requests '%d'", c.Int("max-concurrent-requests"))
+		}
+		provider.RateLimit.MaxConcurrent = c.Int("max-concurrent-requests")
+	}
+	if c.IsSet("request-interval") {
+		if c.Duration("request-interval") < 0 {
+			return errors.Errorf("Invalid request interval '%s'", c.Duration("request-interval"))
+		}
+		provider.RateLimit.Interval = c.Duration("request-interval")
+	}
+	err = dbp.SaveCloud(provider)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", name, cloud.Type.String())
+		return errors.Wrapf(err, "Failed to save cloud '%s'", name)
+	}
+	log.Infof("API rate limit of cloud '%s' set to %s", name, formatRateLimit(provider.RateLimit))
+	return nil
+}
+
+// formatRateLimit describes a rate limit, whose zero values stand for the defaults of the provider
+func formatRateLimit(limit cloud.RateLimit) string {
+	concurrent, interval := "provider default", "provider default"
+	if limit.MaxConcurrent > 0 {
+		concurrent = fmt.Sprintf("%d", limit.MaxConcurrent)
+	}
+	if limit.Interval > 0 {
+		interval = limit.Interval.String()
 	}
-	fmt.Printf("Name: %s\n", cloud.Name)
-	fmt.Printf("Type: %s\n", cloud.Type.String())
-	fmt.Printf("Supported locations: %s\n", strings.Join(locations, " | "))
+	return fmt.Sprintf("%s concurrent requests, %s between requests", concurrent, interval)
+}
+
+// infoCloudProvider prints a cloud provider account. Unless offline is set, the provider API is contacted to check
+// the credentials
+func infoCloudProvider(name string, offline bool) error {
+	provider, err := dbp.GetCloud(name)
 	if err != nil {
-		fmt.Printf("Status: NOT OK (%s)\n", err.Error())
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := provider.Client()
+	locations := client.SupportedLocations()
+	status := "OK"
+	if offline {
+		status = "unknown"
 	} else {
-		fmt.Printf("Status: OK - API reachable\n")
+		err = client.Init(provider.Auth, locations[0])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", name, provider.Type.String())
+		}
+	}
+
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	linked := 0
+	for _, instance := range instances {
+		if instance.CloudName == provider.Name {
+			linked++
+		}
+	}
+
+	info := struct {
+		Name             string
+		Type             string
+		Locations        []string
+		RateLimit        cloud.RateLimit
+		Instances        int
+		CredentialsAdded time.Time
+		Status           string
+	}{Name: provider.Name, Type: provider.Type.String(), Locations: locations, RateLimit: provider.RateLimit, Instances: linked, CredentialsAdded: provider.CredentialsAdded, Status: status}
+	return printOutput(info, func() {
+		fmt.Printf("Name: %s\n", provider.Name)
+		fmt.Printf("Type: %s\n", provider.Type.String())
+		fmt.Printf("Supported locations: %s\n", strings.Join(locations, " | "))
+		fmt.Printf("API rate limit: %s\n", formatRateLimit(provider.RateLimit))
+		fmt.Printf("Instances: %d\n", linked)
+		if provider.CredentialsAdded.IsZero() {
+			fmt.Printf("Credentials added: n/a\n")
+		} else {
+			fmt.Printf("Credentials added: %s (%s ago)\n", formatTime(provider.CredentialsAdded), time.Since(provider.CredentialsAdded).Round(time.Minute))
+		}
+		if offline {
+			fmt.Printf("Status: unknown - API not contacted (offline)\n")
+		} else {
+			fmt.Printf("Status: OK - API reachable\n")
+		}
+	})
+}
+
+func usageCloudProvider(name string, location string) error {
+	provider, err := dbp.GetCloud(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	locations := provider.Client().SupportedLocations()
+	if location != "" {
+		locations = []string{location}
+	}
+
+	usages := []cloud.Usage{}
+	for _, loc := range locations {
+		client, _, err := initCloudClient(name, loc)
+		if err != nil {
+			return err
+		}
+		usage, err := client.GetUsage()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retrieve usage of cloud '%s' in location '%s'", name, loc)
+		}
+		usages = append(usages, usage)
+	}
+
+	total := cloud.Usage{Location: "total"}
+	for _, usage := range usages {
+		total.Instances += usage.Instances
+		total.Volumes += usage.Volumes
+		total.VolumesSize += usage.VolumesSize
+		total.Images += usage.Images
+		total.Snapshots += usage.Snapshots
+		total.IPs += usage.IPs
+		total.MonthlyCost += usage.MonthlyCost
+		total.Unpriced += usage.Unpriced
+	}
+
+	return printOutput(usages, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		rows := usages
+		if len(usages) > 1 {
+			rows = append(rows, total)
+		}
+		printTableHeader(w, "Location", "Instances", "Volumes", "Volume size", "Images", "Snapshots", "IPs", "Est. monthly cost")
+		for _, usage := range rows {
+			fmt.Fprintf(w, "\n %s\t%d\t%d\t%s\t%d\t%d\t%d\t%.2f EUR\t", usage.Location, usage.Instances, usage.Volumes, formatSize(usage.VolumesSize), usage.Images, usage.Snapshots, usage.IPs, usage.MonthlyCost)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		fmt.Println("\nThe cost is an estimate based on list prices, excluding VAT and traffic. Check the provider console for your actual bill")
+		if total.Unpriced > 0 {
+			fmt.Printf("%d resource(s) with an unknown price are not part of the estimate\n", total.Unpriced)
+		}
+	})
+}
+
+// apiCloudProvider sends a raw request to the API of a cloud and prints the response body, indented if it's JSON. A
+// response with an error status is printed as well, and the command fails
+func apiCloudProvider(name string, location string, method string, path string, data string, include bool) error {
+	var body io.Reader
+	switch {
+	case data == "-":
+		body = os.Stdin
+	case strings.HasPrefix(data, "@"):
+		file, err := os.Open(strings.TrimPrefix(data, "@"))
+		if err != nil {
+			return errors.Wrap(err, "Failed to open request body")
+		}
+		defer file.Close()
+		body = file
+	case data != "":
+		body = strings.NewReader(data)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	client, _, err := initCloudClient(name, location)
+	if err != nil {
+		return err
+	}
+	resp, err := cloud.RawRequest(client, method, path, body)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send request to cloud '%s'", name)
+	}
+
+	if include {
+		fmt.Printf("Status: %d %s\n", resp.Status, http.StatusText(resp.Status))
+		keys := []string{}
+		for key := range resp.Header {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s: %s\n", key, strings.Join(resp.Header[key], ", "))
+		}
+		fmt.Println()
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, resp.Body, "", "  ") == nil {
+		fmt.Println(indented.String())
+	} else if len(resp.Body) > 0 {
+		os.Stdout.Write(resp.Body)
+		if !bytes.HasSuffix(resp.Body, []byte("\n")) {
+			fmt.Println()
+		}
+	}
+	if resp.Status >= 400 {
+		return errors.Errorf("%s %s returned status %d %s", method, path, resp.Status, http.StatusText(resp.Status))
 	}
 	return nil
 }
+
+// initCloudClient retrieves a cloud from the db and returns an initialized client for it. If location is empty, the
+// first supported location is used. The resolved location is returned
+func initCloudClient(cloudName string, location string) (cloud.Provider, string, error) {
+	provider, err := dbp.GetCloud(cloudName)
+	if err != nil {
+		return nil, location, errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
+	}
+	client := provider.Client()
+	if location == "" {
+		location = client.SupportedLocations()[0]
+	}
+	resolved, err := cloud.ResolveLocation(client, location)
+	if err != nil {
+		return nil, location, errors.Wrapf(err, "Invalid location for cloud '%s'", cloudName)
+	}
+	if resolved != location {
+		log.Infof("Using location '%s' for '%s'", resolved, location)
+		location = resolved
+	}
+	err = client.Init(provider.Auth, location)
+	if err != nil {
+		return nil, location, errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", cloudName, provider.Type.String())
+	}
+	return client, location, nil
+}
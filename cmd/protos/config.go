@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/urfave/cli/v2"
+)
+
+// configSetting is a config field that can be changed using 'protos config'. Values are checked by validate before
+// being saved
+type configSetting struct {
+	field    func(cfg *userconfig.Config) *string
+	validate func(value string) error
+}
+
+// configSettings maps the keys accepted by 'protos config' to the config fields they change. Aliases have their own
+// command
+var configSettings = map[string]configSetting{
+	"release-index":  {func(cfg *userconfig.Config) *string { return &cfg.ReleaseIndex }, validateURL},
+	"image-mirror":   {func(cfg *userconfig.Config) *string { return &cfg.ImageMirror }, validateURL},
+	"tunnel-ports":   {func(cfg *userconfig.Config) *string { return &cfg.TunnelPorts }, validatePortRange},
+	"user":           {func(cfg *userconfig.Config) *string { return &cfg.User }, validateUser},
+	"cache-max-size": {func(cfg *userconfig.Config) *string { return &cfg.CacheMaxSize }, validateSize},
+	"log-max-size":   {func(cfg *userconfig.Config) *string { return &cfg.LogMaxSize }, validateSize},
+}
+
+var cmdConfig *cli.Command = &cli.Command{
+	Name:  "config",
+	Usage: "Manage CLI settings",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List settings",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listSettings()
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<key> <value>",
+			Usage:     "Change a setting. Supported keys: release-index (URL of an alternative release index), image-mirror (base URL of a mirror serving the release images), tunnel-ports (range local tunnel ports are allocated from, e.g. 20000-20999), user (name recorded in the history of a shared database, instead of the login name), cache-max-size (size the cache is pruned to once exceeded, 5G by default), log-max-size (size after which the log file is rotated, 5M by default)",
+			Action: func(c *cli.Context) error {
+				key := c.Args().Get(0)
+				value := c.Args().Get(1)
+				if key == "" || value == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return setSetting(key, value)
+			},
+		},
+		{
+			Name:      "unset",
+			ArgsUsage: "<key>",
+			Usage:     "Restore the default value of a setting",
+			Action: func(c *cli.Context) error {
+				key := c.Args().Get(0)
+				if key == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return setSetting(key, "")
+			},
+		},
+	},
+}
+
+//
+// Config methods
+//
+
+func configPath() string {
+	return filepath.Join(protosDir(), "config.json")
+}
+
+func listSettings() error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	keys := []string{}
+	settings := map[string]string{}
+	for key, setting := range configSettings {
+		keys = append(keys, key)
+		settings[key] = *setting.field(&cfg)
+	}
+	sort.Strings(keys)
+
+	return printOutput(settings, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Key", "Value")
+		for _, key := range keys {
+			value := settings[key]
+			if value == "" {
+				value = "-"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t", key, value)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+func setSetting(key string, value string) error {
+	setting, found := configSettings[key]
+	if !found {
+		return errors.Errorf("Setting '%s' not supported", key)
+	}
+	if value != "" {
+		err := setting.validate(value)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid value for setting '%s'", key)
+		}
+	}
+
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	*setting.field(&cfg) = value
+	err = userconfig.Save(configPath(), cfg)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		log.Infof("Setting '%s' restored to its default", key)
+	} else {
+		log.Infof("Setting '%s' set to '%s'", key, value)
+	}
+	return nil
+}
+
+func validateUser(value string) error {
+	if strings.ContainsAny(value, " \t\n") {
+		return errors.Errorf("User name '%s' can't contain spaces", value)
+	}
+	return nil
+}
+
+func validateSize(value string) error {
+	size, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	if size == 0 {
+		return errors.New("Size must be greater than 0")
+	}
+	return nil
+}
+
+func validateURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("'%s' is not an HTTP(S) URL", value)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/db"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdDB *cli.Command = &cli.Command{
+	Name:  "db",
+	Usage: "Manage the local database",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "snapshots",
+			Usage: "List the database snapshots taken before each command that changes the local state",
+			Action: func(c *cli.Context) error {
+				return listDBSnapshots()
+			},
+		},
+		{
+			Name:  "migrate-keys",
+			Usage: "Move the instance SSH keys stored in plain text by older clients to the encrypted keystore, remove the database snapshots still holding them, and remove the key files written for other tools by 'protos env' and 'protos export'",
+			Action: func(c *cli.Context) error {
+				return migrateKeys()
+			},
+		},
+		{
+			Name:  "undo",
+			Usage: "Restore the local database to the state before the last command that changed it. Not available while the database is shared (see 'protos state')",
+			Action: func(c *cli.Context) error {
+				return undoDB()
+			},
+		},
+	},
+}
+
+//
+// DB methods
+//
+
+// undoPoint is the snapshot taken by snapshotDB for the current command, along with the revision of the database once
+// the command was recorded in the history
+var undoPoint struct {
+	snapshot string
+	revision int
+}
+
+// snapshotDB is used as the Before hook of commands that change the local state, so that they can be undone. It also
+// checks that the user can change a shared database, and records the command in the history. Both are dropped by
+// discardUndoPoint if the command fails without changing the database
+func snapshotDB(c *cli.Context) error {
+	err := authorizeChange()
+	if err != nil {
+		return err
+	}
+	// commands run with --async are snapshotted and recorded by their worker, see startJob
+	if c.Bool("async") && os.Getenv(jobEnvVar) == "" {
+		return nil
+	}
+	snapshot, err := dbp.Snapshot()
+	if err != nil {
+		return err
+	}
+	log.Debugf("Database snapshot saved to '%s'", snapshot)
+	err = recordHistory(c)
+	if err != nil {
+		os.Remove(snapshot)
+		return err
+	}
+	revision, err := dbp.Revision()
+	if err != nil {
+		return err
+	}
+	undoPoint.snapshot = snapshot
+	undoPoint.revision = revision
+	return nil
+}
+
+// discardUndoPoint removes the snapshot and the history entry of a command that failed, e.g. on a usage error, if it
+// didn't write to the database since. Otherwise they would evict older snapshots, and 'db undo' would restore a copy
+// identical to the database
+func discardUndoPoint() {
+	if undoPoint.snapshot == "" || dbp == nil {
+		return
+	}
+	revision, err := dbp.Revision()
+	if err != nil || revision != undoPoint.revision {
+		return
+	}
+	// nothing was written since the command was recorded, so its entry is the last one
+	entries, err := dbp.GetHistory()
+	if err == nil && len(entries) > 0 {
+		err = dbp.DeleteHistory(entries[len(entries)-1].ID)
+	}
+	if err != nil {
+		log.Warnf("Failed to remove the history entry of the failed command: %s", err.Error())
+		return
+	}
+	err = os.Remove(undoPoint.snapshot)
+	if err != nil {
+		log.Warnf("Failed to remove database snapshot '%s': %s", undoPoint.snapshot, err.Error())
+		return
+	}
+	log.Debugf("Database snapshot '%s' removed, since the command failed without changing the database", undoPoint.snapshot)
+	undoPoint.snapshot = ""
+}
+
+func listDBSnapshots() error {
+	snapshots, err := db.Snapshots("")
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		fmt.Println(filepath.Base(snapshot))
+	}
+	return nil
+}
+
+// undoDB restores the latest snapshot. It's refused for a shared database, whose snapshots are only local copies that
+// would be replaced by the next pull, and that could hold an older version than the one changed since by others
+func undoDB() error {
+	backend, err := stateBackend()
+	if err != nil {
+		return err
+	}
+	if backend != nil {
+		return errors.Errorf("The database is shared using instance '%s', so it can't be restored from a local snapshot. Disable sharing first using 'protos state disable'", backend.Instance)
+	}
+	// the database is kept open while it's replaced, so that it's not in use by other commands, e.g. a background job
+	local, err := db.Open("")
+	if err == db.ErrLocked {
+		err = dbLockedError()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to undo last change")
+	}
+	defer local.Close()
+	snapshot, err := db.Undo("")
+	if err != nil {
+		return errors.Wrap(err, "Failed to undo last change")
+	}
+	log.Infof("Database restored from snapshot '%s'", filepath.Base(snapshot))
+	return nil
+}
+
+// migrateKeys moves the plain text SSH keys to the keystore and removes the key files. The db command doesn't open the
+// database, so it's opened here
+func migrateKeys() error {
+	err := openDB()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := releaseDB()
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}()
+
+	err = removeKeyFiles()
+	if err != nil {
+		return err
+	}
+	count, err := dbp.LegacyKeys()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		log.Info("All SSH keys are already stored in the keystore")
+	} else {
+		// no snapshot is taken, since it would hold the plain text keys. The migration runs in a transaction instead
+		moved, err := dbp.MigrateKeys()
+		if err != nil {
+			return errors.Wrap(err, "Failed to migrate SSH keys")
+		}
+		log.Infof("Secured %d plain text SSH key(s) using the keystore. Keep a backup of '%s', which is needed to use them", moved, filepath.Join(protosDir(), db.KeystoreKeyFile))
+	}
+	return removeLegacyKeyCopies()
+}
+
+// removeLegacyKeyCopies removes the copies of the plain text SSH keys left once they are in the keystore: the database
+// snapshots holding them, including the ones taken before earlier migrations, and the free pages of the database file
+func removeLegacyKeyCopies() error {
+	snapshots, err := db.Snapshots("")
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, snapshot := range snapshots {
+		found, err := db.HoldsLegacyKeys(snapshot)
+		if err != nil {
+			return err
+		}
+		if !found {
+			continue
+		}
+		err = os.Remove(snapshot)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove database snapshot '%s'", snapshot)
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("Removed %d database snapshot(s) holding plain text SSH keys. They can't be restored using 'protos db undo' anymore", removed)
+	}
+
+	found, err := db.HoldsLegacyKeys(localDBPath())
+	if err != nil || !found {
+		return err
+	}
+	err = dbp.Compact()
+	if err != nil {
+		return err
+	}
+	log.Info("Compacted the database, so that its free pages don't hold the plain text SSH keys anymore")
+	return nil
+}
+
+// removeKeyFiles removes the plain text key files written by writeInstanceKey, except the one used to reach the shared
+// database
+func removeKeyFiles() error {
+	backend, err := stateBackend()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(keysDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to read key directory '%s'", keysDir())
+	}
+	removed := 0
+	for _, f := range files {
+		path := filepath.Join(keysDir(), f.Name())
+		if f.IsDir() || (backend != nil && backend.KeyFile == path) {
+			continue
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove key file '%s'", path)
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Infof("Removed %d plain text key file(s) from '%s'. Run 'protos env' or 'protos export' again to write them", removed, keysDir())
+	}
+	if backend != nil && filepath.Dir(backend.KeyFile) == keysDir() {
+		log.Infof("Kept '%s', which is needed to reach the shared database", backend.KeyFile)
+	}
+	return nil
+}
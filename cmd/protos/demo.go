@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/db"
+	"github.com/protosio/cli/internal/release"
+	"github.com/urfave/cli/v2"
+)
+
+// demoName is used for both the fake cloud and the instance created by 'protos demo'
+const demoName = "demo"
+
+// demoVersion is the version of the image used by the demo instance, which doesn't correspond to a Protos release
+const demoVersion = "demo"
+
+var cmdDemo *cli.Command = &cli.Command{
+	Name:  "demo",
+	Usage: "Deploy a sandbox instance on a simulated cloud, to try the CLI without a cloud account",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "delete",
+			Usage: "Delete the sandbox instance and its cloud",
+		},
+	},
+	Before: func(c *cli.Context) error {
+		// the sandbox is meant for new users, so the local DB is created if needed
+		var err error
+		dbp, err = db.Open("")
+		if err != nil && os.IsNotExist(errors.Cause(err)) {
+			return protosDBInit()
+		}
+		return err
+	},
+	Action: func(c *cli.Context) error {
+		if c.Bool("delete") {
+			return deleteDemo()
+		}
+		return startDemo()
+	},
+}
+
+var cmdFakeEndpoint *cli.Command = &cli.Command{
+	Name:      cloud.FakeEndpointCommand,
+	ArgsUsage: "<cloud> <instance id>",
+	Usage:     "Run the SSH endpoint of an instance deployed on a fake cloud. Started automatically by the fake cloud provider",
+	Hidden:    true,
+	Action: func(c *cli.Context) error {
+		if c.Args().Len() != 2 {
+			cli.ShowCommandHelp(c, cloud.FakeEndpointCommand)
+			return cli.Exit("", 1)
+		}
+		return cloud.ServeFakeInstance(c.Args().Get(0), c.Args().Get(1), log)
+	},
+}
+
+//
+// Demo methods
+//
+
+func startDemo() error {
+	if _, err := dbp.GetCloud(demoName); err != nil {
+		log.Infof("Adding fake cloud '%s'", demoName)
+		client, err := cloud.NewProvider(demoName, cloud.Fake.String())
+		if err != nil {
+			return err
+		}
+		err = client.Init(map[string]string{}, client.SupportedLocations()[0])
+		if err != nil {
+			return err
+		}
+		err = dbp.SaveCloud(client.GetInfo())
+		if err != nil {
+			return errors.Wrap(err, "Failed to save cloud provider info")
+		}
+	}
+
+	instance, err := dbp.GetInstance(demoName)
+	if err == nil {
+		if instance.CloudName != demoName {
+			return errors.Errorf("Instance '%s' already exists and is not a sandbox instance", demoName)
+		}
+		err = startInstance(demoName)
+		if err != nil {
+			return err
+		}
+	} else {
+		client, location, err := initCloudClient(demoName, "")
+		if err != nil {
+			return err
+		}
+		// no release is downloaded, so the image is added up front for the deploy to find it
+		images, err := client.GetImages()
+		if err != nil {
+			return err
+		}
+		if _, found := images["protos-"+demoVersion]; !found {
+			_, err = client.AddImage("", "", demoVersion, 0)
+			if err != nil {
+				return err
+			}
+		}
+		instance, err = deployInstance(demoName, demoName, location, release.Release{Version: demoVersion}, deployOptions{})
+		if err != nil {
+			return errors.Wrap(err, "Failed to deploy sandbox instance")
+		}
+	}
+
+	err = recordInstanceContact(&instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to connect to sandbox instance '%s' via SSH", demoName)
+	}
+	log.Infof("Sandbox instance '%s' is running at '%s'. Commands run on it are executed on this machine", demoName, instance.PublicIP)
+	fmt.Printf("Try the CLI with the sandbox instance:\n")
+	fmt.Printf("  protos instance info %s\n", demoName)
+	fmt.Printf("  protos fleet exec -- uname -a\n")
+	fmt.Printf("  protos volume ls\n")
+	fmt.Printf("Remove it with:\n")
+	fmt.Printf("  protos demo --delete\n")
+	return nil
+}
+
+func deleteDemo() error {
+	if instance, err := dbp.GetInstance(demoName); err == nil && instance.CloudName == demoName {
+		err = deleteInstance(demoName, false)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := dbp.GetCloud(demoName); err == nil {
+		err = deleteCloudProvider(demoName)
+		if err != nil {
+			return err
+		}
+	}
+	log.Info("Sandbox removed")
+	return nil
+}
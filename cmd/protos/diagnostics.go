@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+)
+
+// diagnosticPorts are scanned besides the SSH port of the instance, to tell a firewall from a host that didn't boot
+var diagnosticPorts = []int{80, 443}
+
+const portScanTimeout = 3 * time.Second
+
+// portScanResult is the state of a port of the instance, as seen from the CLI
+type portScanResult struct {
+	Port  int
+	State string // open, closed (the host refused the connection) or filtered (no answer)
+	Error string
+}
+
+//
+// Diagnostics methods
+//
+
+// collectBootDiagnostics gathers what can be learned about an instance that didn't become reachable after boot, without
+// SSH access: the provider status, events and console log, and a scan of its ports. They are saved to a bundle in the
+// diagnostics directory, whose path is returned. Parts that can't be collected are noted in the bundle summary
+func collectBootDiagnostics(client cloud.Provider, instance cloud.InstanceInfo, sshErr error) (string, error) {
+	files := map[string]string{}
+	summary := &strings.Builder{}
+	fmt.Fprintf(summary, "Instance: %s\n", instance.Name)
+	fmt.Fprintf(summary, "VM ID: %s\n", instance.VMID)
+	fmt.Fprintf(summary, "Cloud: %s (%s)\n", instance.CloudName, instance.CloudType.String())
+	fmt.Fprintf(summary, "Location: %s\n", instance.Location)
+	fmt.Fprintf(summary, "Version: %s\n", instance.Version)
+	fmt.Fprintf(summary, "Collected: %s\n", time.Now().UTC().Format(time.RFC3339))
+	if sshErr != nil {
+		fmt.Fprintf(summary, "SSH error: %s\n", sshErr.Error())
+	}
+
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		fmt.Fprintf(summary, "Provider status: unknown (%s)\n", err.Error())
+	} else {
+		fmt.Fprintf(summary, "Provider status: %s\n", vmInfo.Status)
+		fmt.Fprintf(summary, "Public IP: %s\n", vmInfo.PublicIP)
+		instance.PublicIP = vmInfo.PublicIP
+	}
+
+	if client.Capabilities().Events {
+		events, err := client.GetInstanceEvents(instance.VMID)
+		if err != nil {
+			fmt.Fprintf(summary, "Events: %s\n", err.Error())
+		} else if len(events) == 0 {
+			fmt.Fprintf(summary, "Events: none\n")
+		} else {
+			out := &strings.Builder{}
+			for _, event := range events {
+				fmt.Fprintf(out, "%s %s: %s\n", formatTime(event.Time), event.Type, event.Description)
+			}
+			files["events.txt"] = out.String()
+			fmt.Fprintf(summary, "Events: %d, see events.txt\n", len(events))
+		}
+	} else {
+		fmt.Fprintf(summary, "Events: %s\n", cloud.NotSupported(client, "events").Error())
+	}
+
+	// the console shows the boot and cloud-init output, which is the only way to see them without SSH access
+	if client.Capabilities().ConsoleLog {
+		console, err := client.GetConsoleLog(instance.VMID)
+		if err != nil {
+			fmt.Fprintf(summary, "Console log: %s\n", err.Error())
+		} else {
+			files["console.log"] = console
+			fmt.Fprintf(summary, "Console log: see console.log\n")
+		}
+	} else {
+		fmt.Fprintf(summary, "Console log: %s. Check the boot and cloud-init output in the provider console\n", cloud.NotSupported(client, "console logs").Error())
+	}
+
+	if instance.PublicIP != "" {
+		out := &strings.Builder{}
+		for _, result := range scanInstancePorts(instance.PublicIP) {
+			if result.Error != "" {
+				fmt.Fprintf(out, "%d\t%s\t%s\n", result.Port, result.State, result.Error)
+			} else {
+				fmt.Fprintf(out, "%d\t%s\n", result.Port, result.State)
+			}
+		}
+		files["ports.txt"] = out.String()
+		fmt.Fprintf(summary, "Port scan: see ports.txt\n")
+	} else {
+		fmt.Fprintf(summary, "Port scan: skipped, the instance has no public IP\n")
+	}
+	files["summary.txt"] = summary.String()
+
+	dir := filepath.Join(protosDir(), "diagnostics")
+	err = os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create diagnostics directory '%s'", dir)
+	}
+	path := filepath.Join(dir, instance.Name+"-"+time.Now().UTC().Format("20060102T150405")+".tar.gz")
+	err = writeBundle(path, files)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// scanInstancePorts tries to connect to the SSH port of the instance and to the diagnostic ports, concurrently
+func scanInstancePorts(address string) []portScanResult {
+	host, sshPort := address, 22
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host = h
+		sshPort, _ = strconv.Atoi(p)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	ports := []int{sshPort}
+	for _, port := range diagnosticPorts {
+		if port != sshPort {
+			ports = append(ports, port)
+		}
+	}
+
+	results := make([]portScanResult, len(ports))
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		go func(i int, port int) {
+			defer wg.Done()
+			results[i] = portScanResult{Port: port, State: "open"}
+			conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), portScanTimeout)
+			if err != nil {
+				results[i].State = "filtered"
+				if strings.Contains(err.Error(), "connection refused") {
+					results[i].State = "closed"
+				}
+				results[i].Error = err.Error()
+				return
+			}
+			conn.Close()
+		}(i, port)
+	}
+	wg.Wait()
+	return results
+}
+
+// writeBundle writes the files to a gzip compressed tar archive at path, readable only by the current user
+func writeBundle(path string, files map[string]string) error {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"summary.txt", "console.log", "events.txt", "ports.txt"} {
+		content, found := files[name]
+		if !found {
+			continue
+		}
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: time.Now()})
+		if err != nil {
+			return errors.Wrap(err, "Failed to write diagnostics bundle")
+		}
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			return errors.Wrap(err, "Failed to write diagnostics bundle")
+		}
+	}
+	err := tw.Close()
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to write diagnostics bundle")
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write diagnostics bundle '%s'", path)
+	}
+	return nil
+}
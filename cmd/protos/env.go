@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+var envDashboardPort int
+
+var cmdEnv *cli.Command = &cli.Command{
+	Name:      "env",
+	ArgsUsage: "<instance>",
+	Usage:     "Print shell exports that point other tools to an instance. Use it with: eval $(protos env <instance>). Without --agent, PROTOS_SSH_KEY is an unencrypted copy of the instance key, removed by --unset",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "agent",
+			Usage: "Start an ssh-agent holding the instance key and export SSH_AUTH_SOCK, SSH_AGENT_PID and PROTOS_SSH_AGENT_PID. The key is not written to disk then, so PROTOS_SSH_KEY is not exported",
+		},
+		&cli.IntFlag{
+			Name:        "dashboard-port",
+			Usage:       "Local `PORT` used for PROTOS_DASHBOARD_URL, as passed to 'protos instance tunnel --port'. By default, the tunnel port allocated to the instance is used",
+			Destination: &envDashboardPort,
+		},
+		&cli.BoolFlag{
+			Name:  "unset",
+			Usage: "Print the commands that remove the exported variables, stop the ssh-agent started by --agent and remove the key file. Other ssh-agents are left running",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if c.Bool("unset") {
+			printEnvUnset()
+			return nil
+		}
+		name := c.Args().Get(0)
+		if name == "" {
+			cli.ShowCommandHelp(c, "env")
+			return cli.Exit("", 1)
+		}
+		name, err := resolveInstanceName(name)
+		if err != nil {
+			return err
+		}
+		return printEnv(name, c.Bool("agent"), envDashboardPort)
+	},
+}
+
+var envVariables = []string{"PROTOS_INSTANCE", "PROTOS_HOST", "PROTOS_SSH_KEY", "PROTOS_KNOWN_HOSTS", "PROTOS_DASHBOARD_URL", "PROTOS_SSH_AGENT_PID"}
+
+//
+// Env methods
+//
+
+func printEnv(name string, startAgent bool, dashboardPort int) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+
+	dashboardURL, tunnelHint, err := envDashboardURL(instance, dashboardPort)
+	if err != nil {
+		return err
+	}
+
+	exports := [][2]string{
+		{"PROTOS_INSTANCE", instance.Name},
+		{"PROTOS_HOST", instance.PublicIP},
+		{"PROTOS_KNOWN_HOSTS", knownHosts.Path()},
+	}
+	if dashboardURL != "" {
+		exports = append(exports, [2]string{"PROTOS_DASHBOARD_URL", dashboardURL})
+	}
+	if startAgent {
+		agentVars, err := startSSHAgent(instance)
+		if err != nil {
+			return err
+		}
+		exports = append(exports, agentVars...)
+	} else {
+		keyFile, err := writeInstanceKey(instance)
+		if err != nil {
+			return err
+		}
+		exports = append(exports, [2]string{"PROTOS_SSH_KEY", keyFile})
+	}
+
+	for _, export := range exports {
+		fmt.Printf("export %s=%s\n", export[0], shellQuote(export[1]))
+	}
+	if tunnelHint != "" {
+		fmt.Printf("# %s\n", tunnelHint)
+	}
+	fmt.Printf("# Run this command to configure your shell:\n# eval $(protos env %s)\n", name)
+	return nil
+}
+
+// instanceKey returns the SSH key of an instance, as decrypted from the keystore
+func instanceKey(instance cloud.InstanceInfo) (ssh.Key, error) {
+	if len(instance.KeySeed) == 0 {
+		return ssh.Key{}, errors.Errorf("Instance '%s' is missing its SSH key", instance.Name)
+	}
+	key, err := ssh.NewKeyFromSeed(instance.KeySeed)
+	if err != nil {
+		return ssh.Key{}, errors.Wrapf(err, "Instance '%s' has an invalid SSH key", instance.Name)
+	}
+	return key, nil
+}
+
+func keysDir() string {
+	return filepath.Join(protosDir(), "keys")
+}
+
+// writeInstanceKey writes the private SSH key of an instance to the keys directory, for tools that need a key file.
+// It's rewritten every time, so that it follows changes of the key. The file is not encrypted, since the tools
+// reading it can't ask for a passphrase. Such files are removed by 'protos env --unset' and 'protos db migrate-keys'
+func writeInstanceKey(instance cloud.InstanceInfo) (string, error) {
+	keyFile := filepath.Join(keysDir(), instance.Name)
+	return keyFile, writeKeyFile(instance, keyFile)
+}
+
+func writeKeyFile(instance cloud.InstanceInfo, keyFile string) error {
+	key, err := instanceKey(instance)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(keyFile), os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", filepath.Dir(keyFile))
+	}
+	err = ioutil.WriteFile(keyFile, []byte(key.EncodePrivateKeytoPEM()), os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write SSH key for instance '%s'", instance.Name)
+	}
+	return nil
+}
+
+// envDashboardURL returns the local URL of the dashboard of an instance, as reached through its tunnel, and a hint
+// about starting the tunnel when it isn't running. Unless a port is given, the URL uses the port of the running
+// tunnel or the one allocated to the instance. The URL is empty when the instance was never allocated a port
+func envDashboardURL(instance cloud.InstanceInfo, port int) (string, string, error) {
+	if port != 0 {
+		return fmt.Sprintf("http://localhost:%d/", port), fmt.Sprintf("The dashboard URL requires a running tunnel: protos instance tunnel --port %d %s", port, instance.Name), nil
+	}
+	tunnels, err := runningTunnels()
+	if err != nil {
+		return "", "", err
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.Instance != instance.Name {
+			continue
+		}
+		if tunnel.Target != "" && tunnel.Target != instanceAPIAddress {
+			return "", fmt.Sprintf("The tunnel to instance '%s' forwards to %s, not to the dashboard", instance.Name, tunnel.Target), nil
+		}
+		return tunnel.URL(), "", nil
+	}
+	if instance.TunnelPort == 0 {
+		return "", fmt.Sprintf("Instance '%s' has no tunnel port yet. Run 'protos instance tunnel %s' once to allocate it, or use --dashboard-port", instance.Name, instance.Name), nil
+	}
+	return fmt.Sprintf("http://localhost:%d/", instance.TunnelPort), fmt.Sprintf("The dashboard URL requires a running tunnel: protos instance tunnel %s", instance.Name), nil
+}
+
+// printEnvUnset prints the commands that undo printEnv. The ssh-agent is stopped and the key file removed before their
+// variables are unset. The ssh-agent is stopped only if it was started by --agent, as recorded by PROTOS_SSH_AGENT_PID,
+// so that the agent of the user is left alone. Only key files written by printEnv are removed, and never the one used
+// to reach the shared database, which was kept in the keys directory by older clients
+func printEnvUnset() {
+	fmt.Println(`if [ -n "$PROTOS_SSH_AGENT_PID" ] && [ "$SSH_AGENT_PID" = "$PROTOS_SSH_AGENT_PID" ]; then ssh-agent -k > /dev/null; unset SSH_AUTH_SOCK SSH_AGENT_PID; fi;`)
+	keep := ""
+	if backend, err := stateBackend(); err == nil && backend != nil {
+		keep = backend.KeyFile
+	}
+	fmt.Printf("case \"$PROTOS_SSH_KEY\" in %s) ;; %s/*) rm -f \"$PROTOS_SSH_KEY\";; esac;\n", shellQuote(keep), shellQuote(keysDir()))
+	for _, variable := range envVariables {
+		fmt.Printf("unset %s\n", variable)
+	}
+}
+
+var sshAgentVarRegexp = regexp.MustCompile(`(SSH_AUTH_SOCK|SSH_AGENT_PID)=([^;]+);`)
+
+// startSSHAgent starts a new ssh-agent, adds the key of the instance to it and returns the variables that point clients
+// to the agent, and PROTOS_SSH_AGENT_PID marking it as started by protos. The key is passed to ssh-add on its stdin, so
+// that it's not written to disk. The agent is stopped if the key can't be added
+func startSSHAgent(instance cloud.InstanceInfo) ([][2]string, error) {
+	key, err := instanceKey(instance)
+	if err != nil {
+		return nil, err
+	}
+	out, err := exec.Command("ssh-agent", "-s").Output()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to start ssh-agent")
+	}
+	vars := [][2]string{}
+	env := os.Environ()
+	for _, match := range sshAgentVarRegexp.FindAllStringSubmatch(string(out), -1) {
+		vars = append(vars, [2]string{match[1], match[2]})
+		env = append(env, match[1]+"="+match[2])
+	}
+	if len(vars) != 2 {
+		return nil, errors.Errorf("Failed to parse ssh-agent output: %s", strings.TrimSpace(string(out)))
+	}
+
+	addCmd := exec.Command("ssh-add", "-")
+	addCmd.Env = env
+	addCmd.Stdin = strings.NewReader(key.EncodePrivateKeytoPEM())
+	out, err = addCmd.CombinedOutput()
+	if err != nil {
+		killCmd := exec.Command("ssh-agent", "-k")
+		killCmd.Env = env
+		if killErr := killCmd.Run(); killErr != nil {
+			log.Warnf("Failed to stop ssh-agent: %s", killErr.Error())
+		}
+		return nil, errors.Wrapf(err, "Failed to add SSH key to ssh-agent: %s", strings.TrimSpace(string(out)))
+	}
+	for _, v := range vars {
+		if v[0] == "SSH_AGENT_PID" {
+			vars = append(vars, [2]string{"PROTOS_SSH_AGENT_PID", v[1]})
+			break
+		}
+	}
+	return vars, nil
+}
+
+// shellQuote quotes a value so it can be safely used in a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
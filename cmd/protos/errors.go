@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/protosio/cli/internal/output"
+	"github.com/urfave/cli/v2"
+)
+
+// Error codes reported by commands using JSON output, so that automation doesn't have to match error messages
+const (
+	errorCodeTimeout    = "timeout"
+	errorCodeCanceled   = "canceled"
+	errorCodeNotFound   = "not_found"
+	errorCodePermission = "permission_denied"
+	errorCodeNetwork    = "network"
+	errorCodeUnknown    = "error"
+)
+
+// commandArgs are the arguments of the command, once aliases are expanded
+var commandArgs []string
+
+// jsonError is how a failed command reports its error on stderr when JSON output is requested
+type jsonError struct {
+	Code     string
+	Message  string
+	Causes   []string
+	ExitCode int
+}
+
+// notFoundError is returned when a resource named by the user doesn't exist, e.g. an instance
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return string(e)
+}
+
+// causer is implemented by the errors wrapped using pkg/errors
+type causer interface {
+	Cause() error
+}
+
+//
+// Error methods
+//
+
+// newJSONError describes err: its code, the full message, and the message of each error it wraps, from the outermost
+// one to the root cause
+func newJSONError(err error, exitCode int) jsonError {
+	jerr := jsonError{Code: errorCodeUnknown, Message: err.Error(), Causes: []string{}, ExitCode: exitCode}
+	for err != nil {
+		if jerr.Code == errorCodeUnknown {
+			jerr.Code = errorCode(err)
+		}
+		var next error
+		if c, ok := err.(causer); ok {
+			next = c.Cause()
+		}
+		// errors adding a stack trace wrap another one without changing the message
+		if next == nil || next.Error() != err.Error() {
+			message := err.Error()
+			if next != nil {
+				message = strings.TrimSuffix(message, ": "+next.Error())
+			}
+			jerr.Causes = append(jerr.Causes, message)
+		}
+		err = next
+	}
+	return jerr
+}
+
+// errorCode classifies err, without looking at the errors it wraps
+func errorCode(err error) string {
+	switch err.(type) {
+	case timeoutError:
+		return errorCodeTimeout
+	case notFoundError:
+		return errorCodeNotFound
+	}
+	switch err {
+	case context.DeadlineExceeded:
+		return errorCodeTimeout
+	case context.Canceled:
+		return errorCodeCanceled
+	case storm.ErrNotFound:
+		return errorCodeNotFound
+	}
+	if os.IsNotExist(err) {
+		return errorCodeNotFound
+	}
+	if os.IsPermission(err) {
+		return errorCodePermission
+	}
+	if nerr, ok := err.(net.Error); ok {
+		if nerr.Timeout() {
+			return errorCodeTimeout
+		}
+		return errorCodeNetwork
+	}
+	return errorCodeUnknown
+}
+
+// jsonErrorsRequested returns true if errors should be reported as JSON. The arguments are checked as well, since
+// errors can happen before the flags of the command are parsed, e.g. while opening the database
+func jsonErrorsRequested(args []string) bool {
+	if outputSpec != "" {
+		return outputSpec == output.JSON
+	}
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch {
+		case arg == "--output=json" || arg == "-output=json" || arg == "-o=json":
+			return true
+		case (arg == "--output" || arg == "-output" || arg == "-o") && i+1 < len(args) && args[i+1] == output.JSON:
+			return true
+		}
+	}
+	return false
+}
+
+// exitWithError reports the error a command failed with and exits. The error is written to stderr as JSON if JSON output
+// was requested, on a single line so that it can be told apart from the logs
+func exitWithError(err error) {
+	exitCode := 1
+	if _, timedOut := err.(timeoutError); timedOut {
+		exitCode = exitTimeout
+	}
+	// exit errors without a message are returned by commands that already reported the problem, e.g. by showing their help
+	if exitErr, ok := err.(cli.ExitCoder); ok {
+		exitCode = exitErr.ExitCode()
+		if err.Error() == "" {
+			os.Exit(exitCode)
+		}
+	}
+	if !jsonErrorsRequested(commandArgs) {
+		log.Error(err)
+		os.Exit(exitCode)
+	}
+	data, jsonErr := json.Marshal(newJSONError(err, exitCode))
+	if jsonErr != nil {
+		log.Error(err)
+		os.Exit(exitCode)
+	}
+	fmt.Fprintln(os.Stderr, string(data))
+	os.Exit(exitCode)
+}
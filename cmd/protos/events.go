@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/urfave/cli/v2"
+)
+
+var eventsCloud string
+var eventsWatch time.Duration
+
+var cmdEvents *cli.Command = &cli.Command{
+	Name:  "events",
+	Usage: "Show the events reported by cloud providers for the managed instances, like crashes and planned maintenance",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "cloud",
+			Usage:       "Only check the instances of `CLOUD`",
+			Destination: &eventsCloud,
+		},
+		&cli.DurationFlag{
+			Name:        "watch",
+			Usage:       "Keep checking every `INTERVAL` (e.g. 5m) and log new events, until CTRL+C is pressed",
+			Destination: &eventsWatch,
+		},
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		if eventsWatch < 0 {
+			return errors.Errorf("Invalid watch interval '%s'", eventsWatch)
+		}
+		if eventsWatch > 0 {
+			return watchEvents(eventsCloud, eventsWatch)
+		}
+		return listEvents(eventsCloud)
+	},
+}
+
+// instanceEvent is a provider event correlated with the managed instance it affects
+type instanceEvent struct {
+	Instance string
+	Cloud    string
+	cloud.Event
+}
+
+//
+// Events methods
+//
+
+// fetchEvents retrieves the events of the managed instances. Clouds whose provider doesn't report events are skipped.
+// Failures are logged, so that one unreachable cloud doesn't hide the events of the others
+func fetchEvents(instances []cloud.InstanceInfo, clouds map[string]cloud.ProviderInfo) []instanceEvent {
+	events := []instanceEvent{}
+	clients := map[string]cloud.Provider{}
+	for _, instance := range instances {
+		provider, found := clouds[instance.CloudName]
+		if !found {
+			continue
+		}
+		key := instance.CloudName + "/" + instance.Location
+		client, found := clients[key]
+		if !found {
+			client = provider.Client()
+			if !client.Capabilities().Events {
+				log.Debugf("Cloud '%s' doesn't report events", instance.CloudName)
+				continue
+			}
+			err := client.Init(provider.Auth, instance.Location)
+			if err != nil {
+				log.Warnf("Failed to connect to cloud provider '%s'(%s) API: %s", instance.CloudName, provider.Type.String(), err.Error())
+				continue
+			}
+			clients[key] = client
+		}
+		instanceEvents, err := client.GetInstanceEvents(instance.VMID)
+		if err != nil {
+			log.Warnf("Failed to retrieve events of instance '%s': %s", instance.Name, err.Error())
+			continue
+		}
+		for _, event := range instanceEvents {
+			events = append(events, instanceEvent{Instance: instance.Name, Cloud: instance.CloudName, Event: event})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Instance < events[j].Instance })
+	return events
+}
+
+// eventTargets returns the instances to check and their clouds, optionally limited to one cloud
+func eventTargets(cloudName string) ([]cloud.InstanceInfo, map[string]cloud.ProviderInfo, error) {
+	clouds := map[string]cloud.ProviderInfo{}
+	if cloudName != "" {
+		provider, err := dbp.GetCloud(cloudName)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
+		}
+		if !provider.Client().Capabilities().Events {
+			return nil, nil, errors.Errorf("Cloud provider '%s' does not report events", provider.Type)
+		}
+		clouds[cloudName] = provider
+	} else {
+		providers, err := dbp.GetAllClouds()
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, provider := range providers {
+			clouds[provider.Name] = provider
+		}
+	}
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return nil, nil, err
+	}
+	targets := []cloud.InstanceInfo{}
+	for _, instance := range instances {
+		if _, found := clouds[instance.CloudName]; found {
+			targets = append(targets, instance)
+		}
+	}
+	return targets, clouds, nil
+}
+
+func listEvents(cloudName string) error {
+	instances, clouds, err := eventTargets(cloudName)
+	if err != nil {
+		return err
+	}
+	events := fetchEvents(instances, clouds)
+
+	return printOutput(events, func() {
+		if len(events) == 0 {
+			fmt.Printf("No events reported for %d instance(s)\n", len(instances))
+			return
+		}
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Instance", "Cloud", "Event", "Time", "Description")
+		for _, event := range events {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t", event.Instance, event.Cloud, event.Type, formatEventTime(event.Time), event.Description)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// watchEvents checks for events every interval and logs the new ones. The instances are read once, and the database
+// is released while watching, so that other commands can be used meanwhile
+func watchEvents(cloudName string, interval time.Duration) error {
+	instances, clouds, err := eventTargets(cloudName)
+	if err != nil {
+		return err
+	}
+	err = releaseDB()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	log.Infof("Watching %d instance(s) for events every %s. Press CTRL+C to stop", len(instances), interval)
+	seen := map[string]bool{}
+	for {
+		current := map[string]bool{}
+		for _, event := range fetchEvents(instances, clouds) {
+			key := event.Instance + "/" + event.Type + "/" + event.Description
+			current[key] = true
+			if !seen[key] {
+				log.Warnf("Instance '%s' (cloud '%s'): %s - %s", event.Instance, event.Cloud, event.Type, event.Description)
+			}
+		}
+		for key := range seen {
+			if !current[key] {
+				log.Infof("Event cleared: %s", key)
+			}
+		}
+		seen = current
+
+		select {
+		case <-quit:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func formatEventTime(t time.Time) string {
+	if t.IsZero() {
+		return "n/a"
+	}
+	return formatTime(t)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdExport *cli.Command = &cli.Command{
+	Name:  "export",
+	Usage: "Export the managed instances for use by other tools",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ansible-inventory",
+			Usage: "Print the instances as an Ansible dynamic inventory, grouped by cloud (cloud_<name>), group (group_<name>) and tag (tag_<tag>). Use it from an executable inventory script containing: exec protos export ansible-inventory \"$@\". The instance keys are written unencrypted to the keys directory for Ansible, and removed by 'protos db migrate-keys'",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "list",
+					Usage: "Print the whole inventory, which is the default. Accepted since Ansible passes it to inventory scripts",
+				},
+				&cli.StringFlag{
+					Name:  "host",
+					Usage: "Only print the variables of instance `NAME`",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return exportAnsibleInventory(c.String("host"))
+			},
+		},
+	},
+}
+
+// ansibleGroup is a group of an Ansible dynamic inventory
+type ansibleGroup struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Children []string `json:"children,omitempty"`
+}
+
+// ansibleGroupRegexp matches the characters not allowed in Ansible group names
+var ansibleGroupRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+//
+// Export methods
+//
+
+// exportAnsibleInventory prints the inventory in the JSON format expected from inventory scripts called with --list,
+// or the variables of one instance, as expected with --host. The key files of the instances are written unencrypted to
+// the keys directory, so that Ansible can use them, until removed by 'protos db migrate-keys'
+func exportAnsibleInventory(host string) error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	if host != "" {
+		for _, instance := range instances {
+			if instance.Name == host {
+				return printJSON(ansibleHostVars(instance))
+			}
+		}
+		return errors.Errorf("Could not find instance '%s'", host)
+	}
+
+	groups := map[string]*ansibleGroup{}
+	addHost := func(group string, host string) {
+		name := ansibleGroupRegexp.ReplaceAllString(group, "_")
+		if groups[name] == nil {
+			groups[name] = &ansibleGroup{}
+		}
+		for _, h := range groups[name].Hosts {
+			if h == host {
+				return
+			}
+		}
+		groups[name].Hosts = append(groups[name].Hosts, host)
+	}
+	hostVars := map[string]map[string]interface{}{}
+	for _, instance := range instances {
+		hostVars[instance.Name] = ansibleHostVars(instance)
+		addHost("cloud_"+instance.CloudName, instance.Name)
+		for _, group := range instance.Groups {
+			addHost("group_"+group, instance.Name)
+		}
+		for _, tag := range instance.Tags {
+			addHost("tag_"+tag, instance.Name)
+		}
+	}
+
+	inventory := map[string]interface{}{
+		"_meta": map[string]interface{}{"hostvars": hostVars},
+	}
+	all := &ansibleGroup{}
+	for name, group := range groups {
+		inventory[name] = group
+		all.Children = append(all.Children, name)
+	}
+	sort.Strings(all.Children)
+	inventory["all"] = all
+	return printJSON(inventory)
+}
+
+// ansibleHostVars returns the variables Ansible uses to connect to an instance, along with its Protos details. The key
+// file is left out if it can't be written, so that one instance doesn't break the whole inventory
+func ansibleHostVars(instance cloud.InstanceInfo) map[string]interface{} {
+	vars := map[string]interface{}{
+		"ansible_host":            instance.PublicIP,
+		"ansible_user":            "root",
+		"ansible_ssh_common_args": "-o UserKnownHostsFile=" + knownHosts.Path(),
+		"protos_cloud":            instance.CloudName,
+		"protos_location":         instance.Location,
+		"protos_version":          instance.Version,
+		"protos_status":           instance.Status,
+		"protos_groups":           nonNil(instance.Groups),
+		"protos_tags":             nonNil(instance.Tags),
+	}
+	if host, port, err := net.SplitHostPort(instance.PublicIP); err == nil {
+		vars["ansible_host"] = host
+		if p, err := strconv.Atoi(port); err == nil {
+			vars["ansible_port"] = p
+		}
+	}
+	keyFile, err := writeInstanceKey(instance)
+	if err != nil {
+		log.Warn(err)
+	} else {
+		vars["ansible_ssh_private_key_file"] = keyFile
+	}
+	return vars
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func printJSON(data interface{}) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode JSON")
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+var fleetGroup string
+
+var cmdFleet *cli.Command = &cli.Command{
+	Name:  "fleet",
+	Usage: "Run operations on several instances at once",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "exec",
+			ArgsUsage: "-- <command>",
+			Usage:     "Run a command over SSH on every instance in a group concurrently",
+			Before:    authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "group",
+					Usage:       "Run the command on the instances in `GROUP`. All instances are used by default",
+					Destination: &fleetGroup,
+				},
+				&cli.BoolFlag{
+					Name:  "forward-agent",
+					Usage: "Forward your SSH agent to the command, so it can use your keys, e.g. to clone private repositories. Only use it with instances you trust",
+				},
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				command := strings.Join(c.Args().Slice(), " ")
+				if command == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return withTimeout(c, func() error {
+					return fleetExec(fleetGroup, command, c.Bool("forward-agent"))
+				})
+			},
+		},
+	},
+}
+
+//
+// Fleet methods
+//
+
+// fleetInstances returns the instances in a group, or all the instances if group is empty
+func fleetInstances(group string) ([]cloud.InstanceInfo, error) {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return nil, err
+	}
+	if group == "" {
+		return instances, nil
+	}
+	selected := []cloud.InstanceInfo{}
+	for _, instance := range instances {
+		for _, g := range instance.Groups {
+			if g == group {
+				selected = append(selected, instance)
+				break
+			}
+		}
+	}
+	return selected, nil
+}
+
+type fleetResult struct {
+	instance string
+	exitCode int
+	err      error
+}
+
+func fleetExec(group string, command string, forwardAgent bool) error {
+	instances, err := fleetInstances(group)
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		return errors.Errorf("No instances found in group '%s'", group)
+	}
+
+	width := 0
+	for _, instance := range instances {
+		if len(instance.Name) > width {
+			width = len(instance.Name)
+		}
+	}
+
+	outputLock := &sync.Mutex{}
+	results := make(chan fleetResult, len(instances))
+	for _, instance := range instances {
+		go func(instance cloud.InstanceInfo) {
+			prefix := fmt.Sprintf("%-*s | ", width, instance.Name)
+			stdout := &prefixWriter{prefix: prefix, out: os.Stdout, lock: outputLock}
+			stderr := &prefixWriter{prefix: prefix, out: os.Stderr, lock: outputLock}
+			result := fleetResult{instance: instance.Name, exitCode: -1}
+
+			sshClient, err := connectInstance(instance, 1, false)
+			if err != nil {
+				result.err = err
+				results <- result
+				return
+			}
+			if forwardAgent {
+				result.exitCode, result.err = ssh.RunCommandWithAgent(command, stdout, stderr, sshClient)
+			} else {
+				result.exitCode, result.err = ssh.RunCommand(command, stdout, stderr, sshClient)
+			}
+			stdout.Flush()
+			stderr.Flush()
+			results <- result
+		}(instance)
+	}
+
+	summary := []fleetResult{}
+	for range instances {
+		summary = append(summary, <-results)
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].instance < summary[j].instance })
+
+	failed := 0
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "\n")
+	printTableHeader(w, "Instance", "Exit code", "Error")
+	for _, result := range summary {
+		exitCode, errMsg := "-", "-"
+		if result.err != nil {
+			errMsg = result.err.Error()
+		} else {
+			exitCode = fmt.Sprintf("%d", result.exitCode)
+		}
+		if result.err != nil || result.exitCode != 0 {
+			failed++
+		}
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t", result.instance, exitCode, errMsg)
+	}
+	fmt.Fprint(w, "\n")
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("Command failed on %d of %d instances", failed, len(summary))
+	}
+	return nil
+}
+
+// prefixWriter writes complete lines to out, each one starting with prefix. Writes to out are serialized using lock
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	pw.buf.Write(p)
+	for {
+		i := bytes.IndexByte(pw.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := pw.buf.Next(i + 1)
+		pw.lock.Lock()
+		_, err := fmt.Fprint(pw.out, pw.prefix+string(line))
+		pw.lock.Unlock()
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any remaining partial line
+func (pw *prefixWriter) Flush() {
+	if pw.buf.Len() == 0 {
+		return
+	}
+	pw.lock.Lock()
+	fmt.Fprintln(pw.out, pw.prefix+pw.buf.String())
+	pw.lock.Unlock()
+	pw.buf.Reset()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdGC *cli.Command = &cli.Command{
+	Name:   "gc",
+	Usage:  "Clean up resources that are no longer needed",
+	Before: snapshotDB,
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "expired",
+			Usage: "Destroy instances whose TTL has passed",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if !c.Bool("expired") {
+			cli.ShowCommandHelp(c, "gc")
+			return cli.Exit("", 1)
+		}
+		return destroyExpiredInstances()
+	},
+}
+
+//
+// GC methods
+//
+
+func destroyExpiredInstances() error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, instance := range instances {
+		if instance.ExpiresAt.IsZero() {
+			continue
+		}
+		if instance.ExpiresAt.After(time.Now()) {
+			warnIfExpiring(instance)
+			continue
+		}
+		log.Infof("Instance '%s' expired on %s. Destroying it", instance.Name, formatTime(instance.ExpiresAt))
+		err = deleteInstance(instance.Name, false)
+		if err != nil {
+			log.Errorf("Failed to destroy expired instance '%s': %s", instance.Name, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed to destroy %d expired instance(s)", failed)
+	}
+	return nil
+}
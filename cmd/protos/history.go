@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/db"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdHistory *cli.Command = &cli.Command{
+	Name:  "history",
+	Usage: "Show the commands that changed the database and who ran them, useful when it's shared by a team",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "Only show the commands run by `USER`",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "Show the last `N` commands",
+			Value: 50,
+		},
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		if c.Int("limit") < 1 {
+			return errors.Errorf("Invalid limit %d", c.Int("limit"))
+		}
+		return listHistory(c.String("user"), c.Int("limit"))
+	},
+}
+
+//
+// History methods
+//
+
+// recordHistory adds the command being run to the history, along with the current user. Flags and the values of
+// key=value arguments are left out, since they can hold credentials
+func recordHistory(c *cli.Context) error {
+	// the name of a subcommand's app is the path of its parent commands, starting with the name of the CLI
+	path := strings.Fields(c.App.Name)
+	if len(path) > 0 {
+		path = path[1:]
+	}
+	args := []string{}
+	for _, arg := range c.Args().Slice() {
+		// settings like API_TOKEN=... can hold credentials as well
+		if i := strings.Index(arg, "="); i >= 0 {
+			arg = arg[:i+1] + "<redacted>"
+		}
+		args = append(args, arg)
+	}
+	return saveHistory(strings.Join(append(append(path, c.Command.Name), args...), " "))
+}
+
+// saveHistory adds a command to the history, along with the current user. It's used directly for changes that don't
+// come from a CLI command, like those requested through the control socket of 'protos serve'
+func saveHistory(command string) error {
+	entry := db.HistoryEntry{Time: time.Now(), User: stateUser(), Command: command}
+	err := dbp.SaveHistory(entry)
+	if err != nil {
+		return errors.Wrap(err, "Failed to record the command in the history")
+	}
+	return nil
+}
+
+func listHistory(user string, limit int) error {
+	entries, err := dbp.GetHistory()
+	if err != nil {
+		return err
+	}
+	if user != "" {
+		filtered := []db.HistoryEntry{}
+		for _, entry := range entries {
+			if entry.User == user {
+				filtered = append(filtered, entry)
+			}
+		}
+		entries = filtered
+	}
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return printOutput(entries, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "Time", "User", "Command")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t", formatTimeSeconds(entry.Time), entry.User, entry.Command)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+	})
+}
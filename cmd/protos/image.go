@@ -0,0 +1,610 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/httpclient"
+	"github.com/protosio/cli/internal/release"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+// maxTransferStreams limits the connections opened by an upload, since SSH servers throttle concurrent connections
+const maxTransferStreams = 8
+
+var imageFile string
+var shareFrom string
+var shareFromLocation string
+var shareTo string
+var shareToLocation string
+var pruneKeep int
+
+var cmdImage *cli.Command = &cli.Command{
+	Name:  "image",
+	Usage: "Manage Protos images in cloud provider accounts",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "upload",
+			Usage:  "Upload a local Protos image file to a cloud provider account, without downloading it from the releases server",
+			Before: authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "cloud",
+					Usage:       "Specify which `CLOUD` to upload the image to",
+					Required:    true,
+					Destination: &cloudName,
+				},
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Specify one of the supported `LOCATION`s to upload the image to (cloud specific). Defaults to the first supported location",
+					Destination: &cloudLocation,
+				},
+				&cli.StringFlag{
+					Name:        "file",
+					Usage:       "Path to the raw Protos image `FILE`",
+					Required:    true,
+					Destination: &imageFile,
+				},
+				&cli.StringFlag{
+					Name:        "version",
+					Usage:       "Protos `VERSION` of the image file",
+					Required:    true,
+					Destination: &protosVersion,
+				},
+				bandwidthLimitFlag(),
+				&cli.IntFlag{
+					Name:  "streams",
+					Usage: "Upload the image over `N` parallel connections, which speeds up transfers over high latency links",
+					Value: 1,
+				},
+				&cli.BoolFlag{
+					Name:  "compress",
+					Usage: "Compress the image during the transfer. Speeds up slow links, especially for images with empty space",
+				},
+				&cli.BoolFlag{
+					Name:  "async",
+					Usage: "Run the upload in the background and return immediately. Use 'protos job' to follow it",
+				},
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				limit, err := parseSize(bandwidthLimit)
+				if err != nil {
+					return err
+				}
+				if c.Int("streams") < 1 || c.Int("streams") > maxTransferStreams {
+					return errors.Errorf("The number of streams should be between 1 and %d", maxTransferStreams)
+				}
+				if c.Bool("async") && os.Getenv(jobEnvVar) == "" {
+					return startJob("image upload " + protosVersion)
+				}
+				transfer := ssh.TransferOptions{BandwidthLimit: limit, Streams: c.Int("streams"), Compress: c.Bool("compress")}
+				return withTimeout(c, func() error {
+					return uploadImage(cloudName, cloudLocation, imageFile, protosVersion, transfer)
+				})
+			},
+		},
+		{
+			Name:   "share",
+			Usage:  "Copy a Protos image from one cloud provider account to another, without downloading it from the releases server. The copy can't be verified against the release, so deploys to providers that record image digests add the release image again instead of using it",
+			Before: authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "from",
+					Usage:       "Specify which `CLOUD` to copy the image from",
+					Required:    true,
+					Destination: &shareFrom,
+				},
+				&cli.StringFlag{
+					Name:        "from-location",
+					Usage:       "Specify the `LOCATION` of the image in the source cloud. Defaults to the first supported location",
+					Destination: &shareFromLocation,
+				},
+				&cli.StringFlag{
+					Name:        "to",
+					Usage:       "Specify which `CLOUD` to copy the image to",
+					Required:    true,
+					Destination: &shareTo,
+				},
+				&cli.StringFlag{
+					Name:        "to-location",
+					Usage:       "Specify the `LOCATION` to copy the image to in the destination cloud. Defaults to the first supported location",
+					Destination: &shareToLocation,
+				},
+				&cli.StringFlag{
+					Name:        "version",
+					Usage:       "Protos `VERSION` of the image to copy",
+					Required:    true,
+					Destination: &protosVersion,
+				},
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return withTimeout(c, func() error {
+					return shareImage(shareFrom, shareFromLocation, shareTo, shareToLocation, protosVersion)
+				})
+			},
+		},
+		{
+			Name:   "prune",
+			Usage:  "Delete old Protos images from a cloud provider account, keeping the most recent versions",
+			Before: authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "cloud",
+					Usage:       "Specify which `CLOUD` to delete the images from",
+					Required:    true,
+					Destination: &cloudName,
+				},
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Specify one of the supported `LOCATION`s to delete the images from (cloud specific). Defaults to the first supported location",
+					Destination: &cloudLocation,
+				},
+				&cli.IntFlag{
+					Name:        "keep",
+					Usage:       "`NUMBER` of most recent Protos versions to keep",
+					Value:       2,
+					Destination: &pruneKeep,
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the images that would be deleted",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if pruneKeep < 0 {
+					return errors.New("The number of versions to keep can't be negative")
+				}
+				return pruneImages(cloudName, cloudLocation, pruneKeep, c.Bool("dry-run"))
+			},
+		},
+		{
+			Name:   "warm",
+			Usage:  "Add the images of Protos releases to a cloud provider account ahead of time, e.g. from a CI pipeline, so that deploys don't wait for them",
+			Before: authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "cloud",
+					Usage:       "Specify which `CLOUD` to add the images to",
+					Required:    true,
+					Destination: &cloudName,
+				},
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Specify one of the supported `LOCATION`s to add the images to (cloud specific). Defaults to the first supported location",
+					Destination: &cloudLocation,
+				},
+				&cli.StringFlag{
+					Name:  "versions",
+					Usage: "Comma separated Protos `VERSIONS` to add. Besides version numbers, 'latest' and 'previous' name the two most recent releases",
+					Value: "latest",
+				},
+				bandwidthLimitFlag(),
+				&cli.BoolFlag{
+					Name:  "stream-image",
+					Usage: "Download the images through the CLI and stream them to the cloud provider, instead of letting the provider fetch them",
+				},
+				timeoutFlag(),
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				limit, err := parseSize(bandwidthLimit)
+				if err != nil {
+					return err
+				}
+				return withTimeout(c, func() error {
+					return warmImages(cloudName, cloudLocation, strings.Split(c.String("versions"), ","), limit, c.Bool("stream-image"))
+				})
+			},
+		},
+	},
+}
+
+//
+// Image methods
+//
+
+func uploadImage(cloudName string, location string, imagePath string, version string, transfer ssh.TransferOptions) error {
+	client, location, err := initCloudClient(cloudName, location)
+	if err != nil {
+		return err
+	}
+	if !client.Capabilities().CustomImages {
+		return cloud.NotSupported(client, "custom images")
+	}
+
+	log.Infof("Calculating digest for image file '%s'", imagePath)
+	digest, err := fileDigest(imagePath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to upload Protos image")
+	}
+
+	protosImage := "protos-" + version
+	existing, err := findProtosImage(client, version, digest)
+	if err != nil {
+		return errors.Wrap(err, "Failed to upload Protos image")
+	}
+	if existing != "" {
+		return errors.Errorf("Protos image '%s' already exists in cloud '%s', location '%s'", protosImage, cloudName, location)
+	}
+
+	imageID, err := client.UploadLocalImage(imagePath, digest, version, transfer)
+	if err != nil {
+		return errors.Wrap(err, "Failed to upload Protos image")
+	}
+	recordImageDigest(client, imageID, digest)
+	log.Infof("Protos image '%s' (%s) uploaded to cloud '%s', location '%s'", protosImage, imageID, cloudName, location)
+	return nil
+}
+
+func shareImage(fromCloud string, fromLocation string, toCloud string, toLocation string, version string) error {
+	protosImage := "protos-" + version
+
+	srcClient, fromLocation, err := initCloudClient(fromCloud, fromLocation)
+	if err != nil {
+		return err
+	}
+	if !srcClient.Capabilities().ImageExport {
+		return cloud.NotSupported(srcClient, "exporting images")
+	}
+	srcImages, err := srcClient.GetImages()
+	if err != nil {
+		return errors.Wrap(err, "Failed to share Protos image")
+	}
+	imageID, found := srcImages[protosImage]
+	if !found {
+		return errors.Errorf("Protos image '%s' not found in cloud '%s', location '%s'", protosImage, fromCloud, fromLocation)
+	}
+	// the digest of the source image, if recorded, finds a copy made earlier under another name
+	digest := ""
+	if srcClient.Capabilities().ImageDigests {
+		digests, err := cloud.ImageDigests(srcClient)
+		if err != nil {
+			return errors.Wrap(err, "Failed to share Protos image")
+		}
+		digest = digests[imageID]
+	}
+
+	dstClient, toLocation, err := initCloudClient(toCloud, toLocation)
+	if err != nil {
+		return err
+	}
+	if !dstClient.Capabilities().ImageExport {
+		return cloud.NotSupported(dstClient, "importing images")
+	}
+	existing, err := findProtosImage(dstClient, version, digest)
+	if err != nil {
+		return errors.Wrap(err, "Failed to share Protos image")
+	}
+	if existing != "" {
+		return errors.Errorf("Protos image '%s' already exists in cloud '%s', location '%s'", protosImage, toCloud, toLocation)
+	}
+
+	log.Infof("Copying Protos image '%s' from cloud '%s' (%s) to cloud '%s' (%s)", protosImage, fromCloud, fromLocation, toCloud, toLocation)
+	image, err := srcClient.ExportImage(imageID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to share Protos image")
+	}
+	defer image.Close()
+
+	newImageID, err := dstClient.ImportImage(image, version)
+	if err != nil {
+		return errors.Wrap(err, "Failed to share Protos image")
+	}
+	// the exported disk contents can't be compared with the release image, so the copy isn't tagged with its digest
+	log.Infof("Protos image '%s' (%s) copied to cloud '%s', location '%s'", protosImage, newImageID, toCloud, toLocation)
+	return nil
+}
+
+// protosImage is a Protos image found in a cloud provider account
+type protosImage struct {
+	name    string
+	id      string
+	version *semver.Version
+}
+
+func pruneImages(cloudName string, location string, keep int, dryRun bool) error {
+	client, location, err := initCloudClient(cloudName, location)
+	if err != nil {
+		return err
+	}
+	images, err := client.GetImages()
+	if err != nil {
+		return errors.Wrap(err, "Failed to prune Protos images")
+	}
+
+	protosImages := []protosImage{}
+	for name, id := range images {
+		if !strings.HasPrefix(name, "protos-") {
+			continue
+		}
+		version, err := semver.NewVersion(strings.TrimPrefix(name, "protos-"))
+		if err != nil {
+			log.Debugf("Ignoring image '%s', which doesn't have a valid Protos version", name)
+			continue
+		}
+		protosImages = append(protosImages, protosImage{name: name, id: id, version: version})
+	}
+	sort.Slice(protosImages, func(i, j int) bool { return protosImages[i].version.GreaterThan(protosImages[j].version) })
+
+	if len(protosImages) <= keep {
+		log.Infof("Found %d Protos image(s) in cloud '%s', location '%s'. Nothing to delete", len(protosImages), cloudName, location)
+		return nil
+	}
+	for _, image := range protosImages[:keep] {
+		log.Infof("Keeping Protos image '%s' (%s)", image.name, image.id)
+	}
+
+	failed := 0
+	for _, image := range protosImages[keep:] {
+		if dryRun {
+			log.Infof("Would delete Protos image '%s' (%s)", image.name, image.id)
+			continue
+		}
+		log.Infof("Deleting Protos image '%s' (%s)", image.name, image.id)
+		err = client.RemoveImage(image.id)
+		if err != nil {
+			log.Errorf("Failed to delete Protos image '%s': %s", image.name, err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed to delete %d Protos image(s)", failed)
+	}
+	if dryRun {
+		log.Infof("Dry run: %d Protos image(s) would be deleted from cloud '%s', location '%s'", len(protosImages)-keep, cloudName, location)
+	}
+	return nil
+}
+
+// findProtosImage returns the ID of the image of a Protos release in a cloud account, empty if it has none. Images are
+// matched by the digest recorded when they were added, if the provider stores it and the release lists one, so that a
+// renamed image is still found while an image replaced under the name of the release isn't reused. Otherwise they are
+// matched by name. The digest is recorded by the CLI, not computed by the provider, so only renamed and replaced images
+// are detected: an image modified in place, or whose digest tag was changed, is still reused
+func findProtosImage(client cloud.Provider, version string, digest string) (string, error) {
+	protosImage := "protos-" + version
+	images, err := client.GetImages()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve Protos images")
+	}
+	named, found := images[protosImage]
+	if digest == "" || !client.Capabilities().ImageDigests {
+		return named, nil
+	}
+
+	digests, err := cloud.ImageDigests(client)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve Protos image digests")
+	}
+	if found && digests[named] == digest {
+		return named, nil
+	}
+	matching := []string{}
+	for id, d := range digests {
+		if d == digest {
+			matching = append(matching, id)
+		}
+	}
+	if len(matching) > 0 {
+		sort.Strings(matching)
+		for name, id := range images {
+			if id == matching[0] {
+				log.Infof("Using image '%s' (%s), which has the digest of Protos image '%s'", name, id, protosImage)
+			}
+		}
+		return matching[0], nil
+	}
+	if recorded, tagged := digests[named]; tagged {
+		log.Warnf("Protos image '%s' (%s) has digest '%s' instead of '%s'. Adding the image again", protosImage, named, recorded, digest)
+	} else if found {
+		log.Warnf("Protos image '%s' (%s) has no recorded digest, so it can't be verified. Adding the image again", protosImage, named)
+	}
+	return "", nil
+}
+
+// recordImageDigest stores the digest of the release image with an image added to a cloud account, so that
+// findProtosImage can verify it. A failure only means that the image will be added again when needed
+func recordImageDigest(client cloud.Provider, id string, digest string) {
+	if digest == "" || !client.Capabilities().ImageDigests {
+		return
+	}
+	err := cloud.SetImageDigest(client, id, digest)
+	if err != nil {
+		log.Warnf("Failed to record the digest of image '%s': %s", id, err.Error())
+	}
+}
+
+// addProtosImage adds the image of a Protos release to a cloud account, which doesn't have it yet. The provider native
+// snapshot is imported when possible, since it's faster, falling back to the image at its URL. The source of the image
+// is returned along with its ID: snapshot, streamed or uploaded
+func addProtosImage(client cloud.Provider, image release.CloudImage, version string, bandwidthLimit int64, stream bool) (string, string, error) {
+	if !client.Capabilities().CustomImages {
+		return "", "", cloud.NotSupported(client, "custom images")
+	}
+	if image.Snapshot != "" && client.Capabilities().SnapshotImages {
+		imageID, err := client.AddImageFromSnapshot(image.Snapshot, version)
+		if err == nil {
+			recordImageDigest(client, imageID, image.Digest)
+			return imageID, "snapshot", nil
+		}
+		if image.URL == "" {
+			return "", "", err
+		}
+		log.Warnf("Failed to add Protos image from snapshot, uploading it instead: %s", err.Error())
+	}
+	if image.URL == "" {
+		return "", "", errors.Errorf("Could not find a Scaleway release for Protos version '%s'", version)
+	}
+	log.Infof("Protos image 'protos-%s' not in your cloud account. Adding it.", version)
+	imageID, source := "", "uploaded"
+	var err error
+	if stream {
+		imageID, err = streamImageFromURL(client, image.URL, image.Digest, version, bandwidthLimit)
+		source = "streamed"
+	} else {
+		imageID, err = client.AddImage(image.URL, image.Digest, version, bandwidthLimit)
+	}
+	if err != nil {
+		return "", "", err
+	}
+	recordImageDigest(client, imageID, image.Digest)
+	return imageID, source, nil
+}
+
+// warmResult is the outcome of adding the image of a release to a cloud account, as reported by 'protos image warm'
+type warmResult struct {
+	Version string
+	Image   string // ID of the image, empty if it couldn't be added
+	Status  string // present, snapshot, streamed, uploaded or failed
+	Error   string `json:",omitempty"`
+}
+
+// resolveWarmVersions turns the versions requested for 'image warm' into releases, without duplicates
+func resolveWarmVersions(releases release.Releases, specs []string) ([]release.Release, error) {
+	newest, err := releases.Newest()
+	if err != nil {
+		return nil, err
+	}
+	resolved := []release.Release{}
+	seen := map[string]bool{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		var rls release.Release
+		switch spec {
+		case "":
+			continue
+		case "latest":
+			if len(newest) < 1 {
+				return nil, errors.New("Could not find the latest Protos release. 0 releases found")
+			}
+			rls = newest[0]
+		case "previous":
+			if len(newest) < 2 {
+				return nil, errors.Errorf("Could not find the previous Protos release. %d release(s) found", len(newest))
+			}
+			rls = newest[1]
+		default:
+			rls, err = releases.GetVersion(spec)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if !seen[rls.Version] {
+			seen[rls.Version] = true
+			resolved = append(resolved, rls)
+		}
+	}
+	if len(resolved) == 0 {
+		return nil, errors.New("No Protos versions to add")
+	}
+	return resolved, nil
+}
+
+// warmImages adds the images of the requested releases that are missing from a cloud account. All of them are tried,
+// and the command fails if any of them couldn't be added, so that CI pipelines notice
+func warmImages(cloudName string, location string, specs []string, bandwidthLimit int64, stream bool) error {
+	releases, err := getProtosReleases()
+	if err != nil {
+		return err
+	}
+	toAdd, err := resolveWarmVersions(releases, specs)
+	if err != nil {
+		return err
+	}
+	client, location, err := initCloudClient(cloudName, location)
+	if err != nil {
+		return err
+	}
+
+	results := []warmResult{}
+	failed := 0
+	for _, rls := range toAdd {
+		result := warmResult{Version: rls.Version}
+		image := rls.CloudImages["scaleway"]
+		id, err := findProtosImage(client, rls.Version, image.Digest)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			log.Infof("Protos image 'protos-%s' (%s) already in cloud '%s', location '%s'", rls.Version, id, cloudName, location)
+			result.Image = id
+			result.Status = "present"
+			results = append(results, result)
+			continue
+		}
+		id, source, err := addProtosImage(client, image, rls.Version, bandwidthLimit, stream)
+		if err != nil {
+			log.Errorf("Failed to add Protos image 'protos-%s': %s", rls.Version, err.Error())
+			result.Status = "failed"
+			result.Error = err.Error()
+			failed++
+		} else {
+			log.Infof("Protos image 'protos-%s' (%s) added to cloud '%s', location '%s'", rls.Version, id, cloudName, location)
+			result.Image = id
+			result.Status = source
+		}
+		results = append(results, result)
+	}
+
+	err = printOutput(results, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		printTableHeader(w, "Version", "Image", "Status")
+		for _, result := range results {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t", result.Version, result.Image, result.Status)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed to add %d Protos image(s) to cloud '%s', location '%s'", failed, cloudName, location)
+	}
+	return nil
+}
+
+// streamImageFromURL downloads an image and streams it to the cloud provider while it is being downloaded
+func streamImageFromURL(client cloud.Provider, url string, digest string, version string, bandwidthLimit int64) (string, error) {
+	log.Infof("Downloading Protos image from '%s'", url)
+	resp, err := httpclient.New(0).Get(url)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to download Protos image from '%s'", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Failed to download Protos image from '%s': %s", url, resp.Status)
+	}
+	return client.StreamImage(resp.Body, digest, version, bandwidthLimit)
+}
+
+// fileDigest returns the hex encoded SHA256 digest of a file
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to open file '%s'", path)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read file '%s'", path)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 
 	survey "github.com/AlecAivazis/survey/v2"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/db"
-	ssh "github.com/protosio/cli/internal/ssh"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var cmdInit *cli.Command = &cli.Command{
@@ -80,13 +85,12 @@ func protosFullInit() error {
 	//
 
 	// select one of the supported locations by this particular cloud
-	var cloudLocation string
 	supportedLocations := cloudProvider.SupportedLocations()
-	cloudLocationQuestions := surveySelect(supportedLocations, fmt.Sprintf("Choose one of the following supported locations for '%s':", cloudProvider.GetInfo().Type))
-	err = survey.AskOne(cloudLocationQuestions, &cloudLocation)
+	selected, err := selectOption(fmt.Sprintf("Choose one of the following supported locations for '%s':", cloudProvider.GetInfo().Type), supportedLocations, nil)
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
+	cloudLocation := supportedLocations[selected]
 
 	// get a name to use internally for this instance. This name should be reflected accordingly in the cloud provider account
 	vmNameQuestion := []*survey.Question{{
@@ -108,7 +112,7 @@ func protosFullInit() error {
 	}
 
 	// deploy the vm
-	instanceInfo, err := deployInstance(vmName, cloudName, cloudLocation, latestRelease)
+	instanceInfo, err := deployInstance(vmName, cloudName, cloudLocation, latestRelease, deployOptions{})
 	if err != nil {
 		return errors.Wrap(err, "Failed to initialize Protos")
 	}
@@ -117,21 +121,15 @@ func protosFullInit() error {
 	// Perform setup via SSH tunnel
 	//
 
-	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
-	if err != nil {
-		return errors.Wrap(err, "Failed to initialize Protos")
-	}
-
-	// test SSH and create SSH tunnel used for initialisation
-	tempClient, err := ssh.NewConnection(instanceInfo.PublicIP, "root", key.SSHAuth(), 10)
+	// test SSH. The connection is reused by the SSH tunnel used for initialisation
+	_, err = instanceSSHClient(instanceInfo, 10)
 	if err != nil {
 		return errors.Wrap(err, "Failed to connect to Protos instance via SSH")
 	}
-	tempClient.Close()
 	log.Info("Instance is ready and accepting SSH connections. Perform instance setup using the web based dashboard")
 
 	// create tunnel to reach the instance dashboard
-	tunnelInstance(instanceInfo.Name)
+	tunnelInstance(instanceInfo.Name, 0, tunnelOptions{})
 	log.Infof("Protos instance '%s' - '%s' deployed successfully", vmName, instanceInfo.PublicIP)
 
 	return nil
@@ -174,11 +172,101 @@ func getUserDetailsQuestions(ud *userDetails) []*survey.Question {
 	}
 }
 
-func surveySelect(options []string, message string) *survey.Select {
-	return &survey.Select{
-		Message: message,
-		Options: options,
+// selectOption asks the user to choose one of values, shown using labels if not nil, and returns its index. Typing
+// filters the list, every word having to appear in an option. Dumb terminals and non interactive input get a numbered
+// list instead, answered with a number or an exact value
+func selectOption(message string, values []string, labels []string) (int, error) {
+	if len(values) == 0 {
+		return 0, errors.New("No options to choose from")
+	}
+	if labels == nil {
+		labels = values
+	}
+	if os.Getenv("TERM") == "dumb" || !terminal.IsTerminal(int(os.Stdin.Fd())) || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		return selectOptionPlain(message, values, labels)
+	}
+	prompt := &survey.Select{
+		Message:  message,
+		Options:  labels,
+		PageSize: selectPageSize,
+		Filter: func(filter string, label string, index int) bool {
+			return matchesFilter(filter, values[index]) || matchesFilter(filter, label)
+		},
+	}
+	if len(labels) > selectPageSize {
+		prompt.Message += " (type to filter)"
+	}
+	var selected int
+	err := survey.AskOne(prompt, &selected)
+	return selected, err
+}
+
+// selectPageSize is the number of options shown at once by selectOption
+const selectPageSize = 10
+
+func matchesFilter(filter string, option string) bool {
+	option = strings.ToLower(option)
+	for _, word := range strings.Fields(strings.ToLower(filter)) {
+		if !strings.Contains(option, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectOptionPlain prints the options as a numbered list and reads the answer, without moving the cursor. Invalid
+// answers are asked again until the input ends
+func selectOptionPlain(message string, values []string, labels []string) (int, error) {
+	fmt.Println(message)
+	for i, label := range labels {
+		fmt.Printf("  %d) %s\n", i+1, label)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Enter a number or a value: ")
+		answer, err := reader.ReadString('\n')
+		answer = strings.TrimSpace(answer)
+		if answer != "" {
+			index, matchErr := matchOption(answer, values)
+			if matchErr == nil {
+				return index, nil
+			}
+			fmt.Println(matchErr.Error())
+		}
+		if err != nil {
+			if err == io.EOF {
+				return 0, errors.New("No option selected")
+			}
+			return 0, errors.Wrap(err, "Failed to read the selected option")
+		}
+	}
+}
+
+// matchOption returns the index of the value selected by answer: a number from the list, a value matching exactly
+// regardless of case, or the only value matching it as a filter
+func matchOption(answer string, values []string) (int, error) {
+	if n, err := strconv.Atoi(answer); err == nil {
+		if n < 1 || n > len(values) {
+			return 0, errors.Errorf("Choose a number between 1 and %d", len(values))
+		}
+		return n - 1, nil
+	}
+	matches := []int{}
+	for i, value := range values {
+		if strings.EqualFold(answer, value) {
+			return i, nil
+		}
+		if matchesFilter(answer, value) {
+			matches = append(matches, i)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0], nil
+	}
+	if len(matches) > 1 {
+		return 0, errors.Errorf("'%s' matches several options", answer)
 	}
+	return 0, errors.Errorf("'%s' doesn't match any option", answer)
 }
 
 func getCloudCredentialsQuestions(providerName string, fields []string) []*survey.Question {
@@ -2,16 +2,31 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"text/tabwriter"
+	"time"
 
+	survey "github.com/AlecAivazis/survey/v2"
+	"github.com/Masterminds/semver"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/deploy"
+	"github.com/protosio/cli/internal/fuzzy"
 	"github.com/protosio/cli/internal/release"
+	"github.com/protosio/cli/internal/saga"
 	ssh "github.com/protosio/cli/internal/ssh"
 	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var cmdInstance *cli.Command = &cli.Command{
@@ -21,14 +36,67 @@ var cmdInstance *cli.Command = &cli.Command{
 		{
 			Name:  "ls",
 			Usage: "List instances",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "stale-days",
+					Usage:       "Warn about instances that have not been reachable for `DAYS` days",
+					Value:       7,
+					Destination: &staleDays,
+				},
+				&cli.BoolFlag{
+					Name:  "notes",
+					Usage: "Show the notes of the instances",
+				},
+				&cli.BoolFlag{
+					Name:  "usage",
+					Usage: "Show the memory and disk utilization of the instances, probed over SSH, highlighting the ones nearing capacity",
+				},
+				&cli.BoolFlag{
+					Name:  "live",
+					Usage: "Show the current status and IP of the instances, retrieved from the cloud providers using one request per cloud and location",
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listInstances(c.Bool("notes"), c.Bool("usage"), c.Bool("live"))
+			},
+		},
+		{
+			Name:      "info",
+			ArgsUsage: "[name]",
+			Usage:     "Prints info about an instance and checks if it is reachable over SSH",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "stale-days",
+					Usage:       "Warn if the instance has not been reachable for `DAYS` days",
+					Value:       7,
+					Destination: &staleDays,
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				return infoInstance(name)
+			},
+		},
+		{
+			Name:  "outdated",
+			Usage: "List the instances that don't run the latest Protos release, or the one they are pinned to, and summarize what they are missing",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
 			Action: func(c *cli.Context) error {
-				return listInstances()
+				return listOutdatedInstances()
 			},
 		},
 		{
 			Name:      "deploy",
 			ArgsUsage: "<name>",
 			Usage:     "Deploy a new Protos instance",
+			Before:    snapshotDB,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:        "cloud",
@@ -48,359 +116,2529 @@ var cmdInstance *cli.Command = &cli.Command{
 					Required:    false,
 					Destination: &protosVersion,
 				},
+				bandwidthLimitFlag(),
+				&cli.BoolFlag{
+					Name:  "use-ssh-config",
+					Usage: "Honor ~/.ssh/config (ProxyJump, ProxyCommand, ciphers) when connecting to the instance over SSH",
+				},
+				&cli.BoolFlag{
+					Name:  "async",
+					Usage: "Run the deployment in the background and return immediately. Use 'protos job' to follow it",
+				},
+				&cli.BoolFlag{
+					Name:  "ipv6-only",
+					Usage: "Deploy the instance without a public IPv4 address (cheaper on some clouds). The instance is reachable over IPv6 only",
+				},
+				&cli.BoolFlag{
+					Name:  "stream-image",
+					Usage: "If the Protos image is not in the cloud account yet, download it through the CLI and stream it to the cloud provider, instead of letting the provider fetch it",
+				},
+				&cli.DurationFlag{
+					Name:        "ttl",
+					Usage:       "Mark the instance as expired after `DURATION` (e.g. 48h), so it is destroyed by 'protos gc --expired'",
+					Destination: &instanceTTL,
+				},
+				&cli.StringFlag{
+					Name:        "volume-type",
+					Usage:       "`TYPE` of storage used by the data volume: block (network attached, survives the instance) or local (on the host running the instance, faster but tied to it)",
+					Value:       cloud.BlockVolume.String(),
+					Destination: &volumeType,
+				},
+				&cli.StringFlag{
+					Name:  "from-snapshot",
+					Usage: "Create the data volume from the snapshot with `ID` (see 'protos volume snapshot') instead of empty. The snapshot has to be in the same cloud and location",
+				},
+				&cli.StringFlag{
+					Name:  "groups",
+					Usage: "Comma separated `GROUPS` the instance belongs to (see 'protos fleet')",
+				},
+				&cli.StringFlag{
+					Name:  "personal-key",
+					Usage: "Also authorize the public key in `FILE` (e.g. ~/.ssh/id_ed25519_sk.pub for a FIDO2 security key), so 'protos instance ssh' can use it through your SSH agent",
+				},
+				&cli.BoolFlag{
+					Name:  "spread-az",
+					Usage: "Treat --location as a region (e.g. fr-par) and deploy in its availability zone with the fewest instances sharing a group with this one, so that a group survives the loss of a zone",
+				},
+				timeoutFlag(),
+				progressFlag(),
 			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				releases, err := getProtosReleases()
+				limit, err := parseSize(bandwidthLimit)
 				if err != nil {
 					return err
 				}
-				var release release.Release
-				if protosVersion == "" {
-					release, err = releases.GetLatest()
+				dataVolumeType, err := cloud.ParseVolumeType(volumeType)
+				if err != nil {
+					return err
+				}
+				if instanceTTL < 0 {
+					return errors.Errorf("Invalid TTL '%s'", instanceTTL)
+				}
+				if c.Bool("async") && os.Getenv(jobEnvVar) == "" {
+					return startJob("instance deploy " + name)
+				}
+				groups := parseGroups(c.String("groups"))
+				if c.Bool("spread-az") {
+					cloudLocation, err = spreadZone(cloudName, cloudLocation, groups)
 					if err != nil {
 						return err
 					}
-				} else {
-					release, err = releases.GetVersion(protosVersion)
+				}
+				release, err := deployRelease(protosVersion)
+				if err != nil {
+					return err
+				}
+
+				personalKey := ""
+				if c.String("personal-key") != "" {
+					personalKey, err = readPersonalKey(c.String("personal-key"))
 					if err != nil {
 						return err
 					}
 				}
-
-				_, err = deployInstance(name, cloudName, cloudLocation, release)
-				return err
+				opts := deployOptions{bandwidthLimit: limit, streamImage: c.Bool("stream-image"), ipv6Only: c.Bool("ipv6-only"), volumeType: dataVolumeType, fromSnapshot: c.String("from-snapshot"), personalKey: personalKey}
+				err = withTimeout(c, func() error {
+					_, err := deployInstance(name, cloudName, cloudLocation, release, opts)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				err = setInstanceSSHConfig(name, c.Bool("use-ssh-config"))
+				if err != nil {
+					return err
+				}
+				if len(groups) > 0 {
+					err = setInstanceGroups(name, c.String("groups"))
+					if err != nil {
+						return err
+					}
+				}
+				if instanceTTL > 0 {
+					return setInstanceTTL(name, instanceTTL)
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<name>",
+			Usage:     "Change local settings of an instance",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "use-ssh-config",
+					Usage: "Honor ~/.ssh/config (ProxyJump, ProxyCommand, ciphers) when connecting to the instance over SSH. Use --use-ssh-config=false to disable",
+				},
+				&cli.DurationFlag{
+					Name:        "ttl",
+					Usage:       "Mark the instance as expired `DURATION` from now (e.g. 48h). Use --ttl=0 to remove the expiry",
+					Destination: &instanceTTL,
+				},
+				&cli.StringFlag{
+					Name:  "groups",
+					Usage: "Comma separated `GROUPS` the instance belongs to, replacing the current ones. Use --groups= to remove all groups",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				if c.IsSet("use-ssh-config") {
+					err := setInstanceSSHConfig(name, c.Bool("use-ssh-config"))
+					if err != nil {
+						return err
+					}
+				}
+				if c.IsSet("ttl") {
+					if instanceTTL < 0 {
+						return errors.Errorf("Invalid TTL '%s'", instanceTTL)
+					}
+					err := setInstanceTTL(name, instanceTTL)
+					if err != nil {
+						return err
+					}
+				}
+				if c.IsSet("groups") {
+					return setInstanceGroups(name, c.String("groups"))
+				}
+				return nil
+			},
+		},
+		{
+			Name:      "annotate",
+			ArgsUsage: "<name> [notes]",
+			Usage:     "Attach free-form notes to an instance, e.g. \"customer X staging\". Omit the notes to remove them",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return annotateInstance(name, strings.Join(c.Args().Tail(), " "))
+			},
+		},
+		{
+			Name:      "pin",
+			ArgsUsage: "<name> [version]",
+			Usage:     "Pin an instance to a Protos version, which is reported when the instance runs another one. Omit the version to remove the pin",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return pinInstance(name, c.Args().Get(1))
 			},
 		},
 		{
 			Name:      "delete",
 			ArgsUsage: "<name>",
 			Usage:     "Delete instance",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "final-backup",
+					Usage: "Snapshot the volumes of the instance before deleting them. The snapshots are listed by 'protos instance backups'",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
 				}
-				return deleteInstance(name)
+				return deleteInstance(name, c.Bool("final-backup"))
+			},
+		},
+		{
+			Name:      "backups",
+			ArgsUsage: "[name]",
+			Usage:     "List the backups taken when deleting instances and by 'protos backup run', optionally only the ones of instance <name>",
+			Flags:     []cli.Flag{outputFlag()},
+			Action: func(c *cli.Context) error {
+				return listBackups(c.Args().Get(0))
 			},
 		},
 		{
 			Name:      "start",
-			ArgsUsage: "<name>",
+			ArgsUsage: "[name]",
 			Usage:     "Power on instance",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				return startInstance(name)
+			},
+		},
+		{
+			Name:      "stop",
+			ArgsUsage: "[name]",
+			Usage:     "Power off instance",
+			Before:    authorizeCloudChange,
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				return stopInstance(name)
+			},
+		},
+		{
+			Name:      "reboot",
+			ArgsUsage: "<name>",
+			Usage:     "Reboot instance",
+			Before:    authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "hard",
+					Usage: "Reboot using the cloud provider API, falling back to a stop and start if the provider can't reboot instances (default)",
+				},
+				&cli.BoolFlag{
+					Name:  "soft",
+					Usage: "Reboot by asking the instance operating system over SSH",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				return startInstance(name)
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				if c.Bool("hard") && c.Bool("soft") {
+					return errors.New("Flags --hard and --soft are mutually exclusive")
+				}
+				return rebootInstance(name, c.Bool("soft"))
 			},
 		},
 		{
-			Name:      "stop",
+			Name:      "sync",
 			ArgsUsage: "<name>",
-			Usage:     "Power off instance",
+			Usage:     "Refresh the stored instance details (IP, volumes, status) from the cloud provider and print what changed",
+			Before:    snapshotDB,
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				return stopInstance(name)
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return syncInstance(name)
 			},
 		},
 		{
 			Name:      "tunnel",
+			ArgsUsage: "[name]",
+			Usage:     "Creates SSH encrypted tunnel to instance dashboard. Using --reverse, the tunnel lets the instance reach the network through this machine instead, e.g. when its egress is restricted during setup",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "port",
+					Usage:       "Local `PORT` to access the dashboard on. By default, every instance is allocated a port that stays the same across tunnels (see 'protos tunnel ls'). With --reverse, the port of the proxy on the instance, 3128 by default",
+					Destination: &tunnelPort,
+				},
+				&cli.BoolFlag{
+					Name:  "stats",
+					Usage: "Print the transfer statistics every few seconds while the tunnel is used. They can also be shown using 'protos tunnel ls --stats'",
+				},
+				&cli.BoolFlag{
+					Name:  "reverse",
+					Usage: "Run an HTTP and SOCKS5 proxy on the instance, listening on 127.0.0.1, whose connections are made from this machine",
+				},
+				&cli.StringFlag{
+					Name:  "allow",
+					Usage: "With --reverse, only let the instance reach the comma separated `HOSTS`, e.g. releases.protos.io,*.debian.org",
+				},
+				&cli.BoolFlag{
+					Name:  "allow-private",
+					Usage: "With --reverse, let the instance reach private and loopback addresses, including the services of this machine and its network",
+				},
+				&cli.DurationFlag{
+					Name:  "duration",
+					Usage: "With --reverse, close the tunnel after `DURATION` (e.g. 30m)",
+				},
+				&cli.StringFlag{
+					Name:  "listen-addr",
+					Usage: "Local `IP` address the tunnel listens on, localhost by default. Non-loopback addresses require --token",
+				},
+				&cli.BoolFlag{
+					Name:  "token",
+					Usage: "Require the random token included in the printed URL to use the tunnel",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				if c.Bool("reverse") {
+					if c.Duration("duration") < 0 {
+						return errors.Errorf("Invalid duration '%s'", c.Duration("duration"))
+					}
+					policy := ssh.ProxyPolicy{Hosts: parseGroups(c.String("allow")), Private: c.Bool("allow-private")}
+					return reverseTunnelInstance(name, tunnelPort, policy, c.Duration("duration"))
+				}
+				if c.IsSet("allow") || c.IsSet("allow-private") || c.IsSet("duration") {
+					return errors.New("--allow, --allow-private and --duration require --reverse")
+				}
+				opts := tunnelOptions{stats: c.Bool("stats"), listenAddr: c.String("listen-addr"), token: c.Bool("token")}
+				if opts.listenAddr != "" {
+					ip := net.ParseIP(opts.listenAddr)
+					if ip == nil {
+						return errors.Errorf("Invalid listen address '%s'. Use an IP address, e.g. 127.0.0.1", opts.listenAddr)
+					}
+					if !ip.IsLoopback() && !opts.token {
+						return errors.Errorf("Listening on '%s' exposes the dashboard to other machines. Use --token to require a token", opts.listenAddr)
+					}
+				}
+				return tunnelInstance(name, tunnelPort, opts)
+			},
+		},
+		{
+			Name:      "bench",
+			ArgsUsage: "<name>",
+			Usage:     "Run a quick disk and network benchmark on an instance over SSH, to compare locations and machine types",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "size",
+					Usage:       "`SIZE` of the data written to disk and transferred over the network, e.g. 512M",
+					Value:       "256M",
+					Destination: &benchSize,
+				},
+				&cli.StringFlag{
+					Name:        "path",
+					Usage:       "`PATH` of the temporary file used by the disk test on the instance",
+					Value:       "/var/tmp/protos-bench",
+					Destination: &benchPath,
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				size, err := parseSize(benchSize)
+				if err != nil {
+					return err
+				}
+				return benchInstance(name, size, benchPath)
+			},
+		},
+		{
+			Name:      "df",
+			ArgsUsage: "<name>",
+			Usage:     "Report the disk usage of an instance, per filesystem and per app",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "apps-dir",
+					Usage:       "`DIR` on the instance holding one directory of data per app",
+					Value:       "/opt/protos/apps",
+					Destination: &appsDir,
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return dfInstance(name, appsDir)
+			},
+		},
+		{
+			Name:      "known-hosts",
+			ArgsUsage: "[name]",
+			Usage:     "Print the recorded SSH host keys of an instance, or of all instances, in known_hosts format",
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name != "" {
+					var err error
+					name, err = resolveInstanceName(name)
+					if err != nil {
+						return err
+					}
+				}
+				return knownHostsInstance(name)
+			},
+		},
+		{
+			Name:      "ssh-master",
+			ArgsUsage: "[name]",
+			Usage:     "Keeps a persistent SSH connection to the instance open, which is reused by other commands until CTRL+C is pressed",
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				return sshMasterInstance(name)
+			},
+		},
+		{
+			Name:      "ssh",
+			ArgsUsage: "[name] [-- command...]",
+			Usage:     "Open an SSH session to the instance using the system ssh client and your SSH agent, e.g. with a personal key backed by a security key",
+			Action: func(c *cli.Context) error {
+				name, err := instanceNameArg(c)
+				if err != nil {
+					return err
+				}
+				command := c.Args().Tail()
+				if len(command) > 0 && command[0] == "--" {
+					command = command[1:]
+				}
+				return sshInstance(name, command)
+			},
+		},
+		{
+			Name:      "identity",
 			ArgsUsage: "<name>",
-			Usage:     "Creates SSH encrypted tunnel to instance dashboard",
+			Usage:     "Verify that the machine behind the instance IP is the one deployed, using the machine ID recorded after deploy",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "reset",
+					Usage: "Record the machine ID currently reported by the instance, e.g. after reinstalling it",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				return tunnelInstance(name)
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return identityInstance(name, c.Bool("reset"))
 			},
 		},
 		{
 			Name:      "key",
 			ArgsUsage: "<name>",
 			Usage:     "Prints to stdout the SSH key associated with the instance",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "encrypt",
+					Usage: "Prompt for a passphrase and encrypt the key with it, like ssh-keygen does",
+				},
+				&cli.StringFlag{
+					Name:  "output",
+					Usage: "Write the key to `FILE`, readable only by the current user, instead of stdout",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				name := c.Args().Get(0)
 				if name == "" {
 					cli.ShowSubcommandHelp(c)
-					os.Exit(1)
+					return cli.Exit("", 1)
 				}
-				return keyInstance(name)
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return keyInstance(name, c.Bool("encrypt"), c.String("output"))
 			},
 		},
-	},
+		{
+			Name:      "grow-data",
+			ArgsUsage: "<name>",
+			Usage:     "Grow the data volume of an instance at the cloud provider, then the filesystem on it, so the new space can be used right away",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "to",
+					Usage:    "New `SIZE` of the data volume, e.g. 100GB",
+					Required: true,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				size, err := parseSize(c.String("to"))
+				if err != nil {
+					return err
+				}
+				return growData(name, size)
+			},
+		},
+		cmdInstanceConfig,
+		cmdInstanceServices,
+		cmdInstanceTags,
+		cmdInstanceTop,
+		cmdInstanceAudit,
+		cmdInstanceHistory,
+	},
 }
 
+var staleDays int
+var instanceTTL time.Duration
+var tunnelPort int
+var benchSize string
+var benchPath string
+var appsDir string
+
 //
 // Instance methods
 //
 
-func listInstances() error {
+func listInstances(showNotes bool, showUsage bool, live bool) error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	if live {
+		current := liveInstances(instances)
+		for i, instance := range instances {
+			info, found := current[instance.Name]
+			if !found {
+				continue
+			}
+			if info.PublicIP != "" && info.PublicIP != instance.PublicIP {
+				log.Warnf("The IP of instance '%s' changed to %s. Use 'protos instance sync %s' to update it", instance.Name, info.PublicIP, instance.Name)
+				instances[i].PublicIP = info.PublicIP
+			}
+			instances[i].Status = info.Status
+		}
+	}
+	usage := map[string]resourceUsage{}
+	if showUsage {
+		usage = probeUsage(instances)
+	}
+	for i := range instances {
+		instances[i].KeySeed = nil
+	}
+	var data interface{} = instances
+	if showUsage {
+		withUsage := []instanceWithUsage{}
+		for _, instance := range instances {
+			entry := instanceWithUsage{InstanceInfo: instance}
+			if u, found := usage[instance.Name]; found {
+				entry.Usage = &u
+			}
+			withUsage = append(withUsage, entry)
+		}
+		data = withUsage
+	}
+
+	err = printOutput(data, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		header := []string{"Name", "IP", "Cloud", "VM ID", "Location", "Version", "Status", "Last seen"}
+		if showUsage {
+			header = append(header, "Memory", "Disk")
+		}
+		if showNotes {
+			header = append(header, "Notes")
+		}
+		printTableHeader(w, header...)
+		for _, instance := range instances {
+			status := instance.Status
+			if status == "" {
+				status = "n/a"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t", instance.Name, instance.PublicIP, instance.CloudName, instance.VMID, instance.Location, formatVersion(instance), status, formatLastSeen(instance.LastSeen))
+			if showUsage {
+				u, found := usage[instance.Name]
+				if found {
+					fmt.Fprintf(w, "%s\t%s\t", formatUtilization(u.MemoryPercent), formatUtilization(u.DiskPercent))
+				} else {
+					fmt.Fprintf(w, "%s\t%s\t", formatUtilization(-1), formatUtilization(-1))
+				}
+			}
+			if showNotes {
+				notes := instance.Notes
+				if notes == "" {
+					notes = "-"
+				}
+				fmt.Fprintf(w, "%s\t", notes)
+			}
+		}
+		fmt.Fprint(w, "\n")
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, instance := range instances {
+		warnIfStale(instance)
+		warnIfExpiring(instance)
+		warnIfDrifted(instance)
+		if u, found := usage[instance.Name]; found {
+			warnIfNearCapacity(instance, u)
+		}
+	}
+	return nil
+}
+
+// liveInstances retrieves the instances from the cloud providers, by name. Every cloud and location is listed once,
+// concurrently, instead of retrieving the instances one by one. Instances no longer found at their provider get the
+// "not found" status, while the ones of clouds that can't be listed are left out
+func liveInstances(instances []cloud.InstanceInfo) map[string]cloud.InstanceInfo {
+	type listResult struct {
+		cloud     string
+		location  string
+		instances []cloud.InstanceInfo
+		err       error
+	}
+	type cloudLocation struct {
+		cloud    string
+		location string
+	}
+	start := time.Now()
+	groups := map[cloudLocation][]cloud.InstanceInfo{}
+	for _, instance := range instances {
+		key := cloudLocation{cloud: instance.CloudName, location: instance.Location}
+		groups[key] = append(groups[key], instance)
+	}
+	results := make(chan listResult, len(groups))
+	for key := range groups {
+		go func(key cloudLocation) {
+			result := listResult{cloud: key.cloud, location: key.location}
+			client, _, err := initCloudClient(key.cloud, key.location)
+			if err == nil {
+				result.instances, err = client.ListInstances()
+			}
+			result.err = err
+			results <- result
+		}(key)
+	}
+
+	live := map[string]cloud.InstanceInfo{}
+	for range groups {
+		result := <-results
+		if result.err != nil {
+			log.Warnf("Failed to retrieve the instances of cloud '%s' in '%s', showing their stored status: %s", result.cloud, result.location, result.err.Error())
+			continue
+		}
+		byID := map[string]cloud.InstanceInfo{}
+		for _, info := range result.instances {
+			byID[info.VMID] = info
+		}
+		for _, instance := range groups[cloudLocation{cloud: result.cloud, location: result.location}] {
+			info, found := byID[instance.VMID]
+			if !found {
+				info = cloud.InstanceInfo{Status: "not found"}
+			}
+			live[instance.Name] = info
+		}
+	}
+	log.Debugf("Retrieved the live status of %d instance(s) with %d request(s) in %s", len(instances), len(groups), time.Since(start).Round(time.Millisecond))
+	return live
+}
+
+func infoInstance(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+
+	contactErr := recordInstanceContact(&instance)
+	if contactErr != nil {
+		warnIfStale(instance)
+	}
+	warnIfExpiring(instance)
+	warnIfDrifted(instance)
+	fingerprint := ""
+	if len(instance.KeySeed) > 0 {
+		key, err := ssh.NewKeyFromSeed(instance.KeySeed)
+		if err != nil {
+			return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
+		}
+		fingerprint = key.Fingerprint()
+	}
+	instance.KeySeed = nil
+
+	return printOutput(instanceWithKey{InstanceInfo: instance, KeyFingerprint: fingerprint}, func() {
+		fmt.Printf("Name: %s\n", instance.Name)
+		fmt.Printf("VM ID: %s\n", instance.VMID)
+		fmt.Printf("Public IP: %s\n", instance.PublicIP)
+		fmt.Printf("Cloud: %s (%s)\n", instance.CloudName, instance.CloudType.String())
+		fmt.Printf("Location: %s\n", instance.Location)
+		fmt.Printf("Version: %s\n", formatVersion(instance))
+		if instance.Image != nil {
+			fmt.Printf("Image: %s (%s, %s)\n", instance.Image.ID, instance.Image.Version, formatImageSource(*instance.Image))
+			if instance.Image.Digest != "" {
+				fmt.Printf("Image digest: sha256:%s\n", instance.Image.Digest)
+			}
+			if instance.Image.URL != "" {
+				fmt.Printf("Image URL: %s\n", instance.Image.URL)
+			}
+		}
+		if instance.MachineID != "" {
+			fmt.Printf("Machine ID: %s\n", instance.MachineID)
+		}
+		if instance.Notes != "" {
+			fmt.Printf("Notes: %s\n", instance.Notes)
+		}
+		if len(instance.Tags) > 0 {
+			fmt.Printf("Tags: %s\n", strings.Join(instance.Tags, ", "))
+		}
+		if fingerprint != "" {
+			fmt.Printf("SSH key: %s\n", fingerprint)
+		} else {
+			fmt.Printf("SSH key: missing\n")
+		}
+		for _, key := range instance.PersonalKeys {
+			fmt.Printf("Personal key: %s\n", key)
+		}
+		for _, vol := range instance.Volumes {
+			fmt.Printf("Volume: %s (%s) - %d bytes\n", vol.Name, vol.VolumeID, vol.Size)
+		}
+		fmt.Printf("Last seen: %s\n", formatLastSeen(instance.LastSeen))
+		if !instance.ExpiresAt.IsZero() {
+			fmt.Printf("Expires: %s\n", formatTime(instance.ExpiresAt))
+		}
+		if !instance.BootTime.IsZero() {
+			fmt.Printf("Up since: %s (%s)\n", formatTime(instance.BootTime), time.Since(instance.BootTime).Round(time.Minute))
+		}
+		if contactErr != nil {
+			fmt.Printf("Status: NOT OK (%s)\n", contactErr.Error())
+		} else {
+			fmt.Printf("Status: OK - SSH reachable\n")
+		}
+	})
+}
+
+// formatImageSource describes how the image of an instance got into the cloud account, and when
+func formatImageSource(image cloud.ImageProvenance) string {
+	source := image.Source
+	if source == "existing" {
+		source = "already in the cloud account"
+	}
+	if !image.AddedAt.IsZero() {
+		source += fmt.Sprintf(", added %s", formatTime(image.AddedAt))
+	}
+	return source
+}
+
+// instanceWithKey adds the fingerprint of the instance SSH key to the instance info, whose key itself is never output
+type instanceWithKey struct {
+	cloud.InstanceInfo
+	KeyFingerprint string `json:",omitempty"`
+}
+
+// outdatedInstance lists the releases an instance is missing to reach its target version
+type outdatedInstance struct {
+	Instance string
+	Version  string
+	Target   string // version the instance is pinned to, or the latest release
+	Pinned   bool
+	Missing  []release.Release
+}
+
+func listOutdatedInstances() error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	releases, err := getProtosReleases()
+	if err != nil {
+		return err
+	}
+	latest, err := releases.GetLatest()
+	if err != nil {
+		return err
+	}
+
+	outdated := []outdatedInstance{}
+	for _, instance := range instances {
+		if instance.Version == "" {
+			log.Warnf("Version of instance '%s' is unknown, since it was deployed by an older CLI", instance.Name)
+			continue
+		}
+		if _, err := semver.NewVersion(instance.Version); err != nil {
+			log.Debugf("Skipping instance '%s', which doesn't run a Protos release (%s)", instance.Name, instance.Version)
+			continue
+		}
+		target := outdatedInstance{Instance: instance.Name, Version: instance.Version, Target: latest.Version}
+		if instance.PinnedVersion != "" {
+			target.Target = instance.PinnedVersion
+			target.Pinned = true
+		}
+		target.Missing, err = releases.Between(instance.Version, target.Target)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to compare the version of instance '%s'", instance.Name)
+		}
+		if len(target.Missing) > 0 {
+			outdated = append(outdated, target)
+		}
+	}
+
+	return printOutput(outdated, func() {
+		if len(outdated) == 0 {
+			fmt.Printf("All instances run their target version (latest is %s)\n", latest.Version)
+			return
+		}
+		for _, instance := range outdated {
+			kind := "latest"
+			if instance.Pinned {
+				kind = "pinned"
+			}
+			fmt.Printf("%s: %s -> %s (%s), %d release(s) behind\n", instance.Instance, instance.Version, instance.Target, kind, len(instance.Missing))
+			for _, missing := range instance.Missing {
+				fmt.Printf("  %s (%s): %s\n", missing.Version, formatDate(missing.ReleaseDate), summarizeDescription(missing.Description))
+			}
+		}
+	})
+}
+
+// summarizeDescription returns the first line of a release description, shortened to fit a terminal line
+func summarizeDescription(description string) string {
+	summary := strings.TrimSpace(strings.SplitN(strings.TrimSpace(description), "\n", 2)[0])
+	if len(summary) > 100 {
+		summary = summary[:97] + "..."
+	}
+	if summary == "" {
+		return "no description"
+	}
+	return summary
+}
+
+// deployOptions holds the optional settings used when deploying an instance
+// spreadZone picks the availability zone of region with the fewest instances of the cloud that share a group with
+// the new instance, or the fewest instances of the cloud if it has no groups. Ties go to the first zone
+func spreadZone(cloudName string, region string, groups []string) (string, error) {
+	provider, err := dbp.GetCloud(cloudName)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
+	}
+	region = cloud.Region(region)
+	zones := cloud.Zones(provider.Client(), region)
+	if len(zones) < 2 {
+		return "", errors.Errorf("Cloud '%s' has no region '%s' with several availability zones. Supported locations: %s", cloudName, region, strings.Join(provider.Client().SupportedLocations(), ", "))
+	}
+
 	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return "", err
+	}
+	counts := map[string]int{}
+	for _, instance := range instances {
+		if instance.CloudName != cloudName || (len(groups) > 0 && !sharesGroup(instance.Groups, groups)) {
+			continue
+		}
+		counts[instance.Location]++
+	}
+	zone := zones[0]
+	for _, z := range zones[1:] {
+		if counts[z] < counts[zone] {
+			zone = z
+		}
+	}
+	log.Infof("Spreading over the availability zones of '%s': using '%s', which has %d related instance(s)", region, zone, counts[zone])
+	return zone, nil
+}
+
+func sharesGroup(a []string, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deployRelease returns the release to deploy, the latest one if version is empty
+func deployRelease(version string) (release.Release, error) {
+	releases, err := getProtosReleases()
+	if err != nil {
+		if version == "" {
+			return release.Release{}, err
+		}
+		// the release index might not be reachable in air-gapped environments, in which case the image
+		// should have been uploaded beforehand using 'image upload'
+		log.Warnf("%s. Deploying version '%s' using an image already present in the cloud account", err.Error(), version)
+		return release.Release{Version: version}, nil
+	}
+	if version == "" {
+		return releases.GetLatest()
+	}
+	return releases.GetVersion(version)
+}
+
+type deployOptions struct {
+	bandwidthLimit int64 // maximum image transfer rate in bytes per second, 0 meaning unlimited
+	streamImage    bool  // stream the image through the CLI instead of letting the provider download it
+	ipv6Only       bool  // deploy without a public IPv4 address
+	volumeType     cloud.VolumeType
+	fromSnapshot   string // ID of the snapshot the data volume is created from, empty for an empty volume
+	personalKey    string // public key authorized besides the instance key, in the authorized_keys format
+}
+
+func deployInstance(instanceName string, cloudName string, cloudLocation string, release release.Release, opts deployOptions) (cloud.InstanceInfo, error) {
+	if opts.volumeType == "" {
+		opts.volumeType = cloud.BlockVolume
+	}
+	params := map[string]string{
+		"instance":        instanceName,
+		"cloud":           cloudName,
+		"location":        cloudLocation,
+		"version":         release.Version,
+		"bandwidth-limit": strconv.FormatInt(opts.bandwidthLimit, 10),
+		"stream-image":    strconv.FormatBool(opts.streamImage),
+		"ipv6-only":       strconv.FormatBool(opts.ipv6Only),
+		"volume-type":     opts.volumeType.String(),
+		"from-snapshot":   opts.fromSnapshot,
+		"personal-key":    opts.personalKey,
+	}
+	if image, found := release.CloudImages["scaleway"]; found {
+		params["image-url"] = image.URL
+		params["image-digest"] = image.Digest
+		params["image-snapshot"] = image.Snapshot
+	}
+	noteMeteredEgress(cloudName, cloudLocation, release)
+	op, err := saga.New(deploy.Operation, "instance deploy "+instanceName, params)
+	if err != nil {
+		return cloud.InstanceInfo{}, err
+	}
+	err = observeProgress(op)
+	if err != nil {
+		return cloud.InstanceInfo{}, err
+	}
+	steps, err := deploySteps(op)
+	if err != nil {
+		return cloud.InstanceInfo{}, err
+	}
+	err = saga.Run(dbp, op, steps)
+	if err != nil {
+		return cloud.InstanceInfo{}, operationFailed(op, err)
+	}
+	return dbp.GetInstance(instanceName)
+}
+
+// noteMeteredEgress tells the user about the traffic an instance is expected to generate when its location bills the
+// traffic sent to the internet, based on the sizes published in the release index. Problems with the cloud or the
+// location are left to the deploy to report
+func noteMeteredEgress(cloudName string, location string, rls release.Release) {
+	provider, err := dbp.GetCloud(cloudName)
+	if err != nil {
+		return
+	}
+	client := provider.Client()
+	location, err = cloud.ResolveLocation(client, location)
+	if err != nil {
+		return
+	}
+	pricing := client.EgressPricing(location)
+	if !pricing.Metered {
+		return
+	}
+	log.Infof("Location '%s' of cloud '%s' has metered egress: %s per instance included each month, then %.2f EUR per GiB", location, cloudName, formatSize(pricing.Included), pricing.PricePerGB)
+	if image := rls.CloudImages["scaleway"]; image.Size > 0 {
+		log.Infof("The image of Protos %s is a %s download", rls.Version, formatSize(image.Size))
+	}
+	if rls.MonthlyEgress > 0 {
+		var cost float64
+		if rls.MonthlyEgress > pricing.Included {
+			cost = float64(rls.MonthlyEgress-pricing.Included) / (1 << 30) * pricing.PricePerGB
+		}
+		log.Infof("Instances running Protos %s and their apps typically send %s per month, an estimated %.2f EUR over the included traffic", rls.Version, formatSize(rls.MonthlyEgress), cost)
+	}
+}
+
+// deployHooks are the parts of the deploy steps that depend on the CLI
+var deployHooks = deploy.Hooks{
+	FindImage:            findProtosImage,
+	AddImage:             addProtosImage,
+	Started:              deployStarted,
+	AuthorizePersonalKey: authorizePersonalKey,
+}
+
+// deploySteps returns the steps of a deploy operation, after connecting to the cloud provider it deploys to
+func deploySteps(op *saga.Operation) ([]saga.Step, error) {
+	p := op.Params
+	cloudName := p["cloud"]
+	ipv6Only, _ := strconv.ParseBool(p["ipv6-only"])
+	volumeType := cloud.VolumeType(p["volume-type"])
+
+	// init cloud
+	provider, err := dbp.GetCloud(cloudName)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
+	}
+	client := provider.Client()
+	if ipv6Only && !client.Capabilities().IPv6 {
+		return nil, cloud.NotSupported(client, "IPv6 only instances")
+	}
+	if volumeType == cloud.LocalVolume && !client.Capabilities().LocalVolumes {
+		return nil, cloud.NotSupported(client, "local volumes")
+	}
+	if p["from-snapshot"] != "" && !client.Capabilities().Snapshots {
+		return nil, cloud.NotSupported(client, "volume snapshots")
+	}
+	location, err := cloud.ResolveLocation(client, p["location"])
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid location for cloud '%s'", cloudName)
+	}
+	if location != p["location"] {
+		log.Infof("Using location '%s' for '%s'", location, p["location"])
+		p["location"] = location
+	}
+	err = client.Init(provider.Auth, location)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", cloudName, provider.Type.String())
+	}
+
+	return deploy.Steps(dbp, client, deployHooks, op), nil
+}
+
+// deployStarted records the machine ID of a newly started instance, or collects its boot diagnostics if it's not
+// reachable over SSH
+func deployStarted(client cloud.Provider, instanceInfo *cloud.InstanceInfo) {
+	// the IP might have been used by a deleted instance, whose host key is not valid anymore
+	err := knownHosts.Remove(instanceInfo.PublicIP)
+	if err != nil {
+		log.Warnf("Failed to remove stale host key for '%s': %s", instanceInfo.PublicIP, err.Error())
+	}
+
+	// the machine ID is generated on first boot. If the instance is not reachable yet, it's recorded on the
+	// next contact
+	sshClient, err := connectInstance(*instanceInfo, 10, false)
+	if err != nil {
+		log.Warnf("Failed to record the machine ID of instance '%s': %s", instanceInfo.Name, err.Error())
+		log.Infof("Collecting boot diagnostics for instance '%s'", instanceInfo.Name)
+		bundle, diagErr := collectBootDiagnostics(client, *instanceInfo, err)
+		if diagErr != nil {
+			log.Warnf("Failed to collect boot diagnostics: %s", diagErr.Error())
+		} else {
+			log.Warnf("Instance '%s' didn't become reachable over SSH. Boot diagnostics saved to '%s'", instanceInfo.Name, bundle)
+		}
+		return
+	}
+	recordMachineID(instanceInfo, sshClient)
+}
+
+func setInstanceSSHConfig(name string, useSSHConfig bool) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if instance.UseSSHConfig == useSSHConfig {
+		return nil
+	}
+	instance.UseSSHConfig = useSSHConfig
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Instance '%s' use of ~/.ssh/config set to %t", name, useSSHConfig)
+	return nil
+}
+
+func annotateInstance(name string, notes string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instance.Notes = strings.TrimSpace(notes)
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	if instance.Notes == "" {
+		log.Infof("Notes of instance '%s' removed", name)
+	} else {
+		log.Infof("Notes of instance '%s' set to '%s'", name, instance.Notes)
+	}
+	return nil
+}
+
+// pinInstance pins an instance to a Protos version. An empty version removes the pin
+func pinInstance(name string, version string) error {
+	if version != "" {
+		_, err := semver.NewVersion(version)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid Protos version '%s'", version)
+		}
+	}
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instance.PinnedVersion = version
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	if version == "" {
+		log.Infof("Instance '%s' unpinned", name)
+		return nil
+	}
+	log.Infof("Instance '%s' pinned to Protos version '%s'", name, version)
+	warnIfDrifted(instance)
+	return nil
+}
+
+// setInstanceTTL marks the instance as expiring ttl from now. A zero ttl removes the expiry
+func setInstanceTTL(name string, ttl time.Duration) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instance.ExpiresAt = time.Time{}
+	if ttl > 0 {
+		instance.ExpiresAt = time.Now().Add(ttl)
+	}
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	if instance.ExpiresAt.IsZero() {
+		log.Infof("Instance '%s' does not expire", name)
+	} else {
+		log.Infof("Instance '%s' expires on %s", name, formatTime(instance.ExpiresAt))
+	}
+	return nil
+}
+
+// parseGroups parses a comma separated list of groups, ignoring empty ones
+func parseGroups(groups string) []string {
+	parsed := []string{}
+	for _, group := range strings.Split(groups, ",") {
+		group = strings.TrimSpace(group)
+		if group != "" {
+			parsed = append(parsed, group)
+		}
+	}
+	return parsed
+}
+
+// setInstanceGroups replaces the groups of an instance with the ones in the comma separated list
+func setInstanceGroups(name string, groups string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instance.Groups = parseGroups(groups)
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Instance '%s' groups set to [%s]", name, strings.Join(instance.Groups, ", "))
+	return nil
+}
+
+// deleteInstance deletes an instance and its volumes. With finalBackup, the volumes are snapshotted once the instance
+// is stopped, and the instance is kept if any snapshot fails
+func deleteInstance(name string, finalBackup bool) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth, instance.Location)
+	if err != nil {
+		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	}
+	if finalBackup && !client.Capabilities().Snapshots {
+		return cloud.NotSupported(client, "volume snapshots")
+	}
+
+	log.Infof("Stopping instance '%s' (%s)", instance.Name, instance.VMID)
+	err = client.StopInstance(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not stop instance '%s'", name)
+	}
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get details for instance '%s'", name)
+	}
+	if finalBackup {
+		err = backupInstanceVolumes(client, instance, vmInfo.Volumes, false)
+		if err != nil {
+			return errors.Wrapf(err, "Final backup of instance '%s' failed. The instance is stopped but was not deleted", name)
+		}
+	}
+	log.Infof("Deleting instance '%s' (%s)", instance.Name, instance.VMID)
+	err = client.DeleteInstance(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete instance '%s'", name)
+	}
+	for _, vol := range vmInfo.Volumes {
+		log.Infof("Deleting volume '%s' (%s) for instance '%s'", vol.Name, vol.VolumeID, name)
+		err = client.DeleteVolume(vol.VolumeID)
+		if err != nil {
+			log.Errorf("Failed to delete volume '%s': %s", vol.Name, err.Error())
+			continue
+		}
+		if _, err := dbp.GetVolume(vol.VolumeID); err == nil {
+			err = dbp.DeleteVolume(vol.VolumeID)
+			if err != nil {
+				log.Errorf("Failed to remove volume '%s' from the db: %s", vol.Name, err.Error())
+			}
+		}
+	}
+	err = knownHosts.Remove(instance.PublicIP)
+	if err != nil {
+		log.Warnf("Failed to remove host key of instance '%s': %s", name, err.Error())
+	}
+	return dbp.DeleteInstance(name)
+}
+
+// backupInstanceVolumes snapshots the volumes of an instance and records the snapshots as backups. Scheduled backups
+// are taken by 'protos backup run', the other ones when deleting the instance. The snapshots of one backup share their
+// creation time
+func backupInstanceVolumes(client cloud.Provider, instance cloud.InstanceInfo, volumes []cloud.VolumeInfo, scheduled bool) error {
+	created := time.Now()
+	kind := "final"
+	if scheduled {
+		kind = "backup"
+	}
+	for _, vol := range volumes {
+		name := instance.Name + "-" + kind + "-" + vol.Name + "-" + created.UTC().Format("20060102-150405")
+		log.Infof("Snapshotting volume '%s' (%s) of instance '%s'", vol.Name, vol.VolumeID, instance.Name)
+		snapshotID, err := client.SnapshotVolume(vol.VolumeID, name)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to snapshot volume '%s'", vol.VolumeID)
+		}
+		backup := cloud.BackupInfo{
+			SnapshotID: snapshotID,
+			Name:       name,
+			Instance:   instance.Name,
+			VolumeName: vol.Name,
+			Size:       vol.Size,
+			CloudName:  instance.CloudName,
+			Location:   instance.Location,
+			Version:    instance.Version,
+			Created:    created,
+			Scheduled:  scheduled,
+		}
+		err = dbp.SaveBackup(backup)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to record snapshot '%s' of volume '%s'", snapshotID, vol.VolumeID)
+		}
+		log.Infof("Volume '%s' backed up to snapshot '%s' (%s)", vol.Name, name, snapshotID)
+	}
+	return nil
+}
+
+func listBackups(instanceName string) error {
+	all, err := dbp.GetAllBackups()
+	if err != nil {
+		return err
+	}
+	backups := []cloud.BackupInfo{}
+	for _, backup := range all {
+		if instanceName == "" || backup.Instance == instanceName {
+			backups = append(backups, backup)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Created.Before(backups[j].Created) })
+
+	return printOutput(backups, func() {
+		if len(backups) == 0 {
+			fmt.Println("No backups found")
+			return
+		}
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		printTableHeader(w, "Snapshot ID", "Instance", "Volume", "Size", "Cloud", "Location", "Version", "Kind", "Created")
+		for _, backup := range backups {
+			kind := "final"
+			if backup.Scheduled {
+				kind = "scheduled"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t", backup.SnapshotID, backup.Instance, backup.VolumeName, formatSize(backup.Size), backup.CloudName, backup.Location, backup.Version, kind, formatTime(backup.Created))
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		fmt.Println("\nRestore a backup with: protos instance deploy --cloud <cloud> --location <location> --from-snapshot <snapshot id> <name>")
+	})
+}
+
+func startInstance(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth, instance.Location)
+	if err != nil {
+		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	}
+
+	log.Infof("Starting instance '%s' (%s)", instance.Name, instance.VMID)
+	err = client.StartInstance(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not start instance '%s'", name)
+	}
+
+	// providers often assign a new public IP when an instance is started again
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		log.Warnf("Failed to check the IP of instance '%s' after starting it: %s. Update it using 'protos instance sync %s'", name, err.Error(), name)
+		return nil
+	}
+	instance.Status = vmInfo.Status
+	if vmInfo.PublicIP == "" {
+		log.Warnf("Instance '%s' has no public IP yet. Update it once assigned using 'protos instance sync %s'", name, name)
+	} else if vmInfo.PublicIP != instance.PublicIP {
+		log.Warnf("Instance '%s' got a new public IP after starting: '%s' -> '%s'", name, instance.PublicIP, vmInfo.PublicIP)
+		changeInstanceIP(&instance, vmInfo.PublicIP)
+	}
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	return nil
+}
+
+// changeInstanceIP records a new public IP for the instance. The instance keeps its host key, so the key recorded for
+// the old IP is moved to the new one, replacing any key of a machine that used it before. That way the next connection
+// is verified against the pinned key, instead of trusting whichever host answers
+func changeInstanceIP(instance *cloud.InstanceInfo, ip string) {
+	var err error
+	switch {
+	case ip == "":
+		// the old IP might be assigned to another machine
+		err = knownHosts.Remove(instance.PublicIP)
+	case instance.PublicIP == "":
+		err = knownHosts.Remove(ip)
+	default:
+		err = knownHosts.Move(instance.PublicIP, ip)
+	}
+	if err != nil {
+		log.Warnf("Failed to move the host key of instance '%s' to '%s': %s", instance.Name, ip, err.Error())
+	}
+	if instance.MeshIP != "" {
+		log.Warnf("Instance '%s' is part of the mesh. Run 'protos mesh up' again to update its address at its peers", instance.Name)
+	}
+	instance.PublicIP = ip
+}
+
+func stopInstance(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth, instance.Location)
+	if err != nil {
+		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	}
+
+	log.Infof("Stopping instance '%s' (%s)", instance.Name, instance.VMID)
+	err = client.StopInstance(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not stop instance '%s'", name)
+	}
+	return nil
+}
+
+func rebootInstance(name string, soft bool) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+
+	if soft {
+		sshClient, err := instanceSSHClient(instance, 1)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Rebooting instance '%s' (%s) over SSH", instance.Name, instance.VMID)
+		// the reboot is delayed so that the command returns before the SSH connection is dropped
+		_, err = ssh.ExecuteCommand("nohup sh -c 'sleep 1; reboot' > /dev/null 2>&1 &", sshClient)
+		if err != nil {
+			return errors.Wrapf(err, "Could not reboot instance '%s'", name)
+		}
+		return nil
+	}
+
+	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth, instance.Location)
+	if err != nil {
+		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	}
+
+	if !client.Capabilities().Reboot {
+		log.Infof("Cloud '%s' does not support rebooting instances. Stopping and starting instance '%s' instead", instance.CloudName, instance.Name)
+		err = client.StopInstance(instance.VMID)
+		if err != nil {
+			return errors.Wrapf(err, "Could not stop instance '%s'", name)
+		}
+		err = client.StartInstance(instance.VMID)
+		if err != nil {
+			return errors.Wrapf(err, "Could not start instance '%s'", name)
+		}
+		return nil
+	}
+
+	log.Infof("Rebooting instance '%s' (%s)", instance.Name, instance.VMID)
+	err = client.RebootInstance(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Could not reboot instance '%s'", name)
+	}
+	return nil
+}
+
+func syncInstance(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	client := cloudInfo.Client()
+	err = client.Init(cloudInfo.Auth, instance.Location)
+	if err != nil {
+		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	}
+
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get details for instance '%s'", name)
+	}
+
+	changes := diffInstance(instance, vmInfo)
+	if len(changes) == 0 {
+		log.Infof("Instance '%s' is in sync with cloud '%s'", name, instance.CloudName)
+		return nil
+	}
+	fmt.Printf("Instance '%s' differs from cloud '%s':\n", name, instance.CloudName)
+	for _, change := range changes {
+		fmt.Println(" " + change)
+	}
+
+	if vmInfo.PublicIP != instance.PublicIP {
+		changeInstanceIP(&instance, vmInfo.PublicIP)
+	}
+	instance.Status = vmInfo.Status
+	instance.Volumes = vmInfo.Volumes
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+
+	// update the tracked volumes to match the attachments reported by the provider
+	attached := map[string]cloud.VolumeInfo{}
+	for _, vol := range vmInfo.Volumes {
+		attached[vol.VolumeID] = vol
+	}
+	volumes, err := dbp.GetAllVolumes()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve volumes")
+	}
+	for _, volume := range volumes {
+		instanceName, size := volume.InstanceName, volume.Size
+		if vol, found := attached[volume.VolumeID]; found {
+			instanceName, size = name, vol.Size
+		} else if volume.InstanceName == name {
+			instanceName = ""
+		}
+		if instanceName == volume.InstanceName && size == volume.Size {
+			continue
+		}
+		volume.InstanceName, volume.Size = instanceName, size
+		err = dbp.SaveVolume(volume)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save volume '%s'", volume.VolumeID)
+		}
+	}
+	log.Infof("Instance '%s' updated", name)
+	return nil
+}
+
+// diffInstance returns a human readable list of the differences between the stored and the provider side details of an instance
+func diffInstance(stored cloud.InstanceInfo, current cloud.InstanceInfo) []string {
+	changes := []string{}
+	if stored.PublicIP != current.PublicIP {
+		changes = append(changes, fmt.Sprintf("IP: %s -> %s", stored.PublicIP, current.PublicIP))
+	}
+	if stored.Status != current.Status {
+		changes = append(changes, fmt.Sprintf("Status: %s -> %s", stored.Status, current.Status))
+	}
+
+	storedVolumes := map[string]cloud.VolumeInfo{}
+	for _, vol := range stored.Volumes {
+		storedVolumes[vol.VolumeID] = vol
+	}
+	for _, vol := range current.Volumes {
+		old, found := storedVolumes[vol.VolumeID]
+		if !found {
+			changes = append(changes, fmt.Sprintf("+ volume %s (%s, %s)", vol.VolumeID, vol.Name, formatSize(vol.Size)))
+			continue
+		}
+		delete(storedVolumes, vol.VolumeID)
+		if old.Size != vol.Size {
+			changes = append(changes, fmt.Sprintf("~ volume %s (%s): %s -> %s", vol.VolumeID, vol.Name, formatSize(old.Size), formatSize(vol.Size)))
+		}
+	}
+	for _, vol := range stored.Volumes {
+		if _, found := storedVolumes[vol.VolumeID]; found {
+			changes = append(changes, fmt.Sprintf("- volume %s (%s, %s)", vol.VolumeID, vol.Name, formatSize(vol.Size)))
+		}
+	}
+	return changes
+}
+
+// tunnelOptions control how the local end of a tunnel to the dashboard of an instance is exposed
+type tunnelOptions struct {
+	stats      bool   // log the transfer statistics while the tunnel is used
+	listenAddr string // local IP address to listen on, empty for localhost
+	token      bool   // require a random token from the clients of the tunnel
+	// target is the address the tunnel forwards to, on the instance, and description what it is, e.g. "app 'foo'".
+	// The dashboard of the instance if empty
+	target      string
+	description string
+}
+
+func tunnelInstance(name string, localPort int, opts tunnelOptions) error {
+	instanceInfo, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if localPort == 0 {
+		localPort, err = allocateTunnelPort(&instanceInfo)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Infof("Creating SSH tunnel to instance '%s', using ip '%s'", instanceInfo.Name, instanceInfo.PublicIP)
+	sshClient, err := instanceSSHClient(instanceInfo, 1)
+	if err != nil {
+		return errors.Wrap(err, "Error while creating the SSH tunnel")
+	}
+	target, description := instanceAPIAddress, "the instance dashboard"
+	if opts.target != "" {
+		target, description = opts.target, opts.description
+	}
+	tunnel := ssh.NewTunnelFromConnection(sshClient, target, log)
+	tunnel.SetLocalPort(localPort)
+	tunnel.SetListenAddress(opts.listenAddr)
+	token := ""
+	if opts.token {
+		token, err = randomToken()
+		if err != nil {
+			return err
+		}
+		tunnel.RequireToken(token)
+	}
+	localPort, err = tunnel.Start()
+	if err != nil {
+		return errors.Wrap(err, "Error while creating the SSH tunnel")
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	instanceInfo.LastSeen = time.Now()
+	err = dbp.SaveInstance(instanceInfo)
+	if err != nil {
+		log.Warnf("Failed to record last contact for instance '%s': %s", name, err.Error())
+	}
+	// the DB is released while the tunnel runs, so that other commands and tunnels can be used meanwhile
+	err = releaseDB()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+	}
+	record := tunnelRecord{Instance: name, ListenAddr: opts.listenAddr, LocalPort: localPort, Target: target, TokenRequired: opts.token, PID: os.Getpid(), Started: time.Now()}
+	err = recordTunnel(record)
+	if err != nil {
+		log.Warn(err.Error())
+	}
+	defer removeTunnelRecord(name)
+	stopStats := make(chan struct{})
+	statsDone := make(chan struct{})
+	go func() {
+		reportTunnelStats(tunnel, record, opts.stats, stopStats)
+		close(statsDone)
+	}()
+
+	url := record.URL()
+	if token != "" {
+		url += "?" + ssh.TokenParam + "=" + token
+	}
+	log.Infof("SSH tunnel ready. Use '%s' to access %s. Once finished, press CTRL+C to terminate the SSH tunnel", url, description)
+
+	// waiting for a SIGTERM or SIGINT
+	<-quit
+
+	log.Info("CTRL+C received. Terminating the SSH tunnel")
+	// the statistics stop being recorded before the record is removed, so that it's not written again afterwards
+	close(stopStats)
+	<-statsDone
+	err = tunnel.Close()
+	if err != nil {
+		return errors.Wrap(err, "Error while terminating the SSH tunnel")
+	}
+	stats := tunnel.Stats()
+	log.Infof("SSH tunnel terminated successfully. Transferred %s in and %s out over %d connection(s)", formatSize(stats.BytesIn), formatSize(stats.BytesOut), stats.Connections)
+	return nil
+}
+
+func sshMasterInstance(name string) error {
+	instanceInfo, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := instanceSSHClient(instanceInfo, 1)
+	if err != nil {
+		return err
+	}
+
+	socketPath := sshPool.ControlSocketPath(instanceInfo.PublicIP)
+	listener, err := ssh.ServeControlSocket(sshClient, socketPath, log)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to serve control socket for instance '%s'", name)
+	}
+	// the DB is released while the connection is kept open, so that the commands reusing it can open the DB meanwhile
+	err = releaseDB()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	log.Infof("Persistent SSH connection to instance '%s' ready. Other protos commands targeting it will reuse it. Once finished, press CTRL+C to close it", name)
+
+	// waiting for a SIGTERM or SIGINT
+	<-quit
+
+	log.Info("CTRL+C received. Closing the persistent SSH connection")
+	err = listener.Close()
+	if err != nil {
+		return errors.Wrap(err, "Error while closing the control socket")
+	}
+	return nil
+}
+
+// instanceNameArg returns the instance referred to by the first argument of a command. If it's missing and the CLI runs
+// in a terminal, the user picks the instance from a list. Otherwise the command help is printed and an exit error returned
+func instanceNameArg(c *cli.Context) (string, error) {
+	name := c.Args().Get(0)
+	if name != "" {
+		return resolveInstanceName(name)
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) || !terminal.IsTerminal(int(os.Stdout.Fd())) {
+		cli.ShowSubcommandHelp(c)
+		return "", cli.Exit("", 1)
+	}
+	return pickInstance()
+}
+
+// pickInstance asks the user to select one of the known instances
+func pickInstance() (string, error) {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve instances")
+	}
+	if len(instances) == 0 {
+		return "", errors.New("No instances found. Deploy one using 'protos instance deploy'")
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	names := []string{}
+	labels := []string{}
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+		labels = append(labels, fmt.Sprintf("%s (%s, %s/%s, %s)", instance.Name, instance.PublicIP, instance.CloudName, instance.Location, instance.Status))
+	}
+	selected, err := selectOption("Choose an instance:", names, labels)
+	if err != nil {
+		return "", err
+	}
+	return instances[selected].Name, nil
+}
+
+// resolveInstanceName returns the name of the instance referred to by ref, which can be an instance name, a VM ID or
+// a public IP. If no instance matches, the error suggests instances with a similar name
+func resolveInstanceName(ref string) (string, error) {
+	if _, err := dbp.GetInstance(ref); err == nil {
+		return ref, nil
+	}
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to retrieve instances")
+	}
+
+	names := []string{}
+	matches := []string{}
+	for _, instance := range instances {
+		names = append(names, instance.Name)
+		host := instance.PublicIP
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if instance.VMID == ref || instance.PublicIP == ref || host == strings.TrimSuffix(strings.TrimPrefix(ref, "["), "]") {
+			matches = append(matches, instance.Name)
+		}
+	}
+	switch {
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		return "", errors.Errorf("'%s' matches several instances: %s. Use the instance name instead", ref, strings.Join(matches, ", "))
+	}
+
+	msg := fmt.Sprintf("Instance '%s' not found", ref)
+	if suggestions := fuzzy.Suggest(ref, names, 2); len(suggestions) > 0 {
+		msg += fmt.Sprintf(". Did you mean '%s'?", strings.Join(suggestions, "' or '"))
+	}
+	return "", notFoundError(msg)
+}
+
+// benchResult holds the throughputs measured by benchInstance, in bytes per second
+type benchResult struct {
+	Latency   time.Duration // duration of a command that does nothing, which is subtracted from the other measurements
+	DiskWrite float64
+	DiskRead  float64
+	Download  float64 // from the instance to the workstation
+	Upload    float64 // from the workstation to the instance
+}
+
+// benchInstance measures disk and network throughput using tools available on any instance. The network is measured
+// through the SSH connection, so the results include the encryption overhead, like any other transfer done by Protos
+func benchInstance(name string, size int64, path string) error {
+	if size < 1<<20 {
+		return errors.Errorf("Invalid benchmark size: should be at least 1M")
+	}
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := instanceSSHClient(instance, 1)
 	if err != nil {
 		return err
 	}
 
-	w := new(tabwriter.Writer)
-	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
-
-	defer w.Flush()
+	result := benchResult{}
+	timeCommand := func(cmd string) (time.Duration, error) {
+		start := time.Now()
+		_, err := ssh.ExecuteCommand(cmd, sshClient)
+		return time.Since(start), err
+	}
+	rate := func(elapsed time.Duration) float64 {
+		elapsed -= result.Latency
+		if elapsed <= 0 {
+			elapsed = time.Millisecond
+		}
+		return float64(size) / elapsed.Seconds()
+	}
 
-	fmt.Fprintf(w, " %s\t%s\t%s\t%s\t%s\t%s\t", "Name", "IP", "Cloud", "VM ID", "Location", "Status")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", "----", "--", "-----", "-----", "--------", "------")
-	for _, instance := range instances {
-		fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", instance.Name, instance.PublicIP, instance.CloudName, instance.VMID, instance.Location, "n/a")
+	result.Latency, err = timeCommand("true")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to benchmark instance '%s'", name)
 	}
-	fmt.Fprint(w, "\n")
-	return nil
-}
 
-func deployInstance(instanceName string, cloudName string, cloudLocation string, release release.Release) (cloud.InstanceInfo, error) {
-	protosImage := "protos-" + release.Version
+	log.Infof("Measuring disk write throughput on instance '%s'", name)
+	blocks := size >> 20
+	elapsed, err := timeCommand(fmt.Sprintf("dd if=/dev/zero of=%s bs=1M count=%d conv=fsync 2>/dev/null", shellQuote(path), blocks))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to benchmark disk of instance '%s'", name)
+	}
+	result.DiskWrite = rate(elapsed)
 
-	// init cloud
-	provider, err := dbp.GetCloud(cloudName)
+	log.Infof("Measuring disk read throughput on instance '%s'", name)
+	// dropping the page cache requires root, without it the read is served from memory and the result is too high
+	_, err = ssh.ExecuteCommand("sync; (echo 3 > /proc/sys/vm/drop_caches) 2>/dev/null; true", sshClient)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrapf(err, "Could not retrieve cloud '%s'", cloudName)
+		return errors.Wrapf(err, "Failed to benchmark disk of instance '%s'", name)
+	}
+	elapsed, err = timeCommand(fmt.Sprintf("dd if=%s of=/dev/null bs=1M 2>/dev/null", shellQuote(path)))
+	ssh.ExecuteCommand("rm -f "+shellQuote(path), sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to benchmark disk of instance '%s'", name)
+	}
+	result.DiskRead = rate(elapsed)
+
+	log.Infof("Measuring download throughput from instance '%s'", name)
+	start := time.Now()
+	exitCode, err := ssh.RunCommand(fmt.Sprintf("head -c %d /dev/zero", size), ioutil.Discard, ioutil.Discard, sshClient)
+	if err == nil && exitCode != 0 {
+		err = errors.Errorf("Command exited with code %d", exitCode)
 	}
-	client := provider.Client()
-	err = client.Init(provider.Auth, cloudLocation)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to connect to cloud provider '%s'(%s) API", cloudName, provider.Type.String())
+		return errors.Wrapf(err, "Failed to benchmark network of instance '%s'", name)
 	}
+	result.Download = rate(time.Since(start))
 
-	// add image
-	imageID := ""
-	images, err := client.GetImages()
+	log.Infof("Measuring upload throughput to instance '%s'", name)
+	start = time.Now()
+	err = ssh.WriteFile(io.LimitReader(zeroReader{}, size), "/dev/null", sshClient)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to initialize Protos")
+		return errors.Wrapf(err, "Failed to benchmark network of instance '%s'", name)
+	}
+	result.Upload = rate(time.Since(start))
+
+	return printOutput(result, func() {
+		fmt.Printf("SSH latency: %s\n", result.Latency.Round(time.Millisecond))
+		fmt.Printf("Disk write: %s/s\n", formatSize(uint64(result.DiskWrite)))
+		fmt.Printf("Disk read: %s/s\n", formatSize(uint64(result.DiskRead)))
+		fmt.Printf("Download: %s/s\n", formatSize(uint64(result.Download)))
+		fmt.Printf("Upload: %s/s\n", formatSize(uint64(result.Upload)))
+	})
+}
+
+// zeroReader is an endless source of zero bytes
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
 	}
-	if id, found := images[protosImage]; found == true {
-		log.Infof("Found Protos image version '%s'  in your cloud account", protosImage)
-		imageID = id
+	return len(p), nil
+}
+
+func knownHostsInstance(name string) error {
+	instances := []cloud.InstanceInfo{}
+	if name != "" {
+		instance, err := dbp.GetInstance(name)
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+		}
+		instances = append(instances, instance)
 	} else {
-		// upload protos image
-		if image, found := release.CloudImages["scaleway"]; found {
-			log.Info("Latest Protos image not in your infra cloud account. Adding it.")
-			imageID, err = client.AddImage(image.URL, image.Digest, release.Version)
-			if err != nil {
-				return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to initialize Protos")
-			}
-		} else {
-			return cloud.InstanceInfo{}, errors.Errorf("Could not find a Scaleway release for Protos version '%s'", release.Version)
+		var err error
+		instances, err = dbp.GetAllInstances()
+		if err != nil {
+			return err
 		}
 	}
 
-	// create SSH key used for instance
-	log.Info("Generating SSH key for the new VM instance")
-	key, err := ssh.GenerateKey()
-	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to initialize Protos")
+	for _, instance := range instances {
+		entries, err := knownHosts.Entries(instance.PublicIP)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 && name != "" {
+			log.Warnf("No host key recorded for instance '%s' yet. It is recorded the first time the instance is contacted", name)
+		}
+		for _, entry := range entries {
+			fmt.Println(entry)
+		}
 	}
+	return nil
+}
 
-	// deploy a protos instance
-	log.Infof("Deploying Protos instance '%s' using image '%s'", instanceName, imageID)
-	vmID, err := client.NewInstance(instanceName, imageID, key.Public())
+// keyInstance prints the SSH key of the instance, or writes it to outputPath, optionally encrypted with a passphrase
+func keyInstance(name string, encrypt bool, outputPath string) error {
+	instanceInfo, err := dbp.GetInstance(name)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to deploy Protos instance")
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if len(instanceInfo.KeySeed) == 0 {
+		return errors.Errorf("Instance '%s' is missing its SSH key", name)
+	}
+	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+	if err != nil {
+		return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
 	}
-	log.Infof("Instance with ID '%s' deployed", vmID)
 
-	// get instance info
-	instanceInfo, err := client.GetInstanceInfo(vmID)
+	encoded := key.EncodePrivateKeytoPEM()
+	if encrypt {
+		passphrase, err := keyPassphrasePrompt()
+		if err != nil {
+			return err
+		}
+		encoded, err = key.EncodeEncryptedPrivateKeytoPEM([]byte(passphrase))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to encrypt the SSH key of instance '%s'", name)
+		}
+	}
+	if outputPath == "" {
+		fmt.Print(encoded)
+		return nil
+	}
+
+	// the file is created with restricted permissions, and they are also enforced when overwriting an existing one
+	file, err := os.OpenFile(outputPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(0600))
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to get Protos instance info")
+		return errors.Wrapf(err, "Failed to create key file '%s'", outputPath)
 	}
-	// save of the instance information
-	err = dbp.SaveInstance(instanceInfo)
+	defer file.Close()
+	err = file.Chmod(os.FileMode(0600))
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to save instance '%s'", instanceName)
+		return errors.Wrapf(err, "Failed to restrict access to key file '%s'", outputPath)
 	}
-
-	// create protos data volume
-	log.Infof("Creating data volume for Protos instance '%s'", instanceName)
-	volumeID, err := client.NewVolume(instanceName, 30000)
+	_, err = file.WriteString(encoded)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to create data volume")
+		return errors.Wrapf(err, "Failed to write key file '%s'", outputPath)
 	}
+	log.Infof("SSH key of instance '%s' written to '%s'", name, outputPath)
+	return nil
+}
 
-	// attach volume to instance
-	err = client.AttachVolume(volumeID, vmID)
+// keyPassphrasePrompt asks for the passphrase used to encrypt an exported key, twice. The prompts are written to stderr,
+// so that they don't end up in the exported key when stdout is redirected
+func keyPassphrasePrompt() (string, error) {
+	var passphrase, confirmation string
+	stdio := survey.WithStdio(os.Stdin, os.Stderr, os.Stderr)
+	err := survey.AskOne(&survey.Password{Message: "Passphrase:"}, &passphrase, survey.WithValidator(survey.Required), stdio)
+	if err != nil {
+		return "", err
+	}
+	err = survey.AskOne(&survey.Password{Message: "Confirm passphrase:"}, &confirmation, stdio)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to attach volume to instance '%s'", instanceName)
+		return "", err
+	}
+	if passphrase != confirmation {
+		return "", errors.New("Passphrases don't match")
 	}
+	return passphrase, nil
+}
 
-	// start protos instance
-	log.Infof("Starting Protos instance '%s'", instanceName)
-	err = client.StartInstance(vmID)
+// recordInstanceContact connects to the instance over SSH and, if successful, updates and saves its last seen and boot times
+func recordInstanceContact(instance *cloud.InstanceInfo) error {
+	sshClient, err := instanceSSHClient(*instance, 1)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to start Protos instance")
+		return err
 	}
 
-	// get instance info again
-	instanceInfo, err = client.GetInstanceInfo(vmID)
+	instance.LastSeen = time.Now()
+	recordMachineID(instance, sshClient)
+	out, err := ssh.ExecuteCommand("cat /proc/stat", sshClient)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrap(err, "Failed to get Protos instance info")
+		log.Warnf("Failed to retrieve boot time for instance '%s': %s", instance.Name, err.Error())
+	} else {
+		bootTime, err := parseBootTime(out)
+		if err != nil {
+			log.Warnf("Failed to retrieve boot time for instance '%s': %s", instance.Name, err.Error())
+		} else {
+			instance.BootTime = bootTime
+		}
 	}
-	// final save of the instance information
-	instanceInfo.KeySeed = key.Seed()
-	err = dbp.SaveInstance(instanceInfo)
+
+	err = dbp.SaveInstance(*instance)
 	if err != nil {
-		return cloud.InstanceInfo{}, errors.Wrapf(err, "Failed to save instance '%s'", instanceName)
+		return errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
 	}
+	return nil
+}
 
-	return instanceInfo, nil
+// parseBootTime extracts the boot time from the contents of /proc/stat
+func parseBootTime(procStat string) (time.Time, error) {
+	for _, line := range strings.Split(procStat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "btime" {
+			btime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, errors.Wrapf(err, "Invalid boot time '%s'", fields[1])
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("Boot time not found in /proc/stat")
 }
 
-func deleteInstance(name string) error {
-	instance, err := dbp.GetInstance(name)
-	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+func formatLastSeen(lastSeen time.Time) string {
+	if lastSeen.IsZero() {
+		return "never"
 	}
-	cloudInfo, err := dbp.GetCloud(instance.CloudName)
-	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	return formatTime(lastSeen)
+}
+
+// warnIfStale logs a warning if the instance has not been contacted for more than staleDays days
+func warnIfStale(instance cloud.InstanceInfo) {
+	if staleDays <= 0 || instance.LastSeen.IsZero() {
+		return
 	}
-	client := cloudInfo.Client()
-	err = client.Init(cloudInfo.Auth, instance.Location)
-	if err != nil {
-		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	if time.Since(instance.LastSeen) > time.Duration(staleDays)*24*time.Hour {
+		log.Warnf("Instance '%s' has not been reachable since %s", instance.Name, formatLastSeen(instance.LastSeen))
 	}
+}
 
-	log.Infof("Stopping instance '%s' (%s)", instance.Name, instance.VMID)
-	err = client.StopInstance(instance.VMID)
+// warnIfDrifted logs a warning if the instance doesn't run the Protos version it is pinned to
+func warnIfDrifted(instance cloud.InstanceInfo) {
+	if instance.PinnedVersion == "" || instance.PinnedVersion == instance.Version {
+		return
+	}
+	version := instance.Version
+	if version == "" {
+		version = "an unknown version"
+	}
+	log.Warnf("Instance '%s' is pinned to Protos version '%s', but runs %s", instance.Name, instance.PinnedVersion, version)
+}
+
+// formatVersion returns the Protos version of an instance, followed by the pinned one if it differs
+func formatVersion(instance cloud.InstanceInfo) string {
+	version := instance.Version
+	if version == "" {
+		version = "n/a"
+	}
+	if instance.PinnedVersion != "" && instance.PinnedVersion != instance.Version {
+		return fmt.Sprintf("%s (pinned %s)", version, instance.PinnedVersion)
+	}
+	if instance.PinnedVersion != "" {
+		return version + " (pinned)"
+	}
+	return version
+}
+
+// warnIfExpiring logs a warning if the instance expired or expires in less than a day
+func warnIfExpiring(instance cloud.InstanceInfo) {
+	if instance.ExpiresAt.IsZero() {
+		return
+	}
+	left := time.Until(instance.ExpiresAt)
+	if left <= 0 {
+		log.Warnf("Instance '%s' expired on %s and will be destroyed by 'protos gc --expired'", instance.Name, formatTime(instance.ExpiresAt))
+	} else if left < 24*time.Hour {
+		log.Warnf("Instance '%s' expires in %s", instance.Name, left.Round(time.Minute))
+	}
+}
+
+// diskFullPercent is the usage above which a filesystem is reported as close to full
+const diskFullPercent = 90
+
+// capacityWarningPercent is the memory or disk usage above which an instance is highlighted by 'instance ls --usage'
+const capacityWarningPercent = 75
+
+// resourceUsage is the memory and disk utilization of an instance, probed over SSH
+type resourceUsage struct {
+	MemoryPercent int
+	DiskPercent   int    // usage of the fullest filesystem
+	DiskMount     string // mount point of the fullest filesystem
+}
+
+type instanceWithUsage struct {
+	cloud.InstanceInfo
+	Usage *resourceUsage `json:",omitempty"` // nil if the instance could not be probed
+}
+
+// probeUsage retrieves the resource usage of the instances concurrently. Instances that can't be reached without
+// prompting the user are left out
+func probeUsage(instances []cloud.InstanceInfo) map[string]resourceUsage {
+	type probeResult struct {
+		instance string
+		usage    resourceUsage
+		err      error
+	}
+	results := make(chan probeResult, len(instances))
+	for _, instance := range instances {
+		go func(instance cloud.InstanceInfo) {
+			result := probeResult{instance: instance.Name}
+			result.usage, result.err = instanceUsage(instance)
+			results <- result
+		}(instance)
+	}
+	usage := map[string]resourceUsage{}
+	for range instances {
+		result := <-results
+		if result.err != nil {
+			log.Debugf("Failed to probe resource usage of instance '%s': %s", result.instance, result.err.Error())
+			continue
+		}
+		usage[result.instance] = result.usage
+	}
+	return usage
+}
+
+func instanceUsage(instance cloud.InstanceInfo) (resourceUsage, error) {
+	usage := resourceUsage{}
+	sshClient, err := connectInstance(instance, 1, false)
 	if err != nil {
-		return errors.Wrapf(err, "Could not stop instance '%s'", name)
+		return usage, err
 	}
-	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	out, err := ssh.ExecuteCommand("cat /proc/meminfo", sshClient)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to get details for instance '%s'", name)
+		return usage, errors.Wrap(err, "Failed to retrieve memory usage")
 	}
-	log.Infof("Deleting instance '%s' (%s)", instance.Name, instance.VMID)
-	err = client.DeleteInstance(instance.VMID)
+	usage.MemoryPercent, err = parseMemoryUsage(out)
 	if err != nil {
-		return errors.Wrapf(err, "Could not delete instance '%s'", name)
+		return usage, err
 	}
-	for _, vol := range vmInfo.Volumes {
-		log.Infof("Deleting volume '%s' (%s) for instance '%s'", vol.Name, vol.VolumeID, name)
-		err = client.DeleteVolume(vol.VolumeID)
+	out, err = ssh.ExecuteCommand("df -P -k", sshClient)
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve disk usage")
+	}
+	for _, fs := range parseDf(out) {
+		if fs.Percent() >= usage.DiskPercent {
+			usage.DiskPercent = fs.Percent()
+			usage.DiskMount = fs.MountPoint
+		}
+	}
+	return usage, nil
+}
+
+// parseMemoryUsage returns the memory in use as a percentage of the total memory, from the contents of /proc/meminfo.
+// Memory used by caches that can be reclaimed is not counted
+func parseMemoryUsage(memInfo string) (int, error) {
+	values := map[string]uint64{}
+	for _, line := range strings.Split(memInfo, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseUint(fields[1], 10, 64)
 		if err != nil {
-			log.Errorf("Failed to delete volume '%s': %s", vol.Name, err.Error())
+			continue
 		}
+		values[strings.TrimSuffix(fields[0], ":")] = value
 	}
-	return dbp.DeleteInstance(name)
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total == 0 {
+		return 0, errors.New("Total memory not found in /proc/meminfo")
+	}
+	if available > total {
+		available = total
+	}
+	return int((total - available) * 100 / total), nil
 }
 
-func startInstance(name string) error {
-	instance, err := dbp.GetInstance(name)
-	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+// formatUtilization renders a usage percentage, colored by how close it is to capacity. With plain output, usage
+// above capacityWarningPercent is marked with (!). Negative values mean the usage is not known
+func formatUtilization(percent int) string {
+	value := "n/a"
+	if percent >= 0 {
+		value = fmt.Sprintf("%d%%", percent)
 	}
-	cloudInfo, err := dbp.GetCloud(instance.CloudName)
-	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	if plainOutput {
+		if percent >= capacityWarningPercent {
+			value += " (!)"
+		}
+		return value
 	}
-	client := cloudInfo.Client()
-	err = client.Init(cloudInfo.Auth, instance.Location)
-	if err != nil {
-		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+	// all the color codes have the same length, so that the table columns stay aligned
+	color := "\x1b[39m"
+	switch {
+	case percent >= diskFullPercent:
+		color = "\x1b[31m"
+	case percent >= capacityWarningPercent:
+		color = "\x1b[33m"
+	case percent >= 0:
+		color = "\x1b[32m"
 	}
+	return color + value + "\x1b[0m"
+}
 
-	log.Infof("Starting instance '%s' (%s)", instance.Name, instance.VMID)
-	err = client.StartInstance(instance.VMID)
-	if err != nil {
-		return errors.Wrapf(err, "Could not start instance '%s'", name)
+// warnIfNearCapacity logs a warning if the memory or disk usage of the instance is above capacityWarningPercent
+func warnIfNearCapacity(instance cloud.InstanceInfo, usage resourceUsage) {
+	if usage.MemoryPercent >= capacityWarningPercent {
+		log.Warnf("Instance '%s' uses %d%% of its memory. Consider deploying it on a larger machine", instance.Name, usage.MemoryPercent)
+	}
+	if usage.DiskPercent >= capacityWarningPercent {
+		log.Warnf("Instance '%s' uses %d%% of '%s'. Consider growing its data volume using 'protos instance grow-data'", instance.Name, usage.DiskPercent, usage.DiskMount)
 	}
-	return nil
 }
 
-func stopInstance(name string) error {
+type filesystemUsage struct {
+	Filesystem string
+	MountPoint string
+	Size       uint64 // in bytes
+	Used       uint64
+	Available  uint64
+}
+
+// Percent returns the used space as a percentage of the space usable by non root users, like df
+func (fs filesystemUsage) Percent() int {
+	if fs.Used+fs.Available == 0 {
+		return 0
+	}
+	return int((fs.Used*100 + fs.Used + fs.Available - 1) / (fs.Used + fs.Available))
+}
+
+type appUsage struct {
+	Name string
+	Used uint64 // in bytes
+}
+
+type diskUsage struct {
+	Filesystems []filesystemUsage
+	Apps        []appUsage
+}
+
+// pseudoFilesystems are memory backed filesystems, which are left out of the disk usage report
+var pseudoFilesystems = map[string]bool{"tmpfs": true, "devtmpfs": true, "udev": true, "shm": true, "overlay": true, "none": true}
+
+// dfInstance reports the output of df and du on the instance. Both are run in POSIX mode with 1K blocks, so that the
+// report works with the GNU and busybox versions of the tools
+func dfInstance(name string, appsDir string) error {
 	instance, err := dbp.GetInstance(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
-	cloudInfo, err := dbp.GetCloud(instance.CloudName)
+	sshClient, err := instanceSSHClient(instance, 1)
 	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+		return err
 	}
-	client := cloudInfo.Client()
-	err = client.Init(cloudInfo.Auth, instance.Location)
+
+	output, err := ssh.ExecuteCommand("df -P -k", sshClient)
 	if err != nil {
-		return errors.Wrapf(err, "Could not init cloud '%s'", name)
+		return errors.Wrapf(err, "Failed to retrieve disk usage of instance '%s'", name)
 	}
+	usage := diskUsage{Filesystems: parseDf(output), Apps: []appUsage{}}
 
-	log.Infof("Stopping instance '%s' (%s)", instance.Name, instance.VMID)
-	err = client.StopInstance(instance.VMID)
+	output, err = ssh.ExecuteCommand(fmt.Sprintf("cd %s 2>/dev/null && du -s -k -- */ 2>/dev/null; true", shellQuote(appsDir)), sshClient)
 	if err != nil {
-		return errors.Wrapf(err, "Could not stop instance '%s'", name)
+		return errors.Wrapf(err, "Failed to retrieve app data usage of instance '%s'", name)
+	}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		used, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		usage.Apps = append(usage.Apps, appUsage{Name: strings.TrimSuffix(fields[1], "/"), Used: used << 10})
+	}
+	sort.Slice(usage.Apps, func(i, j int) bool { return usage.Apps[i].Used > usage.Apps[j].Used })
+
+	err = printOutput(usage, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "Filesystem", "Size", "Used", "Available", "Use%", "Mounted on")
+		for _, fs := range usage.Filesystems {
+			percent := fmt.Sprintf("%d%%", fs.Percent())
+			if fs.Percent() >= diskFullPercent {
+				percent += " (!)"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t", fs.Filesystem, formatSize(fs.Size), formatSize(fs.Used), formatSize(fs.Available), percent, fs.MountPoint)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+
+		if len(usage.Apps) == 0 {
+			return
+		}
+		fmt.Print("\n")
+		printTableHeader(w, "App", "Used")
+		for _, app := range usage.Apps {
+			fmt.Fprintf(w, "\n %s\t%s\t", app.Name, formatSize(app.Used))
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, fs := range usage.Filesystems {
+		if fs.Percent() < diskFullPercent {
+			continue
+		}
+		if fs.MountPoint == "/" {
+			log.Warnf("The root filesystem of instance '%s' is %d%% full", name, fs.Percent())
+			continue
+		}
+		log.Warnf("Filesystem '%s' of instance '%s' is %d%% full", fs.MountPoint, name, fs.Percent())
+		for _, vol := range instance.Volumes {
+			if vol.Name == instance.Name {
+				log.Warnf("If it is on the data volume, grow it using 'protos volume resize %s --size %s'", vol.VolumeID, formatSize(vol.Size*2))
+			}
+		}
 	}
 	return nil
 }
 
-func tunnelInstance(name string) error {
-	instanceInfo, err := dbp.GetInstance(name)
-	if err != nil {
-		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+// parseDf parses the output of 'df -P -k', leaving out pseudo filesystems
+func parseDf(output string) []filesystemUsage {
+	filesystems := []filesystemUsage{}
+	for _, line := range strings.Split(output, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		// mount points can contain spaces, unlike the numeric fields, so the fields are read from the start
+		size, err1 := strconv.ParseUint(fields[1], 10, 64)
+		used, err2 := strconv.ParseUint(fields[2], 10, 64)
+		available, err3 := strconv.ParseUint(fields[3], 10, 64)
+		if err1 != nil || err2 != nil || err3 != nil || size == 0 || pseudoFilesystems[fields[0]] {
+			continue
+		}
+		filesystems = append(filesystems, filesystemUsage{
+			Filesystem: fields[0],
+			MountPoint: strings.Join(fields[5:], " "),
+			Size:       size << 10,
+			Used:       used << 10,
+			Available:  available << 10,
+		})
 	}
-	if len(instanceInfo.KeySeed) == 0 {
-		return errors.Errorf("Instance '%s' is missing its SSH key", name)
+	return filesystems
+}
+
+// instanceSSHClient returns an SSH connection to the instance, reusing an existing one if possible. The stored instance
+// key is tried first, falling back to password and keyboard-interactive authentication, which prompt the user. The
+// connection is owned by the SSH connection pool and should not be closed by the caller
+func instanceSSHClient(instance cloud.InstanceInfo, maxRetries int) (*gossh.Client, error) {
+	return connectInstance(instance, maxRetries, true)
+}
+
+// connectInstance is like instanceSSHClient, but only falls back to the authentication methods that prompt the user if
+// interactive is true. Non interactive connections can be opened concurrently
+func connectInstance(instance cloud.InstanceInfo, maxRetries int, interactive bool) (*gossh.Client, error) {
+	auth := []gossh.AuthMethod{}
+	if len(instance.KeySeed) > 0 {
+		key, err := ssh.NewKeyFromSeed(instance.KeySeed)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Instance '%s' has an invalid SSH key", instance.Name)
+		}
+		auth = append(auth, key.SSHAuth())
+	} else if interactive {
+		log.Warnf("Instance '%s' is missing its SSH key. Falling back to password authentication", instance.Name)
+	} else {
+		return nil, errors.Errorf("Instance '%s' is missing its SSH key", instance.Name)
 	}
-	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
-	if err != nil {
-		return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
+	if interactive {
+		auth = append(auth, ssh.PasswordAuth(passwordPrompt(instance)), ssh.KeyboardInteractiveAuth(keyboardInteractivePrompt))
 	}
 
-	log.Infof("Creating SSH tunnel to instance '%s', using ip '%s'", instanceInfo.Name, instanceInfo.PublicIP)
-	tunnel := ssh.NewTunnel(instanceInfo.PublicIP+":22", "root", key.SSHAuth(), "localhost:8080", log)
-	localPort, err := tunnel.Start()
+	sshClient, err := sshPool.Get(instance.PublicIP, "root", auth, maxRetries, instance.UseSSHConfig)
 	if err != nil {
-		return errors.Wrap(err, "Error while creating the SSH tunnel")
+		return nil, errors.Wrapf(err, "Failed to connect to instance '%s'", instance.Name)
 	}
+	err = verifyMachineID(instance, sshClient)
+	if err != nil {
+		return nil, err
+	}
+	return sshClient, nil
+}
 
-	quit := make(chan interface{}, 1)
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	go catchSignals(sigs, quit)
-
-	log.Infof("SSH tunnel ready. Use 'http://localhost:%d/' to access the instance dashboard. Once finished, press CTRL+C to terminate the SSH tunnel", localPort)
+// machineIDCommand prints the machine ID generated by the instance OS on first boot
+const machineIDCommand = "cat /etc/machine-id"
 
-	// waiting for a SIGTERM or SIGINT
-	<-quit
+var (
+	verifiedMu       sync.Mutex
+	verifiedMachines = map[string]bool{}
+)
 
-	log.Info("CTRL+C received. Terminating the SSH tunnel")
-	err = tunnel.Close()
+// verifyMachineID checks that the machine answering at the instance IP is the one recorded after deploy, so that an IP
+// reassigned by the provider to another machine is detected before anything is run on it. Every instance is checked
+// once per run. The lock is not held while the instance is asked, so that a slow instance doesn't hold up the others,
+// which means concurrent connections to an unverified instance might all check it
+func verifyMachineID(instance cloud.InstanceInfo, sshClient *gossh.Client) error {
+	if instance.MachineID == "" {
+		return nil
+	}
+	verifiedMu.Lock()
+	verified := verifiedMachines[instance.Name]
+	verifiedMu.Unlock()
+	if verified {
+		return nil
+	}
+	out, err := ssh.ExecuteCommand(machineIDCommand, sshClient)
 	if err != nil {
-		return errors.Wrap(err, "Error while terminating the SSH tunnel")
+		return errors.Wrapf(err, "Failed to verify the identity of instance '%s'", instance.Name)
+	}
+	machineID := strings.TrimSpace(out)
+	if machineID != instance.MachineID {
+		return errors.Errorf("The machine at '%s' is not instance '%s': it reports machine ID '%s' instead of '%s'. The IP might have been reassigned to another machine. If the instance was reinstalled, run 'protos instance identity --reset %s'", instance.PublicIP, instance.Name, machineID, instance.MachineID, instance.Name)
 	}
-	log.Info("SSH tunnel terminated successfully")
+	verifiedMu.Lock()
+	verifiedMachines[instance.Name] = true
+	verifiedMu.Unlock()
 	return nil
 }
 
-func keyInstance(name string) error {
-	instanceInfo, err := dbp.GetInstance(name)
+// recordMachineID stores the machine ID of an instance that doesn't have one yet. The caller is responsible for saving
+// the instance
+func recordMachineID(instance *cloud.InstanceInfo, sshClient *gossh.Client) {
+	if instance.MachineID != "" {
+		return
+	}
+	out, err := ssh.ExecuteCommand(machineIDCommand, sshClient)
+	machineID := strings.TrimSpace(out)
+	if err != nil || machineID == "" {
+		log.Warnf("Failed to retrieve the machine ID of instance '%s'", instance.Name)
+		return
+	}
+	instance.MachineID = machineID
+	verifiedMu.Lock()
+	verifiedMachines[instance.Name] = true
+	verifiedMu.Unlock()
+}
+
+// identityInstance checks the machine ID of an instance, recording it if it's missing. With reset, the recorded ID is
+// replaced by the one currently reported by the instance
+func identityInstance(name string, reset bool) error {
+	instance, err := dbp.GetInstance(name)
 	if err != nil {
 		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
 	}
-	if len(instanceInfo.KeySeed) == 0 {
-		return errors.Errorf("Instance '%s' is missing its SSH key", name)
+	previous := instance.MachineID
+	if reset {
+		instance.MachineID = ""
 	}
-	key, err := ssh.NewKeyFromSeed(instanceInfo.KeySeed)
+	sshClient, err := instanceSSHClient(instance, 1)
 	if err != nil {
-		return errors.Wrapf(err, "Instance '%s' has an invalid SSH key", name)
+		return err
+	}
+	if instance.MachineID != "" {
+		log.Infof("Instance '%s' verified. Machine ID: %s", name, instance.MachineID)
+		return nil
+	}
+	recordMachineID(&instance, sshClient)
+	if instance.MachineID == "" {
+		return errors.Errorf("Failed to record the machine ID of instance '%s'", name)
+	}
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	if previous != "" && previous != instance.MachineID {
+		log.Warnf("Machine ID of instance '%s' changed from '%s' to '%s'", name, previous, instance.MachineID)
 	}
-	fmt.Print(key.EncodePrivateKeytoPEM())
+	log.Infof("Recorded machine ID '%s' for instance '%s'", instance.MachineID, name)
 	return nil
 }
+
+// passwordPrompt returns a function that securely asks the user for the SSH password of an instance. The password is
+// asked only once, and reused for connection retries
+func passwordPrompt(instance cloud.InstanceInfo) func() (string, error) {
+	var password string
+	return func() (string, error) {
+		if password != "" {
+			return password, nil
+		}
+		err := survey.AskOne(&survey.Password{Message: fmt.Sprintf("SSH password for root@%s (%s):", instance.PublicIP, instance.Name)}, &password)
+		return password, err
+	}
+}
+
+func keyboardInteractivePrompt(instruction string, question string, echo bool) (string, error) {
+	if instruction != "" {
+		fmt.Fprintln(os.Stderr, instruction)
+	}
+	var answer string
+	var prompt survey.Prompt = &survey.Password{Message: question}
+	if echo {
+		prompt = &survey.Input{Message: question}
+	}
+	err := survey.AskOne(prompt, &answer)
+	return answer, err
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/db"
+	"github.com/protosio/cli/internal/deploy"
+	"github.com/protosio/cli/internal/job"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/saga"
+	"github.com/urfave/cli/v2"
+)
+
+// operationSteps maps the operation kinds to the functions returning their steps, used to resume and roll back
+// operations
+var operationSteps = map[string]func(op *saga.Operation) ([]saga.Step, error){
+	deploy.Operation: deploySteps,
+}
+
+// jobEnvVar is set for worker processes started by startJob, and holds the ID of the job they execute
+const jobEnvVar = "PROTOS_JOB_ID"
+
+var cmdJob *cli.Command = &cli.Command{
+	Name:  "job",
+	Usage: "Inspect long running operations started with --async, and resume or roll back interrupted ones",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List jobs",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listJobs()
+			},
+		},
+		{
+			Name:      "status",
+			ArgsUsage: "<id>",
+			Usage:     "Prints the status of a job",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return statusJob(id)
+			},
+		},
+		{
+			Name:      "attach",
+			ArgsUsage: "<id>",
+			Usage:     "Follow the output of a job until it finishes. Press CTRL+C to detach",
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return attachJob(id)
+			},
+		},
+		{
+			Name:  "operations",
+			Usage: "List the multi-step operations, like deploys, including the interrupted ones that can be resumed or rolled back",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				err := openDB()
+				if err != nil {
+					return err
+				}
+				return listOperations()
+			},
+		},
+		{
+			Name:      "resume",
+			ArgsUsage: "<operation id>",
+			Usage:     "Resume an interrupted operation from the step that didn't complete",
+			Before:    openSnapshotDB,
+			Flags: []cli.Flag{
+				timeoutFlag(),
+				progressFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return withTimeout(c, func() error {
+					return resumeOperation(id)
+				})
+			},
+		},
+		{
+			Name:      "rollback",
+			ArgsUsage: "<operation id>",
+			Usage:     "Undo the steps of an interrupted operation, most recent first",
+			Before:    openSnapshotDB,
+			Flags: []cli.Flag{
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return withTimeout(c, func() error {
+					return rollbackOperation(id)
+				})
+			},
+		},
+	},
+}
+
+//
+// Job methods
+//
+
+// openSnapshotDB opens the database for the job commands that change it, since config doesn't open it for them, and
+// snapshots it like the other commands changing it. Nothing is opened on usage errors
+func openSnapshotDB(c *cli.Context) error {
+	if c.Args().Get(0) == "" {
+		return nil
+	}
+	err := openDB()
+	if err != nil {
+		return err
+	}
+	return snapshotDB(c)
+}
+
+func jobsDir() string {
+	return filepath.Join(protosDir(), "jobs")
+}
+
+// startJob records a job and runs the current command again in a background worker process, without the --async flag.
+// Commands run it only when jobEnvVar is not set, so that a worker never starts another job
+func startJob(command string) error {
+	args := []string{}
+	for _, arg := range os.Args[1:] {
+		if arg == "--async" || arg == "-async" || strings.HasPrefix(arg, "--async=") || strings.HasPrefix(arg, "-async=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+
+	j, err := job.New(jobsDir(), command, args)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(j.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create log file for job '%s'", j.ID)
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start background job")
+	}
+	worker := exec.Command(executable, args...)
+	worker.Env = append(os.Environ(), jobEnvVar+"="+j.ID)
+	worker.Stdout = logFile
+	worker.Stderr = logFile
+	job.Detach(worker)
+	err = worker.Start()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start background job")
+	}
+	// the worker records its own status, and is not waited for
+	worker.Process.Release()
+
+	log.Infof("Started job '%s' (%s). Use 'protos job attach %s' to follow it", j.ID, command, j.ID)
+	return nil
+}
+
+// dbLockedError explains that the database is in use, naming the background job using it if there is one
+func dbLockedError() error {
+	jobs, err := job.List(jobsDir())
+	if err != nil {
+		return db.ErrLocked
+	}
+	for _, j := range jobs {
+		if j.Status == job.Running && j.ID != os.Getenv(jobEnvVar) {
+			return errors.Errorf("The database is in use by job '%s' (%s). Wait for it to finish using 'protos job attach %s'", j.ID, j.Command, j.ID)
+		}
+	}
+	return db.ErrLocked
+}
+
+func listJobs() error {
+	jobs, err := job.List(jobsDir())
+	if err != nil {
+		return err
+	}
+
+	return printOutput(jobs, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "ID", "Command", "Status", "Started")
+		for _, j := range jobs {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t", j.ID, j.Command, j.Status, formatTime(j.CreatedAt))
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+func statusJob(id string) error {
+	j, err := job.Get(jobsDir(), id)
+	if err != nil {
+		return err
+	}
+
+	return printOutput(j, func() {
+		fmt.Printf("ID: %s\n", j.ID)
+		fmt.Printf("Command: %s\n", j.Command)
+		fmt.Printf("Status: %s\n", j.Status)
+		fmt.Printf("Created: %s\n", formatTimeSeconds(j.CreatedAt))
+		if !j.FinishedAt.IsZero() {
+			fmt.Printf("Finished: %s (took %s)\n", formatTimeSeconds(j.FinishedAt), j.FinishedAt.Sub(j.StartedAt).Round(time.Second))
+		}
+		if j.Error != "" {
+			fmt.Printf("Error: %s\n", j.Error)
+		}
+		fmt.Printf("Log: %s\n", j.LogFile)
+	})
+}
+
+func attachJob(id string) error {
+	j, err := job.Get(jobsDir(), id)
+	if err != nil {
+		return err
+	}
+	logFile, err := os.Open(j.LogFile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open log file for job '%s'", id)
+	}
+	defer logFile.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		_, err = io.Copy(os.Stdout, logFile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read log file for job '%s'", id)
+		}
+		if j.Done() {
+			break
+		}
+		select {
+		case <-sigs:
+			log.Infof("Detached from job '%s', which keeps running in the background", id)
+			return nil
+		case <-time.After(500 * time.Millisecond):
+		}
+		j, err = job.Get(jobsDir(), id)
+		if err != nil {
+			return err
+		}
+	}
+	// print anything written between the last read and the job finishing
+	_, err = io.Copy(os.Stdout, logFile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read log file for job '%s'", id)
+	}
+
+	switch j.Status {
+	case job.Failed:
+		return errors.Errorf("Job '%s' failed: %s", id, j.Error)
+	case job.Lost:
+		return errors.Errorf("Job '%s' exited without recording a result", id)
+	}
+	log.Infof("Job '%s' finished successfully", id)
+	return nil
+}
+
+// operationFailed returns the error of a failed operation, explaining how to resume or roll it back
+func operationFailed(op *saga.Operation, err error) error {
+	return errors.Errorf("%s. Resume the operation using 'protos job resume %s', or undo it using 'protos job rollback %s'", err.Error(), op.ID, op.ID)
+}
+
+func listOperations() error {
+	ops, err := dbp.GetAllOperations()
+	if err != nil {
+		return err
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].StartedAt.Before(ops[j].StartedAt) })
+	for _, op := range ops {
+		redactParams(op.Params)
+	}
+
+	return printOutput(ops, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "ID", "Operation", "Status", "Completed steps", "Started")
+		for _, op := range ops {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%d\t%s\t", op.ID, op.Description, op.Status, len(op.Completed), formatTime(op.StartedAt))
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// secretParams are the operation params holding secrets, which are redacted from the output. Only operations started
+// by clients older than the keystore hold them
+var secretParams = []string{"key-seed"}
+
+func redactParams(params map[string]string) {
+	for _, name := range secretParams {
+		if _, found := params[name]; found {
+			params[name] = "REDACTED"
+		}
+	}
+}
+
+// observeProgress writes the progress events of op to stdout, if requested using --progress
+func observeProgress(op *saga.Operation) error {
+	switch progressSpec {
+	case "":
+		return nil
+	case output.JSON:
+		encoder := json.NewEncoder(os.Stdout)
+		op.Observe(func(event saga.Event) {
+			if err := encoder.Encode(event); err != nil {
+				log.Debugf("Failed to write progress event: %s", err.Error())
+			}
+		})
+		return nil
+	}
+	return errors.Errorf("Invalid progress format '%s'. Only json is supported", progressSpec)
+}
+
+// operationWithSteps retrieves an operation and the steps used to resume or roll it back
+func operationWithSteps(id string) (*saga.Operation, []saga.Step, error) {
+	op, err := dbp.GetOperation(id)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Could not retrieve operation '%s'", id)
+	}
+	if op.Done() {
+		return nil, nil, errors.Errorf("Operation '%s' (%s) already %s", id, op.Description, op.Status)
+	}
+	stepsFn, found := operationSteps[op.Kind]
+	if !found {
+		return nil, nil, errors.Errorf("Operation '%s' has an unknown kind '%s'", id, op.Kind)
+	}
+	steps, err := stepsFn(&op)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &op, steps, nil
+}
+
+func resumeOperation(id string) error {
+	op, steps, err := operationWithSteps(id)
+	if err != nil {
+		return err
+	}
+	err = observeProgress(op)
+	if err != nil {
+		return err
+	}
+	log.Infof("Resuming operation '%s' (%s) after %d completed step(s)", id, op.Description, len(op.Completed))
+	err = saga.Run(dbp, op, steps)
+	if err != nil {
+		return operationFailed(op, err)
+	}
+	log.Infof("Operation '%s' (%s) completed", id, op.Description)
+	return nil
+}
+
+func rollbackOperation(id string) error {
+	op, steps, err := operationWithSteps(id)
+	if err != nil {
+		return err
+	}
+	log.Infof("Rolling back operation '%s' (%s)", id, op.Description)
+	err = saga.Rollback(dbp, op, steps)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to roll back operation '%s'. Retry using 'protos job rollback %s'", id, id)
+	}
+	log.Infof("Operation '%s' (%s) rolled back", id, op.Description)
+	return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/protosio/cli/internal/wireguard"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// meshInterface is the WireGuard interface configured on the instances, using /etc/wireguard/<interface>.conf
+	meshInterface    = "protos0"
+	meshFullTopology = "full"
+	meshHubTopology  = "hub"
+)
+
+var meshGroup string
+var meshTopology string
+var meshHub string
+var meshSubnet string
+var meshPort int
+
+var cmdMesh *cli.Command = &cli.Command{
+	Name:  "mesh",
+	Usage: "Connect instances through a private WireGuard network",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List the instances in the mesh and their private addresses",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listMesh()
+			},
+		},
+		{
+			Name:   "up",
+			Usage:  "Configure WireGuard peering between instances. Running it again after adding instances updates every peer",
+			Before: snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "group",
+					Usage:       "Connect the instances in `GROUP`. All instances are used by default",
+					Destination: &meshGroup,
+				},
+				&cli.StringFlag{
+					Name:        "topology",
+					Usage:       "`TOPOLOGY` of the network: full (every instance peers with every other) or hub (instances peer with the hub only, which routes between them)",
+					Value:       meshFullTopology,
+					Destination: &meshTopology,
+				},
+				&cli.StringFlag{
+					Name:        "hub",
+					Usage:       "`INSTANCE` used as hub by the hub topology",
+					Destination: &meshHub,
+				},
+				&cli.StringFlag{
+					Name:        "subnet",
+					Usage:       "IPv4 `SUBNET` the private addresses are allocated from",
+					Value:       "10.99.0.0/24",
+					Destination: &meshSubnet,
+				},
+				&cli.IntFlag{
+					Name:        "port",
+					Usage:       "UDP `PORT` WireGuard listens on. It has to be allowed by the instance firewalls",
+					Value:       51820,
+					Destination: &meshPort,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if meshTopology != meshFullTopology && meshTopology != meshHubTopology {
+					return errors.Errorf("Topology '%s' not supported. Supported topologies: %s, %s", meshTopology, meshFullTopology, meshHubTopology)
+				}
+				if meshTopology == meshHubTopology {
+					if meshHub == "" {
+						return errors.New("The hub topology requires --hub")
+					}
+					hub, err := resolveInstanceName(meshHub)
+					if err != nil {
+						return err
+					}
+					meshHub = hub
+				}
+				return meshUp(meshGroup, meshTopology, meshHub, meshSubnet, meshPort)
+			},
+		},
+		{
+			Name:   "down",
+			Usage:  "Remove the WireGuard configuration from the instances in the mesh",
+			Before: snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "group",
+					Usage:       "Only remove the instances in `GROUP` from the mesh",
+					Destination: &meshGroup,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return meshDown(meshGroup)
+			},
+		},
+	},
+}
+
+//
+// Mesh methods
+//
+
+func listMesh() error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	members := []cloud.InstanceInfo{}
+	for _, instance := range instances {
+		if instance.MeshIP != "" {
+			instance.KeySeed = nil
+			members = append(members, instance)
+		}
+	}
+
+	return printOutput(members, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Name", "Mesh IP", "Public IP")
+		for _, instance := range members {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t", instance.Name, instance.MeshIP, instance.PublicIP)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// meshUp allocates a private address to every instance in the group that doesn't have one yet, generates new keys and
+// writes the WireGuard configuration of every instance over SSH. With the hub topology, traffic between the other
+// instances is routed through the hub
+func meshUp(group string, topology string, hub string, subnet string, port int) error {
+	instances, err := fleetInstances(group)
+	if err != nil {
+		return err
+	}
+	if len(instances) < 2 {
+		return errors.New("At least two instances are required to set up a mesh")
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	if topology == meshHubTopology {
+		found := false
+		for _, instance := range instances {
+			if instance.Name == hub {
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("Hub instance '%s' is not part of the instances being connected", hub)
+		}
+	}
+
+	_, network, err := net.ParseCIDR(subnet)
+	if err != nil || network.IP.To4() == nil {
+		return errors.Errorf("Invalid subnet '%s': should be an IPv4 network in CIDR notation, e.g. 10.99.0.0/24", subnet)
+	}
+	err = allocateMeshIPs(instances, network)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]wireguard.Key{}
+	for _, instance := range instances {
+		keys[instance.Name], err = wireguard.GenerateKey()
+		if err != nil {
+			return err
+		}
+	}
+	prefix, _ := network.Mask.Size()
+	peer := func(instance cloud.InstanceInfo, allowedIPs string, keepalive int) wireguard.Peer {
+		host := instance.PublicIP
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return wireguard.Peer{
+			PublicKey:           keys[instance.Name].Public(),
+			Endpoint:            net.JoinHostPort(host, strconv.Itoa(port)),
+			AllowedIPs:          []string{allowedIPs},
+			PersistentKeepalive: keepalive,
+		}
+	}
+
+	for _, instance := range instances {
+		config := wireguard.Config{
+			PrivateKey: keys[instance.Name].Private(),
+			Address:    fmt.Sprintf("%s/%d", instance.MeshIP, prefix),
+			ListenPort: port,
+		}
+		for _, other := range instances {
+			if other.Name == instance.Name {
+				continue
+			}
+			switch {
+			case topology == meshFullTopology:
+				config.Peers = append(config.Peers, peer(other, other.MeshIP+"/32", 0))
+			case instance.Name == hub:
+				config.Peers = append(config.Peers, peer(other, other.MeshIP+"/32", 0))
+			case other.Name == hub:
+				// spokes reach each other through the hub, which keeps the connection open for them
+				config.Peers = append(config.Peers, peer(other, network.String(), 25))
+			}
+		}
+		if topology == meshHubTopology && instance.Name == hub {
+			config.PostUp = []string{"sysctl -w net.ipv4.ip_forward=1"}
+		}
+
+		log.Infof("Configuring WireGuard on instance '%s' with address '%s'", instance.Name, instance.MeshIP)
+		err = applyMeshConfig(instance, config)
+		if err != nil {
+			return err
+		}
+		err = dbp.SaveInstance(instance)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
+		}
+	}
+	log.Infof("Mesh with %d instances is up. Instances reach each other using the addresses listed by 'protos mesh ls'", len(instances))
+	return nil
+}
+
+// allocateMeshIPs sets the mesh address of the instances that don't have one in network yet, using the lowest
+// addresses that are not used by any instance
+func allocateMeshIPs(instances []cloud.InstanceInfo, network *net.IPNet) error {
+	all, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, instance := range all {
+		if instance.MeshIP != "" {
+			used[instance.MeshIP] = true
+		}
+	}
+
+	base := binary.BigEndian.Uint32(network.IP.To4())
+	ones, bits := network.Mask.Size()
+	hosts := uint32(1)<<uint(bits-ones) - 1 // the last address is the broadcast address
+	next := uint32(1)
+	for i := range instances {
+		if ip := net.ParseIP(instances[i].MeshIP); ip != nil && network.Contains(ip) {
+			continue
+		}
+		for ; next < hosts; next++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, base+next)
+			if !used[ip.String()] {
+				break
+			}
+		}
+		if next >= hosts {
+			return errors.Errorf("Subnet '%s' is too small for %d instances", network.String(), len(instances))
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, base+next)
+		instances[i].MeshIP = ip.String()
+		used[instances[i].MeshIP] = true
+	}
+	return nil
+}
+
+// applyMeshConfig writes the WireGuard configuration of an instance and (re)starts its interface
+func applyMeshConfig(instance cloud.InstanceInfo, config wireguard.Config) error {
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return err
+	}
+	path := "/etc/wireguard/" + meshInterface + ".conf"
+	_, err = ssh.ExecuteCommand("command -v wg-quick >/dev/null && mkdir -p /etc/wireguard && touch "+path+" && chmod 600 "+path, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to configure WireGuard on instance '%s'. Make sure wireguard-tools is installed", instance.Name)
+	}
+	err = ssh.WriteFile(strings.NewReader(config.String()), path, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to configure WireGuard on instance '%s'", instance.Name)
+	}
+	_, err = ssh.ExecuteCommand(fmt.Sprintf("(wg-quick down %s || true) 2>/dev/null; wg-quick up %s", meshInterface, meshInterface), sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to start WireGuard interface on instance '%s'", instance.Name)
+	}
+	return nil
+}
+
+func meshDown(group string) error {
+	instances, err := fleetInstances(group)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, instance := range instances {
+		if instance.MeshIP == "" {
+			continue
+		}
+		log.Infof("Removing WireGuard configuration from instance '%s'", instance.Name)
+		sshClient, err := instanceSSHClient(instance, 1)
+		if err != nil {
+			return err
+		}
+		_, err = ssh.ExecuteCommand(fmt.Sprintf("(wg-quick down %s || true) 2>/dev/null; rm -f /etc/wireguard/%s.conf", meshInterface, meshInterface), sshClient)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove WireGuard configuration from instance '%s'", instance.Name)
+		}
+		instance.MeshIP = ""
+		err = dbp.SaveInstance(instance)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
+		}
+		removed++
+	}
+	if removed == 0 {
+		return errors.New("No instances in the mesh")
+	}
+	if group != "" {
+		log.Info("The remaining instances still list the removed ones as peers until 'protos mesh up' is run again")
+	}
+	return nil
+}
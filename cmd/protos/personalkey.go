@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+//
+// Personal key methods
+//
+
+// readPersonalKey reads and validates the public key in path, e.g. one backed by a FIDO2 security key, returning it
+// in the authorized_keys format
+func readPersonalKey(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read personal key '%s'", path)
+	}
+	key, err := ssh.ParsePersonalKey(string(data))
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid personal key '%s'", path)
+	}
+	return key, nil
+}
+
+// authorizePersonalKey adds the public key to the authorized keys of the root user of the instance, besides the
+// instance key, and records it on the instance
+func authorizePersonalKey(name string, key string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := connectInstance(instance, 10, false)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Authorizing personal key on instance '%s'", name)
+	quoted := shellQuote(key)
+	cmd := "mkdir -p ~/.ssh && chmod 700 ~/.ssh && (grep -qxF " + quoted + " ~/.ssh/authorized_keys 2>/dev/null || echo " + quoted + " >> ~/.ssh/authorized_keys) && chmod 600 ~/.ssh/authorized_keys"
+	out, err := ssh.ExecuteCommand(cmd, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to authorize personal key on instance '%s': %s", name, strings.TrimSpace(out))
+	}
+
+	for _, existing := range instance.PersonalKeys {
+		if existing == key {
+			return nil
+		}
+	}
+	instance.PersonalKeys = append(instance.PersonalKeys, key)
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	return nil
+}
+
+// sshInstance runs the system ssh client against the instance, authenticating with the keys held by the user's SSH
+// agent, so that keys backed by a security key prompt for a touch. It exits with the status of ssh
+func sshInstance(name string, command []string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if len(instance.PersonalKeys) == 0 {
+		log.Warnf("No personal key is authorized on instance '%s'. Deploy it with '--personal-key', or load the instance key in an agent using: eval $(protos env --agent %s)", name, name)
+	}
+	if os.Getenv("SSH_AUTH_SOCK") == "" {
+		log.Warn("SSH_AUTH_SOCK is not set, so no SSH agent is used")
+	}
+
+	host, port := instance.PublicIP, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	args := []string{"-o", "UserKnownHostsFile=" + knownHosts.Path()}
+	if port != "" {
+		args = append(args, "-p", port)
+	}
+	args = append(args, "root@"+host)
+	if len(command) > 0 {
+		args = append(args, "--")
+		args = append(args, command...)
+	}
+
+	// the database is not needed anymore, and would otherwise be locked for the whole session
+	err = releaseDB()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("ssh", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return cli.Exit("", exitErr.ExitCode())
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to run ssh")
+	}
+	return nil
+}
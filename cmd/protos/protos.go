@@ -1,18 +1,54 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/AlecAivazis/survey/v2/core"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	userconfig "github.com/protosio/cli/internal/config"
 	"github.com/protosio/cli/internal/db"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/protosio/cli/internal/httpclient"
+	"github.com/protosio/cli/internal/job"
+	"github.com/protosio/cli/internal/logfile"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/ssh"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 var log *logrus.Logger
 var dbp db.DB
+var sshPool *ssh.Pool
+var knownHosts *ssh.KnownHosts
 var cloudName string
 var cloudLocation string
 var protosVersion string
+var outputSpec string
+var progressSpec string
+var bandwidthLimit string
+var plainOutput bool
+var caBundle string
+var utcOutput bool
+var logToFile bool
+var logHook *logfile.Hook
+
+const (
+	// exitTimeout is the exit code of commands aborted by --timeout, the same as the timeout command
+	exitTimeout = 124
+	// exitInterrupted is the exit code of commands interrupted while holding the shared database, as set by shells
+	exitInterrupted = 130
+	// timeoutGrace is how long commands aborted by --timeout have to stop once their operations are canceled
+	timeoutGrace = 10 * time.Second
+)
 
 func main() {
 	log = logrus.New()
@@ -28,36 +64,130 @@ func main() {
 				Usage:       "Log level: warn, info, debug",
 				Destination: &loglevel,
 			},
+			&cli.BoolFlag{
+				Name:        "log-file",
+				Usage:       "Also write the logs, with debug detail regardless of --log, to protos.log in the log directory (see 'protos cache ls'). The file is rotated once it reaches the log-max-size setting, 5M by default",
+				EnvVars:     []string{"PROTOS_LOG_FILE"},
+				Destination: &logToFile,
+			},
+			&cli.BoolFlag{
+				Name:        "no-color",
+				Usage:       "Disable colors and table decorations. Also enabled by setting NO_COLOR or using a dumb terminal",
+				Destination: &plainOutput,
+			},
+			&cli.BoolFlag{
+				Name:        "utc",
+				Usage:       "Show timestamps in UTC instead of local time. JSON output always uses RFC3339 timestamps",
+				Destination: &utcOutput,
+			},
+			&cli.StringFlag{
+				Name:        "ca-bundle",
+				Usage:       "Trust the certificates in the PEM `FILE` when connecting to cloud providers and downloading releases, e.g. behind a TLS intercepting proxy. Proxies are configured using HTTP_PROXY, HTTPS_PROXY and NO_PROXY",
+				EnvVars:     []string{"PROTOS_CA_BUNDLE"},
+				Destination: &caBundle,
+			},
 		},
 		Commands: []*cli.Command{
 			cmdInit,
 			cmdRelease,
 			cmdCloud,
 			cmdInstance,
+			cmdImage,
+			cmdVolume,
+			cmdGC,
+			cmdBackup,
+			cmdDB,
+			cmdEnv,
+			cmdExport,
+			cmdFleet,
+			cmdMesh,
+			cmdEvents,
+			cmdTunnel,
+			cmdJob,
+			cmdDemo,
+			cmdAlias,
+			cmdConfig,
+			cmdCache,
+			cmdState,
+			cmdHistory,
+			cmdStatus,
+			cmdServe,
+			cmdFakeEndpoint,
 		},
 	}
 
+	// exit errors are reported by exitWithError once app.After released the database, instead of exiting right away
+	commandFailed := false
+	app.ExitErrHandler = func(c *cli.Context, err error) {
+		if err != nil {
+			commandFailed = true
+		}
+	}
+
 	app.Before = func(c *cli.Context) error {
 		level, err := logrus.ParseLevel(loglevel)
 		if err != nil {
 			return err
 		}
 		log.SetLevel(level)
+		if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			plainOutput = true
+		}
+		if plainOutput {
+			log.SetFormatter(&logrus.TextFormatter{DisableColors: true})
+			core.DisableColor = true
+		}
+		if logToFile {
+			err = startLogFile(level, c.Args().First())
+			if err != nil {
+				return err
+			}
+		}
+		if caBundle != "" {
+			err = httpclient.SetCABundle(caBundle)
+			if err != nil {
+				return err
+			}
+		}
 		config(c.Args().First())
+		if jobID := os.Getenv(jobEnvVar); jobID != "" {
+			return job.Start(jobsDir(), jobID)
+		}
 		return nil
 	}
 
 	app.After = func(c *cli.Context) error {
-		if dbp != nil {
-			return dbp.Close()
+		if commandFailed {
+			discardUndoPoint()
 		}
-		return nil
+		err := releaseDB()
+		if sshPool != nil {
+			poolErr := sshPool.Close()
+			if poolErr != nil {
+				log.Warn(poolErr)
+			}
+		}
+		if logHook != nil {
+			logHook.Close()
+		}
+		return err
 	}
 
-	err := app.Run(os.Args)
+	args, err := expandArgs(app, os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
+	commandArgs = args
+	err = app.Run(args)
+	if jobID := os.Getenv(jobEnvVar); jobID != "" {
+		jobErr := job.Finish(jobsDir(), jobID, err)
+		if jobErr != nil {
+			log.Error(jobErr)
+		}
+	}
+	if err != nil {
+		exitWithError(err)
+	}
 
 }
 
@@ -77,17 +207,279 @@ func transformCredentials(creds map[string]interface{}) map[string]string {
 	return transformed
 }
 
+// outputFlag returns the flag used by read commands to select their output format
+func outputFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "output",
+		Aliases:     []string{"o"},
+		Value:       output.Table,
+		Usage:       "Output `FORMAT`: table, json, template=<Go template>, jsonpath=<expression>. With json, errors are also written to stderr as JSON, with a code, the message and its causes",
+		Destination: &outputSpec,
+	}
+}
+
+// printOutput renders data in the output format requested by the user, or calls printTable for the default table format
+func printOutput(data interface{}, printTable func()) error {
+	format, err := output.Parse(outputSpec)
+	if err != nil {
+		return err
+	}
+	if format.IsTable() {
+		printTable()
+		return nil
+	}
+	return format.Write(os.Stdout, data)
+}
+
+// printTableHeader writes the header row of a table, underlined unless plain output is requested
+func printTableHeader(w io.Writer, columns ...string) {
+	header := " "
+	separator := "\n "
+	for _, column := range columns {
+		header += column + "\t"
+		separator += strings.Repeat("-", len(column)) + "\t"
+	}
+	fmt.Fprint(w, header)
+	if !plainOutput {
+		fmt.Fprint(w, separator)
+	}
+}
+
+// bandwidthLimitFlag returns the flag used by commands that transfer images to limit the transfer rate
+func bandwidthLimitFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "bandwidth-limit",
+		Usage:       "Limit image transfers to `RATE` bytes per second. Supports K, M and G suffixes, e.g. 512K. Unlimited by default",
+		Destination: &bandwidthLimit,
+	}
+}
+
+// timeoutFlag returns the flag used by long running commands to abort them once they take too long
+func timeoutFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  "timeout",
+		Usage: fmt.Sprintf("Abort the command after `DURATION` (e.g. 15m), canceling its cloud API calls and SSH commands, and exit with code %d. No timeout by default", exitTimeout),
+	}
+}
+
+// progressFlag returns the flag used by commands running an operation to report its progress to wrapping tools
+func progressFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:        "progress",
+		Usage:       "Write the progress of the operation to stdout in `FORMAT`. Only json is supported: one JSON object per line when the operation or one of its steps starts, completes, fails or is skipped on resume, with a timestamp",
+		Destination: &progressSpec,
+	}
+}
+
+// timeoutError is returned by commands aborted by --timeout, which exit with exitTimeout
+type timeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e timeoutError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("Timed out after %s", e.timeout)
+	}
+	return fmt.Sprintf("Timed out after %s: %s", e.timeout, e.err.Error())
+}
+
+// Cause returns the error the command failed with once its operations were canceled, if any
+func (e timeoutError) Cause() error {
+	return e.err
+}
+
+// withTimeout runs action, canceling the HTTP requests and SSH connections it uses once the --timeout of the command is
+// exceeded. The action is given timeoutGrace to stop after that, so that it can record how far it got, e.g. the failed
+// step of a deploy. If it doesn't, the command exits right away, without uploading the shared database
+func withTimeout(c *cli.Context, action func() error) error {
+	timeout := c.Duration("timeout")
+	if timeout < 0 {
+		return errors.Errorf("Invalid timeout '%s'", timeout)
+	}
+	if timeout == 0 {
+		return action()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	httpclient.SetContext(ctx)
+	sshPool.SetContext(ctx)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- action()
+	}()
+	var err error
+	select {
+	case err = <-done:
+		if ctx.Err() == nil || err == nil {
+			return err
+		}
+	case <-ctx.Done():
+		log.Warnf("Timed out after %s. Canceling the operations in progress", timeout)
+		select {
+		case err = <-done:
+			if err == nil {
+				// the action completed regardless, e.g. since the canceled operations were optional
+				return nil
+			}
+		case <-time.After(timeoutGrace):
+			// the database can't be released by app.After while the operations still use it
+			log.Warnf("The operations in progress didn't stop within %s", timeoutGrace)
+			abandonDB(timeoutError{timeout: timeout})
+		}
+	}
+	return timeoutError{timeout: timeout, err: err}
+}
+
+// parseSize parses a size like 512K, 10M or 5GB into a number of bytes, using powers of 1024
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := int64(1)
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errors.Errorf("Invalid size '%s'", size)
+	}
+	return value * multiplier, nil
+}
+
+// formatSize formats a number of bytes into a human readable size, using powers of 1024
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value = value / 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// formatTime formats a timestamp for tables and other human readable output, in local time unless --utc is used
+func formatTime(t time.Time) string {
+	return timeIn(t).Format("Jan 2, 2006 15:04")
+}
+
+// formatTimeSeconds is like formatTime, for timestamps that need to be precise to the second
+func formatTimeSeconds(t time.Time) string {
+	return timeIn(t).Format("Jan 2, 2006 15:04:05")
+}
+
+// formatDate formats the date part of a timestamp for human readable output
+func formatDate(t time.Time) string {
+	return timeIn(t).Format("Jan 2, 2006")
+}
+
+func timeIn(t time.Time) time.Time {
+	if utcOutput {
+		return t.UTC()
+	}
+	return t.Local()
+}
+
 func catchSignals(sigs chan os.Signal, quit chan interface{}) {
 	<-sigs
 	quit <- true
 }
 
-func config(currentCmd string) {
+// consoleFormatter hides the entries over the console log level, when the logger level is raised so that the log file
+// gets the debug ones
+type consoleFormatter struct {
+	logrus.Formatter
+	level logrus.Level
+}
+
+func (f consoleFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > f.level {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// startLogFile tees the logs into the log file, including the debug ones, while the console keeps using level. Only the
+// name of the command is logged, since its arguments can contain secrets
+func startLogFile(level logrus.Level, command string) error {
 	var err error
-	if currentCmd != "init" {
-		dbp, err = db.Open("")
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	maxSize, err := parseSize(cfg.LogMaxSize)
+	if err != nil {
+		return errors.Wrap(err, "Invalid log-max-size setting")
+	}
+	logHook, err = logfile.New(dirs.Logs(), "protos.log", maxSize)
+	if err != nil {
+		return err
+	}
+	log.AddHook(logHook)
+	if level < logrus.DebugLevel {
+		log.SetFormatter(consoleFormatter{Formatter: log.Formatter, level: level})
+		log.SetLevel(logrus.DebugLevel)
+	}
+	log.Debugf("Command '%s' started (PID %d)", command, os.Getpid())
+	return nil
+}
+
+// protosDir returns the directory where Protos keeps its local state, like the database, keys and settings. Downloads
+// and logs are kept separately, see the dirs package
+func protosDir() string {
+	return dirs.State()
+}
+
+func config(currentCmd string) {
+	knownHosts = ssh.NewKnownHosts(filepath.Join(protosDir(), "known_hosts"))
+	sshPool = ssh.NewPool(filepath.Join(protosDir(), "ssh"), knownHosts)
+	switch currentCmd {
+	case "init", "db", "job", "demo", "alias", "config", "cache", "tunnel", "state", "serve", cloud.FakeEndpointCommand:
+		// these commands work on their own files, open the db themselves, or run alongside other commands
+	default:
+		err := openDB()
 		if err != nil {
-			log.Fatal(err)
+			exitWithError(err)
+		}
+	}
+}
+
+// openDB opens the database used by the commands, pulling it first if it's shared (see 'protos state'). It's released
+// by releaseDB once the command finishes
+func openDB() error {
+	err := pullState()
+	if err != nil {
+		return err
+	}
+	dbp, err = db.Open("")
+	if err == db.ErrLocked {
+		err = dbLockedError()
+	}
+	if err != nil {
+		if sharedState != nil {
+			sharedState.release()
+			sharedState = nil
 		}
+		return err
 	}
+	return nil
 }
@@ -1,13 +1,28 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/errors"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/protosio/cli/internal/httpclient"
 	"github.com/protosio/cli/internal/release"
 	"github.com/urfave/cli/v2"
 )
@@ -19,17 +34,65 @@ const (
 var cmdRelease *cli.Command = &cli.Command{
 	Name:  "release",
 	Usage: "Lists the latest available Protos releases",
+	Flags: []cli.Flag{
+		outputFlag(),
+	},
 	Action: func(c *cli.Context) error {
 
 		releases, err := getProtosReleases()
 		if err != nil {
 			return err
 		}
-		printProtosReleases(releases)
-		return nil
+		return printOutput(releases, func() { printProtosReleases(releases) })
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:      "fetch",
+			ArgsUsage: "<version>",
+			Usage:     "Download the image of a release, verify its digest and convert it using qemu-img to the format needed by a provider. Converted images are cached, and can be uploaded using 'protos image upload'",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "target",
+					Usage: "Convert the image for `TARGET`: aws (raw, ready to import as an AMI), azure (fixed size VHD), raw or qcow2",
+					Value: "raw",
+				},
+				&cli.BoolFlag{
+					Name:  "force",
+					Usage: "Download and convert the image again, even if it's cached",
+				},
+				timeoutFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				version := c.Args().Get(0)
+				if version == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return withTimeout(c, func() error {
+					return fetchRelease(version, c.String("target"), c.Bool("force"))
+				})
+			},
+		},
 	},
 }
 
+// imageTarget is an image format produced by 'protos release fetch'
+type imageTarget struct {
+	format    string   // qemu-img output format
+	extension string   // extension of the converted file
+	options   []string // qemu-img convert options
+	align     int64    // the virtual size is rounded up to a multiple of align bytes, if set
+}
+
+// imageTargets are the targets supported by 'protos release fetch'. Azure only accepts fixed size VHDs whose size is a
+// whole number of MiB, and AWS imports raw disk images as snapshots to create AMIs from
+var imageTargets = map[string]imageTarget{
+	"aws":   {format: "raw", extension: "raw"},
+	"azure": {format: "vpc", extension: "vhd", options: []string{"-o", "subformat=fixed,force_size"}, align: 1 << 20},
+	"raw":   {format: "raw", extension: "raw"},
+	"qcow2": {format: "qcow2", extension: "qcow2"},
+}
+
 //
 // Releases methods
 //
@@ -40,21 +103,55 @@ func printProtosReleases(releases release.Releases) {
 
 	defer w.Flush()
 
-	fmt.Fprintf(w, " %s\t%s\t%s\t", "Version", "Date", "Description")
-	fmt.Fprintf(w, "\n %s\t%s\t%s\t", "-------", "----", "-----------")
+	printTableHeader(w, "Version", "Date", "Description")
 	for _, release := range releases.Releases {
-		fmt.Fprintf(w, "\n %s\t%s\t%s\t", release.Version, release.ReleaseDate.Format("Jan 2, 2006"), release.Description)
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t", release.Version, formatDate(release.ReleaseDate), release.Description)
 	}
 	fmt.Fprint(w, "\n")
 }
 
 func getProtosReleases() (release.Releases, error) {
 	var releases release.Releases
-	resp, err := http.Get(releasesURL)
+	cfg, err := userconfig.Load(configPath())
 	if err != nil {
-		return releases, errors.Wrapf(err, "Failed to retrieve releases from '%s'", releasesURL)
+		return releases, err
+	}
+	indexURL := releasesURL
+	if cfg.ReleaseIndex != "" {
+		indexURL = cfg.ReleaseIndex
+	}
+
+	releases, err = fetchReleaseIndex(indexURL)
+	if err != nil {
+		cached, cacheErr := loadCachedReleaseIndex(indexURL)
+		if cacheErr != nil {
+			return releases, err
+		}
+		log.Warnf("%s. Using the release index cached on %s", err.Error(), formatTime(cached.Time))
+		releases = cached.Releases
+	} else {
+		cacheReleaseIndex(indexURL, releases)
+	}
+
+	if cfg.ImageMirror != "" {
+		err = releases.UseImageMirror(cfg.ImageMirror)
+		if err != nil {
+			return releases, err
+		}
+	}
+	return releases, nil
+}
+
+func fetchReleaseIndex(indexURL string) (release.Releases, error) {
+	var releases release.Releases
+	resp, err := httpclient.New(30 * time.Second).Get(indexURL)
+	if err != nil {
+		return releases, errors.Wrapf(err, "Failed to retrieve releases from '%s'", indexURL)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return releases, errors.Errorf("Failed to retrieve releases from '%s': %s", indexURL, resp.Status)
+	}
 
 	err = json.NewDecoder(resp.Body).Decode(&releases)
 	if err != nil {
@@ -62,8 +159,228 @@ func getProtosReleases() (release.Releases, error) {
 	}
 
 	if len(releases.Releases) == 0 {
-		return releases, errors.Errorf("Something went wrong. Parsed 0 releases from '%s'", releasesURL)
+		return releases, errors.Errorf("Something went wrong. Parsed 0 releases from '%s'", indexURL)
 	}
-
 	return releases, nil
 }
+
+// releaseImagesDir returns the directory caching the images of a release, downloaded and converted by
+// 'protos release fetch'
+func releaseImagesDir(version string) string {
+	return filepath.Join(dirs.Cache(), "images", version)
+}
+
+// fetchRelease downloads the image of a release and converts it for target. The downloaded image is verified against
+// the digest of the release index every time it's used, and the converted one is only reused if its digest file was
+// written, which happens once the conversion succeeded
+func fetchRelease(version string, targetName string, force bool) error {
+	target, found := imageTargets[targetName]
+	if !found {
+		names := []string{}
+		for name := range imageTargets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return errors.Errorf("Target '%s' not supported. Supported targets: %s", targetName, strings.Join(names, ", "))
+	}
+	qemuImg, err := exec.LookPath("qemu-img")
+	if err != nil {
+		return errors.New("qemu-img is required to convert images. Install it, e.g. using 'apt install qemu-utils' or 'brew install qemu'")
+	}
+	releases, err := getProtosReleases()
+	if err != nil {
+		return err
+	}
+	rls, err := releases.GetVersion(version)
+	if err != nil {
+		return err
+	}
+	provider, source, err := releaseSourceImage(rls)
+	if err != nil {
+		return err
+	}
+
+	dir := releaseImagesDir(rls.Version)
+	err = os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", dir)
+	}
+	output := filepath.Join(dir, fmt.Sprintf("protos-%s-%s.%s", rls.Version, targetName, target.extension))
+	if !force {
+		if digest, err := ioutil.ReadFile(output + ".sha256"); err == nil {
+			if _, err := os.Stat(output); err == nil {
+				log.Infof("Using the cached %s image of release %s", targetName, rls.Version)
+				// the modification time marks when the image was last used, for 'protos cache prune'
+				now := time.Now()
+				os.Chtimes(output, now, now)
+				printFetchedImage(output, strings.TrimSpace(string(digest)))
+				return nil
+			}
+		}
+	}
+
+	u, err := url.Parse(source.URL)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to parse image URL '%s'", source.URL)
+	}
+	sourcePath := filepath.Join(dir, fmt.Sprintf("protos-%s-%s%s", rls.Version, provider, path.Ext(u.Path)))
+	err = fetchImage(source, sourcePath, force)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Converting the image of release %s for %s", rls.Version, targetName)
+	os.Remove(output + ".sha256")
+	err = convertImage(qemuImg, sourcePath, output, target)
+	if err != nil {
+		return err
+	}
+	digest, err := fileDigest(output)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(output+".sha256", []byte(digest+"\n"), os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write the digest of '%s'", output)
+	}
+	enforceCacheLimit(dir)
+	printFetchedImage(output, digest)
+	return nil
+}
+
+// releaseSourceImage returns the image of a release used as source for conversions: the raw one if the release index
+// lists it, otherwise the first provider image, since qemu-img detects the format of its input
+func releaseSourceImage(rls release.Release) (string, release.CloudImage, error) {
+	if image, found := rls.CloudImages["raw"]; found {
+		return "raw", image, nil
+	}
+	providers := []string{}
+	for provider := range rls.CloudImages {
+		providers = append(providers, provider)
+	}
+	if len(providers) == 0 {
+		return "", release.CloudImage{}, errors.Errorf("Release %s doesn't include any image", rls.Version)
+	}
+	sort.Strings(providers)
+	return providers[0], rls.CloudImages[providers[0]], nil
+}
+
+// fetchImage downloads an image to dst, unless a copy matching its digest is already there. The image is written to a
+// temporary file and verified before being moved to dst, so dst never holds a partial or corrupted image
+func fetchImage(image release.CloudImage, dst string, force bool) error {
+	if image.Digest == "" {
+		return errors.Errorf("The release index has no digest for image '%s', so it can't be verified", image.URL)
+	}
+	if !force {
+		if _, err := os.Stat(dst); err == nil {
+			log.Infof("Verifying the cached image '%s'", dst)
+			digest, err := fileDigest(dst)
+			if err != nil {
+				return err
+			}
+			if digest == image.Digest {
+				return nil
+			}
+			log.Warnf("Cached image '%s' doesn't match the digest of the release index. Downloading it again", dst)
+		}
+	}
+
+	log.Infof("Downloading Protos image from '%s'", image.URL)
+	resp, err := httpclient.New(0).Get(image.URL)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to download Protos image from '%s'", image.URL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("Failed to download Protos image from '%s': %s", image.URL, resp.Status)
+	}
+	f, err := os.OpenFile(dst+".part", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create file '%s'", dst+".part")
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), resp.Body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst + ".part")
+		return errors.Wrapf(err, "Failed to download Protos image from '%s'", image.URL)
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	if digest != image.Digest {
+		os.Remove(dst + ".part")
+		return errors.Errorf("Downloaded image '%s' has digest '%s' instead of '%s' listed in the release index", image.URL, digest, image.Digest)
+	}
+	return os.Rename(dst+".part", dst)
+}
+
+// convertImage converts src to the format of target. Images whose size has to be aligned are converted to raw first,
+// since raw images can be resized in place
+func convertImage(qemuImg string, src string, dst string, target imageTarget) error {
+	tmp := dst + ".part"
+	defer os.Remove(tmp)
+	input, inputFormat := src, ""
+	if target.align > 0 {
+		raw := dst + ".raw.part"
+		defer os.Remove(raw)
+		err := runQemuImg(qemuImg, "convert", "-O", "raw", src, raw)
+		if err != nil {
+			return err
+		}
+		size, err := imageVirtualSize(qemuImg, raw)
+		if err != nil {
+			return err
+		}
+		if aligned := (size + target.align - 1) / target.align * target.align; aligned != size {
+			log.Debugf("Resizing image from %d to %d bytes", size, aligned)
+			err = runQemuImg(qemuImg, "resize", "-f", "raw", raw, strconv.FormatInt(aligned, 10))
+			if err != nil {
+				return err
+			}
+		}
+		input, inputFormat = raw, "raw"
+	}
+	args := []string{"convert"}
+	if inputFormat != "" {
+		args = append(args, "-f", inputFormat)
+	}
+	args = append(args, "-O", target.format)
+	args = append(args, target.options...)
+	err := runQemuImg(qemuImg, append(args, input, tmp)...)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+func runQemuImg(qemuImg string, args ...string) error {
+	log.Debugf("Running qemu-img %s", strings.Join(args, " "))
+	out, err := exec.Command(qemuImg, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to run 'qemu-img %s': %s", args[0], strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// imageVirtualSize returns the size of the disk held by an image, as reported by qemu-img
+func imageVirtualSize(qemuImg string, image string) (int64, error) {
+	out, err := exec.Command(qemuImg, "info", "--output=json", image).Output()
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to inspect image '%s'", image)
+	}
+	info := struct {
+		VirtualSize int64 `json:"virtual-size"`
+	}{}
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse the details of image '%s'", image)
+	}
+	return info.VirtualSize, nil
+}
+
+func printFetchedImage(image string, digest string) {
+	fmt.Printf("Image: %s\n", image)
+	fmt.Printf("SHA256: %s\n", digest)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/db"
+	"github.com/urfave/cli/v2"
+)
+
+// revisionTimeLayouts are the layouts accepted for times given to 'protos instance history --diff', in local time
+var revisionTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04", "2006-01-02"}
+
+var cmdInstanceHistory *cli.Command = &cli.Command{
+	Name:      "history",
+	ArgsUsage: "<name>",
+	Usage:     "Show how the details of an instance changed over time, like its IP, version, volumes and status. Deleted instances are included",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "diff",
+			Usage: "Show the differences between two points, given as `FROM[..TO]`. Points are revision numbers or times (e.g. 2026-01-31 or \"2026-01-31 18:00\"), which select the last revision at that time. TO defaults to the last revision",
+		},
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		name := c.Args().Get(0)
+		if name == "" {
+			cli.ShowSubcommandHelp(c)
+			return cli.Exit("", 1)
+		}
+		// deleted instances can't be resolved, so the name is only resolved if it's not an exact match
+		if _, err := dbp.GetInstance(name); err != nil {
+			if resolved, err := resolveInstanceName(name); err == nil {
+				name = resolved
+			}
+		}
+		if c.IsSet("diff") {
+			return diffInstanceRevisions(name, c.String("diff"))
+		}
+		return listInstanceRevisions(name)
+	},
+}
+
+// instanceRevision is a revision of an instance, along with the changes since the previous one
+type instanceRevision struct {
+	Revision int
+	Time     time.Time
+	Deleted  bool
+	Changes  []string
+	Record   cloud.InstanceInfo
+}
+
+type instanceRevisionDiff struct {
+	Instance string
+	From     int
+	To       int
+	Changes  []string
+}
+
+//
+// Instance history methods
+//
+
+func instanceRevisions(name string) ([]db.InstanceRevision, error) {
+	revisions, err := dbp.GetInstanceRevisions(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve the history of instance '%s'", name)
+	}
+	if len(revisions) == 0 {
+		return nil, errors.Errorf("No history recorded for instance '%s'. It's recorded from the first change of the instance", name)
+	}
+	return revisions, nil
+}
+
+func listInstanceRevisions(name string) error {
+	revisions, err := instanceRevisions(name)
+	if err != nil {
+		return err
+	}
+	list := []instanceRevision{}
+	for i, revision := range revisions {
+		changes := []string{}
+		switch {
+		case revision.Deleted:
+			changes = []string{"deleted"}
+		case i == 0 || revisions[i-1].Deleted:
+			changes = []string{"created"}
+		default:
+			changes = diffInstanceRecords(revisions[i-1].Record, revision.Record)
+			if len(changes) == 0 {
+				changes = []string{"details updated"}
+			}
+		}
+		list = append(list, instanceRevision{Revision: revision.ID, Time: revision.Time, Deleted: revision.Deleted, Changes: changes, Record: revision.Record})
+	}
+
+	return printOutput(list, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "Revision", "Time", "IP", "Version", "Status", "Changes")
+		for _, revision := range list {
+			fmt.Fprintf(w, "\n %d\t%s\t%s\t%s\t%s\t%s\t", revision.Revision, formatTimeSeconds(revision.Time), revision.Record.PublicIP, revision.Record.Version, revision.Record.Status, strings.Join(revision.Changes, ", "))
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		fmt.Printf("\nCompare two revisions using: protos instance history --diff <from>..<to> %s\n", name)
+	})
+}
+
+func diffInstanceRevisions(name string, spec string) error {
+	revisions, err := instanceRevisions(name)
+	if err != nil {
+		return err
+	}
+	fromSpec, toSpec := spec, ""
+	if i := strings.Index(spec, ".."); i >= 0 {
+		fromSpec, toSpec = spec[:i], spec[i+2:]
+	}
+	from, err := findRevision(revisions, fromSpec)
+	if err != nil {
+		return err
+	}
+	to := revisions[len(revisions)-1]
+	if toSpec != "" {
+		to, err = findRevision(revisions, toSpec)
+		if err != nil {
+			return err
+		}
+	}
+
+	diff := instanceRevisionDiff{Instance: name, From: from.ID, To: to.ID, Changes: diffInstanceRecords(from.Record, to.Record)}
+	if from.Deleted != to.Deleted {
+		if to.Deleted {
+			diff.Changes = append(diff.Changes, "deleted")
+		} else {
+			diff.Changes = append(diff.Changes, "recreated")
+		}
+	}
+	return printOutput(diff, func() {
+		fmt.Printf("Instance '%s', from revision %d (%s) to revision %d (%s)\n", name, from.ID, formatTimeSeconds(from.Time), to.ID, formatTimeSeconds(to.Time))
+		if len(diff.Changes) == 0 {
+			fmt.Println("No changes")
+			return
+		}
+		for _, change := range diff.Changes {
+			fmt.Printf("  %s\n", change)
+		}
+	})
+}
+
+// findRevision returns the revision with the given number, or the last one at the given time
+func findRevision(revisions []db.InstanceRevision, spec string) (db.InstanceRevision, error) {
+	if id, err := strconv.Atoi(spec); err == nil {
+		for _, revision := range revisions {
+			if revision.ID == id {
+				return revision, nil
+			}
+		}
+		return db.InstanceRevision{}, errors.Errorf("Revision %d not found. List the revisions by running the command without --diff", id)
+	}
+	t, err := parseRevisionTime(spec)
+	if err != nil {
+		return db.InstanceRevision{}, err
+	}
+	i := sort.Search(len(revisions), func(i int) bool { return revisions[i].Time.After(t) })
+	if i == 0 {
+		return db.InstanceRevision{}, errors.Errorf("No revision recorded at %s, the first one is from %s", formatTimeSeconds(t), formatTimeSeconds(revisions[0].Time))
+	}
+	return revisions[i-1], nil
+}
+
+func parseRevisionTime(value string) (time.Time, error) {
+	for _, layout := range revisionTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			if layout == "2006-01-02" {
+				// a day selects the state at its end
+				t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+			}
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("Invalid revision '%s'. Use a revision number or a time like 2026-01-31 or \"2026-01-31 18:00\"", value)
+}
+
+// diffInstanceRecords returns a human readable list of the differences between two records of an instance. It extends
+// diffInstance, which only compares the details reported by providers
+func diffInstanceRecords(old cloud.InstanceInfo, new cloud.InstanceInfo) []string {
+	changes := diffInstance(old, new)
+	changed := func(field string, from string, to string) {
+		if from == to {
+			return
+		}
+		if from == "" {
+			from = "none"
+		}
+		if to == "" {
+			to = "none"
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", field, from, to))
+	}
+	changed("Version", old.Version, new.Version)
+	changed("Pinned version", old.PinnedVersion, new.PinnedVersion)
+	changed("Cloud", old.CloudName, new.CloudName)
+	changed("VM ID", old.VMID, new.VMID)
+	changed("Image", imageID(old.Image), imageID(new.Image))
+	changed("Location", old.Location, new.Location)
+	changed("Mesh IP", old.MeshIP, new.MeshIP)
+	changed("Groups", strings.Join(old.Groups, ","), strings.Join(new.Groups, ","))
+	changed("Tags", strings.Join(old.Tags, ","), strings.Join(new.Tags, ","))
+	changed("Notes", old.Notes, new.Notes)
+	changed("Expires", formatRevisionTime(old.ExpiresAt), formatRevisionTime(new.ExpiresAt))
+	if !new.BootTime.IsZero() && !new.BootTime.Equal(old.BootTime) {
+		if old.BootTime.IsZero() {
+			changes = append(changes, fmt.Sprintf("booted at %s", formatTimeSeconds(new.BootTime)))
+		} else {
+			changes = append(changes, fmt.Sprintf("rebooted at %s", formatTimeSeconds(new.BootTime)))
+		}
+	}
+	if old.MachineID != new.MachineID {
+		changes = append(changes, "machine ID changed")
+	}
+	if !reflect.DeepEqual(old.Settings, new.Settings) {
+		changes = append(changes, "settings changed")
+	}
+	if !reflect.DeepEqual(old.PersonalKeys, new.PersonalKeys) {
+		changes = append(changes, fmt.Sprintf("personal keys: %d -> %d", len(old.PersonalKeys), len(new.PersonalKeys)))
+	}
+	if !reflect.DeepEqual(old.BackupPolicy, new.BackupPolicy) {
+		changes = append(changes, "backup policy changed")
+	}
+	if old.UseSSHConfig != new.UseSSHConfig || old.TunnelPort != new.TunnelPort {
+		changes = append(changes, "connection settings changed")
+	}
+	return changes
+}
+
+func imageID(image *cloud.ImageProvenance) string {
+	if image == nil {
+		return ""
+	}
+	return image.ID
+}
+
+func formatRevisionTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return formatTime(t)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/control"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
+)
+
+var serveSocket string
+
+var cmdServe *cli.Command = &cli.Command{
+	Name:  "serve",
+	Usage: "Serve a local gRPC API on a unix socket, used by editor extensions and GUIs to list and deploy instances and manage tunnels",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:        "socket",
+			Usage:       "Listen on the unix socket at `PATH` (default: control.sock in the state directory, see 'protos cache ls')",
+			Destination: &serveSocket,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		if serveSocket == "" {
+			serveSocket = controlSocketPath()
+		}
+		return serve(serveSocket)
+	},
+}
+
+// controlServer implements the control API. Requests are served one at a time, and the database is only opened while
+// serving one, so that other commands can be used meanwhile
+type controlServer struct {
+	mu      sync.Mutex
+	tunnels map[string]*runningTunnel
+}
+
+type runningTunnel struct {
+	control.Tunnel
+	tunnel *ssh.Tunnel
+}
+
+//
+// Serve methods
+//
+
+// controlSocketPath returns the default control socket
+func controlSocketPath() string {
+	return filepath.Join(protosDir(), "control.sock")
+}
+
+func serve(socketPath string) error {
+	err := os.MkdirAll(filepath.Dir(socketPath), os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create directory for control socket '%s'", socketPath)
+	}
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		return errors.Errorf("Control socket '%s' is already served by another process", socketPath)
+	}
+	// a socket left behind by a server that didn't terminate cleanly
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove stale control socket '%s'", socketPath)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen on control socket '%s'", socketPath)
+	}
+	defer os.Remove(socketPath)
+	err = os.Chmod(socketPath, os.FileMode(0600))
+	if err != nil {
+		listener.Close()
+		return errors.Wrapf(err, "Failed to restrict access to control socket '%s'", socketPath)
+	}
+
+	srv := &controlServer{tunnels: map[string]*runningTunnel{}}
+	grpcServer := grpc.NewServer()
+	control.RegisterServer(grpcServer, srv)
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+	go func() {
+		<-quit
+		log.Info("Stopping the control server")
+		grpcServer.GracefulStop()
+	}()
+
+	log.Infof("Serving the control API on '%s'. Press CTRL+C to stop", socketPath)
+	err = grpcServer.Serve(listener)
+	srv.stopTunnels()
+	if err != nil {
+		return errors.Wrap(err, "Control server failed")
+	}
+	return nil
+}
+
+// withDB runs fn with the database open, releasing it afterwards
+func (s *controlServer) withDB(fn func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := openDB()
+	if err != nil {
+		return err
+	}
+	err = fn()
+	releaseErr := releaseDB()
+	if releaseErr != nil {
+		log.Warnf("Failed to release the database: %s", releaseErr.Error())
+	}
+	return err
+}
+
+func (s *controlServer) ListInstances(ctx context.Context, req *control.ListInstancesRequest) (*control.ListInstancesResponse, error) {
+	resp := &control.ListInstancesResponse{}
+	err := s.withDB(func() error {
+		instances, err := dbp.GetAllInstances()
+		if err != nil {
+			return err
+		}
+		for i := range instances {
+			instances[i].KeySeed = nil
+		}
+		resp.Instances = instances
+		return nil
+	})
+	return resp, err
+}
+
+func (s *controlServer) Deploy(ctx context.Context, req *control.DeployRequest) (*control.DeployResponse, error) {
+	if req.Name == "" || req.Cloud == "" || req.Location == "" {
+		return nil, errors.New("Name, cloud and location are required to deploy an instance")
+	}
+	resp := &control.DeployResponse{}
+	err := s.withDB(func() error {
+		err := authorizeChange()
+		if err != nil {
+			return err
+		}
+		// like the deploys started by the CLI, it can be undone with 'db undo' and shows up in the history
+		snapshot, err := dbp.Snapshot()
+		if err != nil {
+			return err
+		}
+		log.Debugf("Database snapshot saved to '%s'", snapshot)
+		err = saveHistory("serve deploy " + req.Name)
+		if err != nil {
+			return err
+		}
+		release, err := deployRelease(req.Version)
+		if err != nil {
+			return err
+		}
+		log.Infof("Deploying instance '%s' for control client", req.Name)
+		instance, err := deployInstance(req.Name, req.Cloud, req.Location, release, deployOptions{})
+		if err != nil {
+			return err
+		}
+		instance.KeySeed = nil
+		resp.Instance = instance
+		return nil
+	})
+	return resp, err
+}
+
+func (s *controlServer) StartTunnel(ctx context.Context, req *control.StartTunnelRequest) (*control.StartTunnelResponse, error) {
+	resp := &control.StartTunnelResponse{}
+	err := s.withDB(func() error {
+		name, err := resolveInstanceName(req.Instance)
+		if err != nil {
+			return err
+		}
+		if _, found := s.tunnels[name]; found {
+			return errors.Errorf("A tunnel to instance '%s' is already running", name)
+		}
+		instance, err := dbp.GetInstance(name)
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+		}
+		localPort := req.Port
+		if localPort == 0 {
+			localPort, err = allocateTunnelPort(&instance)
+			if err != nil {
+				return err
+			}
+		}
+
+		sshClient, err := connectInstance(instance, 1, false)
+		if err != nil {
+			return errors.Wrap(err, "Error while creating the SSH tunnel")
+		}
+		target := instanceAPIAddress
+		tunnel := ssh.NewTunnelFromConnection(sshClient, target, log)
+		tunnel.SetLocalPort(localPort)
+		localPort, err = tunnel.Start()
+		if err != nil {
+			return errors.Wrap(err, "Error while creating the SSH tunnel")
+		}
+
+		instance.LastSeen = time.Now()
+		err = dbp.SaveInstance(instance)
+		if err != nil {
+			log.Warnf("Failed to record last contact for instance '%s': %s", name, err.Error())
+		}
+		err = recordTunnel(tunnelRecord{Instance: name, LocalPort: localPort, Target: target, PID: os.Getpid(), Started: time.Now()})
+		if err != nil {
+			log.Warn(err.Error())
+		}
+		running := &runningTunnel{Tunnel: control.Tunnel{Instance: name, LocalPort: localPort, Target: target}, tunnel: tunnel}
+		s.tunnels[name] = running
+		log.Infof("SSH tunnel to instance '%s' ready on port %d", name, localPort)
+		resp.Tunnel = running.Tunnel
+		return nil
+	})
+	return resp, err
+}
+
+func (s *controlServer) StopTunnel(ctx context.Context, req *control.StopTunnelRequest) (*control.StopTunnelResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	running, found := s.tunnels[req.Instance]
+	if !found {
+		return nil, errors.Errorf("No tunnel to instance '%s' is run by this server", req.Instance)
+	}
+	delete(s.tunnels, req.Instance)
+	removeTunnelRecord(req.Instance)
+	err := running.tunnel.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while terminating the SSH tunnel")
+	}
+	log.Infof("SSH tunnel to instance '%s' terminated", req.Instance)
+	return &control.StopTunnelResponse{}, nil
+}
+
+func (s *controlServer) ListTunnels(ctx context.Context, req *control.ListTunnelsRequest) (*control.ListTunnelsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &control.ListTunnelsResponse{Tunnels: []control.Tunnel{}}
+	for _, running := range s.tunnels {
+		resp.Tunnels = append(resp.Tunnels, running.Tunnel)
+	}
+	sort.Slice(resp.Tunnels, func(i, j int) bool { return resp.Tunnels[i].Instance < resp.Tunnels[j].Instance })
+	return resp, nil
+}
+
+// stopTunnels terminates the tunnels still running when the server stops
+func (s *controlServer) stopTunnels() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, running := range s.tunnels {
+		removeTunnelRecord(name)
+		err := running.tunnel.Close()
+		if err != nil {
+			log.Warnf("Failed to terminate the SSH tunnel to instance '%s': %s", name, err.Error())
+		}
+	}
+	s.tunnels = map[string]*runningTunnel{}
+}
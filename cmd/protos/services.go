@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	// instanceAPIAddress is where the Protos daemon serves its API and dashboard, on the instance
+	instanceAPIAddress = "localhost:8080"
+	// instanceAppsPath is the API endpoint listing the apps installed on an instance
+	instanceAppsPath = "/api/v1/e/apps"
+	// instanceAPITimeout bounds the requests sent to the API of an instance
+	instanceAPITimeout = 30 * time.Second
+)
+
+var cmdInstanceServices *cli.Command = &cli.Command{
+	Name:      "services",
+	ArgsUsage: "<name>",
+	Usage:     "List the apps running on an instance and the ports of their services, as reported by the Protos daemon. Using --tunnel, a tunnel to one of them is created instead",
+	Flags: []cli.Flag{
+		outputFlag(),
+		&cli.StringFlag{
+			Name:  "tunnel",
+			Usage: "Create an SSH tunnel to the service of `APP[:PORT]` from the list. The port can be omitted for apps with a single TCP port",
+		},
+		&cli.IntFlag{
+			Name:        "port",
+			Usage:       "With --tunnel, local `PORT` to access the service on. By default, the port allocated to the instance is used (see 'protos tunnel ls')",
+			Destination: &tunnelPort,
+		},
+	},
+	Action: func(c *cli.Context) error {
+		name, err := instanceNameArg(c)
+		if err != nil {
+			return err
+		}
+		if c.String("tunnel") == "" {
+			if c.IsSet("port") {
+				return errors.New("--port requires --tunnel")
+			}
+			return listInstanceServices(name)
+		}
+		return tunnelInstanceService(name, c.String("tunnel"), tunnelPort)
+	},
+}
+
+// instanceApp is an app installed on an instance, as listed by the Protos daemon
+type instanceApp struct {
+	ID          string
+	Name        string
+	Status      string
+	IP          string // address of the app in the private network of the instance, empty if not running
+	PublicPorts []instancePort
+}
+
+type instancePort struct {
+	Nr   int
+	Type string // tcp or udp
+}
+
+// instanceService is a port served by an app of an instance, one of the rows of 'protos instance services'
+type instanceService struct {
+	App      string
+	Status   string
+	Port     int
+	Protocol string
+	Target   string // address of the service, as reached from the instance
+}
+
+//
+// Service methods
+//
+
+// getInstanceApps retrieves the apps of an instance from the Protos daemon, through an SSH connection
+func getInstanceApps(name string) ([]instanceApp, error) {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				return sshClient.Dial("tcp", instanceAPIAddress)
+			},
+		},
+		Timeout: instanceAPITimeout,
+	}
+	resp, err := client.Get("http://" + instanceAPIAddress + instanceAppsPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to query the Protos daemon of instance '%s'", name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Failed to query the Protos daemon of instance '%s': %s", name, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to query the Protos daemon of instance '%s'", name)
+	}
+
+	// apps are returned by ID
+	byID := map[string]instanceApp{}
+	err = json.Unmarshal(data, &byID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to decode the apps of instance '%s'", name)
+	}
+	apps := []instanceApp{}
+	for id, app := range byID {
+		if app.ID == "" {
+			app.ID = id
+		}
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	return apps, nil
+}
+
+// appServices returns the services of the apps, by app and port
+func appServices(apps []instanceApp) []instanceService {
+	services := []instanceService{}
+	for _, app := range apps {
+		host := app.IP
+		if host == "" {
+			host = "localhost"
+		}
+		ports := app.PublicPorts
+		sort.Slice(ports, func(i, j int) bool { return ports[i].Nr < ports[j].Nr })
+		for _, port := range ports {
+			protocol := strings.ToLower(port.Type)
+			if protocol == "" {
+				protocol = "tcp"
+			}
+			services = append(services, instanceService{
+				App:      app.Name,
+				Status:   app.Status,
+				Port:     port.Nr,
+				Protocol: protocol,
+				Target:   net.JoinHostPort(host, strconv.Itoa(port.Nr)),
+			})
+		}
+	}
+	return services
+}
+
+func listInstanceServices(name string) error {
+	apps, err := getInstanceApps(name)
+	if err != nil {
+		return err
+	}
+	services := appServices(apps)
+
+	return printOutput(services, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		printTableHeader(w, "App", "Status", "Port", "Protocol", "Target")
+		for _, service := range services {
+			fmt.Fprintf(w, "\n %s\t%s\t%d\t%s\t%s\t", service.App, service.Status, service.Port, service.Protocol, service.Target)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		for _, app := range apps {
+			if len(app.PublicPorts) == 0 {
+				fmt.Printf("App '%s' (%s) doesn't expose any port\n", app.Name, app.Status)
+			}
+		}
+	})
+}
+
+// tunnelInstanceService creates a tunnel to the service of an app, selected as APP[:PORT]
+func tunnelInstanceService(name string, selector string, localPort int) error {
+	appName, portSpec := selector, ""
+	if i := strings.LastIndex(selector, ":"); i >= 0 {
+		appName, portSpec = selector[:i], selector[i+1:]
+	}
+	port := 0
+	if portSpec != "" {
+		var err error
+		port, err = strconv.Atoi(portSpec)
+		if err != nil || port <= 0 {
+			return errors.Errorf("Invalid port '%s'. Use APP or APP:PORT", portSpec)
+		}
+	}
+
+	apps, err := getInstanceApps(name)
+	if err != nil {
+		return err
+	}
+	appFound := false
+	for _, app := range apps {
+		if app.Name == appName {
+			appFound = true
+		}
+	}
+	matching := []instanceService{}
+	for _, service := range appServices(apps) {
+		if service.App == appName && service.Protocol == "tcp" && (port == 0 || service.Port == port) {
+			matching = append(matching, service)
+		}
+	}
+	if !appFound {
+		return notFoundError(fmt.Sprintf("App '%s' not found on instance '%s'. Use 'protos instance services %s' to list them", appName, name, name))
+	}
+	switch {
+	case len(matching) == 0 && port != 0:
+		return notFoundError(fmt.Sprintf("App '%s' doesn't serve TCP port %d", appName, port))
+	case len(matching) == 0:
+		return errors.Errorf("App '%s' doesn't serve any TCP port. Only TCP services can be tunneled", appName)
+	case len(matching) > 1:
+		ports := []string{}
+		for _, service := range matching {
+			ports = append(ports, strconv.Itoa(service.Port))
+		}
+		return errors.Errorf("App '%s' serves several TCP ports (%s). Select one using --tunnel %s:PORT", appName, strings.Join(ports, ", "), appName)
+	}
+
+	service := matching[0]
+	if service.Status != "" && service.Status != "running" {
+		log.Warnf("App '%s' is %s, so its service might not answer", service.App, service.Status)
+	}
+	return tunnelInstance(name, localPort, tunnelOptions{target: service.Target, description: fmt.Sprintf("app '%s'", service.App)})
+}
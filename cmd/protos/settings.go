@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+// instanceSettingsFile is the environment file read by the Protos daemon on startup
+const instanceSettingsFile = "/opt/protos/protos.env"
+
+var cmdInstanceConfig *cli.Command = &cli.Command{
+	Name:  "config",
+	Usage: "Manage the settings of the Protos daemon running on an instance",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "set",
+			ArgsUsage: "<name> [key=value...]",
+			Usage:     "Set daemon settings and push them to the instance, restarting the daemon. Omit the settings to push the recorded ones again",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				settings, err := parseSettings(c.Args().Tail())
+				if err != nil {
+					return err
+				}
+				return setInstanceSettings(name, settings, nil)
+			},
+		},
+		{
+			Name:      "unset",
+			ArgsUsage: "<name> <key...>",
+			Usage:     "Remove daemon settings from the instance, restarting the daemon",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" || c.NArg() < 2 {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return setInstanceSettings(name, nil, c.Args().Tail())
+			},
+		},
+		{
+			Name:      "show",
+			ArgsUsage: "<name>",
+			Usage:     "Compare the settings recorded locally with the ones found on the instance",
+			Flags:     []cli.Flag{outputFlag()},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return showInstanceSettings(name)
+			},
+		},
+	},
+}
+
+var settingKeyRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// settingStatus is a daemon setting as recorded locally and as found on the instance
+type settingStatus struct {
+	Key      string
+	Applied  string // value recorded by the last push
+	Instance string // value found on the instance
+	Status   string
+}
+
+//
+// Instance config methods
+//
+
+// parseSettings parses key=value arguments. Values can't span several lines, as they are written to an environment file
+func parseSettings(args []string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid setting '%s'. Settings should be provided as key=value", arg)
+		}
+		err := validateSettingKey(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(parts[1], "\n\r") {
+			return nil, errors.Errorf("Invalid value for setting '%s': values can't contain newlines", parts[0])
+		}
+		settings[parts[0]] = parts[1]
+	}
+	return settings, nil
+}
+
+func validateSettingKey(key string) error {
+	if !settingKeyRegexp.MatchString(key) {
+		return errors.Errorf("Invalid setting key '%s'. Keys can contain only letters, digits and underscores, and can't start with a digit", key)
+	}
+	return nil
+}
+
+// setInstanceSettings updates the recorded settings of an instance and pushes all of them to it. The settings are
+// recorded only after a successful push, so that they always reflect what was applied
+func setInstanceSettings(name string, set map[string]string, unset []string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	settings := map[string]string{}
+	for key, value := range instance.Settings {
+		settings[key] = value
+	}
+	for key, value := range set {
+		settings[key] = value
+	}
+	for _, key := range unset {
+		err := validateSettingKey(key)
+		if err != nil {
+			return err
+		}
+		if _, found := settings[key]; !found {
+			log.Warnf("Setting '%s' is not set on instance '%s'", key, name)
+		}
+		delete(settings, key)
+	}
+
+	log.Infof("Pushing %d setting(s) to instance '%s'", len(settings), name)
+	err = pushSettings(instance, settings)
+	if err != nil {
+		return err
+	}
+	instance.Settings = settings
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Settings of instance '%s' applied", name)
+	return nil
+}
+
+// pushSettings replaces the settings file on the instance and restarts the Protos daemon, if it's running as a service
+func pushSettings(instance cloud.InstanceInfo, settings map[string]string) error {
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return err
+	}
+	dir := instanceSettingsFile[:strings.LastIndex(instanceSettingsFile, "/")]
+	_, err = ssh.ExecuteCommand("mkdir -p "+dir, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push settings to instance '%s'", instance.Name)
+	}
+	err = ssh.WriteFile(strings.NewReader(formatSettings(settings)), instanceSettingsFile+".tmp", sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push settings to instance '%s'", instance.Name)
+	}
+	_, err = ssh.ExecuteCommand(fmt.Sprintf("chmod 600 %s.tmp && mv %s.tmp %s", instanceSettingsFile, instanceSettingsFile, instanceSettingsFile), sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push settings to instance '%s'", instance.Name)
+	}
+	_, err = ssh.ExecuteCommand("(systemctl try-restart protos || true) 2>/dev/null", sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to restart the Protos daemon on instance '%s'", instance.Name)
+	}
+	return nil
+}
+
+// formatSettings renders the settings as an environment file, sorted by key
+func formatSettings(settings map[string]string) string {
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	sb.WriteString("# Managed by 'protos instance config'. Manual changes are reported as drift\n")
+	for _, key := range keys {
+		sb.WriteString(key + "=" + settings[key] + "\n")
+	}
+	return sb.String()
+}
+
+// readInstanceSettings reads the settings file found on the instance. A missing file means no settings
+func readInstanceSettings(instance cloud.InstanceInfo) (map[string]string, error) {
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ssh.ExecuteCommand(fmt.Sprintf("cat %s 2>/dev/null; true", instanceSettingsFile), sshClient)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read settings of instance '%s'", instance.Name)
+	}
+	settings := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		settings[parts[0]] = parts[1]
+	}
+	return settings, nil
+}
+
+func showInstanceSettings(name string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	remote, err := readInstanceSettings(instance)
+	if err != nil {
+		return err
+	}
+
+	keys := map[string]bool{}
+	for key := range instance.Settings {
+		keys[key] = true
+	}
+	for key := range remote {
+		keys[key] = true
+	}
+	statuses := []settingStatus{}
+	drifted := 0
+	for key := range keys {
+		applied, recorded := instance.Settings[key]
+		value, found := remote[key]
+		status := settingStatus{Key: key, Applied: applied, Instance: value}
+		switch {
+		case recorded && !found:
+			status.Status = "missing"
+		case !recorded:
+			status.Status = "unmanaged"
+		case applied != value:
+			status.Status = "changed"
+		default:
+			status.Status = "ok"
+		}
+		if status.Status != "ok" {
+			drifted++
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+
+	return printOutput(statuses, func() {
+		if len(statuses) == 0 {
+			fmt.Printf("No settings on instance '%s'\n", name)
+			return
+		}
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		printTableHeader(w, "Key", "Applied", "Instance", "Status")
+		for _, status := range statuses {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t", status.Key, status.Applied, status.Instance, status.Status)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+		if drifted > 0 {
+			fmt.Printf("\n%d setting(s) drifted. Run 'protos instance config set %s' to push the recorded settings again\n", drifted, name)
+		}
+	})
+}
@@ -0,0 +1,712 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/protosio/cli/internal/db"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// remoteStateDir is the directory holding the shared database on the state instance, relative to the home of the
+	// SSH user
+	remoteStateDir = ".protos-state"
+	remoteStateDB  = remoteStateDir + "/protos.db"
+	// remoteStateLock is created while a CLI uses the shared database. Creating a directory is atomic, so only one
+	// CLI can hold the lock
+	remoteStateLock = remoteStateDir + "/lock"
+	// stateLockTimeout is how long a command waits for another one to release the shared database
+	stateLockTimeout = 30 * time.Second
+)
+
+var stateHost string
+var stateKeyFile string
+
+var cmdState *cli.Command = &cli.Command{
+	Name:  "state",
+	Usage: "Share the local database with a team, by keeping it on a Protos instance",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "show",
+			Usage: "Show where the database is kept and who is using it",
+			Action: func(c *cli.Context) error {
+				return showState()
+			},
+		},
+		{
+			Name:      "use",
+			ArgsUsage: "<instance>",
+			Usage:     "Keep the database on an instance. The local database is uploaded if the instance doesn't hold one yet, otherwise the shared one replaces it. Without --key-file, the instance key is written unencrypted to the state directory, since it's needed to reach the database before the keystore can be read",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "host",
+					Usage:       "SSH `ADDRESS` of the instance, for instances missing from the local database (e.g. when joining a team)",
+					Destination: &stateHost,
+				},
+				&cli.StringFlag{
+					Name:        "key-file",
+					Usage:       "Private SSH key `FILE` of the instance, required with --host",
+					Destination: &stateKeyFile,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" || (stateHost == "") != (stateKeyFile == "") {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return useState(name, stateHost, stateKeyFile)
+			},
+		},
+		{
+			Name:  "disable",
+			Usage: "Stop using the shared database. The local copy is kept and used from now on",
+			Action: func(c *cli.Context) error {
+				return disableState()
+			},
+		},
+		{
+			Name:  "unlock",
+			Usage: "Release the lock on the shared database, left behind by a command that didn't terminate cleanly",
+			Action: func(c *cli.Context) error {
+				return unlockState()
+			},
+		},
+		{
+			Name:  "members",
+			Usage: "Manage who can change the shared database. Until members are added, everyone can. Afterwards only admins can, and other users are read-only",
+			Subcommands: []*cli.Command{
+				{
+					Name:  "ls",
+					Usage: "List members",
+					Flags: []cli.Flag{
+						outputFlag(),
+					},
+					Action: func(c *cli.Context) error {
+						return listMembers()
+					},
+				},
+				{
+					Name:      "set",
+					ArgsUsage: "<user> <role>",
+					Usage:     "Add a member, or change their role: admin or read-only. The first member has to be yourself, as admin",
+					Action: func(c *cli.Context) error {
+						user := c.Args().Get(0)
+						role := c.Args().Get(1)
+						if user == "" || role == "" {
+							cli.ShowSubcommandHelp(c)
+							return cli.Exit("", 1)
+						}
+						return setMember(c, user, role)
+					},
+				},
+				{
+					Name:      "rm",
+					ArgsUsage: "<user>",
+					Usage:     "Remove a member, who becomes read-only. Removing all members lets everyone change the database again",
+					Action: func(c *cli.Context) error {
+						user := c.Args().Get(0)
+						if user == "" {
+							cli.ShowSubcommandHelp(c)
+							return cli.Exit("", 1)
+						}
+						return removeMember(c, user)
+					},
+				},
+			},
+		},
+	},
+}
+
+// Roles of the members of a shared database
+const (
+	roleAdmin    = "admin"
+	roleReadOnly = "read-only"
+)
+
+// stateSession is the shared database lock held by the current command
+type stateSession struct {
+	client *gossh.Client
+	digest []byte // digest of the database when it was downloaded, used to skip uploading unchanged databases
+	// mu is taken for good once the lock is being released, so that an interrupted command neither exits halfway
+	// through the upload nor releases the lock again
+	mu      sync.Mutex
+	signals chan os.Signal
+}
+
+var sharedState *stateSession
+
+//
+// State methods
+//
+
+// stateUser returns the name identifying the current user in the history and the members of a shared database: the
+// user setting, or the login name
+func stateUser() string {
+	cfg, err := userconfig.Load(configPath())
+	if err == nil && cfg.User != "" {
+		return cfg.User
+	}
+	usr, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return usr.Username
+}
+
+// stateKeyPath is where the key of the state instance is written, unless given by --key-file. It's kept apart from the
+// key files written for other tools, which are removed once they are not needed
+func stateKeyPath() string {
+	return filepath.Join(protosDir(), "state_key")
+}
+
+func localDBPath() string {
+	return filepath.Join(protosDir(), "protos.db")
+}
+
+// stateBackend returns the configured state backend, nil if only the local database is used
+func stateBackend() (*userconfig.StateBackend, error) {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return nil, err
+	}
+	return cfg.State, nil
+}
+
+func connectState(backend *userconfig.StateBackend) (*gossh.Client, error) {
+	auth, err := ssh.KeyFileAuth(backend.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sshPool.Get(backend.Host, "root", []gossh.AuthMethod{auth}, 1, false)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to state instance '%s'", backend.Instance)
+	}
+	return client, nil
+}
+
+// dialState opens a connection to the state instance that is not pooled, so that the lock taken by a command can still
+// be released once its pooled connections are closed by --timeout. The caller should close it
+func dialState(backend *userconfig.StateBackend) (*gossh.Client, error) {
+	auth, err := ssh.KeyFileAuth(backend.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sshPool.Dial(backend.Host, "root", []gossh.AuthMethod{auth}, 1)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to state instance '%s'", backend.Instance)
+	}
+	return client, nil
+}
+
+// pullState locks the shared database and replaces the local one with it. It does nothing if no state backend is
+// configured
+func pullState() error {
+	backend, err := stateBackend()
+	if err != nil || backend == nil {
+		return err
+	}
+	client, err := dialState(backend)
+	if err != nil {
+		return err
+	}
+	err = lockState(client)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	session := &stateSession{client: client}
+	session.releaseOnSignal()
+	data, err := readRemoteState(client)
+	if err != nil {
+		session.release()
+		return err
+	}
+	err = ioutil.WriteFile(localDBPath(), data, os.FileMode(0600))
+	if err != nil {
+		session.release()
+		return errors.Wrapf(err, "Failed to write database '%s'", localDBPath())
+	}
+	digest := sha256.Sum256(data)
+	session.digest = digest[:]
+	sharedState = session
+	return nil
+}
+
+// releaseOnSignal releases the lock when the command is interrupted, since app.After doesn't run then. The changes are
+// not uploaded, as the command could have been interrupted halfway through them
+func (s *stateSession) releaseOnSignal() {
+	s.signals = make(chan os.Signal, 1)
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-s.signals
+		if !ok {
+			return
+		}
+		s.mu.Lock()
+		log.Warnf("Received %s, releasing the lock on the shared database without uploading the changes", sig)
+		unlockRemoteState(s.client)
+		os.Exit(exitInterrupted)
+	}()
+}
+
+// stopSignals restores the default handling of signals, once the lock is released
+func (s *stateSession) stopSignals() {
+	signal.Stop(s.signals)
+	close(s.signals)
+}
+
+// release releases the lock without uploading the changes and closes the connection to the state instance
+func (s *stateSession) release() {
+	s.stopSignals()
+	unlockRemoteState(s.client)
+	s.client.Close()
+}
+
+// abandonDB exits with err while an operation of the command may still be running, e.g. once it didn't stop after
+// --timeout. The lock on the shared database is released, but the changes are not uploaded and the local database is
+// not closed, since the operation could still be changing it
+func abandonDB(err error) {
+	if session := sharedState; session != nil {
+		session.mu.Lock()
+		log.Warn("Releasing the lock on the shared database without uploading the changes")
+		unlockRemoteState(session.client)
+	}
+	exitWithError(err)
+}
+
+// releaseDB closes the local database. When it's shared, the changes are uploaded and the lock is released, so that
+// other commands can use it. The changes of users who can't change the shared database are not uploaded, since they
+// are side effects of reading it, like the last seen times of instances
+func releaseDB() error {
+	if dbp == nil {
+		return nil
+	}
+	authErr := authorizeChange()
+	err := dbp.Close()
+	dbp = nil
+	if err != nil || sharedState == nil {
+		return err
+	}
+	session := sharedState
+	sharedState = nil
+	session.mu.Lock()
+	defer session.stopSignals()
+	defer session.client.Close()
+	defer unlockRemoteState(session.client)
+
+	data, err := ioutil.ReadFile(localDBPath())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read database '%s'", localDBPath())
+	}
+	digest := sha256.Sum256(data)
+	if bytes.Equal(digest[:], session.digest) {
+		return nil
+	}
+	if authErr != nil {
+		log.Debugf("Not uploading the changed database: %s", authErr.Error())
+		return nil
+	}
+	log.Debug("Uploading the changed database to the state instance")
+	return uploadState(bytes.NewReader(data), session.client)
+}
+
+// lockState waits for the shared database lock, for at most stateLockTimeout
+func lockState(client *gossh.Client) error {
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("%s@%s (PID %d) since %s", stateUser(), hostname, os.Getpid(), time.Now().Format(time.RFC3339))
+	cmd := fmt.Sprintf("mkdir -p %s && mkdir %s 2>/dev/null && echo %s > %s/owner", remoteStateDir, remoteStateLock, shellQuote(owner), remoteStateLock)
+
+	deadline := time.Now().Add(stateLockTimeout)
+	waiting := false
+	for {
+		exitCode, err := ssh.RunCommand(cmd, ioutil.Discard, ioutil.Discard, client)
+		if err != nil {
+			return errors.Wrap(err, "Failed to lock the shared database")
+		}
+		if exitCode == 0 {
+			return nil
+		}
+		holder := stateLockOwner(client)
+		if time.Now().After(deadline) {
+			return errors.Errorf("The shared database is locked by %s. If that command is not running anymore, release the lock using 'protos state unlock'", holder)
+		}
+		if !waiting {
+			log.Infof("Waiting for the shared database, locked by %s", holder)
+			waiting = true
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func stateLockOwner(client *gossh.Client) string {
+	var out bytes.Buffer
+	exitCode, err := ssh.RunCommand("cat "+remoteStateLock+"/owner", &out, ioutil.Discard, client)
+	if err != nil || exitCode != 0 || out.Len() == 0 {
+		return "another command"
+	}
+	return strings.TrimSpace(out.String())
+}
+
+func unlockRemoteState(client *gossh.Client) {
+	out, err := ssh.ExecuteCommand("rm -rf "+remoteStateLock, client)
+	if err != nil {
+		log.Warnf("Failed to release the lock on the shared database: %s: %s", err.Error(), strings.TrimSpace(out))
+	}
+}
+
+// readRemoteState downloads the shared database. A missing database results in an error, since it means that the
+// state instance was reset and the local database should not silently diverge from the team one
+func readRemoteState(client *gossh.Client) ([]byte, error) {
+	exitCode, err := ssh.RunCommand("test -f "+remoteStateDB, ioutil.Discard, ioutil.Discard, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to download the shared database")
+	}
+	if exitCode != 0 {
+		return nil, errors.New("The state instance doesn't hold a database. Upload the local one using 'protos state use'")
+	}
+	reader, err := ssh.NewCommandReader("cat "+remoteStateDB, client)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to download the shared database")
+	}
+	defer reader.Close()
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to download the shared database")
+	}
+	return data, nil
+}
+
+func showState() error {
+	backend, err := stateBackend()
+	if err != nil {
+		return err
+	}
+	if backend == nil {
+		fmt.Printf("Database: local (%s)\n", localDBPath())
+		return nil
+	}
+	fmt.Printf("Database: shared, on instance '%s' (%s)\n", backend.Instance, backend.Host)
+	fmt.Printf("SSH key: %s\n", backend.KeyFile)
+	fmt.Printf("User: %s\n", stateUser())
+	client, err := connectState(backend)
+	if err != nil {
+		return err
+	}
+	exitCode, err := ssh.RunCommand("test -d "+remoteStateLock, ioutil.Discard, ioutil.Discard, client)
+	if err != nil {
+		return err
+	}
+	if exitCode == 0 {
+		fmt.Printf("Lock: held by %s\n", stateLockOwner(client))
+	} else {
+		fmt.Printf("Lock: free\n")
+	}
+	return nil
+}
+
+// useState configures the shared database on an instance. Unless host and keyFile are provided, the instance is
+// looked up in the local database
+func useState(name string, host string, keyFile string) error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	if cfg.State != nil {
+		return errors.Errorf("The database is already shared using instance '%s'. Disable it first using 'protos state disable'", cfg.State.Instance)
+	}
+
+	if host == "" {
+		localDB, err := db.Open("")
+		if err != nil {
+			return err
+		}
+		instance, err := localDB.GetInstance(name)
+		localDB.Close()
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve instance '%s'. Use --host and --key-file for instances missing from the local database", name)
+		}
+		keyFile = stateKeyPath()
+		err = writeKeyFile(instance, keyFile)
+		if err != nil {
+			return err
+		}
+		host = instance.PublicIP
+	}
+	keyFile, err = filepath.Abs(keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "Invalid SSH key path '%s'", keyFile)
+	}
+
+	backend := &userconfig.StateBackend{Instance: name, Host: host, KeyFile: keyFile}
+	client, err := connectState(backend)
+	if err != nil {
+		return err
+	}
+	err = lockState(client)
+	if err != nil {
+		return err
+	}
+	defer unlockRemoteState(client)
+
+	exitCode, err := ssh.RunCommand("test -f "+remoteStateDB, ioutil.Discard, ioutil.Discard, client)
+	if err != nil {
+		return err
+	}
+	if exitCode == 0 {
+		// the shared database replaces the local one on the next command, which can be undone using 'protos db undo'
+		if _, err := os.Stat(localDBPath()); err == nil {
+			localDB, err := db.Open("")
+			if err != nil {
+				return err
+			}
+			snapshot, err := localDB.Snapshot()
+			localDB.Close()
+			if err != nil {
+				return err
+			}
+			log.Infof("Instance '%s' already holds a database, which replaces the local one. The local one was saved to '%s'", name, snapshot)
+		}
+	} else {
+		f, err := os.Open(localDBPath())
+		if err != nil {
+			return errors.Wrap(err, "Failed to read the local database. Run init first")
+		}
+		defer f.Close()
+		err = uploadState(f, client)
+		if err != nil {
+			return err
+		}
+		log.Infof("Local database uploaded to instance '%s'", name)
+	}
+
+	cfg.State = backend
+	err = userconfig.Save(configPath(), cfg)
+	if err != nil {
+		return err
+	}
+	log.Infof("The database is now shared using instance '%s'", name)
+	return nil
+}
+
+func uploadState(data io.Reader, client *gossh.Client) error {
+	err := ssh.WriteFile(data, remoteStateDB+".tmp", client)
+	if err != nil {
+		return errors.Wrap(err, "Failed to upload the shared database")
+	}
+	out, err := ssh.ExecuteCommand("mv "+remoteStateDB+".tmp "+remoteStateDB, client)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to upload the shared database: %s", strings.TrimSpace(out))
+	}
+	return nil
+}
+
+func disableState() error {
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return err
+	}
+	if cfg.State == nil {
+		return errors.New("The database is not shared")
+	}
+	instance, keyFile := cfg.State.Instance, cfg.State.KeyFile
+	cfg.State = nil
+	err = userconfig.Save(configPath(), cfg)
+	if err != nil {
+		return err
+	}
+	// key files given using --key-file belong to the user
+	if keyFile == stateKeyPath() {
+		err = os.Remove(keyFile)
+		if err != nil && !os.IsNotExist(err) {
+			log.Warnf("Failed to remove the key of state instance '%s': %s", instance, err.Error())
+		}
+	}
+	log.Infof("Stopped sharing the database using instance '%s'. The local copy is used from now on", instance)
+	return nil
+}
+
+func unlockState() error {
+	backend, err := stateBackend()
+	if err != nil {
+		return err
+	}
+	if backend == nil {
+		return errors.New("The database is not shared")
+	}
+	client, err := connectState(backend)
+	if err != nil {
+		return err
+	}
+	log.Infof("Releasing the lock held by %s", stateLockOwner(client))
+	unlockRemoteState(client)
+	return nil
+}
+
+// authorizeChange checks that the current user can change the shared database. Only admins can, once members are
+// added. It's enforced by the CLI, so it prevents mistakes rather than changes made by users holding the key of the
+// state instance
+func authorizeChange() error {
+	if sharedState == nil {
+		return nil
+	}
+	members, err := dbp.GetAllMembers()
+	if err != nil {
+		return errors.Wrap(err, "Failed to retrieve the members of the shared database")
+	}
+	if len(members) == 0 {
+		return nil
+	}
+	current := stateUser()
+	for _, member := range members {
+		if member.User == current && member.Role == roleAdmin {
+			return nil
+		}
+	}
+	return errors.Errorf("User '%s' can't change the shared database, only admins can. List them using 'protos state members ls'", current)
+}
+
+// authorizeCloudChange is used as the Before hook of commands that change the cloud account or the instances but not
+// the local state. Read-only members of a shared database are refused up front, since the database couldn't record the
+// changes and would drift from the cloud account
+func authorizeCloudChange(c *cli.Context) error {
+	return authorizeChange()
+}
+
+// openSharedDB opens the database for the members commands, which only apply to a shared one
+func openSharedDB() error {
+	backend, err := stateBackend()
+	if err != nil {
+		return err
+	}
+	if backend == nil {
+		return errors.New("The database is not shared. Share it first using 'protos state use'")
+	}
+	return openDB()
+}
+
+func listMembers() error {
+	err := openSharedDB()
+	if err != nil {
+		return err
+	}
+	members, err := dbp.GetAllMembers()
+	if err != nil {
+		return err
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].User < members[j].User })
+	return printOutput(members, func() {
+		if len(members) == 0 {
+			fmt.Println("No members. Everyone can change the shared database")
+			return
+		}
+		current := stateUser()
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+		printTableHeader(w, "User", "Role")
+		for _, member := range members {
+			name := member.User
+			if name == current {
+				name += " (you)"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t", name, member.Role)
+		}
+		fmt.Fprint(w, "\n")
+		w.Flush()
+	})
+}
+
+func setMember(c *cli.Context, user string, role string) error {
+	if role != roleAdmin && role != roleReadOnly {
+		return errors.Errorf("Invalid role '%s'. Use %s or %s", role, roleAdmin, roleReadOnly)
+	}
+	err := openSharedDB()
+	if err != nil {
+		return err
+	}
+	err = authorizeChange()
+	if err != nil {
+		return err
+	}
+	members, err := dbp.GetAllMembers()
+	if err != nil {
+		return err
+	}
+	// the first member has to be an admin able to add the others, otherwise nobody could change the database anymore
+	current := stateUser()
+	if len(members) == 0 && (user != current || role != roleAdmin) {
+		return errors.Errorf("The first member has to be yourself as admin: protos state members set %s %s", current, roleAdmin)
+	}
+	if role != roleAdmin && lastAdmin(members, user) {
+		return errors.Errorf("'%s' is the last admin. Make another member admin first", user)
+	}
+	err = snapshotDB(c)
+	if err != nil {
+		return err
+	}
+	err = dbp.SaveMember(db.Member{User: user, Role: role})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save member '%s'", user)
+	}
+	log.Infof("'%s' is now a member of the shared database, as %s", user, role)
+	return nil
+}
+
+func removeMember(c *cli.Context, user string) error {
+	err := openSharedDB()
+	if err != nil {
+		return err
+	}
+	err = authorizeChange()
+	if err != nil {
+		return err
+	}
+	members, err := dbp.GetAllMembers()
+	if err != nil {
+		return err
+	}
+	if len(members) > 1 && lastAdmin(members, user) {
+		return errors.Errorf("'%s' is the last admin. Make another member admin first", user)
+	}
+	err = snapshotDB(c)
+	if err != nil {
+		return err
+	}
+	err = dbp.DeleteMember(user)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to remove member '%s'", user)
+	}
+	log.Infof("'%s' is not a member of the shared database anymore", user)
+	return nil
+}
+
+// lastAdmin returns true if user is the only admin among members
+func lastAdmin(members []db.Member, user string) bool {
+	admins := 0
+	isAdmin := false
+	for _, member := range members {
+		if member.Role == roleAdmin {
+			admins++
+			isAdmin = isAdmin || member.User == user
+		}
+	}
+	return isAdmin && admins == 1
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/protosio/cli/internal/job"
+	"github.com/protosio/cli/internal/saga"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdStatus *cli.Command = &cli.Command{
+	Name:  "status",
+	Usage: "Summarize the clouds, instances, tunnels, jobs and anything needing attention at a glance. Only the local state is used, so instance states are the ones last fetched from the cloud providers",
+	Flags: []cli.Flag{
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		return printStatus()
+	},
+}
+
+// statusSummary is the output of 'protos status'
+type statusSummary struct {
+	Clouds           int
+	Instances        int
+	InstanceStates   map[string]int // number of instances by the status last reported by their cloud provider
+	Tunnels          int
+	ControlServer    string         // control socket served by 'protos serve', empty if not running
+	Jobs             map[string]int // number of background jobs by status, for the ones not finished yet
+	ScheduledBackups int            // instances with a backup schedule
+	Alerts           []string
+}
+
+//
+// Status methods
+//
+
+func printStatus() error {
+	summary := statusSummary{InstanceStates: map[string]int{}, Jobs: map[string]int{}, Alerts: []string{}}
+
+	clouds, err := dbp.GetAllClouds()
+	if err != nil {
+		return err
+	}
+	summary.Clouds = len(clouds)
+
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	summary.Instances = len(instances)
+	for _, instance := range instances {
+		state := instance.Status
+		if state == "" {
+			state = "unknown"
+		}
+		summary.InstanceStates[state]++
+		if !instance.ExpiresAt.IsZero() {
+			left := time.Until(instance.ExpiresAt)
+			if left <= 0 {
+				summary.Alerts = append(summary.Alerts, fmt.Sprintf("Instance '%s' expired on %s. Destroy it using 'protos gc --expired'", instance.Name, formatTime(instance.ExpiresAt)))
+			} else if left < 24*time.Hour {
+				summary.Alerts = append(summary.Alerts, fmt.Sprintf("Instance '%s' expires in %s", instance.Name, left.Round(time.Minute)))
+			}
+		}
+		if instance.BackupPolicy != nil {
+			summary.ScheduledBackups++
+			if instance.BackupPolicy.LastError != "" {
+				summary.Alerts = append(summary.Alerts, fmt.Sprintf("Last backup of instance '%s' failed: %s", instance.Name, instance.BackupPolicy.LastError))
+			}
+		}
+	}
+
+	ops, err := dbp.GetAllOperations()
+	if err != nil {
+		return err
+	}
+	sort.Slice(ops, func(i, j int) bool { return ops[i].StartedAt.Before(ops[j].StartedAt) })
+	for _, op := range ops {
+		// running operations are interrupted ones, since the DB is locked while an operation runs
+		if op.Status == saga.Failed || op.Status == saga.Running {
+			summary.Alerts = append(summary.Alerts, fmt.Sprintf("Operation '%s' (%s) is unfinished. Resume it using 'protos job resume %s', or undo it using 'protos job rollback %s'", op.ID, op.Description, op.ID, op.ID))
+		}
+	}
+
+	tunnels, err := runningTunnels()
+	if err != nil {
+		return err
+	}
+	summary.Tunnels = len(tunnels)
+
+	jobs, err := job.List(jobsDir())
+	if err != nil {
+		return err
+	}
+	for _, j := range jobs {
+		if !j.Done() {
+			summary.Jobs[string(j.Status)]++
+		} else if j.Status == job.Lost && time.Since(j.CreatedAt) < 24*time.Hour {
+			summary.Alerts = append(summary.Alerts, fmt.Sprintf("Job '%s' (%s) exited without recording a result", j.ID, j.Command))
+		}
+	}
+
+	if conn, err := net.Dial("unix", controlSocketPath()); err == nil {
+		conn.Close()
+		summary.ControlServer = controlSocketPath()
+	}
+
+	return printOutput(summary, func() {
+		fmt.Printf("Clouds: %d\n", summary.Clouds)
+		fmt.Printf("Instances: %d%s\n", summary.Instances, formatCounts(summary.InstanceStates))
+		fmt.Printf("Tunnels: %d running\n", summary.Tunnels)
+		if summary.ControlServer != "" {
+			fmt.Printf("Control server: serving on '%s'\n", summary.ControlServer)
+		} else {
+			fmt.Printf("Control server: not running\n")
+		}
+		jobs := 0
+		for _, count := range summary.Jobs {
+			jobs += count
+		}
+		fmt.Printf("Jobs: %d%s\n", jobs, formatCounts(summary.Jobs))
+		fmt.Printf("Scheduled backups: %d instance(s)\n", summary.ScheduledBackups)
+		if len(summary.Alerts) == 0 {
+			fmt.Printf("Alerts: none\n")
+			return
+		}
+		fmt.Printf("Alerts: %d\n", len(summary.Alerts))
+		for _, alert := range summary.Alerts {
+			fmt.Printf("  - %s\n", alert)
+		}
+	})
+}
+
+// formatCounts formats counts by name as " (2 running, 1 stopped)", or an empty string if there are none
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	names := []string{}
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := []string{}
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[name], name))
+	}
+	return " (" + strings.Join(parts, ", ") + ")"
+}
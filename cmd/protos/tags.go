@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdInstanceTags *cli.Command = &cli.Command{
+	Name:  "tags",
+	Usage: "Manage the tags of instances, and sync them with the cloud providers, e.g. for cost allocation",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List the tags of the instances",
+			Flags: []cli.Flag{outputFlag()},
+			Action: func(c *cli.Context) error {
+				return listInstanceTags()
+			},
+		},
+		{
+			Name:      "set",
+			ArgsUsage: "<name> [tag...]",
+			Usage:     "Replace the tags of an instance. Omit the tags to remove all of them. Use 'push' to apply them at the provider",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				name, err := resolveInstanceName(name)
+				if err != nil {
+					return err
+				}
+				return setInstanceTags(name, c.Args().Tail())
+			},
+		},
+		{
+			Name:      "push",
+			ArgsUsage: "[name]",
+			Usage:     "Apply the tags of an instance, or of all instances, to the instance and its volumes at the provider, replacing the provider side ones",
+			Before:    authorizeCloudChange,
+			Action: func(c *cli.Context) error {
+				return syncInstanceTags(c.Args().Get(0), true)
+			},
+		},
+		{
+			Name:      "pull",
+			ArgsUsage: "[name]",
+			Usage:     "Replace the tags of an instance, or of all instances, with the ones set at the provider, e.g. from its console",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				return syncInstanceTags(c.Args().Get(0), false)
+			},
+		},
+	},
+}
+
+//
+// Instance tags methods
+//
+
+// parseTags trims the tags and drops the empty and duplicate ones, keeping their order
+func parseTags(tags []string) []string {
+	parsed := []string{}
+	seen := map[string]bool{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		parsed = append(parsed, tag)
+	}
+	return parsed
+}
+
+func setInstanceTags(name string, tags []string) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	instance.Tags = parseTags(tags)
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", name)
+	}
+	log.Infof("Instance '%s' tags set to [%s]. Use 'protos instance tags push %s' to apply them at the provider", name, strings.Join(instance.Tags, ", "), name)
+	return nil
+}
+
+func listInstanceTags() error {
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return err
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	type instanceTags struct {
+		Instance string
+		Tags     []string
+	}
+	tags := []instanceTags{}
+	for _, instance := range instances {
+		tags = append(tags, instanceTags{Instance: instance.Name, Tags: parseTags(instance.Tags)})
+	}
+
+	return printOutput(tags, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Instance", "Tags")
+		for _, t := range tags {
+			fmt.Fprintf(w, "\n %s\t%s\t", t.Instance, strings.Join(t.Tags, ", "))
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// syncInstanceTags pushes the tags of an instance, or of all instances if name is empty, to the provider, or pulls
+// them from it. When syncing all instances, the ones on clouds without tags are skipped and failures are logged, so
+// that one unreachable cloud doesn't prevent syncing the others
+func syncInstanceTags(name string, push bool) error {
+	instances := []cloud.InstanceInfo{}
+	if name != "" {
+		resolved, err := resolveInstanceName(name)
+		if err != nil {
+			return err
+		}
+		instance, err := dbp.GetInstance(resolved)
+		if err != nil {
+			return errors.Wrapf(err, "Could not retrieve instance '%s'", resolved)
+		}
+		instances = append(instances, instance)
+	} else {
+		all, err := dbp.GetAllInstances()
+		if err != nil {
+			return err
+		}
+		instances = all
+	}
+
+	failed := 0
+	for _, instance := range instances {
+		client, _, err := initCloudClient(instance.CloudName, instance.Location)
+		if err == nil && !client.Capabilities().Tags {
+			err = cloud.NotSupported(client, "tags")
+			if name == "" {
+				log.Debugf("Skipping instance '%s': %s", instance.Name, err.Error())
+				continue
+			}
+		}
+		if err == nil {
+			if push {
+				err = pushInstanceTags(client, instance)
+			} else {
+				err = pullInstanceTags(client, instance)
+			}
+		}
+		if err != nil {
+			if name != "" {
+				return err
+			}
+			log.Warn(err.Error())
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("Failed to sync the tags of %d instance(s)", failed)
+	}
+	return nil
+}
+
+// pushInstanceTags applies the tags of the instance to it and to its volumes
+func pushInstanceTags(client cloud.Provider, instance cloud.InstanceInfo) error {
+	tags := parseTags(instance.Tags)
+	err := client.SetInstanceTags(instance.VMID, tags)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to push the tags of instance '%s'", instance.Name)
+	}
+	for _, vol := range instance.Volumes {
+		err = client.SetVolumeTags(vol.VolumeID, tags)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to push the tags of instance '%s' to volume '%s'", instance.Name, vol.VolumeID)
+		}
+	}
+	log.Infof("Pushed tags [%s] to instance '%s' and %d volume(s)", strings.Join(tags, ", "), instance.Name, len(instance.Volumes))
+	return nil
+}
+
+// pullInstanceTags replaces the tags of the instance with the ones set on it at the provider
+func pullInstanceTags(client cloud.Provider, instance cloud.InstanceInfo) error {
+	tags, err := client.GetInstanceTags(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to pull the tags of instance '%s'", instance.Name)
+	}
+	tags = parseTags(tags)
+	if strings.Join(tags, "\n") == strings.Join(parseTags(instance.Tags), "\n") {
+		log.Infof("Tags of instance '%s' are up to date", instance.Name)
+		return nil
+	}
+	log.Infof("Tags of instance '%s' changed: [%s] -> [%s]", instance.Name, strings.Join(instance.Tags, ", "), strings.Join(tags, ", "))
+	instance.Tags = tags
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
+	}
+	return nil
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/output"
+	"github.com/protosio/cli/internal/procstat"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// topHistorySize is the number of samples kept per instance by 'instance top --watch', which is also the width of the
+// sparklines
+const topHistorySize = 30
+
+// Sources of the utilization shown by 'instance top'
+const (
+	topSourceSSH      = "ssh"      // probed on the instance
+	topSourceProvider = "provider" // measured by the cloud provider, used when the instance can't be reached over SSH
+)
+
+// sparkLevels are the characters of the sparklines, from the lowest to the highest utilization. Plain output uses ASCII
+var sparkLevels = []rune("▁▂▃▄▅▆▇█")
+var plainSparkLevels = []rune("_.:-=+*#")
+
+var cmdInstanceTop *cli.Command = &cli.Command{
+	Name:      "top",
+	ArgsUsage: "[name...]",
+	Usage:     "Show the CPU, memory, disk and network utilization of the instances, or of the given ones, probed over SSH. Instances that can't be reached over SSH show the CPU and network utilization measured by their provider, if it supports it",
+	Flags: []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "watch",
+			Usage: "Refresh every `INTERVAL` (e.g. 5s) until CTRL+C is pressed, showing the recent history of every metric",
+		},
+		outputFlag(),
+	},
+	Action: func(c *cli.Context) error {
+		interval := c.Duration("watch")
+		if interval < 0 {
+			return errors.Errorf("Invalid watch interval '%s'", interval)
+		}
+		instances, err := topInstances(c.Args().Slice())
+		if err != nil {
+			return err
+		}
+		clients := metricsClients(instances)
+		if interval > 0 {
+			if interval < time.Second {
+				return errors.New("The watch interval should be at least 1s")
+			}
+			format, err := output.Parse(outputSpec)
+			if err != nil {
+				return err
+			}
+			if !format.IsTable() {
+				return errors.New("Flag --output can't be used with --watch")
+			}
+			return watchTop(instances, clients, interval)
+		}
+		return showTop(instances, clients)
+	},
+}
+
+// topCounters are the counters of an instance from which its CPU and network utilization are computed
+type topCounters struct {
+	cpu     procstat.CPU
+	network procstat.Network
+	time    time.Time
+}
+
+// topSample is the utilization of an instance at a point in time. Percentages and rates are negative when not known
+type topSample struct {
+	Instance      string
+	Source        string // topSourceSSH or topSourceProvider
+	CPUPercent    int
+	MemoryPercent int
+	DiskPercent   int     // usage of the fullest filesystem
+	DiskMount     string  // mount point of the fullest filesystem
+	NetworkIn     float64 // bytes received per second
+	NetworkOut    float64 // bytes sent per second
+	Error         string  `json:",omitempty"`
+
+	counters *topCounters // nil unless probed over SSH
+}
+
+// topHistory holds the recent samples of an instance, oldest first
+type topHistory struct {
+	samples []topSample
+	last    *topCounters // counters of the last sample probed over SSH, used to compute the utilization of the next one
+}
+
+//
+// Instance top methods
+//
+
+// topInstances returns the named instances, or all of them if there are no names, sorted by name
+func topInstances(names []string) ([]cloud.InstanceInfo, error) {
+	instances := []cloud.InstanceInfo{}
+	if len(names) == 0 {
+		all, err := dbp.GetAllInstances()
+		if err != nil {
+			return nil, err
+		}
+		instances = all
+	}
+	for _, name := range names {
+		resolved, err := resolveInstanceName(name)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := dbp.GetInstance(resolved)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not retrieve instance '%s'", resolved)
+		}
+		instances = append(instances, instance)
+	}
+	if len(instances) == 0 {
+		return nil, errors.New("There are no instances. Deploy one using 'protos instance deploy'")
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+	return instances, nil
+}
+
+// metricsClients returns the provider clients of the instances whose provider measures their utilization, by instance
+// name. The clients are created upfront, since the database is released while watching
+func metricsClients(instances []cloud.InstanceInfo) map[string]cloud.Provider {
+	clients := map[string]cloud.Provider{}
+	byLocation := map[string]cloud.Provider{}
+	for _, instance := range instances {
+		key := instance.CloudName + "/" + instance.Location
+		client, found := byLocation[key]
+		if !found {
+			// capabilities don't require initializing the client, which can involve calls to the provider API
+			provider, err := dbp.GetCloud(instance.CloudName)
+			if err == nil && provider.Client().Capabilities().Metrics {
+				client, _, err = initCloudClient(instance.CloudName, instance.Location)
+			}
+			if err != nil {
+				log.Debugf("Provider metrics of instance '%s' are not available: %s", instance.Name, err.Error())
+				client = nil
+			}
+			byLocation[key] = client
+		}
+		if client != nil {
+			clients[instance.Name] = client
+		}
+	}
+	return clients
+}
+
+func showTop(instances []cloud.InstanceInfo, clients map[string]cloud.Provider) error {
+	samples := sampleTop(instances, clients, nil)
+	return printOutput(samples, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "Instance", "Source", "CPU", "Memory", "Disk", "Network in/out", "Error")
+		for _, s := range samples {
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", s.Instance, s.Source, formatUtilization(s.CPUPercent), formatUtilization(s.MemoryPercent), formatUtilization(s.DiskPercent), formatNetwork(s), s.Error)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// watchTop samples the instances every interval and redraws their utilization along with its recent history. The
+// history is only kept in memory. The database is released while watching, so that other commands can be used meanwhile
+func watchTop(instances []cloud.InstanceInfo, clients map[string]cloud.Provider, interval time.Duration) error {
+	err := releaseDB()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+
+	history := map[string]*topHistory{}
+	for _, instance := range instances {
+		history[instance.Name] = &topHistory{}
+	}
+	for {
+		started := time.Now()
+		for _, sample := range sampleTop(instances, clients, history) {
+			h := history[sample.Instance]
+			h.samples = append(h.samples, sample)
+			if len(h.samples) > topHistorySize {
+				h.samples = h.samples[len(h.samples)-topHistorySize:]
+			}
+			if sample.counters != nil {
+				h.last = sample.counters
+			}
+		}
+		printTopHistory(instances, history, interval)
+
+		// probing takes a while, so it is counted in the interval
+		select {
+		case <-quit:
+			return nil
+		case <-time.After(interval - time.Since(started)):
+		}
+	}
+}
+
+func printTopHistory(instances []cloud.InstanceInfo, history map[string]*topHistory, interval time.Duration) {
+	if !plainOutput {
+		// move the cursor home and clear the screen, so that the table is redrawn in place
+		fmt.Print("\x1b[H\x1b[2J")
+	} else {
+		fmt.Print("\n")
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+	printTableHeader(w, "Instance", "Source", "CPU", "", "Memory", "", "Disk", "", "Network in/out", "", "Error")
+	for _, instance := range instances {
+		samples := history[instance.Name].samples
+		if len(samples) == 0 {
+			continue
+		}
+		last := samples[len(samples)-1]
+		cpu, memory, disk, network := []int{}, []int{}, []int{}, []float64{}
+		for _, s := range samples {
+			cpu = append(cpu, s.CPUPercent)
+			memory = append(memory, s.MemoryPercent)
+			disk = append(disk, s.DiskPercent)
+			if s.NetworkIn < 0 || s.NetworkOut < 0 {
+				network = append(network, -1)
+			} else {
+				network = append(network, s.NetworkIn+s.NetworkOut)
+			}
+		}
+		fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t", instance.Name, last.Source,
+			formatUtilization(last.CPUPercent), sparkline(cpu),
+			formatUtilization(last.MemoryPercent), sparkline(memory),
+			formatUtilization(last.DiskPercent), sparkline(disk),
+			formatNetwork(last), sparkline(relativeToPeak(network)), last.Error)
+	}
+	fmt.Fprint(w, "\n")
+	w.Flush()
+	fmt.Printf("\nRefreshed at %s, every %s. Press CTRL+C to stop\n", time.Now().Format("15:04:05"), interval)
+}
+
+// sampleTop probes the instances concurrently. The utilization is computed against the counters of the previous
+// sample in history. Without one, the counters are read twice, one second apart. Instances that can't be probed over
+// SSH fall back to the metrics of their provider, if it has a client in clients
+func sampleTop(instances []cloud.InstanceInfo, clients map[string]cloud.Provider, history map[string]*topHistory) []topSample {
+	results := make(chan topSample, len(instances))
+	for _, instance := range instances {
+		var last *topCounters
+		if h, found := history[instance.Name]; found {
+			last = h.last
+		}
+		go func(instance cloud.InstanceInfo, last *topCounters, client cloud.Provider) {
+			sample, err := sampleInstance(instance, last)
+			if err != nil {
+				log.Debugf("Failed to probe utilization of instance '%s': %s", instance.Name, err.Error())
+				sample = unknownSample()
+				sample.Error = err.Error()
+				if client != nil {
+					sample = providerSample(instance, client, err)
+				}
+			}
+			sample.Instance = instance.Name
+			results <- sample
+		}(instance, last, clients[instance.Name])
+	}
+	samples := []topSample{}
+	for range instances {
+		samples = append(samples, <-results)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Instance < samples[j].Instance })
+	return samples
+}
+
+func unknownSample() topSample {
+	return topSample{CPUPercent: -1, MemoryPercent: -1, DiskPercent: -1, NetworkIn: -1, NetworkOut: -1}
+}
+
+func sampleInstance(instance cloud.InstanceInfo, last *topCounters) (topSample, error) {
+	sample := unknownSample()
+	sample.Source = topSourceSSH
+	sshClient, err := connectInstance(instance, 1, false)
+	if err != nil {
+		return sample, err
+	}
+	if last == nil {
+		first, err := readCounters(sshClient)
+		if err != nil {
+			return sample, err
+		}
+		last = &first
+		time.Sleep(time.Second)
+	}
+	counters, err := readCounters(sshClient)
+	if err != nil {
+		return sample, err
+	}
+	sample.counters = &counters
+	sample.CPUPercent = percent(procstat.Utilization(last.cpu, counters.cpu))
+	// the counters go back to zero when the instance reboots
+	seconds := counters.time.Sub(last.time).Seconds()
+	if seconds > 0 && counters.network.Received >= last.network.Received && counters.network.Sent >= last.network.Sent {
+		sample.NetworkIn = float64(counters.network.Received-last.network.Received) / seconds
+		sample.NetworkOut = float64(counters.network.Sent-last.network.Sent) / seconds
+	}
+
+	usage, err := instanceUsage(instance)
+	if err != nil {
+		return sample, err
+	}
+	sample.MemoryPercent = usage.MemoryPercent
+	sample.DiskPercent = usage.DiskPercent
+	sample.DiskMount = usage.DiskMount
+	return sample, nil
+}
+
+// providerSample returns the latest utilization of the instance measured by its provider. The provider doesn't see
+// the memory and disk usage inside the instance, so they are left unknown
+func providerSample(instance cloud.InstanceInfo, client cloud.Provider, sshErr error) topSample {
+	sample := unknownSample()
+	metrics, err := client.GetInstanceMetrics(instance.VMID, time.Now().Add(-10*time.Minute))
+	if err != nil {
+		sample.Error = fmt.Sprintf("%s. Failed to retrieve provider metrics: %s", sshErr.Error(), err.Error())
+		return sample
+	}
+	if len(metrics) == 0 {
+		sample.Error = fmt.Sprintf("%s. The provider has no metrics for the instance", sshErr.Error())
+		return sample
+	}
+	latest := metrics[len(metrics)-1]
+	sample.Source = topSourceProvider
+	sample.CPUPercent = percent(latest.CPUPercent)
+	sample.NetworkIn = latest.NetworkIn
+	sample.NetworkOut = latest.NetworkOut
+	return sample
+}
+
+// readCounters reads the CPU and network counters of the instance. Both files are read with a single command, and the
+// lines of one are ignored when parsing the other
+func readCounters(sshClient *gossh.Client) (topCounters, error) {
+	out, err := ssh.ExecuteCommand("cat /proc/stat /proc/net/dev", sshClient)
+	if err != nil {
+		return topCounters{}, errors.Wrap(err, "Failed to retrieve CPU and network usage")
+	}
+	counters := topCounters{time: time.Now()}
+	counters.cpu, err = procstat.ParseCPU(out)
+	if err != nil {
+		return counters, err
+	}
+	counters.network, err = procstat.ParseNetwork(out)
+	if err != nil {
+		return counters, err
+	}
+	return counters, nil
+}
+
+// percent rounds a percentage, keeping negative values, which mean unknown
+func percent(value float64) int {
+	if value < 0 {
+		return -1
+	}
+	return int(math.Round(value))
+}
+
+// formatNetwork renders the network rates of a sample, e.g. "1.2 KiB/s / 300 B/s"
+func formatNetwork(s topSample) string {
+	if s.NetworkIn < 0 || s.NetworkOut < 0 {
+		return "n/a"
+	}
+	return formatSize(uint64(s.NetworkIn)) + "/s / " + formatSize(uint64(s.NetworkOut)) + "/s"
+}
+
+// relativeToPeak converts values to percentages of the highest one, so that rates can be drawn as sparklines
+func relativeToPeak(values []float64) []int {
+	peak := 0.0
+	for _, value := range values {
+		peak = math.Max(peak, value)
+	}
+	percentages := []int{}
+	for _, value := range values {
+		switch {
+		case value < 0:
+			percentages = append(percentages, -1)
+		case peak == 0:
+			percentages = append(percentages, 0)
+		default:
+			percentages = append(percentages, percent(value*100/peak))
+		}
+	}
+	return percentages
+}
+
+// sparkline renders percentages as a line of bars, right aligned to topHistorySize. Unknown values are left blank
+func sparkline(values []int) string {
+	levels := sparkLevels
+	if plainOutput {
+		levels = plainSparkLevels
+	}
+	line := strings.Repeat(" ", topHistorySize-len(values))
+	for _, value := range values {
+		if value < 0 {
+			line += " "
+			continue
+		}
+		if value > 100 {
+			value = 100
+		}
+		line += string(levels[value*(len(levels)-1)/100])
+	}
+	return line
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	userconfig "github.com/protosio/cli/internal/config"
+	"github.com/protosio/cli/internal/job"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+)
+
+// defaultTunnelPorts is the range local tunnel ports are allocated from, unless changed using
+// 'protos config set tunnel-ports'
+const defaultTunnelPorts = "20000-20999"
+
+// defaultReverseProxyPort is the port of the proxy run on instances by reverse tunnels, the usual port of HTTP proxies
+const defaultReverseProxyPort = 3128
+
+// tunnelStatsInterval is how often running tunnels update the statistics in their record, and print them when asked to
+const tunnelStatsInterval = 5 * time.Second
+
+var cmdTunnel *cli.Command = &cli.Command{
+	Name:  "tunnel",
+	Usage: "Manage the SSH tunnels to instances",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List the running tunnels and the local ports they use",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "stats",
+					Usage: "Show the transfer statistics of the tunnels, updated by the tunnels every few seconds",
+				},
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listTunnels(c.Bool("stats"))
+			},
+		},
+	},
+}
+
+// tunnelRecord describes a running tunnel. Tunnels are recorded as individual files, like jobs, so that they can be
+// listed without opening the local DB
+type tunnelRecord struct {
+	Instance   string
+	ListenAddr string `json:",omitempty"` // local IP address the tunnel listens on, empty for localhost
+	LocalPort  int
+	Target     string // address the tunnel forwards to, on the instance
+	// TokenRequired indicates that the clients of the tunnel have to present the token printed when it started
+	TokenRequired bool `json:",omitempty"`
+	PID           int
+	Started       time.Time
+	// Stats are the transfer statistics as of StatsUpdated, nil until the tunnel transferred data
+	Stats        *ssh.TunnelStats `json:",omitempty"`
+	StatsUpdated time.Time
+}
+
+//
+// Tunnel methods
+//
+
+// URL returns the local URL of the dashboard reached through the tunnel, without its token
+func (r tunnelRecord) URL() string {
+	host := "localhost"
+	if ip := net.ParseIP(r.ListenAddr); ip != nil && !ip.IsUnspecified() {
+		host = r.ListenAddr
+	}
+	return fmt.Sprintf("http://%s/", net.JoinHostPort(host, strconv.Itoa(r.LocalPort)))
+}
+
+func tunnelsDir() string {
+	return filepath.Join(protosDir(), "tunnels")
+}
+
+func tunnelRecordPath(instance string) string {
+	return filepath.Join(tunnelsDir(), instance+".json")
+}
+
+func recordTunnel(record tunnelRecord) error {
+	err := os.MkdirAll(tunnelsDir(), os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", tunnelsDir())
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode tunnel")
+	}
+	// write and rename, since records are updated while other commands read them
+	path := tunnelRecordPath(record.Instance)
+	err = ioutil.WriteFile(path+".tmp", data, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record tunnel to instance '%s'", record.Instance)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to record tunnel to instance '%s'", record.Instance)
+	}
+	return nil
+}
+
+// randomToken returns a token protecting a tunnel, long enough not to be guessed
+func randomToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate tunnel token")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func removeTunnelRecord(instance string) {
+	err := os.Remove(tunnelRecordPath(instance))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove tunnel record of instance '%s': %s", instance, err.Error())
+	}
+}
+
+// runningTunnels returns the recorded tunnels whose process is still running. The records of the other ones, left
+// behind by tunnels that didn't terminate cleanly, are removed
+func runningTunnels() ([]tunnelRecord, error) {
+	files, err := ioutil.ReadDir(tunnelsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []tunnelRecord{}, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read tunnel directory '%s'", tunnelsDir())
+	}
+	tunnels := []tunnelRecord{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(tunnelsDir(), f.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read tunnel record '%s'", f.Name())
+		}
+		record := tunnelRecord{}
+		err = json.Unmarshal(data, &record)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to decode tunnel record '%s'", f.Name())
+		}
+		if !job.ProcessAlive(record.PID) {
+			removeTunnelRecord(record.Instance)
+			continue
+		}
+		tunnels = append(tunnels, record)
+	}
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Instance < tunnels[j].Instance })
+	return tunnels, nil
+}
+
+func listTunnels(stats bool) error {
+	tunnels, err := runningTunnels()
+	if err != nil {
+		return err
+	}
+
+	return printOutput(tunnels, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		if stats {
+			printTableHeader(w, "Instance", "Local port", "In", "Out", "Active", "Connections", "Last activity", "Updated")
+			for _, tunnel := range tunnels {
+				s := ssh.TunnelStats{}
+				updated := "never"
+				if tunnel.Stats != nil {
+					s = *tunnel.Stats
+					updated = formatTimeSeconds(tunnel.StatsUpdated)
+				}
+				fmt.Fprintf(w, "\n %s\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t", tunnel.Instance, tunnel.LocalPort, formatSize(s.BytesIn), formatSize(s.BytesOut), s.ActiveConnections, s.Connections, formatLastActivity(s.LastActivity), updated)
+			}
+			fmt.Fprint(w, "\n")
+			return
+		}
+		printTableHeader(w, "Instance", "Local port", "URL", "Token", "PID", "Started")
+		for _, tunnel := range tunnels {
+			token := "no"
+			if tunnel.TokenRequired {
+				token = "required"
+			}
+			fmt.Fprintf(w, "\n %s\t%d\t%s\t%s\t%d\t%s\t", tunnel.Instance, tunnel.LocalPort, tunnel.URL(), token, tunnel.PID, formatTime(tunnel.Started))
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+// reportTunnelStats updates the statistics in the record of a running tunnel every tunnelStatsInterval, and logs them
+// if verbose is set, until quit is closed. Nothing is done while the tunnel is idle
+func reportTunnelStats(tunnel *ssh.Tunnel, record tunnelRecord, verbose bool, quit chan struct{}) {
+	ticker := time.NewTicker(tunnelStatsInterval)
+	defer ticker.Stop()
+	previous := ssh.TunnelStats{}
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		stats := tunnel.Stats()
+		if stats == previous {
+			continue
+		}
+		if verbose {
+			interval := tunnelStatsInterval.Seconds()
+			log.Infof("In: %s (%s/s), out: %s (%s/s), %d active connection(s), %d in total", formatSize(stats.BytesIn), formatSize(uint64(float64(stats.BytesIn-previous.BytesIn)/interval)), formatSize(stats.BytesOut), formatSize(uint64(float64(stats.BytesOut-previous.BytesOut)/interval)), stats.ActiveConnections, stats.Connections)
+		}
+		previous = stats
+		record.Stats = &stats
+		record.StatsUpdated = time.Now()
+		err := recordTunnel(record)
+		if err != nil {
+			log.Debugf("Failed to update the tunnel statistics: %s", err.Error())
+		}
+	}
+}
+
+// reverseTunnelInstance runs a proxy on an instance, whose connections are made from this machine, until CTRL+C is
+// pressed or duration passes. The proxy only listens on the loopback of the instance, so it can't be used from outside
+func reverseTunnelInstance(name string, port int, policy ssh.ProxyPolicy, duration time.Duration) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	if port == 0 {
+		port = defaultReverseProxyPort
+	}
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return errors.Wrap(err, "Error while creating the reverse tunnel")
+	}
+	proxy := ssh.NewReverseProxy(sshClient, fmt.Sprintf("127.0.0.1:%d", port), policy, log)
+	address, err := proxy.Start()
+	if err != nil {
+		return err
+	}
+	defer proxy.Close()
+	// the DB is released while the tunnel runs, so that other commands and tunnels can be used meanwhile
+	err = releaseDB()
+	if err != nil {
+		log.Warnf("Failed to release the database: %s", err.Error())
+	}
+
+	quit := make(chan interface{}, 1)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go catchSignals(sigs, quit)
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+
+	allowed := "any host"
+	if len(policy.Hosts) > 0 {
+		allowed = strings.Join(policy.Hosts, ", ")
+	}
+	if !policy.Private {
+		allowed += " (except private addresses)"
+	}
+	log.Infof("Reverse tunnel ready. Instance '%s' can reach %s through this machine, using the proxy at %s. Press CTRL+C to terminate the tunnel", name, allowed, address)
+	fmt.Printf("On the instance, point programs to the proxy using:\n  export http_proxy=http://%s https_proxy=http://%s all_proxy=socks5h://%s\n", address, address, address)
+
+	select {
+	case <-quit:
+		log.Info("CTRL+C received. Terminating the reverse tunnel")
+	case <-timeout:
+		log.Infof("Terminating the reverse tunnel after %s", duration)
+	}
+	return proxy.Close()
+}
+
+func formatLastActivity(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return formatTimeSeconds(t)
+}
+
+// allocateTunnelPort returns the local port used for tunnels to instance. Every instance keeps the port it was
+// allocated the first time, so that URLs using it stay valid. New ports are the lowest ones in the configured range
+// that are neither allocated to another instance nor in use
+func allocateTunnelPort(instance *cloud.InstanceInfo) (int, error) {
+	tunnels, err := runningTunnels()
+	if err != nil {
+		return 0, err
+	}
+	for _, tunnel := range tunnels {
+		if tunnel.Instance == instance.Name {
+			return 0, errors.Errorf("A tunnel to instance '%s' is already running on port %d (PID %d)", instance.Name, tunnel.LocalPort, tunnel.PID)
+		}
+	}
+
+	cfg, err := userconfig.Load(configPath())
+	if err != nil {
+		return 0, err
+	}
+	portRange := cfg.TunnelPorts
+	if portRange == "" {
+		portRange = defaultTunnelPorts
+	}
+	first, last, err := parsePortRange(portRange)
+	if err != nil {
+		return 0, errors.Wrap(err, "Invalid tunnel port range")
+	}
+
+	if instance.TunnelPort >= first && instance.TunnelPort <= last {
+		if !localPortFree(instance.TunnelPort) {
+			return 0, errors.Errorf("Port %d allocated to instance '%s' is used by another program. Use --port to choose another one", instance.TunnelPort, instance.Name)
+		}
+		return instance.TunnelPort, nil
+	}
+
+	instances, err := dbp.GetAllInstances()
+	if err != nil {
+		return 0, err
+	}
+	allocated := map[int]bool{}
+	for _, other := range instances {
+		allocated[other.TunnelPort] = true
+	}
+	for port := first; port <= last; port++ {
+		if !allocated[port] && localPortFree(port) {
+			instance.TunnelPort = port
+			return port, nil
+		}
+	}
+	return 0, errors.Errorf("No free port left in tunnel port range %s. Change it using 'protos config set tunnel-ports'", portRange)
+}
+
+func localPortFree(port int) bool {
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// parsePortRange parses a port range like "20000-20999"
+func parsePortRange(value string) (int, int, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("'%s' is not a port range, e.g. 20000-20999", value)
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	last, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, errors.Errorf("'%s' is not a port range, e.g. 20000-20999", value)
+	}
+	return first, last, nil
+}
+
+func validatePortRange(value string) error {
+	_, _, err := parsePortRange(value)
+	return err
+}
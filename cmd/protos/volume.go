@@ -0,0 +1,573 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	ssh "github.com/protosio/cli/internal/ssh"
+	"github.com/urfave/cli/v2"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+var volumeSize string
+var volumeType string
+
+var cmdVolume *cli.Command = &cli.Command{
+	Name:  "volume",
+	Usage: "Manage data volumes",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "ls",
+			Usage: "List volumes",
+			Flags: []cli.Flag{
+				outputFlag(),
+			},
+			Action: func(c *cli.Context) error {
+				return listVolumes()
+			},
+		},
+		{
+			Name:      "create",
+			ArgsUsage: "<name>",
+			Usage:     "Create a new volume",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "cloud",
+					Usage:       "Specify which `CLOUD` to create the volume in",
+					Required:    true,
+					Destination: &cloudName,
+				},
+				&cli.StringFlag{
+					Name:        "location",
+					Usage:       "Specify one of the supported `LOCATION`s to create the volume in (cloud specific). Defaults to the first supported location",
+					Destination: &cloudLocation,
+				},
+				&cli.StringFlag{
+					Name:        "size",
+					Usage:       "`SIZE` of the volume, e.g. 30G",
+					Required:    true,
+					Destination: &volumeSize,
+				},
+				&cli.StringFlag{
+					Name:        "type",
+					Usage:       "`TYPE` of storage used by the volume: block (network attached) or local (on the host running the instance, faster but tied to it)",
+					Value:       cloud.BlockVolume.String(),
+					Destination: &volumeType,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				name := c.Args().Get(0)
+				if name == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				size, err := parseSize(volumeSize)
+				if err != nil {
+					return err
+				}
+				vt, err := cloud.ParseVolumeType(volumeType)
+				if err != nil {
+					return err
+				}
+				return createVolume(name, cloudName, cloudLocation, size, vt)
+			},
+		},
+		{
+			Name:      "attach",
+			ArgsUsage: "<volume id> <instance>",
+			Usage:     "Attach a volume to an instance",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				instanceName := c.Args().Get(1)
+				if id == "" || instanceName == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				instanceName, err := resolveInstanceName(instanceName)
+				if err != nil {
+					return err
+				}
+				return attachVolume(id, instanceName)
+			},
+		},
+		{
+			Name:      "detach",
+			ArgsUsage: "<volume id>",
+			Usage:     "Detach a volume from the instance it is attached to",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return detachVolume(id)
+			},
+		},
+		{
+			Name:      "resize",
+			ArgsUsage: "<volume id>",
+			Usage:     "Grow a volume to a new size",
+			Before:    snapshotDB,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "size",
+					Usage:       "New `SIZE` of the volume, e.g. 50G",
+					Required:    true,
+					Destination: &volumeSize,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				size, err := parseSize(volumeSize)
+				if err != nil {
+					return err
+				}
+				return resizeVolume(id, size)
+			},
+		},
+		{
+			Name:      "snapshot",
+			ArgsUsage: "<volume id>",
+			Usage:     "Snapshot a volume. The snapshot ID can be used to deploy instances with a copy of the volume data",
+			Before:    authorizeCloudChange,
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "`NAME` of the snapshot. Defaults to the volume name followed by the current time",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return snapshotVolume(id, c.String("name"))
+			},
+		},
+		{
+			Name:      "delete",
+			ArgsUsage: "<volume id>",
+			Usage:     "Delete a detached volume",
+			Before:    snapshotDB,
+			Action: func(c *cli.Context) error {
+				id := c.Args().Get(0)
+				if id == "" {
+					cli.ShowSubcommandHelp(c)
+					return cli.Exit("", 1)
+				}
+				return deleteVolume(id)
+			},
+		},
+	},
+}
+
+//
+// Volume methods
+//
+
+func listVolumes() error {
+	volumes, err := dbp.GetAllVolumes()
+	if err != nil {
+		return err
+	}
+
+	return printOutput(volumes, func() {
+		w := new(tabwriter.Writer)
+		w.Init(os.Stdout, 0, 0, 2, ' ', 0)
+
+		defer w.Flush()
+
+		printTableHeader(w, "ID", "Name", "Size", "Type", "Cloud", "Location", "Instance")
+		for _, volume := range volumes {
+			instanceName := volume.InstanceName
+			if instanceName == "" {
+				instanceName = "-"
+			}
+			fmt.Fprintf(w, "\n %s\t%s\t%s\t%s\t%s\t%s\t%s\t", volume.VolumeID, volume.Name, formatSize(volume.Size), volume.Type.String(), volume.CloudName, volume.Location, instanceName)
+		}
+		fmt.Fprint(w, "\n")
+	})
+}
+
+func createVolume(name string, cloudName string, location string, size int64, volumeType cloud.VolumeType) error {
+	if size < 1<<20 {
+		return errors.Errorf("Invalid size for volume '%s': should be at least 1M", name)
+	}
+
+	client, location, err := initCloudClient(cloudName, location)
+	if err != nil {
+		return err
+	}
+	if volumeType == cloud.LocalVolume && !client.Capabilities().LocalVolumes {
+		return cloud.NotSupported(client, "local volumes")
+	}
+
+	log.Infof("Creating %s volume '%s' in cloud '%s', location '%s'", volumeType, name, cloudName, location)
+	volumeID, err := client.NewVolume(name, int(size>>20), volumeType)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create volume '%s'", name)
+	}
+	volume, err := client.GetVolumeInfo(volumeID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get details for volume '%s'", name)
+	}
+	err = dbp.SaveVolume(volume)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save volume '%s'", name)
+	}
+	log.Infof("Volume '%s' (%s) created", name, volumeID)
+	return nil
+}
+
+func attachVolume(id string, instanceName string) error {
+	volume, err := dbp.GetVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve volume '%s'", id)
+	}
+	if volume.InstanceName != "" {
+		return errors.Errorf("Volume '%s' is already attached to instance '%s'", id, volume.InstanceName)
+	}
+	instance, err := dbp.GetInstance(instanceName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", instanceName)
+	}
+	if instance.CloudName != volume.CloudName || instance.Location != volume.Location {
+		return errors.Errorf("Volume '%s' (%s, %s) and instance '%s' (%s, %s) are not in the same cloud and location", id, volume.CloudName, volume.Location, instanceName, instance.CloudName, instance.Location)
+	}
+
+	client, _, err := initCloudClient(volume.CloudName, volume.Location)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Attaching volume '%s' (%s) to instance '%s'", volume.Name, id, instanceName)
+	err = client.AttachVolume(id, instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to attach volume '%s' to instance '%s'", id, instanceName)
+	}
+
+	volume.InstanceName = instanceName
+	err = dbp.SaveVolume(volume)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save volume '%s'", id)
+	}
+	return refreshInstanceVolumes(client, instance)
+}
+
+func detachVolume(id string) error {
+	volume, err := dbp.GetVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve volume '%s'", id)
+	}
+	if volume.InstanceName == "" {
+		return errors.Errorf("Volume '%s' is not attached to any instance", id)
+	}
+	instance, err := dbp.GetInstance(volume.InstanceName)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", volume.InstanceName)
+	}
+
+	client, _, err := initCloudClient(volume.CloudName, volume.Location)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Detaching volume '%s' (%s) from instance '%s'", volume.Name, id, instance.Name)
+	err = client.DettachVolume(id, instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to detach volume '%s' from instance '%s'", id, instance.Name)
+	}
+
+	volume.InstanceName = ""
+	err = dbp.SaveVolume(volume)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save volume '%s'", id)
+	}
+	return refreshInstanceVolumes(client, instance)
+}
+
+func resizeVolume(id string, size int64) error {
+	volume, err := dbp.GetVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve volume '%s'", id)
+	}
+	if uint64(size) <= volume.Size {
+		return errors.Errorf("Volume '%s' can only be grown: new size %s is not larger than the current size %s", id, formatSize(uint64(size)), formatSize(volume.Size))
+	}
+
+	volume, err = growVolume(volume, size)
+	if err != nil {
+		return err
+	}
+	if volume.InstanceName != "" {
+		log.Infof("The filesystem on volume '%s' has to be grown from instance '%s' before the new space can be used", id, volume.InstanceName)
+	}
+	return nil
+}
+
+// growVolume resizes a volume at the provider and records its new size
+func growVolume(volume cloud.VolumeInfo, size int64) (cloud.VolumeInfo, error) {
+	client, _, err := initCloudClient(volume.CloudName, volume.Location)
+	if err != nil {
+		return volume, err
+	}
+	if !client.Capabilities().VolumeResize {
+		return volume, cloud.NotSupported(client, "resizing volumes")
+	}
+
+	log.Infof("Resizing volume '%s' (%s) to %s", volume.Name, volume.VolumeID, formatSize(uint64(size)))
+	err = client.ResizeVolume(volume.VolumeID, int(size>>20))
+	if err != nil {
+		return volume, errors.Wrapf(err, "Failed to resize volume '%s'", volume.VolumeID)
+	}
+	updated, err := client.GetVolumeInfo(volume.VolumeID)
+	if err != nil {
+		return volume, errors.Wrapf(err, "Failed to get details for volume '%s'", volume.VolumeID)
+	}
+	volume.Size = updated.Size
+	err = dbp.SaveVolume(volume)
+	if err != nil {
+		return volume, errors.Wrapf(err, "Failed to save volume '%s'", volume.VolumeID)
+	}
+	return volume, nil
+}
+
+// volumeIDRegexp matches the volume IDs that can be used in shell commands without quoting
+var volumeIDRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// dataVolume returns the data volume of an instance: the one named like the instance by deploy, or its only attached
+// volume
+func dataVolume(instanceName string) (cloud.VolumeInfo, error) {
+	volumes, err := dbp.GetAllVolumes()
+	if err != nil {
+		return cloud.VolumeInfo{}, err
+	}
+	attached := []cloud.VolumeInfo{}
+	for _, vol := range volumes {
+		if vol.InstanceName != instanceName {
+			continue
+		}
+		if vol.Name == instanceName {
+			return vol, nil
+		}
+		attached = append(attached, vol)
+	}
+	if len(attached) == 1 {
+		return attached[0], nil
+	}
+	if len(attached) == 0 {
+		return cloud.VolumeInfo{}, errors.Errorf("Instance '%s' has no data volume attached", instanceName)
+	}
+	return cloud.VolumeInfo{}, errors.Errorf("Instance '%s' has %d volumes attached and none of them is its data volume. Use 'protos volume resize' instead", instanceName, len(attached))
+}
+
+// growData grows the data volume of an instance at the provider, then the filesystem on it, and checks that the new
+// space is usable. If the volume already has the requested size, e.g. because a previous attempt failed after
+// resizing it, only the filesystem is grown
+func growData(name string, size int64) error {
+	instance, err := dbp.GetInstance(name)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve instance '%s'", name)
+	}
+	volume, err := dataVolume(name)
+	if err != nil {
+		return err
+	}
+	if !volumeIDRegexp.MatchString(volume.VolumeID) {
+		return errors.Errorf("Volume ID '%s' contains unexpected characters", volume.VolumeID)
+	}
+	if uint64(size) < volume.Size {
+		return errors.Errorf("Volume '%s' can only be grown: new size %s is smaller than the current size %s", volume.VolumeID, formatSize(uint64(size)), formatSize(volume.Size))
+	}
+	if uint64(size) > volume.Size {
+		volume, err = growVolume(volume, size)
+		if err != nil {
+			return err
+		}
+	} else {
+		log.Infof("Volume '%s' (%s) is already %s. Growing its filesystem only", volume.Name, volume.VolumeID, formatSize(volume.Size))
+	}
+
+	sshClient, err := instanceSSHClient(instance, 1)
+	if err != nil {
+		return err
+	}
+	device, err := volumeDevice(volume, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to find volume '%s' on instance '%s'", volume.VolumeID, name)
+	}
+	err = growFilesystem(device, volume.Size, sshClient)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to grow the filesystem on volume '%s' of instance '%s'", volume.VolumeID, name)
+	}
+	return nil
+}
+
+// volumeDevice returns the block device of a volume on the instance, found using the /dev/disk/by-id links that
+// contain the volume ID. It waits for the device to report the size recorded for the volume, asking the kernel to
+// rescan it, since resizes done by the provider are not always noticed right away
+func volumeDevice(volume cloud.VolumeInfo, sshClient *gossh.Client) (string, error) {
+	out, err := ssh.ExecuteCommand(fmt.Sprintf(`for link in /dev/disk/by-id/*%s*; do if [ -e "$link" ]; then readlink -f "$link"; break; fi; done`, volume.VolumeID), sshClient)
+	if err != nil {
+		return "", err
+	}
+	device := strings.TrimSpace(out)
+	if device == "" {
+		return "", errors.New("No device found in /dev/disk/by-id")
+	}
+
+	rescan := fmt.Sprintf("{ echo 1 > /sys/class/block/%s/device/rescan; } 2>/dev/null; blockdev --getsize64 %s", path.Base(device), device)
+	var deviceSize uint64
+	for i := 0; i < 30; i++ {
+		out, err = ssh.ExecuteCommand(rescan, sshClient)
+		if err != nil {
+			return "", err
+		}
+		deviceSize, err = strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+		if err != nil {
+			return "", errors.Errorf("Unexpected size '%s' reported for device '%s'", strings.TrimSpace(out), device)
+		}
+		if deviceSize >= volume.Size {
+			log.Infof("Volume '%s' is device '%s' (%s)", volume.VolumeID, device, formatSize(deviceSize))
+			return device, nil
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return "", errors.Errorf("Device '%s' still reports %s instead of %s", device, formatSize(deviceSize), formatSize(volume.Size))
+}
+
+// growFilesystem grows the filesystem on device to fill it, and verifies its new size using df. Only unpartitioned
+// ext and xfs filesystems are supported, which is how the data volumes of the instances are formatted
+func growFilesystem(device string, size uint64, sshClient *gossh.Client) error {
+	out, err := ssh.ExecuteCommand("findmnt -n -o TARGET,FSTYPE --source "+device, sshClient)
+	if err != nil {
+		return errors.Errorf("Device '%s' is not mounted. Its filesystem might be on a partition, which has to be grown manually", device)
+	}
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return errors.Errorf("Unexpected mount details '%s' for device '%s'", strings.TrimSpace(out), device)
+	}
+	// mount points can contain spaces, unlike the filesystem type
+	mountPoint, fsType := strings.Join(fields[:len(fields)-1], " "), fields[len(fields)-1]
+	before, err := filesystemSize(mountPoint, sshClient)
+	if err != nil {
+		return err
+	}
+
+	var grow string
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		grow = "resize2fs " + device
+	case "xfs":
+		grow = "xfs_growfs " + shellQuote(mountPoint)
+	default:
+		return errors.Errorf("Growing %s filesystems is not supported", fsType)
+	}
+	log.Infof("Growing %s filesystem mounted on '%s'", fsType, mountPoint)
+	out, err = ssh.ExecuteCommand(grow, sshClient)
+	if err != nil {
+		return errors.Wrap(err, strings.TrimSpace(out))
+	}
+
+	after, err := filesystemSize(mountPoint, sshClient)
+	if err != nil {
+		return err
+	}
+	// the filesystem metadata takes some of the space, so the filesystem is always a bit smaller than the device
+	if after < size/10*9 {
+		return errors.Errorf("Filesystem on '%s' is %s after growing it, while the volume is %s", mountPoint, formatSize(after), formatSize(size))
+	}
+	log.Infof("Filesystem on '%s' grown from %s to %s", mountPoint, formatSize(before), formatSize(after))
+	return nil
+}
+
+// filesystemSize returns the size of the filesystem mounted on mountPoint, as reported by df
+func filesystemSize(mountPoint string, sshClient *gossh.Client) (uint64, error) {
+	out, err := ssh.ExecuteCommand("df -P -k "+shellQuote(mountPoint), sshClient)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to check the size of '%s'", mountPoint)
+	}
+	filesystems := parseDf(out)
+	if len(filesystems) == 0 {
+		return 0, errors.Errorf("Failed to check the size of '%s'", mountPoint)
+	}
+	return filesystems[0].Size, nil
+}
+
+func snapshotVolume(id string, name string) error {
+	volume, err := dbp.GetVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve volume '%s'", id)
+	}
+	if name == "" {
+		name = volume.Name + "-" + time.Now().UTC().Format("20060102-150405")
+	}
+
+	client, _, err := initCloudClient(volume.CloudName, volume.Location)
+	if err != nil {
+		return err
+	}
+	if !client.Capabilities().Snapshots {
+		return cloud.NotSupported(client, "volume snapshots")
+	}
+
+	log.Infof("Snapshotting volume '%s' (%s)", volume.Name, id)
+	snapshotID, err := client.SnapshotVolume(id, name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to snapshot volume '%s'", id)
+	}
+	log.Infof("Snapshot '%s' (%s) created. Deploy an instance using it with 'protos instance deploy --from-snapshot %s'", name, snapshotID, snapshotID)
+	return nil
+}
+
+func deleteVolume(id string) error {
+	volume, err := dbp.GetVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve volume '%s'", id)
+	}
+	if volume.InstanceName != "" {
+		return errors.Errorf("Volume '%s' is attached to instance '%s'. Detach it before deleting it", id, volume.InstanceName)
+	}
+
+	client, _, err := initCloudClient(volume.CloudName, volume.Location)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Deleting volume '%s' (%s)", volume.Name, id)
+	err = client.DeleteVolume(id)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete volume '%s'", id)
+	}
+	return dbp.DeleteVolume(id)
+}
+
+// refreshInstanceVolumes updates the volumes stored for an instance using the information from the cloud provider
+func refreshInstanceVolumes(client cloud.Provider, instance cloud.InstanceInfo) error {
+	vmInfo, err := client.GetInstanceInfo(instance.VMID)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to get details for instance '%s'", instance.Name)
+	}
+	instance.Volumes = vmInfo.Volumes
+	err = dbp.SaveInstance(instance)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
+	}
+	return nil
+}
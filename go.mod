@@ -7,7 +7,6 @@ require (
 	github.com/DataDog/zstd v1.4.4 // indirect
 	github.com/Masterminds/semver v1.5.0
 	github.com/Sereal/Sereal v0.0.0-20191211210414-3a6c62eca003 // indirect
-	github.com/asdine/genji v0.4.0
 	github.com/asdine/storm v2.1.2+incompatible
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
@@ -16,11 +15,15 @@ require (
 	github.com/pkg/errors v0.8.1
 	github.com/scaleway/scaleway-sdk-go v1.0.0-beta.5
 	github.com/sirupsen/logrus v1.4.2
+	github.com/stretchr/testify v1.4.0 // indirect
 	github.com/urfave/cli/v2 v2.0.0
 	github.com/vmihailenco/msgpack v4.0.4+incompatible // indirect
+	go.etcd.io/bbolt v1.3.3
 	golang.org/x/crypto v0.0.0-20191122220453-ac88ee75c92c
 	golang.org/x/net v0.0.0-20190628185345-da137c7871d7 // indirect
-	google.golang.org/appengine v1.6.1
-	google.golang.org/genproto v0.0.0-20200128133413-58ce757ed39b
+	golang.org/x/sys v0.0.0-20191228213918-04cbcbbfeed8 // indirect
+	google.golang.org/appengine v1.6.1 // indirect
+	google.golang.org/genproto v0.0.0-20200128133413-58ce757ed39b // indirect
+	google.golang.org/grpc v1.27.1
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
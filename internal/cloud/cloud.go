@@ -1,9 +1,19 @@
 package cloud
 
 import (
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/fuzzy"
+	"github.com/protosio/cli/internal/httpclient"
+	"github.com/protosio/cli/internal/ssh"
 )
 
 type Type string
@@ -17,18 +27,26 @@ const (
 	DigitalOcean = Type("digitalocean")
 	// Scaleway represents the Scaleway cloud provider
 	Scaleway = Type("scaleway")
+	// Fake represents a simulated cloud provider, which runs instances on the local machine
+	Fake = Type("fake")
 )
 
+// ErrNotSupported is returned by providers for operations that their API does not offer
+var ErrNotSupported = errors.New("Operation not supported by cloud provider")
+
 // SupportedProviders returns a list of supported cloud providers
 func SupportedProviders() []string {
-	return []string{Scaleway.String()}
+	return []string{Scaleway.String(), Fake.String()}
 }
 
 // ProviderInfo stores information about a cloud provider
 type ProviderInfo struct {
-	Name string `storm:"id"`
-	Type Type
-	Auth map[string]string
+	Name      string `storm:"id"`
+	Type      Type
+	Auth      map[string]string
+	RateLimit RateLimit // overrides the default API rate limit of the provider
+	// CredentialsAdded is the time the credentials in Auth were entered, zero for accounts added by older CLIs
+	CredentialsAdded time.Time
 }
 
 // Client returns a cloud provider client that can be used to run all the operations exposed by the Provider interface
@@ -37,26 +55,283 @@ func (pi ProviderInfo) Client() Provider {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if limited, ok := client.(rateLimited); ok {
+		limited.setRateLimit(pi.RateLimit)
+	}
 	return client
 }
 
+// RateLimit bounds the requests sent to the API of a cloud provider account, so that bulk operations don't get the
+// account throttled or banned
+type RateLimit struct {
+	MaxConcurrent int           // maximum number of requests in flight, 0 meaning the provider default
+	Interval      time.Duration // minimum time between the start of two requests, 0 meaning the provider default
+}
+
+// merge returns the limit with its zero values replaced by the ones in defaults
+func (rl RateLimit) merge(defaults RateLimit) RateLimit {
+	if rl.MaxConcurrent == 0 {
+		rl.MaxConcurrent = defaults.MaxConcurrent
+	}
+	if rl.Interval == 0 {
+		rl.Interval = defaults.Interval
+	}
+	return rl
+}
+
+// renamer is implemented by the providers that store resources under the name of their account
+type renamer interface {
+	rename(newName string) error
+}
+
+// RenameResources moves the resources a provider stores under the name of its account, if any, when the account is
+// renamed to newName
+func RenameResources(client Provider, newName string) error {
+	if r, ok := client.(renamer); ok {
+		return r.rename(newName)
+	}
+	return nil
+}
+
+// APIResponse is the response of a provider API to a request sent using RawRequest
+type APIResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// rawAPI is implemented by the providers whose API can be called directly
+type rawAPI interface {
+	rawRequest(method string, path string, body io.Reader) (APIResponse, error)
+}
+
+// RawRequest sends a request to the API of an initialized provider, authenticated using its credentials, e.g. to debug
+// provider specific issues. Responses with an error status are returned as well, without an error
+func RawRequest(client Provider, method string, path string, body io.Reader) (APIResponse, error) {
+	if r, ok := client.(rawAPI); ok {
+		return r.rawRequest(method, path, body)
+	}
+	return APIResponse{}, NotSupported(client, "raw API requests")
+}
+
+// imageDigester is implemented by the providers that can store the digest of the release image with an image, so that
+// the image is recognized even if it's renamed. The digest is recorded by the CLI rather than computed by the provider,
+// so it detects images that were renamed or replaced by another image under the release name, not modified ones
+type imageDigester interface {
+	setImageDigest(id string, digest string) error
+	imageDigests() (map[string]string, error)
+}
+
+// SetImageDigest records the SHA256 digest of the release image an image was created from, once it's verified
+func SetImageDigest(client Provider, id string, digest string) error {
+	if d, ok := client.(imageDigester); ok {
+		return d.setImageDigest(id, digest)
+	}
+	return NotSupported(client, "image digests")
+}
+
+// ImageDigests returns the digests recorded using SetImageDigest, by image ID, for the images of the current location.
+// Images renamed since then are included, while images replaced under the same name are not
+func ImageDigests(client Provider) (map[string]string, error) {
+	if d, ok := client.(imageDigester); ok {
+		return d.imageDigests()
+	}
+	return nil, NotSupported(client, "image digests")
+}
+
+// rateLimited is implemented by the providers that talk to a remote API
+type rateLimited interface {
+	setRateLimit(limit RateLimit)
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*httpclient.Limiter{}
+)
+
+// accountLimiter returns the limiter shared by all the clients of a cloud account, so that operations running
+// concurrently in the same process are limited together
+func accountLimiter(cloudName string, limit RateLimit) *httpclient.Limiter {
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	if limiter, found := limiters[cloudName]; found {
+		return limiter
+	}
+	limiter := httpclient.NewLimiter(limit.MaxConcurrent, limit.Interval)
+	limiters[cloudName] = limiter
+	return limiter
+}
+
 // InstanceInfo holds information about a cloud instance
 type InstanceInfo struct {
-	VMID      string
-	Name      string `storm:"id"`
-	KeySeed   []byte
-	PublicIP  string
-	CloudType Type
-	CloudName string
-	Location  string
-	Volumes   []VolumeInfo
+	VMID          string
+	Name          string `storm:"id"`
+	KeySeed       []byte `json:"-"` // kept encrypted in the keystore
+	PublicIP      string
+	CloudType     Type
+	CloudName     string
+	Location      string
+	Status        string // as last reported by the provider
+	Volumes       []VolumeInfo
+	LastSeen      time.Time // last successful SSH contact
+	BootTime      time.Time // as reported on the last contact
+	Groups        []string
+	UseSSHConfig  bool      // honor ~/.ssh/config when connecting
+	ExpiresAt     time.Time // zero means no expiry
+	MeshIP        string    // empty if not part of the mesh
+	Notes         string
+	TunnelPort    int    // 0 until the first tunnel
+	Version       string // empty if deployed by an older CLI
+	PinnedVersion string // empty if not pinned
+	MachineID     string // recorded on the first contact, to detect a reassigned IP
+	Settings      map[string]string
+	Tags          []string
+	PersonalKeys  []string // public keys authorized besides the instance key
+	BackupPolicy  *BackupPolicy
+	Image         *ImageProvenance `json:",omitempty"` // nil if deployed by an older CLI
+}
+
+// ImageProvenance records the image an instance was deployed from
+type ImageProvenance struct {
+	ID      string
+	Version string
+	Digest  string    // from the release index, empty if it lists no image for the provider
+	Source  string    // uploaded, streamed, snapshot or existing
+	URL     string    `json:",omitempty"`
+	AddedAt time.Time // zero if unknown
+}
+
+// VolumeType selects the storage backing a volume
+type VolumeType string
+
+func (vt VolumeType) String() string {
+	return string(vt)
+}
+
+const (
+	// BlockVolume is network attached storage, which survives the instance and can be moved to another instance
+	BlockVolume = VolumeType("block")
+	// LocalVolume is storage on the host running the instance, which is faster but tied to the instance
+	LocalVolume = VolumeType("local")
+)
+
+// ParseVolumeType validates a volume type provided by the user
+func ParseVolumeType(volumeType string) (VolumeType, error) {
+	switch VolumeType(volumeType) {
+	case BlockVolume, LocalVolume:
+		return VolumeType(volumeType), nil
+	}
+	return "", errors.Errorf("Volume type '%s' not supported. Supported types: %s, %s", volumeType, BlockVolume, LocalVolume)
 }
 
 // VolumeInfo holds information about a data volume
 type VolumeInfo struct {
-	VolumeID string
-	Name     string
-	Size     uint64
+	VolumeID     string `storm:"id"`
+	Name         string
+	Size         uint64 // size in bytes
+	Type         VolumeType
+	CloudName    string
+	Location     string
+	InstanceName string `storm:"index"` // name of the instance the volume is attached to, empty if detached
+}
+
+// BackupInfo records a snapshot of an instance volume taken right before the instance was deleted. The snapshot can be
+// restored using 'protos instance deploy --from-snapshot'
+type BackupInfo struct {
+	SnapshotID string `storm:"id"`
+	Name       string // name of the snapshot
+	Instance   string `storm:"index"` // name of the deleted instance
+	VolumeName string
+	Size       uint64 // size in bytes of the snapshotted volume
+	CloudName  string
+	Location   string
+	Version    string // Protos release the instance was running
+	Created    time.Time
+	// Scheduled backups are taken by 'protos backup run', and pruned according to the backup policy of the instance.
+	// Final backups, taken when deleting an instance, are never pruned
+	Scheduled bool
+}
+
+// BackupPolicy schedules the backups of an instance, taken by 'protos backup run', and sets how many are kept. The
+// newest backup of each of the last KeepDaily days, KeepWeekly weeks and KeepMonthly months is kept. All backups are
+// kept if none of them is set
+type BackupPolicy struct {
+	Schedule    string // @hourly, @daily, @weekly, @monthly, or the time between backups, e.g. 12h
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string // error of the last attempt, empty if it succeeded
+}
+
+// Capabilities describes the optional features supported by a cloud provider, so that commands can check them before
+// calling the provider API
+type Capabilities struct {
+	Reboot       bool // instances can be rebooted through the API
+	Snapshots    bool // volumes can be snapshotted
+	VolumeResize bool // volumes can be grown
+	LocalVolumes bool // volumes can use storage local to the host running the instance (see LocalVolume)
+	CustomImages bool // images can be added from a URL or a local file
+	ImageExport  bool // images can be exported and imported into another account
+	IPv6         bool // instances can be deployed without a public IPv4 address, using IPv6 only
+	UserData     bool // instances accept user data at creation
+	Events       bool // the provider reports events affecting instances, like crashes and planned maintenance
+	// SnapshotImages indicates that images can be created from a snapshot provided by a release, without uploading them
+	SnapshotImages bool
+	Tags           bool // instances and volumes can be tagged, and the tags are shown in the provider console
+	ConsoleLog     bool // the output of the instance console, e.g. its boot log, can be retrieved through the API
+	Metrics        bool // the CPU and network utilization of instances can be retrieved through the API, without SSH access
+	ImageDigests   bool // the digest of the release image an image was created from is stored with it (see SetImageDigest)
+}
+
+// MetricSample is the utilization of an instance over an interval, as measured by its provider
+type MetricSample struct {
+	Time       time.Time // end of the interval
+	CPUPercent float64
+	NetworkIn  float64 // bytes received per second
+	NetworkOut float64 // bytes sent per second
+}
+
+// Event types reported by cloud providers
+const (
+	EventCrashed     = "crashed"     // the instance stopped unexpectedly
+	EventMaintenance = "maintenance" // the provider planned a maintenance of the host running the instance
+	EventLocked      = "locked"      // the provider locked the instance, e.g. for abuse or billing reasons
+)
+
+// Event is something that happened to an instance on the provider side, outside of the control of the CLI
+type Event struct {
+	InstanceID  string // VM ID of the affected instance
+	Type        string
+	Description string
+	Time        time.Time // zero if the provider doesn't report when the event happened
+}
+
+// Usage summarizes the resources consumed by a cloud account in one location
+type Usage struct {
+	Location    string
+	Instances   int
+	Volumes     int
+	VolumesSize uint64 // total size of the volumes in bytes
+	Images      int    // private images, e.g. the Protos images
+	Snapshots   int
+	IPs         int // reserved public IPs
+	// MonthlyCost is the estimated monthly spend in EUR, based on the list prices known to the CLI, which might be outdated
+	MonthlyCost float64
+	Unpriced    int // resources missing from the known list prices, which are not part of MonthlyCost
+}
+
+// EgressPricing describes how a provider bills the traffic sent by instances to the internet in a location
+type EgressPricing struct {
+	Metered    bool
+	Included   uint64  // monthly traffic in bytes included with each instance, before it's billed
+	PricePerGB float64 // EUR per GiB sent over the included traffic, based on the list prices known to the CLI
+}
+
+// NotSupported returns the error used when a provider lacks the capability required by an operation
+func NotSupported(provider Provider, feature string) error {
+	return errors.Errorf("Cloud provider '%s' does not support %s", provider.GetInfo().Type, feature)
 }
 
 // Provider allows interactions with cloud instances and images
@@ -66,23 +341,56 @@ type Provider interface {
 	SupportedLocations() (locations []string)           // returns the supported locations for a specific cloud provider
 	Init(auth map[string]string, location string) error // a cloud provider always needs to have Init called to configure it
 	GetInfo() ProviderInfo                              // returns information that can be stored in the database and allows for re-creation of the provider
+	Capabilities() Capabilities                         // returns the optional features supported by the provider. Doesn't require Init
+	GetUsage() (Usage, error)                           // returns the resources consumed in the location the provider was initialized with
+	EgressPricing(location string) EgressPricing        // returns how the traffic sent by instances in location is billed. Doesn't require Init
 
 	// Instance methods
-	NewInstance(name string, image string, pubKey string) (id string, err error)
+	// - ipv6Only requests an instance without a public IPv4 address, reachable over IPv6 only
+	NewInstance(name string, image string, pubKey string, ipv6Only bool) (id string, err error)
 	DeleteInstance(id string) error
 	StartInstance(id string) error
 	StopInstance(id string) error
+	RebootInstance(id string) error // returns ErrNotSupported if the provider can't reboot instances (see Capabilities)
 	GetInstanceInfo(id string) (InstanceInfo, error)
+	ListInstances() ([]InstanceInfo, error)       // returns all the instances in the location, using as few API calls as possible
+	GetInstanceEvents(id string) ([]Event, error) // returns ErrNotSupported if the provider doesn't report events (see Capabilities)
+	GetConsoleLog(id string) (string, error)      // returns ErrNotSupported if the console output can't be retrieved (see Capabilities)
+	// - metrics are returned oldest first, from since on. Return ErrNotSupported if the provider doesn't measure the
+	//   utilization of instances (see Capabilities)
+	GetInstanceMetrics(id string, since time.Time) ([]MetricSample, error)
+	// - tags replace all the existing ones. Return ErrNotSupported if the provider doesn't support tags (see Capabilities)
+	GetInstanceTags(id string) (tags []string, err error)
+	SetInstanceTags(id string, tags []string) error
 	// Image methods
 	GetImages() (images map[string]string, err error)
-	AddImage(url string, hash string, version string) (id string, err error)
-	RemoveImage(name string) error
+	// - bandwidthLimit is the maximum transfer rate in bytes per second, 0 meaning unlimited
+	AddImage(url string, hash string, version string, bandwidthLimit int64) (id string, err error)
+	// - UploadLocalImage copies the image over SSH, tuned by the transfer options (e.g. parallel streams, compression)
+	UploadLocalImage(imagePath string, hash string, version string, transfer ssh.TransferOptions) (id string, err error)
+	// - StreamImage writes a raw image read by the caller (e.g. from a slow URL) directly to the provider, verifying the hash on the fly
+	StreamImage(image io.Reader, hash string, version string, bandwidthLimit int64) (id string, err error)
+	// - images are exported and imported as gzip compressed raw disk contents. Closing an export releases the provider resources used for it
+	ExportImage(id string) (image io.ReadCloser, err error)
+	ImportImage(image io.Reader, version string) (id string, err error)
+	// - snapshot is the provider specific reference found in a release (see release.CloudImage). Returns ErrNotSupported
+	//   if the provider can't create images from snapshots (see Capabilities)
+	AddImageFromSnapshot(snapshot string, version string) (id string, err error)
+	RemoveImage(id string) error
 	// Volume methods
 	// - size should by provided in megabytes
-	NewVolume(name string, size int) (id string, err error)
+	NewVolume(name string, size int, volumeType VolumeType) (id string, err error)
+	// - snapshots return ErrNotSupported if the provider can't snapshot volumes (see Capabilities). A snapshot can be
+	//   used once it is returned, and volumes created from it have its size
+	SnapshotVolume(id string, name string) (snapshotID string, err error)
+	NewVolumeFromSnapshot(name string, snapshotID string, volumeType VolumeType) (id string, err error)
+	DeleteSnapshot(snapshotID string) error
 	DeleteVolume(id string) error
+	GetVolumeInfo(id string) (VolumeInfo, error)
+	ResizeVolume(id string, size int) error
 	AttachVolume(volumeID string, instanceID string) error
 	DettachVolume(volumeID string, instanceID string) error
+	SetVolumeTags(id string, tags []string) error
 }
 
 // NewProvider creates a new cloud provider client
@@ -95,6 +403,8 @@ func NewProvider(cloudName string, cloud string) (Provider, error) {
 	// 	client, err = newDigitalOceanClient()
 	case Scaleway:
 		client = newScalewayClient(cloudName)
+	case Fake:
+		client = newFakeClient(cloudName)
 	default:
 		err = errors.Errorf("Cloud '%s' not supported", cloud)
 	}
@@ -104,6 +414,72 @@ func NewProvider(cloudName string, cloud string) (Provider, error) {
 	return client, nil
 }
 
+// Region returns the region of an availability zone named like "fr-par-2", or the location itself if it's not named
+// like a zone
+func Region(location string) string {
+	i := strings.LastIndex(location, "-")
+	if i <= 0 {
+		return location
+	}
+	if _, err := strconv.Atoi(location[i+1:]); err != nil {
+		return location
+	}
+	return location[:i]
+}
+
+// Zones returns the availability zones of a provider that are in region, in the order they are supported
+func Zones(provider Provider, region string) []string {
+	zones := []string{}
+	for _, location := range provider.SupportedLocations() {
+		if location != region && Region(location) == region {
+			zones = append(zones, location)
+		}
+	}
+	return zones
+}
+
+// ResolveLocation matches a user provided location against the locations supported by a provider. Besides exact
+// matches, it accepts case differences and unambiguous prefixes (a region like "fr-par" resolves to its first zone
+// "fr-par-1"). The returned error lists the supported locations and suggests the closest one
+func ResolveLocation(provider Provider, location string) (string, error) {
+	locations := provider.SupportedLocations()
+	if _, found := findInSlice(locations, location); found {
+		return location, nil
+	}
+
+	lower := strings.ToLower(strings.TrimSpace(location))
+	candidates := []string{}
+	for _, loc := range locations {
+		if strings.ToLower(loc) == lower {
+			return loc, nil
+		}
+		if lower != "" && strings.HasPrefix(strings.ToLower(loc), lower) {
+			candidates = append(candidates, loc)
+		}
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil
+	}
+	for _, loc := range candidates {
+		if strings.ToLower(loc) == strings.TrimSuffix(lower, "-")+"-1" {
+			return loc, nil
+		}
+	}
+
+	msg := fmt.Sprintf("Location '%s' not supported. Supported locations: %s", location, strings.Join(locations, ", "))
+	closest, distance := "", len(lower)
+	for _, loc := range locations {
+		d := fuzzy.Distance(lower, strings.ToLower(loc))
+		if d < distance {
+			closest, distance = loc, d
+		}
+	}
+	if closest != "" && distance <= 3 {
+		msg += fmt.Sprintf(". Did you mean '%s'?", closest)
+	}
+	return "", errors.New(msg)
+}
+
 func findInSlice(slice []string, value string) (int, bool) {
 	for i, item := range slice {
 		if item == value {
@@ -0,0 +1,1151 @@
+package cloud
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/protosio/cli/internal/job"
+	"github.com/protosio/cli/internal/procstat"
+	"github.com/protosio/cli/internal/ssh"
+	"github.com/sirupsen/logrus"
+)
+
+// FakeEndpointCommand is the hidden CLI command that runs the SSH endpoint of an instance deployed on the fake cloud
+// provider. The provider starts it in the background, using the current executable
+const FakeEndpointCommand = "fake-endpoint"
+
+// fakeState is everything the fake provider knows about its simulated resources. It is stored in a file because every
+// CLI invocation creates a new provider
+type fakeState struct {
+	Images       map[string]string // image name to ID
+	ImageDigests map[string]string // image ID to the digest recorded using SetImageDigest
+	Instances    map[string]*fakeInstance
+	Volumes      map[string]*fakeVolume
+	Snapshots    map[string]*fakeSnapshot
+}
+
+type fakeInstance struct {
+	ID          string
+	Name        string
+	Image       string
+	PubKey      string
+	HostKeySeed []byte
+	Address     string // address of the SSH endpoint, e.g. 127.0.0.1:40022
+	Location    string
+	Running     bool
+	Volumes     []string
+	Tags        []string
+}
+
+type fakeVolume struct {
+	ID         string
+	Name       string
+	Size       uint64 // size in bytes
+	Type       VolumeType
+	Location   string
+	InstanceID string
+	Tags       []string
+}
+
+type fakeSnapshot struct {
+	ID       string
+	Name     string
+	Size     uint64 // size in bytes
+	Location string
+}
+
+// fake is a provider that simulates instances and volumes locally, so the CLI can be used without a cloud account.
+// Instances are reachable over SSH through an endpoint process that runs commands on the local machine
+type fake struct {
+	name     string
+	dir      string
+	auth     map[string]string
+	location string
+	failures map[string]error
+	delays   map[string]time.Duration
+}
+
+// FakeFailuresEnv is the environment variable used to script failures of fake providers created by the CLI, so that
+// commands can be tested against provider errors. It holds comma separated Provider method names, optionally followed
+// by '=timeout', e.g. "AddImage,AttachVolume=timeout"
+const FakeFailuresEnv = "PROTOS_FAKE_FAIL"
+
+// FakeDirEnv is the environment variable that overrides the directory storing the simulated resources, like
+// FakeOptions.Dir
+const FakeDirEnv = "PROTOS_FAKE_DIR"
+
+// fakeMetricsInterval is the time over which the utilization of fake instances is measured
+const fakeMetricsInterval = time.Second
+
+var (
+	// ErrFakeFailure is returned by the methods of a fake provider scripted to fail
+	ErrFakeFailure = errors.New("Failure injected by the fake cloud provider")
+	// ErrFakeTimeout is returned by the methods of a fake provider scripted to time out
+	ErrFakeTimeout = errors.New("Timed out waiting for the fake cloud provider")
+)
+
+// FakeOptions scripts the behavior of a fake provider created using NewFakeClient
+type FakeOptions struct {
+	// Dir stores the simulated resources in Dir/<name>, instead of fake/<name> in the state directory. Providers with
+	// the same name and Dir see the same resources, like clients of the same cloud account
+	Dir string
+	// Failures maps Provider method names, e.g. "AddImage", to the error they return without doing anything
+	Failures map[string]error
+	// Delays maps Provider method names to how long they wait before running, e.g. to exceed the timeout of a caller
+	Delays map[string]time.Duration
+}
+
+func newFakeClient(name string) *fake {
+	f := &fake{name: name, dir: filepath.Join(dirs.State(), "fake", name), failures: map[string]error{}, delays: map[string]time.Duration{}}
+	if dir := os.Getenv(FakeDirEnv); dir != "" {
+		f.dir = filepath.Join(dir, name)
+	}
+	for _, spec := range strings.Split(os.Getenv(FakeFailuresEnv), ",") {
+		method := strings.TrimSpace(spec)
+		if method == "" {
+			continue
+		}
+		f.failures[method] = ErrFakeFailure
+		if strings.HasSuffix(method, "=timeout") {
+			delete(f.failures, method)
+			f.failures[strings.TrimSuffix(method, "=timeout")] = ErrFakeTimeout
+		}
+	}
+	return f
+}
+
+// NewFakeClient returns a fake provider whose failures can be scripted, to test code orchestrating providers. Its
+// instances are reachable over SSH only when the FakeEndpointCommand is served by the current executable
+func NewFakeClient(name string, opts FakeOptions) Provider {
+	f := newFakeClient(name)
+	if opts.Dir != "" {
+		f.dir = filepath.Join(opts.Dir, name)
+	}
+	for method, err := range opts.Failures {
+		f.failures[method] = err
+	}
+	for method, delay := range opts.Delays {
+		f.delays[method] = delay
+	}
+	return f
+}
+
+// inject runs the behavior scripted for a Provider method
+func (f *fake) inject(method string) error {
+	if delay, found := f.delays[method]; found {
+		time.Sleep(delay)
+	}
+	if err, found := f.failures[method]; found {
+		return errors.Wrapf(err, "Fake cloud '%s' %s", f.name, method)
+	}
+	return nil
+}
+
+//
+// Config methods
+//
+
+func (f *fake) SupportedLocations() []string {
+	return []string{"local-1", "local-2"}
+}
+
+func (f *fake) AuthFields() []string {
+	return []string{}
+}
+
+func (f *fake) Init(auth map[string]string, location string) error {
+	if err := f.inject("Init"); err != nil {
+		return err
+	}
+	if len(auth) > 0 {
+		return errors.New("The fake cloud provider doesn't use credentials")
+	}
+	if _, found := findInSlice(f.SupportedLocations(), location); !found {
+		return errors.Errorf("Location '%s' not supported by fake cloud provider", location)
+	}
+	err := os.MkdirAll(f.dir, os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create fake cloud directory '%s'", f.dir)
+	}
+	f.auth = map[string]string{}
+	f.location = location
+	return nil
+}
+
+func (f *fake) GetInfo() ProviderInfo {
+	return ProviderInfo{Name: f.name, Type: Fake, Auth: f.auth}
+}
+
+func (f *fake) Capabilities() Capabilities {
+	return Capabilities{
+		Reboot:       true,
+		Snapshots:    true,
+		VolumeResize: true,
+		LocalVolumes: true,
+		CustomImages: true,
+		IPv6:         true,
+		Events:       true,
+		Tags:         true,
+		ConsoleLog:   true,
+		Metrics:      true,
+		ImageDigests: true,
+	}
+}
+
+// EgressPricing simulates metered egress in local-2, so that the notes shown for such locations can be tried out
+func (f *fake) EgressPricing(location string) EgressPricing {
+	if location == "local-2" {
+		return EgressPricing{Metered: true, Included: 100 << 30, PricePerGB: 0.01}
+	}
+	return EgressPricing{}
+}
+
+// rawRequest simulates a read only API over the state of the fake cloud: GET / returns all of it, while GET /servers,
+// /images, /volumes and /snapshots return a part of it
+func (f *fake) rawRequest(method string, path string, body io.Reader) (APIResponse, error) {
+	if err := f.inject("RawRequest"); err != nil {
+		return APIResponse{}, err
+	}
+	respond := func(status int, v interface{}) (APIResponse, error) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return APIResponse{}, errors.Wrap(err, "Failed to encode fake API response")
+		}
+		return APIResponse{Status: status, Header: http.Header{"Content-Type": []string{"application/json"}}, Body: data}, nil
+	}
+	if method != http.MethodGet {
+		return respond(http.StatusMethodNotAllowed, map[string]string{"message": "The fake API is read only"})
+	}
+	state, err := f.load()
+	if err != nil {
+		return APIResponse{}, err
+	}
+	switch strings.TrimSuffix(path, "/") {
+	case "":
+		return respond(http.StatusOK, state)
+	case "/servers":
+		return respond(http.StatusOK, map[string]interface{}{"servers": state.Instances})
+	case "/images":
+		return respond(http.StatusOK, map[string]interface{}{"images": state.Images})
+	case "/volumes":
+		return respond(http.StatusOK, map[string]interface{}{"volumes": state.Volumes})
+	case "/snapshots":
+		return respond(http.StatusOK, map[string]interface{}{"snapshots": state.Snapshots})
+	}
+	return respond(http.StatusNotFound, map[string]string{"message": fmt.Sprintf("Resource '%s' not found", path)})
+}
+
+// GetUsage counts the simulated resources. Fake resources are free
+func (f *fake) GetUsage() (Usage, error) {
+	if err := f.inject("GetUsage"); err != nil {
+		return Usage{}, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return Usage{}, errors.Wrap(err, "Failed to retrieve fake cloud usage")
+	}
+	usage := Usage{Location: f.location, Images: len(state.Images)}
+	for _, inst := range state.Instances {
+		if inst.Location == f.location {
+			usage.Instances++
+		}
+	}
+	for _, vol := range state.Volumes {
+		if vol.Location == f.location {
+			usage.Volumes++
+			usage.VolumesSize += vol.Size
+		}
+	}
+	for _, snapshot := range state.Snapshots {
+		if snapshot.Location == f.location {
+			usage.Snapshots++
+		}
+	}
+	return usage, nil
+}
+
+//
+// Instance methods
+//
+
+func (f *fake) NewInstance(name string, imageID string, pubKey string, ipv6Only bool) (string, error) {
+	if err := f.inject("NewInstance"); err != nil {
+		return "", err
+	}
+	id := newFakeID()
+	err := f.update(func(state *fakeState) error {
+		found := false
+		for _, imgID := range state.Images {
+			if imgID == imageID {
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("Image '%s' not found", imageID)
+		}
+
+		hostKey, err := ssh.GenerateKey()
+		if err != nil {
+			return err
+		}
+		host := "127.0.0.1"
+		if ipv6Only {
+			host = "::1"
+		}
+		address, err := freeAddress(host)
+		if err != nil {
+			return err
+		}
+		state.Instances[id] = &fakeInstance{
+			ID:          id,
+			Name:        name,
+			Image:       imageID,
+			PubKey:      pubKey,
+			HostKeySeed: hostKey.Seed(),
+			Address:     address,
+			Location:    f.location,
+		}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create fake instance")
+	}
+	return id, nil
+}
+
+func (f *fake) DeleteInstance(id string) error {
+	if err := f.inject("DeleteInstance"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		inst, found := state.Instances[id]
+		if !found {
+			return errors.Errorf("Instance '%s' not found", id)
+		}
+		if inst.Running {
+			return errors.Errorf("Instance '%s' must be stopped before being deleted", id)
+		}
+		for _, volID := range inst.Volumes {
+			if vol, found := state.Volumes[volID]; found {
+				vol.InstanceID = ""
+			}
+		}
+		delete(state.Instances, id)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete instance '%s'", id)
+	}
+	return os.RemoveAll(filepath.Join(f.dir, id))
+}
+
+func (f *fake) StartInstance(id string) error {
+	if err := f.inject("StartInstance"); err != nil {
+		return err
+	}
+	address := ""
+	err := f.update(func(state *fakeState) error {
+		inst, found := state.Instances[id]
+		if !found {
+			return errors.Errorf("Instance '%s' not found", id)
+		}
+		inst.Running = true
+		address = inst.Address
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to start fake instance")
+	}
+	if endpointReachable(address) {
+		return nil
+	}
+
+	err = f.startEndpoint(id)
+	if err != nil {
+		return errors.Wrap(err, "Failed to start fake instance")
+	}
+	for i := 0; i < 50; i++ {
+		if endpointReachable(address) {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.Errorf("Failed to start fake instance. SSH endpoint not reachable at '%s'. Check '%s' for details", address, filepath.Join(f.dir, id, "endpoint.log"))
+}
+
+func (f *fake) StopInstance(id string) error {
+	if err := f.inject("StopInstance"); err != nil {
+		return err
+	}
+	// the endpoint exits by itself once it sees the instance is not running anymore
+	err := f.update(func(state *fakeState) error {
+		inst, found := state.Instances[id]
+		if !found {
+			return errors.Errorf("Instance '%s' not found", id)
+		}
+		inst.Running = false
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to stop fake instance")
+	}
+	return nil
+}
+
+func (f *fake) RebootInstance(id string) error {
+	if err := f.inject("RebootInstance"); err != nil {
+		return err
+	}
+	state, err := f.load()
+	if err != nil {
+		return errors.Wrap(err, "Failed to reboot fake instance")
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return errors.Errorf("Failed to reboot fake instance. Instance '%s' not found", id)
+	}
+	if !inst.Running {
+		return errors.Errorf("Failed to reboot fake instance. Instance '%s' is not running", id)
+	}
+	return nil
+}
+
+func (f *fake) GetInstanceInfo(id string) (InstanceInfo, error) {
+	if err := f.inject("GetInstanceInfo"); err != nil {
+		return InstanceInfo{}, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return InstanceInfo{}, errors.Wrapf(err, "Failed to retrieve fake instance (%s) information", id)
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return InstanceInfo{}, errors.Errorf("Failed to retrieve fake instance (%s) information. Instance not found", id)
+	}
+	return f.instanceInfo(state, id, inst), nil
+}
+
+func (f *fake) ListInstances() ([]InstanceInfo, error) {
+	if err := f.inject("ListInstances"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve fake instances")
+	}
+	instances := []InstanceInfo{}
+	for id, inst := range state.Instances {
+		if inst.Location == f.location {
+			instances = append(instances, f.instanceInfo(state, id, inst))
+		}
+	}
+	return instances, nil
+}
+
+func (f *fake) GetInstanceTags(id string) ([]string, error) {
+	if err := f.inject("GetInstanceTags"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve fake instance (%s) information", id)
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return nil, errors.Errorf("Failed to retrieve fake instance (%s) information. Instance not found", id)
+	}
+	return inst.Tags, nil
+}
+
+func (f *fake) SetInstanceTags(id string, tags []string) error {
+	if err := f.inject("SetInstanceTags"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		inst, found := state.Instances[id]
+		if !found {
+			return errors.Errorf("Instance '%s' not found", id)
+		}
+		inst.Tags = tags
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag fake instance '%s'", id)
+	}
+	return nil
+}
+
+// GetInstanceEvents reports running instances whose SSH endpoint is gone as crashed, e.g. after the endpoint process
+// was killed
+func (f *fake) GetInstanceEvents(id string) ([]Event, error) {
+	if err := f.inject("GetInstanceEvents"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve fake instance (%s) information", id)
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return nil, errors.Errorf("Failed to retrieve fake instance (%s) information. Instance not found", id)
+	}
+	events := []Event{}
+	if inst.Running {
+		conn, err := net.DialTimeout("tcp", inst.Address, 2*time.Second)
+		if err != nil {
+			events = append(events, Event{InstanceID: id, Type: EventCrashed, Description: "SSH endpoint is not running"})
+		} else {
+			conn.Close()
+		}
+	}
+	return events, nil
+}
+
+// GetConsoleLog returns the log of the SSH endpoint of the instance, which stands in for its console
+func (f *fake) GetConsoleLog(id string) (string, error) {
+	if err := f.inject("GetConsoleLog"); err != nil {
+		return "", err
+	}
+	state, err := f.load()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to retrieve fake instance (%s) information", id)
+	}
+	if _, found := state.Instances[id]; !found {
+		return "", errors.Errorf("Failed to retrieve fake instance (%s) information. Instance not found", id)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, id, "endpoint.log"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "Failed to read console log of fake instance '%s'", id)
+	}
+	return string(data), nil
+}
+
+// GetInstanceMetrics measures the utilization of the local machine, which runs the commands of the fake instances, over
+// one second. Only the current utilization is returned, regardless of since, and none for stopped instances
+func (f *fake) GetInstanceMetrics(id string, since time.Time) ([]MetricSample, error) {
+	if err := f.inject("GetInstanceMetrics"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve fake instance (%s) information", id)
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return nil, errors.Errorf("Failed to retrieve fake instance (%s) information. Instance not found", id)
+	}
+	if !inst.Running {
+		return []MetricSample{}, nil
+	}
+
+	read := func() (procstat.CPU, procstat.Network, error) {
+		stat, err := ioutil.ReadFile("/proc/stat")
+		if err != nil {
+			return procstat.CPU{}, procstat.Network{}, errors.Wrap(err, "Failed to measure fake instance CPU")
+		}
+		netDev, err := ioutil.ReadFile("/proc/net/dev")
+		if err != nil {
+			return procstat.CPU{}, procstat.Network{}, errors.Wrap(err, "Failed to measure fake instance network")
+		}
+		cpu, err := procstat.ParseCPU(string(stat))
+		if err != nil {
+			return procstat.CPU{}, procstat.Network{}, err
+		}
+		network, err := procstat.ParseNetwork(string(netDev))
+		return cpu, network, err
+	}
+	cpu, network, err := read()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(fakeMetricsInterval)
+	nextCPU, nextNetwork, err := read()
+	if err != nil {
+		return nil, err
+	}
+	seconds := fakeMetricsInterval.Seconds()
+	return []MetricSample{{
+		Time:       time.Now(),
+		CPUPercent: procstat.Utilization(cpu, nextCPU),
+		NetworkIn:  float64(nextNetwork.Received-network.Received) / seconds,
+		NetworkOut: float64(nextNetwork.Sent-network.Sent) / seconds,
+	}}, nil
+}
+
+//
+// Images methods
+//
+
+func (f *fake) GetImages() (map[string]string, error) {
+	if err := f.inject("GetImages"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return map[string]string{}, errors.Wrap(err, "Failed to retrieve fake images")
+	}
+	return state.Images, nil
+}
+
+func (f *fake) AddImage(url string, hash string, version string, bandwidthLimit int64) (string, error) {
+	if err := f.inject("AddImage"); err != nil {
+		return "", err
+	}
+	// nothing is downloaded, the image only needs to exist for instances to use it
+	return f.addImage(version)
+}
+
+func (f *fake) UploadLocalImage(imagePath string, hash string, version string, transfer ssh.TransferOptions) (string, error) {
+	if err := f.inject("UploadLocalImage"); err != nil {
+		return "", err
+	}
+	_, err := os.Stat(imagePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read image '%s'", imagePath)
+	}
+	return f.addImage(version)
+}
+
+func (f *fake) StreamImage(image io.Reader, hash string, version string, bandwidthLimit int64) (string, error) {
+	if err := f.inject("StreamImage"); err != nil {
+		return "", err
+	}
+	digest := sha256.New()
+	_, err := io.Copy(digest, ssh.NewRateLimitedReader(image, bandwidthLimit))
+	if err != nil {
+		return "", errors.Wrap(err, "Error streaming Protos VM image")
+	}
+	streamedHash := hex.EncodeToString(digest.Sum(nil))
+	if streamedHash != hash {
+		return "", errors.Errorf("Error streaming Protos VM image. Integrity check failed: expected digest '%s' but got '%s'", hash, streamedHash)
+	}
+	return f.addImage(version)
+}
+
+func (f *fake) ExportImage(id string) (io.ReadCloser, error) {
+	if err := f.inject("ExportImage"); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotSupported
+}
+
+func (f *fake) ImportImage(image io.Reader, version string) (string, error) {
+	if err := f.inject("ImportImage"); err != nil {
+		return "", err
+	}
+	return "", ErrNotSupported
+}
+
+func (f *fake) AddImageFromSnapshot(snapshot string, version string) (string, error) {
+	if err := f.inject("AddImageFromSnapshot"); err != nil {
+		return "", err
+	}
+	return "", ErrNotSupported
+}
+
+func (f *fake) RemoveImage(id string) error {
+	if err := f.inject("RemoveImage"); err != nil {
+		return err
+	}
+	return f.update(func(state *fakeState) error {
+		for name, imgID := range state.Images {
+			if imgID == id || name == id {
+				delete(state.Images, name)
+				delete(state.ImageDigests, imgID)
+			}
+		}
+		return nil
+	})
+}
+
+func (f *fake) setImageDigest(id string, digest string) error {
+	if err := f.inject("SetImageDigest"); err != nil {
+		return err
+	}
+	return f.update(func(state *fakeState) error {
+		for _, imgID := range state.Images {
+			if imgID == id {
+				state.ImageDigests[id] = digest
+				return nil
+			}
+		}
+		return errors.Errorf("Fake image '%s' not found", id)
+	})
+}
+
+func (f *fake) imageDigests() (map[string]string, error) {
+	if err := f.inject("ImageDigests"); err != nil {
+		return nil, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve fake image digests")
+	}
+	digests := map[string]string{}
+	for _, id := range state.Images {
+		if digest, found := state.ImageDigests[id]; found {
+			digests[id] = digest
+		}
+	}
+	return digests, nil
+}
+
+//
+// Volumes methods
+//
+
+func (f *fake) NewVolume(name string, size int, volumeType VolumeType) (string, error) {
+	if err := f.inject("NewVolume"); err != nil {
+		return "", err
+	}
+	id := newFakeID()
+	err := f.update(func(state *fakeState) error {
+		state.Volumes[id] = &fakeVolume{ID: id, Name: name, Size: uint64(size * 1048576), Type: volumeType, Location: f.location}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create fake volume")
+	}
+	return id, nil
+}
+
+func (f *fake) SnapshotVolume(id string, name string) (string, error) {
+	if err := f.inject("SnapshotVolume"); err != nil {
+		return "", err
+	}
+	snapshotID := newFakeID()
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[id]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", id)
+		}
+		state.Snapshots[snapshotID] = &fakeSnapshot{ID: snapshotID, Name: name, Size: vol.Size, Location: vol.Location}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to snapshot fake volume '%s'", id)
+	}
+	return snapshotID, nil
+}
+
+func (f *fake) NewVolumeFromSnapshot(name string, snapshotID string, volumeType VolumeType) (string, error) {
+	if err := f.inject("NewVolumeFromSnapshot"); err != nil {
+		return "", err
+	}
+	id := newFakeID()
+	err := f.update(func(state *fakeState) error {
+		snapshot, found := state.Snapshots[snapshotID]
+		if !found {
+			return errors.Errorf("Snapshot '%s' not found", snapshotID)
+		}
+		if snapshot.Location != f.location {
+			return errors.Errorf("Snapshot '%s' is in location '%s'", snapshotID, snapshot.Location)
+		}
+		state.Volumes[id] = &fakeVolume{ID: id, Name: name, Size: snapshot.Size, Type: volumeType, Location: f.location}
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create fake volume from snapshot '%s'", snapshotID)
+	}
+	return id, nil
+}
+
+func (f *fake) DeleteSnapshot(snapshotID string) error {
+	if err := f.inject("DeleteSnapshot"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		if _, found := state.Snapshots[snapshotID]; !found {
+			return errors.Errorf("Snapshot '%s' not found", snapshotID)
+		}
+		delete(state.Snapshots, snapshotID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete fake snapshot '%s'", snapshotID)
+	}
+	return nil
+}
+
+func (f *fake) DeleteVolume(id string) error {
+	if err := f.inject("DeleteVolume"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[id]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", id)
+		}
+		if vol.InstanceID != "" {
+			return errors.Errorf("Volume '%s' is attached to instance '%s'", id, vol.InstanceID)
+		}
+		delete(state.Volumes, id)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete fake volume '%s'", id)
+	}
+	return nil
+}
+
+func (f *fake) GetVolumeInfo(id string) (VolumeInfo, error) {
+	if err := f.inject("GetVolumeInfo"); err != nil {
+		return VolumeInfo{}, err
+	}
+	state, err := f.load()
+	if err != nil {
+		return VolumeInfo{}, errors.Wrapf(err, "Failed to retrieve fake volume '%s'", id)
+	}
+	vol, found := state.Volumes[id]
+	if !found {
+		return VolumeInfo{}, errors.Errorf("Failed to retrieve fake volume '%s'. Volume not found", id)
+	}
+	instanceName := ""
+	if inst, found := state.Instances[vol.InstanceID]; found {
+		instanceName = inst.Name
+	}
+	return f.volumeInfo(vol, instanceName), nil
+}
+
+func (f *fake) ResizeVolume(id string, size int) error {
+	if err := f.inject("ResizeVolume"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[id]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", id)
+		}
+		newSize := uint64(size * 1048576)
+		if newSize < vol.Size {
+			return errors.New("Volumes can only be grown")
+		}
+		vol.Size = newSize
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to resize fake volume '%s'", id)
+	}
+	return nil
+}
+
+func (f *fake) SetVolumeTags(id string, tags []string) error {
+	if err := f.inject("SetVolumeTags"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[id]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", id)
+		}
+		vol.Tags = tags
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag fake volume '%s'", id)
+	}
+	return nil
+}
+
+func (f *fake) AttachVolume(volumeID string, instanceID string) error {
+	if err := f.inject("AttachVolume"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[volumeID]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", volumeID)
+		}
+		inst, found := state.Instances[instanceID]
+		if !found {
+			return errors.Errorf("Instance '%s' not found", instanceID)
+		}
+		if vol.InstanceID != "" {
+			return errors.Errorf("Volume '%s' is already attached to instance '%s'", volumeID, vol.InstanceID)
+		}
+		vol.InstanceID = instanceID
+		inst.Volumes = append(inst.Volumes, volumeID)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to attach fake volume '%s' to instance '%s'", volumeID, instanceID)
+	}
+	return nil
+}
+
+func (f *fake) DettachVolume(volumeID string, instanceID string) error {
+	if err := f.inject("DettachVolume"); err != nil {
+		return err
+	}
+	err := f.update(func(state *fakeState) error {
+		vol, found := state.Volumes[volumeID]
+		if !found {
+			return errors.Errorf("Volume '%s' not found", volumeID)
+		}
+		if inst, found := state.Instances[vol.InstanceID]; found {
+			for i, id := range inst.Volumes {
+				if id == volumeID {
+					inst.Volumes = append(inst.Volumes[:i], inst.Volumes[i+1:]...)
+					break
+				}
+			}
+		}
+		vol.InstanceID = ""
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to detach fake volume '%s' from instance '%s'", volumeID, instanceID)
+	}
+	return nil
+}
+
+//
+// Endpoint methods
+//
+
+// ServeFakeInstance runs the SSH endpoint of an instance deployed on the fake cloud provider, until the instance is
+// stopped or deleted. Commands are executed in the instance directory, and commands that would power off the local
+// machine (reboot, poweroff, shutdown) are replaced by stubs
+func ServeFakeInstance(cloudName string, id string, logger *logrus.Logger) error {
+	f := newFakeClient(cloudName)
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	inst, found := state.Instances[id]
+	if !found {
+		return errors.Errorf("Fake instance '%s' not found", id)
+	}
+	hostKey, err := ssh.NewKeyFromSeed(inst.HostKeySeed)
+	if err != nil {
+		return errors.Wrapf(err, "Fake instance '%s' has an invalid host key", id)
+	}
+
+	workDir := filepath.Join(f.dir, id)
+	binDir := filepath.Join(workDir, "bin")
+	err = os.MkdirAll(binDir, os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create directory for fake instance '%s'", id)
+	}
+	for _, stub := range []string{"reboot", "poweroff", "shutdown"} {
+		err = ioutil.WriteFile(filepath.Join(binDir, stub), []byte("#!/bin/sh\n# simulated by the fake cloud provider\nexit 0\n"), os.FileMode(0700))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create directory for fake instance '%s'", id)
+		}
+	}
+	env := append(os.Environ(), "HOME="+workDir, "PATH="+binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	server, err := ssh.NewServer(hostKey, inst.PubKey, workDir, env, logger)
+	if err != nil {
+		return err
+	}
+	// a previous endpoint might still be shutting down after a quick stop and start
+	var listener net.Listener
+	for i := 0; i < 25; i++ {
+		listener, err = net.Listen("tcp", inst.Address)
+		if err == nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen on '%s'", inst.Address)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+	logger.Infof("Fake instance '%s' (%s) accepting SSH connections on '%s'", inst.Name, id, inst.Address)
+
+	for {
+		time.Sleep(500 * time.Millisecond)
+		state, err := f.load()
+		if err != nil {
+			return err
+		}
+		if inst, found := state.Instances[id]; !found || !inst.Running {
+			logger.Infof("Fake instance '%s' stopped", id)
+			return nil
+		}
+	}
+}
+
+// startEndpoint runs the SSH endpoint of an instance in a background process
+func (f *fake) startEndpoint(id string) error {
+	workDir := filepath.Join(f.dir, id)
+	err := os.MkdirAll(workDir, os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create directory for fake instance '%s'", id)
+	}
+	logFile, err := os.OpenFile(filepath.Join(workDir, "endpoint.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create log file for fake instance '%s'", id)
+	}
+	defer logFile.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start SSH endpoint")
+	}
+	endpoint := exec.Command(executable, FakeEndpointCommand, f.name, id)
+	// the endpoint must not be mistaken for the worker of a background job, and reads the state from the directory
+	// of this provider
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "PROTOS_JOB_ID=") && !strings.HasPrefix(v, FakeDirEnv+"=") {
+			endpoint.Env = append(endpoint.Env, v)
+		}
+	}
+	endpoint.Env = append(endpoint.Env, FakeDirEnv+"="+filepath.Dir(f.dir))
+	endpoint.Stdout = logFile
+	endpoint.Stderr = logFile
+	job.Detach(endpoint)
+	err = endpoint.Start()
+	if err != nil {
+		return errors.Wrap(err, "Failed to start SSH endpoint")
+	}
+	return endpoint.Process.Release()
+}
+
+//
+// helper methods
+//
+
+func (f *fake) statePath() string {
+	return filepath.Join(f.dir, "state.json")
+}
+
+// rename moves the simulated resources to the directory of newName. Running instances would stop, since their SSH
+// endpoints find their state using the name of the cloud, so they have to be stopped first
+func (f *fake) rename(newName string) error {
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	for _, inst := range state.Instances {
+		if inst.Running {
+			return errors.Errorf("Fake cloud '%s' has running instances. Stop them before renaming it", f.name)
+		}
+	}
+	// endpoints of recently stopped instances take a moment to notice it, and would otherwise still accept connections
+	// while their state is moved, making a start right after the rename think the instance is already up
+	for _, inst := range state.Instances {
+		for i := 0; i < 25 && endpointReachable(inst.Address); i++ {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}
+	dir := filepath.Join(filepath.Dir(f.dir), newName)
+	if _, err := os.Stat(dir); err == nil {
+		return errors.Errorf("Fake cloud '%s' already has resources in '%s'", newName, dir)
+	}
+	err = os.Rename(f.dir, dir)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to move the resources of fake cloud '%s'", f.name)
+	}
+	f.name = newName
+	f.dir = dir
+	return nil
+}
+
+func (f *fake) load() (fakeState, error) {
+	state := fakeState{Images: map[string]string{}, ImageDigests: map[string]string{}, Instances: map[string]*fakeInstance{}, Volumes: map[string]*fakeVolume{}, Snapshots: map[string]*fakeSnapshot{}}
+	data, err := ioutil.ReadFile(f.statePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return state, errors.Wrapf(err, "Failed to read fake cloud state '%s'", f.statePath())
+	}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return state, errors.Wrapf(err, "Failed to decode fake cloud state '%s'", f.statePath())
+	}
+	return state, nil
+}
+
+// update loads the state, applies fn to it and saves it, unless fn returns an error
+func (f *fake) update(fn func(state *fakeState) error) error {
+	state, err := f.load()
+	if err != nil {
+		return err
+	}
+	err = fn(&state)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode fake cloud state")
+	}
+	// write and rename, so running endpoints never see a partially written state
+	err = ioutil.WriteFile(f.statePath()+".tmp", data, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save fake cloud state '%s'", f.statePath())
+	}
+	return os.Rename(f.statePath()+".tmp", f.statePath())
+}
+
+func (f *fake) addImage(version string) (string, error) {
+	id := newFakeID()
+	err := f.update(func(state *fakeState) error {
+		state.Images["protos-"+version] = id
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to add Protos image")
+	}
+	return id, nil
+}
+
+func (f *fake) instanceInfo(state fakeState, id string, inst *fakeInstance) InstanceInfo {
+	info := InstanceInfo{VMID: id, Name: inst.Name, PublicIP: inst.Address, CloudName: f.name, CloudType: Fake, Location: inst.Location, Status: "stopped"}
+	if inst.Running {
+		info.Status = "running"
+	}
+	for _, volID := range inst.Volumes {
+		if vol, found := state.Volumes[volID]; found {
+			info.Volumes = append(info.Volumes, f.volumeInfo(vol, inst.Name))
+		}
+	}
+	return info
+}
+
+func (f *fake) volumeInfo(vol *fakeVolume, instanceName string) VolumeInfo {
+	return VolumeInfo{VolumeID: vol.ID, Name: vol.Name, Size: vol.Size, Type: vol.Type, CloudName: f.name, Location: vol.Location, InstanceName: instanceName}
+}
+
+func newFakeID() string {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	return hex.EncodeToString(idBytes)
+}
+
+// freeAddress returns an address on host with a port that is currently not in use
+func freeAddress(host string) (string, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to find a free port on '%s'", host)
+	}
+	defer listener.Close()
+	return listener.Addr().String(), nil
+}
+
+func endpointReachable(address string) bool {
+	conn, err := net.DialTimeout("tcp", address, 200*time.Millisecond)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -1,23 +1,48 @@
 package cloud
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/httpclient"
 	"github.com/protosio/cli/internal/ssh"
 	account "github.com/scaleway/scaleway-sdk-go/api/account/v2alpha1"
 	"github.com/scaleway/scaleway-sdk-go/api/instance/v1"
 	"github.com/scaleway/scaleway-sdk-go/api/marketplace/v1"
 	"github.com/scaleway/scaleway-sdk-go/scw"
 	log "github.com/sirupsen/logrus"
+	gossh "golang.org/x/crypto/ssh"
 )
 
 const (
 	scalewayArch = "x86_64"
 	uploadSSHkey = "protos-upload-key"
+	// scalewaySnapshotTimeout is how long to wait for a volume snapshot to become available
+	scalewaySnapshotTimeout = 30 * time.Minute
+	// scalewayAPIURL is the endpoint of all the Scaleway APIs
+	scalewayAPIURL = "https://api.scaleway.com"
+	// scalewayDigestTag prefixes the image tag storing the digest of the release image an image was created from
+	scalewayDigestTag = "protos-digest="
 )
 
+// scalewayAPIPath matches the paths that include the API they are sent to, e.g. /instance/v1/zones/fr-par-1/servers
+var scalewayAPIPath = regexp.MustCompile(`^/[a-z-]+/v[0-9][a-z0-9]*/`)
+
+// scalewayRateLimit is the default API rate limit, which stays well below the limits enforced by Scaleway
+var scalewayRateLimit = RateLimit{MaxConcurrent: 4, Interval: 100 * time.Millisecond}
+
 type scalewayCredentials struct {
 	organisationID string
 	accessKey      string
@@ -28,15 +53,17 @@ type scaleway struct {
 	name           string
 	credentials    *scalewayCredentials
 	client         *scw.Client
+	httpClient     *http.Client
 	instanceAPI    *instance.API
 	accountAPI     *account.API
 	marketplaceAPI *marketplace.API
 	auth           map[string]string
 	location       scw.Zone
+	rateLimit      RateLimit
 }
 
 func newScalewayClient(name string) *scaleway {
-	return &scaleway{name: name}
+	return &scaleway{name: name, rateLimit: scalewayRateLimit}
 }
 
 //
@@ -44,7 +71,8 @@ func newScalewayClient(name string) *scaleway {
 //
 
 func (sw *scaleway) SupportedLocations() []string {
-	return []string{string(scw.ZoneFrPar1), string(scw.ZoneFrPar2), string(scw.ZoneNlAms1)}
+	// zones opened after the SDK release in use are not among its constants
+	return []string{string(scw.ZoneFrPar1), string(scw.ZoneFrPar2), "fr-par-3", string(scw.ZoneNlAms1), "nl-ams-2"}
 }
 
 func (sw *scaleway) AuthFields() []string {
@@ -80,9 +108,11 @@ func (sw *scaleway) Init(auth map[string]string, location string) error {
 	}
 
 	sw.credentials = scwCredentials
+	sw.httpClient = httpclient.NewLimited(30*time.Second, accountLimiter(sw.name, sw.rateLimit))
 	sw.client, err = scw.NewClient(
 		scw.WithDefaultOrganizationID(scwCredentials.organisationID),
 		scw.WithAuth(scwCredentials.accessKey, scwCredentials.secretKey),
+		scw.WithHTTPClient(sw.httpClient),
 	)
 	if err != nil {
 		return errors.Wrap(err, "Failed to init Scaleway client")
@@ -102,6 +132,158 @@ func (sw *scaleway) GetInfo() ProviderInfo {
 	return ProviderInfo{Name: sw.name, Type: Scaleway, Auth: sw.auth}
 }
 
+func (sw *scaleway) setRateLimit(limit RateLimit) {
+	sw.rateLimit = limit.merge(scalewayRateLimit)
+}
+
+func (sw *scaleway) Capabilities() Capabilities {
+	return Capabilities{
+		Reboot:       true,
+		Snapshots:    true,
+		VolumeResize: true,
+		LocalVolumes: true,
+		CustomImages: true,
+		ImageExport:  true,
+		IPv6:         true,
+		UserData:     true,
+		Events:       true,
+		// snapshots are imported from object storage
+		SnapshotImages: true,
+		Tags:           true,
+		ImageDigests:   true,
+	}
+}
+
+// scalewayServerPrices are the monthly list prices in EUR of the instance types, excluding VAT
+var scalewayServerPrices = map[string]float64{
+	"DEV1-S":  2.99,
+	"DEV1-M":  7.99,
+	"DEV1-L":  15.99,
+	"DEV1-XL": 23.99,
+	"GP1-XS":  39.00,
+	"GP1-S":   79.00,
+	"GP1-M":   159.00,
+}
+
+const (
+	scalewayBlockVolumePrice = 0.08 // monthly EUR per GB of block volume
+	scalewaySnapshotPrice    = 0.04 // monthly EUR per GB of snapshot, including the snapshots backing images
+	scalewayIPPrice          = 1.00 // monthly EUR per reserved IP
+)
+
+// rawRequest sends a request to the Scaleway API. Paths starting with an API name and version, like
+// /account/v2alpha1/ssh-keys, are sent as is, while shorter ones like /servers are relative to the instance API in the
+// current zone
+func (sw *scaleway) rawRequest(method string, path string, body io.Reader) (APIResponse, error) {
+	if !scalewayAPIPath.MatchString(path) {
+		path = fmt.Sprintf("/instance/v1/zones/%s/%s", sw.location, strings.TrimPrefix(path, "/"))
+	}
+	req, err := http.NewRequest(method, scalewayAPIURL+path, body)
+	if err != nil {
+		return APIResponse{}, errors.Wrap(err, "Failed to create Scaleway API request")
+	}
+	req.Header.Set("X-Auth-Token", sw.credentials.secretKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := sw.httpClient.Do(req)
+	if err != nil {
+		return APIResponse{}, errors.Wrap(err, "Failed to send Scaleway API request")
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return APIResponse{}, errors.Wrap(err, "Failed to read Scaleway API response")
+	}
+	return APIResponse{Status: resp.StatusCode, Header: resp.Header, Body: data}, nil
+}
+
+// jsonRequest sends a request with a JSON body using rawRequest, for the API calls the SDK doesn't expose, and decodes
+// the JSON response into result. Responses with an error status are returned as errors
+func (sw *scaleway) jsonRequest(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode Scaleway API request")
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	resp, err := sw.rawRequest(method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	if resp.Status >= 300 {
+		return errors.Errorf("Scaleway API returned status %d: %s", resp.Status, strings.TrimSpace(string(resp.Body)))
+	}
+	err = json.Unmarshal(resp.Body, result)
+	if err != nil {
+		return errors.Wrap(err, "Failed to decode Scaleway API response")
+	}
+	return nil
+}
+
+// EgressPricing returns unmetered egress, since the traffic of instances is included in their price in all the zones
+func (sw *scaleway) EgressPricing(location string) EgressPricing {
+	return EgressPricing{}
+}
+
+// GetUsage lists the resources of the account in the current zone. Local volumes are included in the price of the
+// instances they belong to
+func (sw *scaleway) GetUsage() (Usage, error) {
+	usage := Usage{Location: string(sw.location)}
+	org := sw.credentials.organisationID
+
+	servers, err := sw.instanceAPI.ListServers(&instance.ListServersRequest{Zone: sw.location, Organization: &org}, scw.WithAllPages())
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve Scaleway instances")
+	}
+	for _, srv := range servers.Servers {
+		usage.Instances++
+		price, found := scalewayServerPrices[srv.CommercialType]
+		if !found {
+			usage.Unpriced++
+		}
+		usage.MonthlyCost += price
+	}
+
+	volumes, err := sw.instanceAPI.ListVolumes(&instance.ListVolumesRequest{Zone: sw.location, Organization: &org}, scw.WithAllPages())
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve Scaleway volumes")
+	}
+	for _, vol := range volumes.Volumes {
+		usage.Volumes++
+		usage.VolumesSize += uint64(vol.Size)
+		if vol.VolumeType == instance.VolumeTypeBSSD {
+			usage.MonthlyCost += float64(vol.Size) / 1e9 * scalewayBlockVolumePrice
+		}
+	}
+
+	public := false
+	images, err := sw.instanceAPI.ListImages(&instance.ListImagesRequest{Zone: sw.location, Organization: &org, Public: &public}, scw.WithAllPages())
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve Scaleway images")
+	}
+	usage.Images = len(images.Images)
+
+	snapshots, err := sw.instanceAPI.ListSnapshots(&instance.ListSnapshotsRequest{Zone: sw.location, Organization: &org}, scw.WithAllPages())
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve Scaleway snapshots")
+	}
+	for _, snapshot := range snapshots.Snapshots {
+		usage.Snapshots++
+		usage.MonthlyCost += float64(snapshot.Size) / 1e9 * scalewaySnapshotPrice
+	}
+
+	ips, err := sw.instanceAPI.ListIPs(&instance.ListIPsRequest{Zone: sw.location, Organization: &org}, scw.WithAllPages())
+	if err != nil {
+		return usage, errors.Wrap(err, "Failed to retrieve Scaleway IPs")
+	}
+	usage.IPs = len(ips.IPs)
+	usage.MonthlyCost += float64(usage.IPs) * scalewayIPPrice
+	return usage, nil
+}
+
 //
 // Instance methods
 //
@@ -125,7 +307,7 @@ func (sw *scaleway) deleteSSHkey(name string) error {
 }
 
 // NewInstance creates a new Protos instance on Scaleway
-func (sw *scaleway) NewInstance(name string, imageID string, pubKey string) (string, error) {
+func (sw *scaleway) NewInstance(name string, imageID string, pubKey string, ipv6Only bool) (string, error) {
 
 	//
 	// create SSH key
@@ -165,13 +347,14 @@ func (sw *scaleway) NewInstance(name string, imageID string, pubKey string) (str
 	// deploying the instance
 	volumeMap := make(map[string]*instance.VolumeTemplate)
 	log.Infof("Deploing VM using image '%s'", imageID)
-	ipreq := true
+	// without a dynamic IP, the server gets no (billed) public IPv4 address and is reachable over its routed IPv6 address
+	ipreq := !ipv6Only
 	req := &instance.CreateServerRequest{
 		Name:              name,
 		Zone:              sw.location,
 		CommercialType:    "DEV1-S",
 		DynamicIPRequired: &ipreq,
-		EnableIPv6:        false,
+		EnableIPv6:        ipv6Only,
 		BootType:          instance.BootTypeLocal,
 		Image:             imageID,
 		Volumes:           volumeMap,
@@ -228,19 +411,94 @@ func (sw *scaleway) StopInstance(id string) error {
 	return nil
 }
 
+func (sw *scaleway) RebootInstance(id string) error {
+	rebootReq := &instance.ServerActionAndWaitRequest{
+		ServerID: id,
+		Zone:     sw.location,
+		Action:   instance.ServerActionReboot,
+	}
+	err := sw.instanceAPI.ServerActionAndWait(rebootReq)
+	if err != nil {
+		return errors.Wrap(err, "Failed to reboot Scaleway instance")
+	}
+	return nil
+}
+
 func (sw *scaleway) GetInstanceInfo(id string) (InstanceInfo, error) {
 	resp, err := sw.instanceAPI.GetServer(&instance.GetServerRequest{ServerID: id, Zone: sw.location})
 	if err != nil {
 		return InstanceInfo{}, errors.Wrapf(err, "Failed to retrieve Scaleway instance (%s) information", id)
 	}
-	info := InstanceInfo{VMID: id, Name: resp.Server.Name, CloudName: sw.name, CloudType: Scaleway, Location: string(sw.location)}
-	if resp.Server.PublicIP != nil {
-		info.PublicIP = resp.Server.PublicIP.Address.String()
+	return sw.instanceInfo(resp.Server), nil
+}
+
+// ListInstances retrieves all the servers of the organisation in the current zone, paging through the results
+func (sw *scaleway) ListInstances() ([]InstanceInfo, error) {
+	org := sw.credentials.organisationID
+	resp, err := sw.instanceAPI.ListServers(&instance.ListServersRequest{Zone: sw.location, Organization: &org}, scw.WithAllPages())
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to retrieve Scaleway instances")
 	}
-	for _, svol := range resp.Server.Volumes {
-		info.Volumes = append(info.Volumes, VolumeInfo{VolumeID: svol.ID, Name: svol.Name, Size: uint64(svol.Size)})
+	instances := []InstanceInfo{}
+	for _, srv := range resp.Servers {
+		instances = append(instances, sw.instanceInfo(srv))
 	}
-	return info, nil
+	return instances, nil
+}
+
+func (sw *scaleway) instanceInfo(srv *instance.Server) InstanceInfo {
+	info := InstanceInfo{VMID: srv.ID, Name: srv.Name, CloudName: sw.name, CloudType: Scaleway, Location: string(sw.location), Status: string(srv.State)}
+	if srv.PublicIP != nil {
+		info.PublicIP = srv.PublicIP.Address.String()
+	} else if srv.IPv6 != nil {
+		info.PublicIP = srv.IPv6.Address.String()
+	}
+	for _, svol := range srv.Volumes {
+		info.Volumes = append(info.Volumes, VolumeInfo{VolumeID: svol.ID, Name: svol.Name, Size: uint64(svol.Size), Type: scalewayVolumeType(svol.VolumeType), CloudName: sw.name, Location: string(sw.location), InstanceName: srv.Name})
+	}
+	return info
+}
+
+func (sw *scaleway) GetInstanceTags(id string) ([]string, error) {
+	resp, err := sw.instanceAPI.GetServer(&instance.GetServerRequest{ServerID: id, Zone: sw.location})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve Scaleway instance (%s) information", id)
+	}
+	return resp.Server.Tags, nil
+}
+
+func (sw *scaleway) SetInstanceTags(id string, tags []string) error {
+	_, err := sw.instanceAPI.UpdateServer(&instance.UpdateServerRequest{Zone: sw.location, ServerID: id, Tags: &tags})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag Scaleway instance '%s'", id)
+	}
+	return nil
+}
+
+func (sw *scaleway) GetInstanceEvents(id string) ([]Event, error) {
+	resp, err := sw.instanceAPI.GetServer(&instance.GetServerRequest{ServerID: id, Zone: sw.location})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to retrieve Scaleway instance (%s) information", id)
+	}
+	events := []Event{}
+	if resp.Server.State == instance.ServerStateLocked {
+		events = append(events, Event{InstanceID: id, Type: EventLocked, Description: "Instance locked by Scaleway", Time: resp.Server.ModificationDate})
+	}
+	if len(resp.Server.Maintenances) > 0 {
+		events = append(events, Event{InstanceID: id, Type: EventMaintenance, Description: fmt.Sprintf("%d maintenance(s) planned by Scaleway", len(resp.Server.Maintenances))})
+	}
+	return events, nil
+}
+
+// GetConsoleLog is not supported: the Scaleway API only offers an interactive serial console
+func (sw *scaleway) GetConsoleLog(id string) (string, error) {
+	return "", ErrNotSupported
+}
+
+// GetInstanceMetrics is not supported: Scaleway exposes instance metrics through Cockpit, which requires a separate
+// Cockpit token and is not covered by the SDK
+func (sw *scaleway) GetInstanceMetrics(id string, since time.Time) ([]MetricSample, error) {
+	return nil, ErrNotSupported
 }
 
 //
@@ -259,7 +517,135 @@ func (sw *scaleway) GetImages() (map[string]string, error) {
 	return images, nil
 }
 
-func (sw *scaleway) AddImage(url string, hash string, version string) (string, error) {
+func (sw *scaleway) AddImage(url string, hash string, version string, bandwidthLimit int64) (string, error) {
+	return sw.addImage(version, false, func(dial func() (*gossh.Client, error), localISO string) (string, error) {
+		// wget continues partial downloads (-c), so an interrupted download is retried from where it stopped
+		wgetCmd := "wget -c -O " + localISO + " " + url
+		if bandwidthLimit > 0 {
+			wgetCmd = fmt.Sprintf("wget -c --limit-rate=%d -O %s %s", bandwidthLimit, localISO, url)
+		}
+
+		log.Info("Downloading Protos image")
+		tries := 0
+		for {
+			tries++
+			sshClient, err := dial()
+			if err != nil {
+				return "", err
+			}
+			out, err := ssh.ExecuteCommand(wgetCmd, sshClient)
+			sshClient.Close()
+			if err == nil {
+				return hash, nil
+			}
+			if tries > ssh.TransferRetries {
+				log.Errorf("Error downloading Protos VM image: %s", out)
+				return "", errors.Wrap(err, "Error downloading Protos VM image")
+			}
+			log.Warnf("Downloading Protos VM image failed. Resuming download (%d/%d)", tries, ssh.TransferRetries)
+		}
+	})
+}
+
+func (sw *scaleway) UploadLocalImage(imagePath string, hash string, version string, transfer ssh.TransferOptions) (string, error) {
+	return sw.addImage(version, false, func(dial func() (*gossh.Client, error), localISO string) (string, error) {
+		log.Infof("Uploading Protos image '%s'", imagePath)
+		err := ssh.UploadFileChunked(imagePath, localISO, transfer, dial)
+		if err != nil {
+			return "", errors.Wrap(err, "Error uploading Protos VM image")
+		}
+		return hash, nil
+	})
+}
+
+func (sw *scaleway) StreamImage(image io.Reader, hash string, version string, bandwidthLimit int64) (string, error) {
+	return sw.addImage(version, false, func(dial func() (*gossh.Client, error), localISO string) (string, error) {
+		sshClient, err := dial()
+		if err != nil {
+			return "", err
+		}
+		defer sshClient.Close()
+
+		log.Info("Streaming Protos image")
+		digest := sha256.New()
+		err = ssh.WriteFile(ssh.NewRateLimitedReader(io.TeeReader(image, digest), bandwidthLimit), localISO, sshClient)
+		if err != nil {
+			return "", errors.Wrap(err, "Error streaming Protos VM image")
+		}
+		streamedHash := hex.EncodeToString(digest.Sum(nil))
+		if streamedHash != hash {
+			return "", errors.Errorf("Error streaming Protos VM image. Integrity check failed: expected digest '%s' but got '%s'", hash, streamedHash)
+		}
+		return hash, nil
+	})
+}
+
+func (sw *scaleway) ImportImage(image io.Reader, version string) (string, error) {
+	return sw.addImage(version, true, func(dial func() (*gossh.Client, error), localISO string) (string, error) {
+		sshClient, err := dial()
+		if err != nil {
+			return "", err
+		}
+		defer sshClient.Close()
+
+		log.Info("Importing Protos image")
+		digest := sha256.New()
+		err = ssh.WriteFile(io.TeeReader(image, digest), localISO, sshClient)
+		if err != nil {
+			return "", errors.Wrap(err, "Error importing Protos VM image")
+		}
+		return hex.EncodeToString(digest.Sum(nil)), nil
+	})
+}
+
+func (sw *scaleway) ExportImage(id string) (io.ReadCloser, error) {
+	imageResp, err := sw.instanceAPI.GetImage(&instance.GetImageRequest{Zone: sw.location, ImageID: id})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to export Scaleway image '%s'", id)
+	}
+	if imageResp.Image.RootVolume == nil {
+		return nil, errors.Errorf("Failed to export Scaleway image '%s': image has no root volume", id)
+	}
+
+	srv, _, dial, cleanup, err := sw.newTransferVM(imageResp.Image.RootVolume.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to export Scaleway image '%s'", id)
+	}
+	sshClient, err := dial()
+	if err != nil {
+		cleanup()
+		return nil, errors.Wrapf(err, "Failed to export Scaleway image '%s'", id)
+	}
+
+	log.Infof("Exporting image '%s' using server '%s' (%s)", id, srv.Name, srv.ID)
+	reader, err := ssh.NewCommandReader("gzip -c /dev/vdb", sshClient)
+	if err != nil {
+		sshClient.Close()
+		cleanup()
+		return nil, errors.Wrapf(err, "Failed to export Scaleway image '%s'", id)
+	}
+	return &imageExport{ReadCloser: reader, cleanup: func() {
+		sshClient.Close()
+		cleanup()
+	}}, nil
+}
+
+// imageExport is a stream of image contents, which cleans up the resources used for the export when closed
+type imageExport struct {
+	io.ReadCloser
+	cleanup func()
+}
+
+func (ie *imageExport) Close() error {
+	err := ie.ReadCloser.Close()
+	ie.cleanup()
+	return err
+}
+
+// newTransferVM creates a temporary VM, with a second volume attached that is either empty or created from
+// baseSnapshot, which is used to transfer image contents. It returns a function that connects to the VM over SSH, and
+// a cleanup function that removes the VM, its volumes and the temporary SSH key
+func (sw *scaleway) newTransferVM(baseSnapshot string) (*instance.Server, *instance.Volume, func() (*gossh.Client, error), func(), error) {
 
 	//
 	// create and add ssh key to account
@@ -267,15 +653,14 @@ func (sw *scaleway) AddImage(url string, hash string, version string) (string, e
 
 	key, err := ssh.GenerateKey()
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
+		return nil, nil, nil, nil, err
 	}
 	pubKey := strings.TrimSuffix(key.Public(), "\n") + " root@protos.io"
 
 	sshKey, err := sw.accountAPI.CreateSSHKey(&account.CreateSSHKeyRequest{Name: uploadSSHkey, OrganizationID: sw.credentials.organisationID, PublicKey: pubKey})
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway: Failed to add temporary SSH key")
+		return nil, nil, nil, nil, errors.Wrap(err, "Failed to add temporary SSH key")
 	}
-	defer sw.cleanImageSSHkeys(sshKey.ID)
 
 	//
 	// find correct image
@@ -283,48 +668,69 @@ func (sw *scaleway) AddImage(url string, hash string, version string) (string, e
 
 	imageID, err := sw.getUploadImageID(sw.location)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
+		sw.cleanImageSSHkeys(sshKey.ID)
+		return nil, nil, nil, nil, err
 	}
 
-	log.Infof("Using image '%s' for adding Protos image to Scaleway", imageID)
+	log.Infof("Using image '%s' for the Scaleway image transfer server", imageID)
 
 	//
 	// create upload server
 	//
 
-	srv, vol, err := sw.createImageUploadVM(imageID)
+	srv, vol, err := sw.createImageUploadVM(imageID, baseSnapshot)
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
+		sw.cleanImageSSHkeys(sshKey.ID)
+		return nil, nil, nil, nil, err
 	}
-	defer sw.cleanImageUploadVM(srv)
 
-	//
-	// connect via SSH, download Protos image and write it to a volume
-	//
+	dial := func() (*gossh.Client, error) {
+		log.Info("Trying to connect to Scaleway upload instance over SSH")
+		sshClient, err := ssh.NewConnection(srv.PublicIP.Address.String(), "root", key.SSHAuth(), 10)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to connect to Scaleway upload instance")
+		}
+		log.Info("SSH connection initiated")
+		return sshClient, nil
+	}
+	cleanup := func() {
+		sw.cleanImageUploadVM(srv)
+		sw.cleanImageSSHkeys(sshKey.ID)
+	}
+	return srv, vol, dial, cleanup, nil
+}
 
-	log.Info("Trying to connect to Scaleway upload instance over SSH")
+// addImage creates a temporary upload VM, uses fetchImage to place the Protos image on it at localISO, and then
+// writes the image to a volume which is used to create the Protos image. fetchImage can use dial to (re)connect to
+// the upload VM, and returns the SHA256 digest the image should have. If gzipped is true, the fetched image is
+// decompressed while being written to the volume
+func (sw *scaleway) addImage(version string, gzipped bool, fetchImage func(dial func() (*gossh.Client, error), localISO string) (string, error)) (string, error) {
 
-	sshClient, err := ssh.NewConnection(srv.PublicIP.Address.String(), "root", key.SSHAuth(), 10)
+	srv, vol, dial, cleanup, err := sw.newTransferVM("")
 	if err != nil {
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Failed to deploy VM to Scaleway")
+		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
 	}
-	log.Info("SSH connection initiated")
+	defer cleanup()
 
 	//
 	// wite Protos image to volume
 	//
 	localISO := "/tmp/protos-scaleway.iso"
 
-	log.Info("Downloading Protos image")
-	out, err := ssh.ExecuteCommand("wget -O "+localISO+" "+url, sshClient)
+	hash, err := fetchImage(dial, localISO)
 	if err != nil {
-		log.Errorf("Error downloading Protos VM image: %s", out)
-		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Error downloading Protos VM image")
+		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
 	}
 
+	sshClient, err := dial()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
+	}
+	defer sshClient.Close()
+
 	log.Info("Checking image integrity")
 	cmdString := fmt.Sprintf("openssl dgst -r -sha256 %s | awk '{ print $1 }' | { read digest; if [ \"$digest\" = \"%s\" ]; then true; else false; fi }", localISO, hash)
-	out, err = ssh.ExecuteCommand(cmdString, sshClient)
+	out, err := ssh.ExecuteCommand(cmdString, sshClient)
 	if err != nil {
 		log.Errorf("Image integrity check failed: %s: %s", out, err.Error())
 		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Error downloading Protos VM image. Integrity check failed")
@@ -337,7 +743,11 @@ func (sw *scaleway) AddImage(url string, hash string, version string) (string, e
 	}
 
 	log.Info("Writing Protos image to volume")
-	out, err = ssh.ExecuteCommand("dd if="+localISO+" of=/dev/vdb", sshClient)
+	writeCmd := "dd if=" + localISO + " of=/dev/vdb"
+	if gzipped {
+		writeCmd = "gunzip -c " + localISO + " | dd of=/dev/vdb"
+	}
+	out, err = ssh.ExecuteCommand(writeCmd, sshClient)
 	if err != nil {
 		log.Errorf("Error while writing image to volume: %s", out)
 		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Error while writing image to volume")
@@ -398,7 +808,141 @@ func (sw *scaleway) AddImage(url string, hash string, version string) (string, e
 	return imageResp.Image.ID, nil
 }
 
+// scalewayImportSnapshotRequest creates a snapshot from a qcow2 file in object storage. The SDK doesn't expose the
+// bucket and key fields of the snapshot API yet
+type scalewayImportSnapshotRequest struct {
+	Name         string `json:"name"`
+	Organization string `json:"organization"`
+	VolumeType   string `json:"volume_type"`
+	Bucket       string `json:"bucket"`
+	Key          string `json:"key"`
+}
+
+// AddImageFromSnapshot creates the Protos image from a qcow2 snapshot stored in object storage, given as
+// '<bucket>/<key>'. Scaleway imports the snapshot on its side, which is much faster than writing the image to a
+// volume using an upload VM
+func (sw *scaleway) AddImageFromSnapshot(snapshot string, version string) (string, error) {
+	parts := strings.SplitN(snapshot, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.Errorf("Invalid Scaleway snapshot '%s'. Expected an object storage location as '<bucket>/<key>'", snapshot)
+	}
+
+	log.Infof("Importing snapshot '%s' from object storage", snapshot)
+	req := &scw.ScalewayRequest{
+		Method:  "POST",
+		Path:    "/instance/v1/zones/" + sw.location.String() + "/snapshots",
+		Headers: http.Header{},
+	}
+	err := req.SetBody(scalewayImportSnapshotRequest{
+		Name:         "protos-snapshot-" + version,
+		Organization: sw.credentials.organisationID,
+		VolumeType:   instance.VolumeTypeLSSD.String(),
+		Bucket:       parts[0],
+		Key:          parts[1],
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway")
+	}
+	var snapshotResp instance.CreateSnapshotResponse
+	err = sw.client.Do(req, &snapshotResp)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to add Protos image to Scaleway. Error while importing snapshot '%s'", snapshot)
+	}
+	snapshotID := snapshotResp.Snapshot.ID
+	err = sw.waitForSnapshot(snapshotID)
+	if err != nil {
+		sw.instanceAPI.DeleteSnapshot(&instance.DeleteSnapshotRequest{Zone: sw.location, SnapshotID: snapshotID})
+		return "", errors.Wrapf(err, "Failed to add Protos image to Scaleway. Error while importing snapshot '%s'", snapshot)
+	}
+
+	log.Info("Creating image from snapshot")
+	imageResp, err := sw.instanceAPI.CreateImage(&instance.CreateImageRequest{
+		Name:       "protos-" + version,
+		Arch:       instance.ArchX86_64,
+		RootVolume: snapshotID,
+		Zone:       sw.location,
+	})
+	if err != nil {
+		sw.instanceAPI.DeleteSnapshot(&instance.DeleteSnapshotRequest{Zone: sw.location, SnapshotID: snapshotID})
+		return "", errors.Wrap(err, "Failed to add Protos image to Scaleway. Error while creating image from snapshot")
+	}
+	log.Infof("Protos image '%s' created", imageResp.Image.ID)
+	return imageResp.Image.ID, nil
+}
+
+// scalewayImageTags is the part of a Scaleway image that stores its digest. The SDK doesn't expose image tags yet
+type scalewayImageTags struct {
+	ID   string   `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+// setImageDigest stores the digest in a tag of the image. Tags stay with the image when it's renamed. The tag is written
+// by the CLI from the release index and can be changed by anyone with access to the account: it's not computed by
+// Scaleway from the image contents, so it tells apart renamed images and images uploaded again under the same name, but
+// not images modified in place
+func (sw *scaleway) setImageDigest(id string, digest string) error {
+	path := "/images/" + id
+	var imageResp struct {
+		Image scalewayImageTags `json:"image"`
+	}
+	err := sw.jsonRequest("GET", path, nil, &imageResp)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to retrieve Scaleway image '%s'", id)
+	}
+	tags := []string{}
+	for _, tag := range imageResp.Image.Tags {
+		if !strings.HasPrefix(tag, scalewayDigestTag) {
+			tags = append(tags, tag)
+		}
+	}
+	err = sw.jsonRequest("PATCH", path, map[string][]string{"tags": append(tags, scalewayDigestTag+digest)}, &imageResp)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag Scaleway image '%s'", id)
+	}
+	return nil
+}
+
+func (sw *scaleway) imageDigests() (map[string]string, error) {
+	digests := map[string]string{}
+	perPage := 100
+	for page := 1; ; page++ {
+		var resp struct {
+			Images []scalewayImageTags `json:"images"`
+		}
+		query := url.Values{"organization": {sw.credentials.organisationID}, "page": {strconv.Itoa(page)}, "per_page": {strconv.Itoa(perPage)}}
+		err := sw.jsonRequest("GET", "/images?"+query.Encode(), nil, &resp)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to retrieve account images from Scaleway")
+		}
+		for _, img := range resp.Images {
+			for _, tag := range img.Tags {
+				if strings.HasPrefix(tag, scalewayDigestTag) {
+					digests[img.ID] = strings.TrimPrefix(tag, scalewayDigestTag)
+				}
+			}
+		}
+		if len(resp.Images) < perPage {
+			return digests, nil
+		}
+	}
+}
+
 func (sw *scaleway) RemoveImage(id string) error {
+	imageResp, err := sw.instanceAPI.GetImage(&instance.GetImageRequest{Zone: sw.location, ImageID: id})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to retrieve Scaleway image '%s'", id)
+	}
+	err = sw.instanceAPI.DeleteImage(&instance.DeleteImageRequest{Zone: sw.location, ImageID: id})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete Scaleway image '%s'", id)
+	}
+	// the snapshot backing the image is billed separately, so it's removed as well
+	if imageResp.Image.RootVolume != nil {
+		err = sw.instanceAPI.DeleteSnapshot(&instance.DeleteSnapshotRequest{Zone: sw.location, SnapshotID: imageResp.Image.RootVolume.ID})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to delete snapshot '%s' of Scaleway image '%s'", imageResp.Image.RootVolume.ID, id)
+		}
+	}
 	return nil
 }
 
@@ -406,14 +950,17 @@ func (sw *scaleway) RemoveImage(id string) error {
 // Volumes methods
 //
 
-func (sw *scaleway) NewVolume(name string, size int) (string, error) {
+func (sw *scaleway) NewVolume(name string, size int, volumeType VolumeType) (string, error) {
 	sizeVolume := scw.Size(uint64(size * 1048576))
 	createVolumeReq := &instance.CreateVolumeRequest{
 		Name:       name,
-		VolumeType: "b_ssd",
+		VolumeType: instance.VolumeTypeBSSD,
 		Size:       &sizeVolume,
 		Zone:       sw.location,
 	}
+	if volumeType == LocalVolume {
+		createVolumeReq.VolumeType = instance.VolumeTypeLSSD
+	}
 
 	volumeResp, err := sw.instanceAPI.CreateVolume(createVolumeReq)
 	if err != nil {
@@ -422,6 +969,71 @@ func (sw *scaleway) NewVolume(name string, size int) (string, error) {
 	return volumeResp.Volume.ID, nil
 }
 
+func (sw *scaleway) SnapshotVolume(id string, name string) (string, error) {
+	snapshotResp, err := sw.instanceAPI.CreateSnapshot(&instance.CreateSnapshotRequest{
+		VolumeID: id,
+		Name:     name,
+		Zone:     sw.location,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to snapshot Scaleway volume '%s'", id)
+	}
+
+	// volumes can't be created from a snapshot until it is available
+	err = sw.waitForSnapshot(snapshotResp.Snapshot.ID)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to snapshot Scaleway volume '%s'", id)
+	}
+	return snapshotResp.Snapshot.ID, nil
+}
+
+// waitForSnapshot waits until a snapshot is available, which includes snapshots being imported from object storage
+func (sw *scaleway) waitForSnapshot(snapshotID string) error {
+	timeout := time.Now().Add(scalewaySnapshotTimeout)
+	for {
+		resp, err := sw.instanceAPI.GetSnapshot(&instance.GetSnapshotRequest{Zone: sw.location, SnapshotID: snapshotID})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to retrieve Scaleway snapshot '%s'", snapshotID)
+		}
+		switch resp.Snapshot.State {
+		case instance.SnapshotStateAvailable:
+			return nil
+		case instance.SnapshotStateError:
+			return errors.Errorf("Snapshot '%s' is in error state", snapshotID)
+		}
+		if time.Now().After(timeout) {
+			return errors.Errorf("Timed out waiting for Scaleway snapshot '%s' to become available", snapshotID)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (sw *scaleway) NewVolumeFromSnapshot(name string, snapshotID string, volumeType VolumeType) (string, error) {
+	createVolumeReq := &instance.CreateVolumeRequest{
+		Name:         name,
+		VolumeType:   instance.VolumeTypeBSSD,
+		BaseSnapshot: &snapshotID,
+		Zone:         sw.location,
+	}
+	if volumeType == LocalVolume {
+		createVolumeReq.VolumeType = instance.VolumeTypeLSSD
+	}
+
+	volumeResp, err := sw.instanceAPI.CreateVolume(createVolumeReq)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create Scaleway volume from snapshot '%s'", snapshotID)
+	}
+	return volumeResp.Volume.ID, nil
+}
+
+func (sw *scaleway) DeleteSnapshot(snapshotID string) error {
+	err := sw.instanceAPI.DeleteSnapshot(&instance.DeleteSnapshotRequest{Zone: sw.location, SnapshotID: snapshotID})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to delete Scaleway snapshot '%s'", snapshotID)
+	}
+	return nil
+}
+
 func (sw *scaleway) DeleteVolume(id string) error {
 	deleteVolumeReq := &instance.DeleteVolumeRequest{
 		VolumeID: id,
@@ -434,6 +1046,57 @@ func (sw *scaleway) DeleteVolume(id string) error {
 	return nil
 }
 
+func (sw *scaleway) GetVolumeInfo(id string) (VolumeInfo, error) {
+	resp, err := sw.instanceAPI.GetVolume(&instance.GetVolumeRequest{Zone: sw.location, VolumeID: id})
+	if err != nil {
+		return VolumeInfo{}, errors.Wrapf(err, "Failed to retrieve Scaleway volume '%s'", id)
+	}
+	info := VolumeInfo{VolumeID: resp.Volume.ID, Name: resp.Volume.Name, Size: uint64(resp.Volume.Size), Type: scalewayVolumeType(resp.Volume.VolumeType), CloudName: sw.name, Location: string(sw.location)}
+	if resp.Volume.Server != nil {
+		info.InstanceName = resp.Volume.Server.Name
+	}
+	return info, nil
+}
+
+func (sw *scaleway) ResizeVolume(id string, size int) error {
+	// the SDK doesn't expose volume size updates, so the request is done directly
+	sizeVolume := scw.Size(uint64(size * 1048576))
+	req := &scw.ScalewayRequest{
+		Method:  "PATCH",
+		Path:    "/instance/v1/zones/" + string(sw.location) + "/volumes/" + id,
+		Headers: http.Header{},
+	}
+	err := req.SetBody(map[string]interface{}{"size": sizeVolume})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to resize Scaleway volume '%s'", id)
+	}
+	resp := instance.UpdateVolumeResponse{}
+	err = sw.client.Do(req, &resp)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to resize Scaleway volume '%s'", id)
+	}
+	return nil
+}
+
+func (sw *scaleway) SetVolumeTags(id string, tags []string) error {
+	// the SDK doesn't expose volume tags, so the request is done directly
+	req := &scw.ScalewayRequest{
+		Method:  "PATCH",
+		Path:    "/instance/v1/zones/" + string(sw.location) + "/volumes/" + id,
+		Headers: http.Header{},
+	}
+	err := req.SetBody(map[string]interface{}{"tags": tags})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag Scaleway volume '%s'", id)
+	}
+	resp := instance.UpdateVolumeResponse{}
+	err = sw.client.Do(req, &resp)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to tag Scaleway volume '%s'", id)
+	}
+	return nil
+}
+
 func (sw *scaleway) AttachVolume(volumeID string, instanceID string) error {
 	attachVolumeReq := &instance.AttachVolumeRequest{
 		Zone:     sw.location,
@@ -463,6 +1126,13 @@ func (sw *scaleway) DettachVolume(volumeID string, instanceID string) error {
 // helper methods
 //
 
+func scalewayVolumeType(volumeType instance.VolumeType) VolumeType {
+	if volumeType == instance.VolumeTypeLSSD {
+		return LocalVolume
+	}
+	return BlockVolume
+}
+
 func (sw *scaleway) getUploadImageID(zone scw.Zone) (string, error) {
 	resp, err := sw.marketplaceAPI.ListImages(&marketplace.ListImagesRequest{})
 	if err != nil {
@@ -490,19 +1160,23 @@ func (sw *scaleway) cleanImageSSHkeys(keyID string) {
 	log.Infof("Deleted SSH key '%s'", keyID)
 }
 
-func (sw *scaleway) createImageUploadVM(imageID string) (*instance.Server, *instance.Volume, error) {
+func (sw *scaleway) createImageUploadVM(imageID string, baseSnapshot string) (*instance.Server, *instance.Volume, error) {
 
 	//
-	// create volume
+	// create volume, empty or from the provided snapshot
 	//
 
 	size := scw.Size(uint64(10000000000))
 	createVolumeReq := &instance.CreateVolumeRequest{
 		Name:       "protos-image-uploader",
-		VolumeType: "l_ssd",
-		Size:       &size,
+		VolumeType: instance.VolumeTypeLSSD,
 		Zone:       sw.location,
 	}
+	if baseSnapshot != "" {
+		createVolumeReq.BaseSnapshot = &baseSnapshot
+	} else {
+		createVolumeReq.Size = &size
+	}
 
 	log.Info("Creating image volume")
 	volumeResp, err := sw.instanceAPI.CreateVolume(createVolumeReq)
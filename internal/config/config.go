@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds the user settings of the CLI. It's stored as a JSON file that can also be edited by hand
+type Config struct {
+	// Aliases maps alias names to the commands they expand to, e.g. "up" to "instance start"
+	Aliases map[string]string `json:"aliases,omitempty"`
+	// ReleaseIndex is the URL of the release index, e.g. on an internal artifact server. Empty means the upstream index
+	ReleaseIndex string `json:"release-index,omitempty"`
+	// ImageMirror is the base URL images are downloaded from, instead of the location listed in the release index.
+	// The image digests still come from the release index
+	ImageMirror string `json:"image-mirror,omitempty"`
+	// TunnelPorts is the range local tunnel ports are allocated from, e.g. "20000-20999". Empty means the default range
+	TunnelPorts string `json:"tunnel-ports,omitempty"`
+	// User identifies the user in the history and the members of a shared database. Empty means the login name
+	User string `json:"user,omitempty"`
+	// CacheMaxSize is the size the cache directory is kept under, e.g. "5G". Empty means the default size
+	CacheMaxSize string `json:"cache-max-size,omitempty"`
+	// LogMaxSize is the size after which the log file is rotated, e.g. "10M". Empty means the default size
+	LogMaxSize string `json:"log-max-size,omitempty"`
+	// State points to the shared copy of the local database, nil if only the local one is used
+	State *StateBackend `json:"state,omitempty"`
+}
+
+// StateBackend is a Protos instance holding a copy of the local database, shared by a team. See 'protos state'
+type StateBackend struct {
+	Instance string `json:"instance"`
+	Host     string `json:"host"`     // SSH address of the instance
+	KeyFile  string `json:"key-file"` // private SSH key used to connect to the instance
+}
+
+// Load reads the config file at path. A missing file results in an empty config
+func Load(path string) (Config, error) {
+	cfg := Config{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, errors.Wrapf(err, "Failed to read config file '%s'", path)
+	}
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, errors.Wrapf(err, "Failed to parse config file '%s'", path)
+	}
+	return cfg, nil
+}
+
+// Save writes cfg to the config file at path
+func Save(path string, cfg Config) error {
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create '%s' directory", filepath.Dir(path))
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode config")
+	}
+	// write and rename, so a failed write doesn't leave a truncated config behind
+	err = ioutil.WriteFile(path+".tmp", append(data, '\n'), os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save config file '%s'", path)
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,202 @@
+// Package control defines the local gRPC API served by 'protos serve', which lets GUIs and editor extensions drive the
+// CLI operations without shelling out. Messages are plain Go structs encoded as JSON, using the "json" content-subtype,
+// so clients don't need generated protobuf code
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the name of the gRPC service. Methods are called as /protos.Control/<method>
+const ServiceName = "protos.Control"
+
+// Codec is the name of the codec used by the service, which clients select using the "application/grpc+json" content
+// type
+const Codec = "json"
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return Codec }
+
+//
+// Messages
+//
+
+type ListInstancesRequest struct{}
+
+type ListInstancesResponse struct {
+	Instances []cloud.InstanceInfo // the SSH keys of the instances are not included
+}
+
+type DeployRequest struct {
+	Name     string
+	Cloud    string
+	Location string
+	Version  string // Protos release to deploy, the latest one if empty
+}
+
+type DeployResponse struct {
+	Instance cloud.InstanceInfo
+}
+
+// Tunnel is an SSH tunnel to the dashboard of an instance, run by the server
+type Tunnel struct {
+	Instance  string
+	LocalPort int
+	Target    string // address the tunnel forwards to, on the instance
+}
+
+type StartTunnelRequest struct {
+	Instance string
+	Port     int // local port, allocated like 'protos instance tunnel' if 0
+}
+
+type StartTunnelResponse struct {
+	Tunnel Tunnel
+}
+
+type StopTunnelRequest struct {
+	Instance string
+}
+
+type StopTunnelResponse struct{}
+
+type ListTunnelsRequest struct{}
+
+type ListTunnelsResponse struct {
+	Tunnels []Tunnel
+}
+
+//
+// Server methods
+//
+
+// Server is implemented by the CLI to serve the API
+type Server interface {
+	ListInstances(ctx context.Context, req *ListInstancesRequest) (*ListInstancesResponse, error)
+	Deploy(ctx context.Context, req *DeployRequest) (*DeployResponse, error)
+	StartTunnel(ctx context.Context, req *StartTunnelRequest) (*StartTunnelResponse, error)
+	StopTunnel(ctx context.Context, req *StopTunnelRequest) (*StopTunnelResponse, error)
+	ListTunnels(ctx context.Context, req *ListTunnelsRequest) (*ListTunnelsResponse, error)
+}
+
+// unaryHandler adapts a typed server method to a gRPC method handler
+func unaryHandler(method string, newRequest func() interface{}, call func(srv Server, ctx context.Context, req interface{}) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: method,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := newRequest()
+			err := dec(req)
+			if err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return call(srv.(Server), ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + ServiceName + "/" + method}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return call(srv.(Server), ctx, req)
+			})
+		},
+	}
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*Server)(nil),
+	Methods: []grpc.MethodDesc{
+		unaryHandler("ListInstances", func() interface{} { return &ListInstancesRequest{} }, func(srv Server, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.ListInstances(ctx, req.(*ListInstancesRequest))
+		}),
+		unaryHandler("Deploy", func() interface{} { return &DeployRequest{} }, func(srv Server, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.Deploy(ctx, req.(*DeployRequest))
+		}),
+		unaryHandler("StartTunnel", func() interface{} { return &StartTunnelRequest{} }, func(srv Server, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.StartTunnel(ctx, req.(*StartTunnelRequest))
+		}),
+		unaryHandler("StopTunnel", func() interface{} { return &StopTunnelRequest{} }, func(srv Server, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.StopTunnel(ctx, req.(*StopTunnelRequest))
+		}),
+		unaryHandler("ListTunnels", func() interface{} { return &ListTunnelsRequest{} }, func(srv Server, ctx context.Context, req interface{}) (interface{}, error) {
+			return srv.ListTunnels(ctx, req.(*ListTunnelsRequest))
+		}),
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// RegisterServer registers the implementation of the API on a gRPC server
+func RegisterServer(s *grpc.Server, srv Server) {
+	s.RegisterService(&serviceDesc, srv)
+}
+
+//
+// Client methods
+//
+
+// Client calls the API served on a control socket
+type Client struct {
+	conn *grpc.ClientConn
+}
+
+// Dial connects to the API served on the unix socket at socketPath
+func Dial(socketPath string) (*Client, error) {
+	conn, err := grpc.Dial(socketPath,
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", addr)
+		}),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(Codec)),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to control socket '%s'", socketPath)
+	}
+	return &Client{conn: conn}, nil
+}
+
+// Close closes the connection to the server
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req interface{}, resp interface{}) error {
+	return c.conn.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp)
+}
+
+func (c *Client) ListInstances(ctx context.Context, req *ListInstancesRequest) (*ListInstancesResponse, error) {
+	resp := &ListInstancesResponse{}
+	return resp, c.invoke(ctx, "ListInstances", req, resp)
+}
+
+func (c *Client) Deploy(ctx context.Context, req *DeployRequest) (*DeployResponse, error) {
+	resp := &DeployResponse{}
+	return resp, c.invoke(ctx, "Deploy", req, resp)
+}
+
+func (c *Client) StartTunnel(ctx context.Context, req *StartTunnelRequest) (*StartTunnelResponse, error) {
+	resp := &StartTunnelResponse{}
+	return resp, c.invoke(ctx, "StartTunnel", req, resp)
+}
+
+func (c *Client) StopTunnel(ctx context.Context, req *StopTunnelRequest) (*StopTunnelResponse, error) {
+	resp := &StopTunnelResponse{}
+	return resp, c.invoke(ctx, "StopTunnel", req, resp)
+}
+
+func (c *Client) ListTunnels(ctx context.Context, req *ListTunnelsRequest) (*ListTunnelsResponse, error) {
+	resp := &ListTunnelsResponse{}
+	return resp, c.invoke(ctx, "ListTunnels", req, resp)
+}
@@ -0,0 +1,318 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// preservingCodec encodes records as JSON, like the default codec of storm, but keeps the fields it doesn't know about.
+// They are written by newer clients sharing the DB, e.g. through 'protos state', and are added back when this client
+// rewrites the record, instead of being dropped. Fields of nested structures are kept as well, including those of list
+// entries that have an ID, which are matched by it. Fields inside maps and lists of entries without an ID are not kept,
+// since their entries can't be matched reliably
+type preservingCodec struct {
+	mu sync.Mutex
+	// unknown holds the records read that have unknown fields, as stored, by type and ID
+	unknown map[string]map[string]json.RawMessage
+}
+
+func newPreservingCodec() *preservingCodec {
+	return &preservingCodec{unknown: map[string]map[string]json.RawMessage{}}
+}
+
+// Name returns the name of the default codec, since the encoding is the same. Storm refuses to open buckets written
+// using a codec with another name
+func (c *preservingCodec) Name() string {
+	return "json"
+}
+
+func (c *preservingCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	key, t := recordKey(v)
+	if key == "" {
+		return data, nil
+	}
+	c.mu.Lock()
+	stored, found := c.unknown[key]
+	c.mu.Unlock()
+	if !found {
+		return data, nil
+	}
+	record := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return data, nil
+	}
+	return json.Marshal(mergeUnknown(record, stored, t))
+}
+
+func (c *preservingCodec) Unmarshal(b []byte, v interface{}) error {
+	err := json.Unmarshal(b, v)
+	if err != nil {
+		return err
+	}
+	key, t := recordKey(v)
+	if key == "" {
+		return nil
+	}
+	stored := map[string]json.RawMessage{}
+	if json.Unmarshal(b, &stored) != nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hasUnknown(stored, t) {
+		c.unknown[key] = stored
+	} else {
+		delete(c.unknown, key)
+	}
+	return nil
+}
+
+// forget drops the unknown fields of record v once it's deleted, so that they don't end up in a new record with the
+// same ID
+func (c *preservingCodec) forget(v interface{}) {
+	key, _ := recordKey(v)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.unknown, key)
+}
+
+// move keeps the unknown fields of record from for record to, which replaces it under another ID
+func (c *preservingCodec) move(from interface{}, to interface{}) {
+	fromKey, _ := recordKey(from)
+	toKey, _ := recordKey(to)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stored, found := c.unknown[fromKey]; found {
+		delete(c.unknown, fromKey)
+		c.unknown[toKey] = stored
+	}
+}
+
+// recordKey identifies a record by its type and ID, the field named ID or tagged as such for storm. It returns an
+// empty key for values that are not records
+func recordKey(v interface{}) (string, reflect.Type) {
+	value := reflect.ValueOf(v)
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return "", nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return "", nil
+	}
+	t := value.Type()
+	id, found := idField(t)
+	if !found {
+		return "", nil
+	}
+	return fmt.Sprintf("%s/%v", t.String(), value.Field(id).Interface()), t
+}
+
+// idField returns the index of the ID field of struct t: the field tagged as ID for storm, or else the field named ID
+func idField(t reflect.Type) (int, bool) {
+	id := -1
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		for _, tag := range strings.Split(field.Tag.Get("storm"), ",") {
+			if tag == "id" {
+				return i, true
+			}
+		}
+		if field.Name == "ID" {
+			id = i
+		}
+	}
+	return id, id >= 0
+}
+
+// listEntryType returns the struct type of the entries of a list field of type t, and the lowercase JSON name of their
+// ID field, used to match them. It returns nil for other types, and for entries without an ID
+func listEntryType(t reflect.Type) (reflect.Type, string) {
+	if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+		return nil, ""
+	}
+	st := structType(t.Elem())
+	if st == nil {
+		return nil, ""
+	}
+	id, found := idField(st)
+	if !found {
+		return nil, ""
+	}
+	field := st.Field(id)
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "-" {
+		return nil, ""
+	}
+	if name == "" {
+		name = field.Name
+	}
+	return st, strings.ToLower(name)
+}
+
+// entryID returns the ID of a list entry, as stored, using the lowercase JSON name of the ID field
+func entryID(entry map[string]json.RawMessage, idName string) (string, bool) {
+	for name, raw := range entry {
+		if strings.ToLower(name) == idName {
+			return string(raw), true
+		}
+	}
+	return "", false
+}
+
+// jsonFields returns the types of the fields of struct t, by lowercase JSON name, since JSON keys are matched
+// regardless of case. Fields excluded from JSON are included using their Go name, so that values stored by older
+// clients under that name, like plain text keys, are not mistaken for fields of newer clients
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			fields[strings.ToLower(field.Name)] = field.Type
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for n, ft := range jsonFields(embedded) {
+					fields[n] = ft
+				}
+				continue
+			}
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[strings.ToLower(name)] = field.Type
+	}
+	return fields
+}
+
+// structType returns the struct type stored in a field of type t, nil for other types
+func structType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// hasUnknown returns true if the record stored has fields that are not part of struct t, directly or in its nested
+// structures
+func hasUnknown(stored map[string]json.RawMessage, t reflect.Type) bool {
+	fields := jsonFields(t)
+	for name, raw := range stored {
+		ft, known := fields[strings.ToLower(name)]
+		if !known {
+			return true
+		}
+		if st := structType(ft); st != nil {
+			nested := map[string]json.RawMessage{}
+			if json.Unmarshal(raw, &nested) == nil && hasUnknown(nested, st) {
+				return true
+			}
+		}
+		if st, _ := listEntryType(ft); st != nil {
+			entries := []map[string]json.RawMessage{}
+			if json.Unmarshal(raw, &entries) != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if hasUnknown(entry, st) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// mergeUnknown adds the fields of the record stored that are not part of struct t to record, the record being written
+func mergeUnknown(record map[string]json.RawMessage, stored map[string]json.RawMessage, t reflect.Type) map[string]json.RawMessage {
+	fields := jsonFields(t)
+	names := map[string]string{}
+	for name := range record {
+		names[strings.ToLower(name)] = name
+	}
+	for name, raw := range stored {
+		ft, known := fields[strings.ToLower(name)]
+		if !known {
+			if _, found := names[strings.ToLower(name)]; !found {
+				record[name] = raw
+			}
+			continue
+		}
+		current, found := names[strings.ToLower(name)]
+		if !found {
+			continue
+		}
+		if st, idName := listEntryType(ft); st != nil {
+			if merged, ok := mergeList(record[current], raw, st, idName); ok {
+				record[current] = merged
+			}
+			continue
+		}
+		st := structType(ft)
+		if st == nil {
+			continue
+		}
+		nestedStored := map[string]json.RawMessage{}
+		nestedRecord := map[string]json.RawMessage{}
+		// a nested structure removed by this client stays removed
+		if json.Unmarshal(raw, &nestedStored) != nil || json.Unmarshal(record[current], &nestedRecord) != nil || nestedRecord == nil {
+			continue
+		}
+		merged, err := json.Marshal(mergeUnknown(nestedRecord, nestedStored, st))
+		if err == nil {
+			record[current] = merged
+		}
+	}
+	return record
+}
+
+// mergeList adds the unknown fields of the entries of a stored list to the entries with the same ID in the list being
+// written. Entries removed by this client stay removed
+func mergeList(current json.RawMessage, stored json.RawMessage, t reflect.Type, idName string) (json.RawMessage, bool) {
+	storedEntries := []map[string]json.RawMessage{}
+	entries := []map[string]json.RawMessage{}
+	if json.Unmarshal(stored, &storedEntries) != nil || json.Unmarshal(current, &entries) != nil || entries == nil {
+		return nil, false
+	}
+	byID := map[string]map[string]json.RawMessage{}
+	for _, entry := range storedEntries {
+		if id, found := entryID(entry, idName); found {
+			byID[id] = entry
+		}
+	}
+	for i, entry := range entries {
+		id, found := entryID(entry, idName)
+		if !found {
+			continue
+		}
+		if storedEntry, found := byID[id]; found && entry != nil {
+			entries[i] = mergeUnknown(entry, storedEntry, t)
+		}
+	}
+	merged, err := json.Marshal(entries)
+	if err != nil {
+		return nil, false
+	}
+	return merged, true
+}
@@ -0,0 +1,123 @@
+package db
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/protosio/cli/internal/cloud"
+)
+
+// storedInstance is an instance record written by a newer client, with fields this client doesn't know about at the
+// top level, in a nested structure and in a list entry. It also holds a plain text key, as written by older clients
+const storedInstance = `{
+	"Name": "web",
+	"KeySeed": "c2VlZA==",
+	"PublicIP": "10.0.0.1",
+	"Region": "fr-par",
+	"Image": {"ID": "img-1", "Signature": "sig"},
+	"Volumes": [
+		{"VolumeID": "vol-1", "Name": "data", "Encrypted": true},
+		{"VolumeID": "vol-2", "Name": "logs", "Encrypted": false}
+	]
+}`
+
+// rewrite reads the stored instance using codec, changes it like this client would and writes it again
+func rewrite(t *testing.T, codec *preservingCodec, change func(instance *cloud.InstanceInfo)) map[string]interface{} {
+	instance := cloud.InstanceInfo{}
+	err := codec.Unmarshal([]byte(storedInstance), &instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(&instance)
+	data, err := codec.Marshal(&instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestCodecPreservesUnknownFields(t *testing.T) {
+	record := rewrite(t, newPreservingCodec(), func(instance *cloud.InstanceInfo) {
+		instance.PublicIP = "10.0.0.2"
+		// the second volume is detached by this client
+		instance.Volumes = instance.Volumes[:1]
+	})
+
+	if record["PublicIP"] != "10.0.0.2" {
+		t.Fatalf("The change of the record was lost: %v", record["PublicIP"])
+	}
+	if record["Region"] != "fr-par" {
+		t.Fatalf("The unknown top level field was dropped: %v", record)
+	}
+	image, _ := record["Image"].(map[string]interface{})
+	if image["Signature"] != "sig" {
+		t.Fatalf("The unknown field of the nested structure was dropped: %v", record["Image"])
+	}
+	volumes, _ := record["Volumes"].([]interface{})
+	if len(volumes) != 1 {
+		t.Fatalf("Expected the removed volume to stay removed, got %v", record["Volumes"])
+	}
+	volume, _ := volumes[0].(map[string]interface{})
+	if volume["VolumeID"] != "vol-1" || volume["Encrypted"] != true {
+		t.Fatalf("The unknown field of the list entry was dropped: %v", volume)
+	}
+}
+
+func TestCodecMatchesListEntriesByID(t *testing.T) {
+	record := rewrite(t, newPreservingCodec(), func(instance *cloud.InstanceInfo) {
+		// reordered, so that entries at the same position are different volumes
+		instance.Volumes = []cloud.VolumeInfo{instance.Volumes[1], instance.Volumes[0], {VolumeID: "vol-3"}}
+	})
+
+	volumes, _ := record["Volumes"].([]interface{})
+	if len(volumes) != 3 {
+		t.Fatalf("Expected 3 volumes, got %v", record["Volumes"])
+	}
+	expected := map[string]interface{}{"vol-1": true, "vol-2": false, "vol-3": nil}
+	for _, v := range volumes {
+		volume, _ := v.(map[string]interface{})
+		id, _ := volume["VolumeID"].(string)
+		if volume["Encrypted"] != expected[id] {
+			t.Fatalf("Volume '%s' got the unknown fields of another entry: %v", id, volume)
+		}
+	}
+}
+
+func TestCodecForgetsDeletedRecords(t *testing.T) {
+	codec := newPreservingCodec()
+	instance := cloud.InstanceInfo{}
+	err := codec.Unmarshal([]byte(storedInstance), &instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec.forget(&instance)
+
+	// a new record with the same name doesn't get the fields of the deleted one
+	data, err := codec.Marshal(&cloud.InstanceInfo{Name: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]interface{}{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := record["Region"]; found {
+		t.Fatalf("The re-created record got the fields of the deleted one: %v", record)
+	}
+}
+
+func TestCodecDropsExcludedFields(t *testing.T) {
+	record := rewrite(t, newPreservingCodec(), func(instance *cloud.InstanceInfo) {})
+
+	for name := range record {
+		if name == "KeySeed" {
+			t.Fatalf("The plain text key excluded from JSON was written back: %v", record)
+		}
+	}
+}
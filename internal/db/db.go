@@ -1,21 +1,70 @@
 package db
 
 import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"os"
-	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/asdine/storm"
 	"github.com/pkg/errors"
 	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/dirs"
+	"github.com/protosio/cli/internal/saga"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
-	// DefaultPath indicates the default path where the DB file is saved
-	DefaultPath = "/.protos/protos.db"
+	// DefaultName is the name of the DB file, saved in the state directory by default
+	DefaultName = "protos.db"
+	// maxSnapshots is the number of DB snapshots kept for undo
+	maxSnapshots = 10
+	// maxHistory is the number of history entries kept, the oldest ones being removed first
+	maxHistory = 1000
+	// maxInstanceRevisions is the number of revisions kept per instance, the oldest ones being removed first
+	maxInstanceRevisions = 200
+	// lockTimeout is how long opening the DB waits for another process that has it open, e.g. a background job
+	lockTimeout = 5 * time.Second
 )
 
+// ErrLocked is returned by Open when the DB is kept open by another process for longer than lockTimeout
+var ErrLocked = errors.New("The database is in use by another protos command")
+
+// HistoryEntry records a command that changed the database, and the user who ran it
+type HistoryEntry struct {
+	ID      int `storm:"id,increment"`
+	Time    time.Time
+	User    string
+	Command string // command and arguments, without the flags and key=value values since they can hold credentials
+}
+
+// InstanceRevision is a copy of an instance record, saved every time the instance changes, so that 'protos instance
+// history' can show how it evolved. Changes of LastSeen alone, done on every contact, don't create revisions
+type InstanceRevision struct {
+	ID       int    `storm:"id,increment"`
+	Instance string `storm:"index"`
+	Time     time.Time
+	Deleted  bool // the instance was deleted, and Record holds its last details
+	Record   cloud.InstanceInfo
+}
+
+// Member is a user of a shared database, whose role sets if they can change it. See 'protos state members'
+type Member struct {
+	User string `storm:"id"`
+	Role string
+}
+
 type dbstorm struct {
-	s *storm.DB
+	s        *storm.DB
+	codec    *preservingCodec
+	path     string
+	keystore cipher.AEAD // loaded on first use of the keystore
 }
 
 // DB represents a DB client instance, used to interract with the database
@@ -24,18 +73,43 @@ type DB interface {
 	DeleteCloud(name string) error
 	GetCloud(name string) (cloud.ProviderInfo, error)
 	GetAllClouds() ([]cloud.ProviderInfo, error)
+	RenameCloud(name string, newName string) error
 	SaveInstance(instance cloud.InstanceInfo) error
 	DeleteInstance(name string) error
 	GetInstance(name string) (cloud.InstanceInfo, error)
 	GetAllInstances() ([]cloud.InstanceInfo, error)
+	GetInstanceRevisions(name string) ([]InstanceRevision, error)
+	SaveVolume(volume cloud.VolumeInfo) error
+	DeleteVolume(id string) error
+	GetVolume(id string) (cloud.VolumeInfo, error)
+	GetAllVolumes() ([]cloud.VolumeInfo, error)
+	SaveBackup(backup cloud.BackupInfo) error
+	GetAllBackups() ([]cloud.BackupInfo, error)
+	DeleteBackup(snapshotID string) error
+	SaveOperation(op saga.Operation) error
+	GetOperation(id string) (saga.Operation, error)
+	GetAllOperations() ([]saga.Operation, error)
+	SaveHistory(entry HistoryEntry) error
+	GetHistory() ([]HistoryEntry, error)
+	DeleteHistory(id int) error
+	SaveMember(member Member) error
+	DeleteMember(user string) error
+	GetAllMembers() ([]Member, error)
+	SaveDeployKey(opID string, seed []byte) error
+	GetDeployKey(opID string) ([]byte, error)
+	DeleteDeployKey(opID string) error
+	MigrateKeys() (int, error)
+	LegacyKeys() (int, error)
+	Snapshot() (string, error)
+	Revision() (int, error)
+	Compact() error
 	Close() error
 }
 
 // Init creates a new local database used by the Protos client
 func Init() (string, error) {
-	usr, _ := user.Current()
-	protosDir := usr.HomeDir + "/.protos"
-	protosDB := protosDir + "/protos.db"
+	protosDir := dirs.State()
+	protosDB := filepath.Join(protosDir, DefaultName)
 	_, err := os.Stat(protosDB)
 	if err == nil {
 		return protosDB, errors.Errorf("A file exists on path '%s'. Remove it and start the init process again", protosDB)
@@ -62,35 +136,111 @@ func Init() (string, error) {
 	return protosDB, New(protosDB)
 }
 
-// New create a new DB at the path specified
+// New create a new DB at the path specified, using the current schema version
 func New(path string) error {
-	db, err := storm.Open(path)
+	db, err := storm.Open(path, storm.Codec(newPreservingCodec()))
 	if err != nil {
 		return err
 	}
 	defer db.Close()
+	err = db.Set(metaBucket, schemaVersionKey, SchemaVersion())
+	if err != nil {
+		return errors.Wrap(err, "Failed to set database schema version")
+	}
 	return nil
 }
 
-// Open tries to open a client for the db on the provided path
+// Open tries to open a client for the db on the provided path. DBs using an older schema version are migrated to the
+// current one
 func Open(path string) (DB, error) {
-	if path == "" {
-		usr, _ := user.Current()
-		path = usr.HomeDir + DefaultPath
-	}
+	path = dbPath(path)
 	_, err := os.Stat(path)
 	if err != nil {
 		return nil, errors.Wrap(err, "Can't find database file. Please run init")
 	}
-	db := &dbstorm{}
-	dbg, err := storm.Open(path)
+	db := &dbstorm{path: path, codec: newPreservingCodec()}
+	dbg, err := openStorm(path, db.codec)
 	if err != nil {
 		return nil, err
 	}
 	db.s = dbg
+	err = db.migrate()
+	if err != nil {
+		dbg.Close()
+		return nil, err
+	}
 	return db, nil
 }
 
+func openStorm(path string, codec *preservingCodec) (*storm.DB, error) {
+	dbg, err := storm.Open(path, storm.Codec(codec), storm.BoltOptions(0600, &bolt.Options{Timeout: lockTimeout}))
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	}
+	return dbg, err
+}
+
+// HoldsLegacyKeys reports whether the file of a db or of a snapshot holds key seeds stored in plain text by older
+// clients. The file is searched as is, so seeds left in pages freed since they were moved to the keystore are found too
+func HoldsLegacyKeys(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to read database '%s'", path)
+	}
+	return bytes.Contains(data, []byte(`"KeySeed":"`)) || bytes.Contains(data, []byte(`"`+deployKeyParam+`":"`)), nil
+}
+
+// Snapshots returns the snapshots of the db on the provided path, oldest first
+func Snapshots(path string) ([]string, error) {
+	dir := snapshotDir(dbPath(path))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read snapshot directory '%s'", dir)
+	}
+	snapshots := []string{}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".db") {
+			snapshots = append(snapshots, filepath.Join(dir, f.Name()))
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// Undo restores the db on the provided path to its most recent snapshot, which is then removed. Other processes should
+// not have the db open while it's restored, since they would keep using the replaced file: the caller can ensure that by
+// keeping it open using Open meanwhile
+func Undo(path string) (string, error) {
+	path = dbPath(path)
+	snapshots, err := Snapshots(path)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "", errors.New("No database snapshot available")
+	}
+	latest := snapshots[len(snapshots)-1]
+	err = os.Rename(latest, path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to restore database snapshot '%s'", latest)
+	}
+	return latest, nil
+}
+
+func dbPath(path string) string {
+	if path == "" {
+		path = filepath.Join(dirs.State(), DefaultName)
+	}
+	return path
+}
+
+func snapshotDir(path string) string {
+	return filepath.Join(filepath.Dir(path), "snapshots")
+}
+
 //
 // db storm methods for implementing the DB interface
 //
@@ -110,6 +260,7 @@ func (db *dbstorm) DeleteCloud(name string) error {
 	if err != nil {
 		return err
 	}
+	db.codec.forget(&cp)
 	return nil
 }
 
@@ -131,8 +282,129 @@ func (db *dbstorm) GetAllClouds() ([]cloud.ProviderInfo, error) {
 	return cps, nil
 }
 
+// RenameCloud renames a cloud provider account, along with the references to it in the instances, volumes, backups and
+// unfinished operations, in a single transaction
+func (db *dbstorm) RenameCloud(name string, newName string) error {
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cp := cloud.ProviderInfo{}
+	err = tx.One("Name", name, &cp)
+	if err != nil {
+		return errors.Wrapf(err, "Could not retrieve cloud '%s'", name)
+	}
+	err = tx.One("Name", newName, &cloud.ProviderInfo{})
+	if err == nil {
+		return errors.Errorf("Cloud '%s' already exists", newName)
+	} else if err != storm.ErrNotFound {
+		return err
+	}
+	err = tx.DeleteStruct(&cp)
+	if err != nil {
+		return err
+	}
+	renamed := cp
+	renamed.Name = newName
+	db.codec.move(&cp, &renamed)
+	err = tx.Save(&renamed)
+	if err != nil {
+		return err
+	}
+
+	instances := []cloud.InstanceInfo{}
+	err = tx.Find("CloudName", name, &instances)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, instance := range instances {
+		instance.CloudName = newName
+		for i := range instance.Volumes {
+			instance.Volumes[i].CloudName = newName
+		}
+		err = saveRevision(tx, InstanceRevision{Instance: instance.Name, Time: time.Now(), Record: instance})
+		if err != nil {
+			return err
+		}
+		err = tx.Save(&instance)
+		if err != nil {
+			return err
+		}
+	}
+	volumes := []cloud.VolumeInfo{}
+	err = tx.Find("CloudName", name, &volumes)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, volume := range volumes {
+		volume.CloudName = newName
+		err = tx.Save(&volume)
+		if err != nil {
+			return err
+		}
+	}
+	backups := []cloud.BackupInfo{}
+	err = tx.Find("CloudName", name, &backups)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	for _, backup := range backups {
+		backup.CloudName = newName
+		err = tx.Save(&backup)
+		if err != nil {
+			return err
+		}
+	}
+	ops := []saga.Operation{}
+	err = tx.All(&ops)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Done() || op.Params["cloud"] != name {
+			continue
+		}
+		op.Params["cloud"] = newName
+		err = tx.Save(&op)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SaveInstance saves the instance, storing its key seed in the keystore
 func (db *dbstorm) SaveInstance(instance cloud.InstanceInfo) error {
-	return db.s.Save(&instance)
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(instance.KeySeed) > 0 {
+		err = db.saveKey(tx, instance.Name, instance.KeySeed)
+		if err != nil {
+			return err
+		}
+	}
+	previous := cloud.InstanceInfo{}
+	err = tx.One("Name", instance.Name, &previous)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+	if err == storm.ErrNotFound || instanceChanged(previous, instance) {
+		err = saveRevision(tx, InstanceRevision{Instance: instance.Name, Time: time.Now(), Record: instance})
+		if err != nil {
+			return err
+		}
+	}
+	err = tx.Save(&instance)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (db *dbstorm) DeleteInstance(name string) error {
@@ -142,10 +414,64 @@ func (db *dbstorm) DeleteInstance(name string) error {
 		return err
 	}
 
-	err = db.s.Delete("InstanceInfo", name)
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = saveRevision(tx, InstanceRevision{Instance: name, Time: time.Now(), Deleted: true, Record: instance})
 	if err != nil {
 		return err
 	}
+	err = tx.Delete("InstanceInfo", name)
+	if err != nil {
+		return err
+	}
+	err = db.deleteKey(tx, name)
+	if err != nil {
+		return err
+	}
+	db.codec.forget(&instance)
+	return tx.Commit()
+}
+
+// GetInstanceRevisions returns the revisions of an instance, oldest first. They are kept after the instance is deleted
+func (db *dbstorm) GetInstanceRevisions(name string) ([]InstanceRevision, error) {
+	revisions := []InstanceRevision{}
+	err := db.s.Find("Instance", name, &revisions)
+	if err != nil && err != storm.ErrNotFound {
+		return revisions, err
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].ID < revisions[j].ID })
+	return revisions, nil
+}
+
+// instanceChanged returns true if two records of an instance differ by more than the time it was last seen
+func instanceChanged(previous cloud.InstanceInfo, current cloud.InstanceInfo) bool {
+	previous.LastSeen, current.LastSeen = time.Time{}, time.Time{}
+	a, errA := json.Marshal(previous)
+	b, errB := json.Marshal(current)
+	return errA != nil || errB != nil || !bytes.Equal(a, b)
+}
+
+// saveRevision saves a revision of an instance, removing its oldest revisions beyond maxInstanceRevisions
+func saveRevision(tx storm.Node, revision InstanceRevision) error {
+	err := tx.Save(&revision)
+	if err != nil {
+		return err
+	}
+	revisions := []InstanceRevision{}
+	err = tx.Find("Instance", revision.Instance, &revisions)
+	if err != nil || len(revisions) <= maxInstanceRevisions {
+		return err
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].ID < revisions[j].ID })
+	for i := 0; i < len(revisions)-maxInstanceRevisions; i++ {
+		err = tx.DeleteStruct(&revisions[i])
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -155,6 +481,10 @@ func (db *dbstorm) GetInstance(name string) (cloud.InstanceInfo, error) {
 	if err != nil {
 		return instance, err
 	}
+	err = db.withKey(&instance)
+	if err != nil {
+		return instance, err
+	}
 	return instance, nil
 }
 
@@ -164,9 +494,302 @@ func (db *dbstorm) GetAllInstances() ([]cloud.InstanceInfo, error) {
 	if err != nil {
 		return instances, err
 	}
+	for i := range instances {
+		err = db.withKey(&instances[i])
+		if err != nil {
+			return instances, err
+		}
+	}
 	return instances, nil
 }
 
+func (db *dbstorm) SaveVolume(volume cloud.VolumeInfo) error {
+	return db.s.Save(&volume)
+}
+
+func (db *dbstorm) DeleteVolume(id string) error {
+	volume := cloud.VolumeInfo{}
+	err := db.s.One("VolumeID", id, &volume)
+	if err != nil {
+		return err
+	}
+
+	err = db.s.DeleteStruct(&volume)
+	if err != nil {
+		return err
+	}
+	db.codec.forget(&volume)
+	return nil
+}
+
+func (db *dbstorm) GetVolume(id string) (cloud.VolumeInfo, error) {
+	volume := cloud.VolumeInfo{}
+	err := db.s.One("VolumeID", id, &volume)
+	if err != nil {
+		return volume, err
+	}
+	return volume, nil
+}
+
+func (db *dbstorm) GetAllVolumes() ([]cloud.VolumeInfo, error) {
+	volumes := []cloud.VolumeInfo{}
+	err := db.s.All(&volumes)
+	if err != nil {
+		return volumes, err
+	}
+	return volumes, nil
+}
+
+func (db *dbstorm) SaveBackup(backup cloud.BackupInfo) error {
+	return db.s.Save(&backup)
+}
+
+func (db *dbstorm) GetAllBackups() ([]cloud.BackupInfo, error) {
+	backups := []cloud.BackupInfo{}
+	err := db.s.All(&backups)
+	if err != nil {
+		return backups, err
+	}
+	return backups, nil
+}
+
+func (db *dbstorm) DeleteBackup(snapshotID string) error {
+	backup := cloud.BackupInfo{}
+	err := db.s.One("SnapshotID", snapshotID, &backup)
+	if err != nil {
+		return err
+	}
+	err = db.s.DeleteStruct(&backup)
+	if err != nil {
+		return err
+	}
+	db.codec.forget(&backup)
+	return nil
+}
+
+func (db *dbstorm) SaveOperation(op saga.Operation) error {
+	return db.s.Save(&op)
+}
+
+func (db *dbstorm) GetOperation(id string) (saga.Operation, error) {
+	op := saga.Operation{}
+	err := db.s.One("ID", id, &op)
+	if err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+func (db *dbstorm) GetAllOperations() ([]saga.Operation, error) {
+	ops := []saga.Operation{}
+	err := db.s.All(&ops)
+	if err != nil {
+		return ops, err
+	}
+	return ops, nil
+}
+
+// SaveHistory adds an entry to the history, removing the oldest entries beyond maxHistory
+func (db *dbstorm) SaveHistory(entry HistoryEntry) error {
+	err := db.s.Save(&entry)
+	if err != nil {
+		return err
+	}
+	count, err := db.s.Count(&HistoryEntry{})
+	if err != nil || count <= maxHistory {
+		return err
+	}
+	old := []HistoryEntry{}
+	err = db.s.AllByIndex("ID", &old, storm.Limit(count-maxHistory))
+	if err != nil {
+		return err
+	}
+	for i := range old {
+		err = db.s.DeleteStruct(&old[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteHistory removes a history entry, e.g. one recorded for a command that failed without changing the db
+func (db *dbstorm) DeleteHistory(id int) error {
+	entry := HistoryEntry{}
+	err := db.s.One("ID", id, &entry)
+	if err != nil {
+		return err
+	}
+	return db.s.DeleteStruct(&entry)
+}
+
+// GetHistory returns the history entries, oldest first
+func (db *dbstorm) GetHistory() ([]HistoryEntry, error) {
+	entries := []HistoryEntry{}
+	err := db.s.AllByIndex("ID", &entries)
+	if err != nil {
+		return entries, err
+	}
+	return entries, nil
+}
+
+func (db *dbstorm) SaveMember(member Member) error {
+	return db.s.Save(&member)
+}
+
+func (db *dbstorm) DeleteMember(user string) error {
+	member := Member{}
+	err := db.s.One("User", user, &member)
+	if err != nil {
+		return err
+	}
+	err = db.s.DeleteStruct(&member)
+	if err != nil {
+		return err
+	}
+	db.codec.forget(&member)
+	return nil
+}
+
+func (db *dbstorm) GetAllMembers() ([]Member, error) {
+	members := []Member{}
+	err := db.s.All(&members)
+	if err != nil {
+		return members, err
+	}
+	return members, nil
+}
+
+// Snapshot copies the db file to the snapshot directory. It should be called before any writes are done. The oldest
+// snapshots are removed once the db is closed
+func (db *dbstorm) Snapshot() (string, error) {
+	dir := snapshotDir(db.path)
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to create snapshot directory '%s'", dir)
+	}
+
+	snapshot := filepath.Join(dir, "protos-"+time.Now().UTC().Format("20060102T150405.000000000")+".db")
+	err = copyFile(db.path, snapshot)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to snapshot database")
+	}
+	return snapshot, nil
+}
+
+// Revision returns the ID of the last write transaction of the db, which changes with every write. Comparing it tells
+// if the db was written to since a snapshot
+func (db *dbstorm) Revision() (int, error) {
+	revision := 0
+	err := db.s.Bolt.View(func(tx *bolt.Tx) error {
+		revision = tx.ID()
+		return nil
+	})
+	return revision, err
+}
+
+// Compact rewrites the db file with only its current records. Bolt reuses the pages freed by changes without clearing
+// them, so they can still hold deleted data, like key seeds moved to the keystore
+func (db *dbstorm) Compact() error {
+	tmp := db.path + ".compact"
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to compact database")
+	}
+	err = db.s.Bolt.View(func(srcTx *bolt.Tx) error {
+		return dst.Update(func(dstTx *bolt.Tx) error {
+			return srcTx.ForEach(func(name []byte, src *bolt.Bucket) error {
+				b, err := dstTx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(src, b)
+			})
+		})
+	})
+	closeErr := dst.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to compact database")
+	}
+
+	err = db.s.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "Failed to compact database")
+	}
+	err = os.Rename(tmp, db.path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	// the db is opened again even if the compacted copy couldn't replace it
+	dbg, openErr := openStorm(db.path, db.codec)
+	if openErr != nil {
+		return errors.Wrap(openErr, "Failed to open compacted database")
+	}
+	db.s = dbg
+	if err != nil {
+		return errors.Wrap(err, "Failed to replace database with its compacted copy")
+	}
+	return nil
+}
+
+// copyBucket copies the keys, nested buckets and sequence of a bucket
+func copyBucket(src *bolt.Bucket, dst *bolt.Bucket) error {
+	err := dst.SetSequence(src.Sequence())
+	if err != nil {
+		return err
+	}
+	return src.ForEach(func(k []byte, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		nested, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(src.Bucket(k), nested)
+	})
+}
+
+// Close closes the db, and removes the oldest snapshots beyond maxSnapshots. They are not removed by Snapshot, so that
+// a snapshot discarded meanwhile doesn't evict an older one
 func (db *dbstorm) Close() error {
-	return db.s.Close()
+	err := db.s.Close()
+	if err != nil {
+		return err
+	}
+	snapshots, err := Snapshots(db.path)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(snapshots)-maxSnapshots; i++ {
+		err = os.Remove(snapshots[i])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to remove old database snapshot '%s'", snapshots[i])
+		}
+	}
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
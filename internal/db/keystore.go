@@ -0,0 +1,314 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/saga"
+)
+
+const (
+	// keystoreBucket holds the SSH key seeds of the instances, encrypted with the keystore key, by instance name
+	keystoreBucket = "keystore"
+	// KeystoreKeyFile is the name of the file holding the keystore key, next to the DB file
+	KeystoreKeyFile = "keystore.key"
+	// KeystoreKeyEnv is the environment variable that overrides the keystore key file, e.g. for teams sharing the DB
+	// using 'protos state'. It holds the key encoded as base64
+	KeystoreKeyEnv = "PROTOS_KEYSTORE_KEY"
+	// keystoreKeySize is the size of the keystore key, used with AES-256-GCM
+	keystoreKeySize = 32
+	// deployKeyParam is the param of deploy operations that held the key seed, before the keystore was used
+	deployKeyParam = "key-seed"
+)
+
+// legacyInstance holds the key seed stored on instance records by clients older than the keystore
+type legacyInstance struct {
+	KeySeed []byte
+}
+
+// keystoreKeyPath returns the path of the keystore key file
+func (db *dbstorm) keystoreKeyPath() string {
+	return filepath.Join(filepath.Dir(db.path), KeystoreKeyFile)
+}
+
+// keystoreCipher returns the cipher used to encrypt the keystore, loading the keystore key. The key is generated if
+// create is true and there is none yet, unless the keystore already holds keys, e.g. in a database shared using
+// 'protos state': they were stored using another key, which has to be copied instead
+func (db *dbstorm) keystoreCipher(tx storm.Node, create bool) (cipher.AEAD, error) {
+	if db.keystore != nil {
+		return db.keystore, nil
+	}
+
+	var key []byte
+	var err error
+	path := db.keystoreKeyPath()
+	if encoded := os.Getenv(KeystoreKeyEnv); encoded != "" {
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid keystore key in %s", KeystoreKeyEnv)
+		}
+	} else {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err == nil {
+			key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid keystore key file '%s'", path)
+			}
+		} else if os.IsNotExist(err) && create {
+			var stored int
+			stored, err = keystoreEntries(tx)
+			if err != nil {
+				return nil, err
+			}
+			if stored > 0 {
+				return nil, errors.Errorf("Keystore key file '%s' is missing, while the keystore holds %d keys stored using another keystore key. Copy the file from the machine that stored them, or set %s", path, stored, KeystoreKeyEnv)
+			}
+			key = make([]byte, keystoreKeySize)
+			_, err = rand.Read(key)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to generate keystore key")
+			}
+			err = ioutil.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), os.FileMode(0600))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Failed to write keystore key file '%s'", path)
+			}
+		} else if os.IsNotExist(err) {
+			return nil, errors.Errorf("Keystore key file '%s' is missing. Copy it from the machine that stored the instance keys, or set %s", path, KeystoreKeyEnv)
+		} else {
+			return nil, errors.Wrapf(err, "Failed to read keystore key file '%s'", path)
+		}
+	}
+	if len(key) != keystoreKeySize {
+		return nil, errors.Errorf("Invalid keystore key: expected %d bytes, got %d", keystoreKeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to initialize keystore cipher")
+	}
+	db.keystore, err = cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to initialize keystore cipher")
+	}
+	return db.keystore, nil
+}
+
+// saveKey encrypts the key seed of an instance and stores it in the keystore. The instance name is authenticated
+// along with the seed, so that seeds can't be swapped between instances
+func (db *dbstorm) saveKey(tx storm.Node, name string, seed []byte) error {
+	aead, err := db.keystoreCipher(tx, true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return errors.Wrap(err, "Failed to generate keystore nonce")
+	}
+	sealed := aead.Seal(nonce, nonce, seed, []byte(name))
+	err = tx.Set(keystoreBucket, name, sealed)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save the SSH key of instance '%s'", name)
+	}
+	return nil
+}
+
+// getKey returns the key seed of an instance. Seeds stored on the instance record by older clients are returned if
+// the keystore doesn't hold one, and nil if there is none
+func (db *dbstorm) getKey(tx storm.Node, name string) ([]byte, error) {
+	sealed := []byte{}
+	err := tx.Get(keystoreBucket, name, &sealed)
+	if err == storm.ErrNotFound {
+		legacy := legacyInstance{}
+		err = tx.Get("InstanceInfo", name, &legacy)
+		if err != nil && err != storm.ErrNotFound {
+			return nil, errors.Wrapf(err, "Failed to read the SSH key of instance '%s'", name)
+		}
+		return legacy.KeySeed, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read the SSH key of instance '%s'", name)
+	}
+
+	aead, err := db.keystoreCipher(tx, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.Errorf("The stored SSH key of instance '%s' is corrupted", name)
+	}
+	seed, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, errors.Errorf("Failed to decrypt the SSH key of instance '%s'. The keystore key doesn't match the one used to store it", name)
+	}
+	return seed, nil
+}
+
+// keystoreEntries returns the number of keys in the keystore
+func keystoreEntries(tx storm.Node) (int, error) {
+	count := 0
+	err := tx.Select().Bucket(keystoreBucket).RawEach(func(k []byte, v []byte) error {
+		count++
+		return nil
+	})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "Failed to read the keystore")
+	}
+	return count, nil
+}
+
+func (db *dbstorm) deleteKey(tx storm.Node, name string) error {
+	err := tx.Delete(keystoreBucket, name)
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrapf(err, "Failed to delete the SSH key of instance '%s'", name)
+	}
+	return nil
+}
+
+// withKey fills in the key seed of the instance from the keystore
+func (db *dbstorm) withKey(instance *cloud.InstanceInfo) error {
+	seed, err := db.getKey(db.s, instance.Name)
+	if err != nil {
+		return err
+	}
+	instance.KeySeed = seed
+	return nil
+}
+
+//
+// Keystore methods for implementing the DB interface
+//
+
+func (db *dbstorm) SaveDeployKey(opID string, seed []byte) error {
+	return db.saveKey(db.s, deployKeyName(opID), seed)
+}
+
+func (db *dbstorm) GetDeployKey(opID string) ([]byte, error) {
+	seed, err := db.getKey(db.s, deployKeyName(opID))
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) == 0 {
+		return nil, errors.Errorf("No SSH key stored for operation '%s'", opID)
+	}
+	return seed, nil
+}
+
+func (db *dbstorm) DeleteDeployKey(opID string) error {
+	return db.deleteKey(db.s, deployKeyName(opID))
+}
+
+// MigrateKeys moves the key seeds stored in plain text by older clients, on instance records and in the params of
+// deploy operations, to the keystore. The seeds of completed operations are dropped. It returns the number of keys
+// moved or dropped
+func (db *dbstorm) MigrateKeys() (int, error) {
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	moved := 0
+	instances := []cloud.InstanceInfo{}
+	err = tx.All(&instances)
+	if err != nil {
+		return 0, err
+	}
+	for _, instance := range instances {
+		legacy := legacyInstance{}
+		err = tx.Get("InstanceInfo", instance.Name, &legacy)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to read instance '%s'", instance.Name)
+		}
+		if len(legacy.KeySeed) == 0 {
+			continue
+		}
+		err = db.saveKey(tx, instance.Name, legacy.KeySeed)
+		if err != nil {
+			return 0, err
+		}
+		// saving the record again drops the plain text seed, which is not serialized anymore
+		err = tx.Save(&instance)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to save instance '%s'", instance.Name)
+		}
+		moved++
+	}
+
+	ops := []saga.Operation{}
+	err = tx.All(&ops)
+	if err != nil {
+		return 0, err
+	}
+	for _, op := range ops {
+		encoded, found := op.Params[deployKeyParam]
+		if !found {
+			continue
+		}
+		// completed operations don't need the key anymore
+		if !op.Done() {
+			seed, err := hex.DecodeString(encoded)
+			if err != nil {
+				return 0, errors.Wrapf(err, "Invalid SSH key in operation '%s'", op.ID)
+			}
+			err = db.saveKey(tx, deployKeyName(op.ID), seed)
+			if err != nil {
+				return 0, err
+			}
+		}
+		delete(op.Params, deployKeyParam)
+		err = tx.Save(&op)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to save operation '%s'", op.ID)
+		}
+		moved++
+	}
+	return moved, tx.Commit()
+}
+
+// LegacyKeys returns the number of key seeds stored in plain text by older clients, which MigrateKeys moves to the
+// keystore
+func (db *dbstorm) LegacyKeys() (int, error) {
+	count := 0
+	instances := []cloud.InstanceInfo{}
+	err := db.s.All(&instances)
+	if err != nil {
+		return 0, err
+	}
+	for _, instance := range instances {
+		legacy := legacyInstance{}
+		err = db.s.Get("InstanceInfo", instance.Name, &legacy)
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed to read instance '%s'", instance.Name)
+		}
+		if len(legacy.KeySeed) > 0 {
+			count++
+		}
+	}
+	ops := []saga.Operation{}
+	err = db.s.All(&ops)
+	if err != nil {
+		return 0, err
+	}
+	for _, op := range ops {
+		if _, found := op.Params[deployKeyParam]; found {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// deployKeyName is the keystore entry of the key generated by a deploy operation, before the instance is saved
+func deployKeyName(opID string) string {
+	return "operation:" + opID
+}
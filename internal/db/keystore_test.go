@@ -0,0 +1,159 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tempDB creates a database in a temporary directory, removed by the returned function
+func tempDB(t *testing.T) (string, func()) {
+	os.Unsetenv(KeystoreKeyEnv)
+	dir, err := ioutil.TempDir("", "protos-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, DefaultName)
+	err = New(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestKeystoreKeyGeneratedForEmptyKeystore(t *testing.T) {
+	path, cleanup := tempDB(t)
+	defer cleanup()
+	dbp, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbp.Close()
+
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	err = dbp.SaveDeployKey("op1", seed)
+	if err != nil {
+		t.Fatalf("Saving the first key failed: %v", err)
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(path), KeystoreKeyFile))
+	if err != nil {
+		t.Fatalf("The keystore key was not generated: %v", err)
+	}
+	stored, err := dbp.GetDeployKey("op1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, seed) {
+		t.Fatal("The stored key differs from the saved one")
+	}
+}
+
+func TestKeystoreKeyNotGeneratedForStoredKeys(t *testing.T) {
+	path, cleanup := tempDB(t)
+	defer cleanup()
+	dbp, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dbp.SaveDeployKey("op1", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbp.Close()
+
+	// another user of a shared database, without the keystore key
+	keyFile := filepath.Join(filepath.Dir(path), KeystoreKeyFile)
+	err = os.Remove(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbp, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbp.Close()
+	err = dbp.SaveDeployKey("op2", []byte("fedcba9876543210fedcba9876543210"))
+	if err == nil {
+		t.Fatal("A new keystore key was generated while the keystore holds keys")
+	}
+	if !strings.Contains(err.Error(), KeystoreKeyEnv) {
+		t.Fatalf("The error doesn't mention %s: %v", KeystoreKeyEnv, err)
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Fatal("A keystore key file was written")
+	}
+}
+
+func TestMigrateKeysAndCompact(t *testing.T) {
+	path, cleanup := tempDB(t)
+	defer cleanup()
+	dbp, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbp.Close()
+
+	// a record written by a client older than the keystore, holding the seed in plain text
+	seed := []byte("0123456789abcdef0123456789abcdef")
+	legacy := struct {
+		Name    string `storm:"id"`
+		KeySeed []byte
+	}{Name: "old", KeySeed: seed}
+	err = dbp.(*dbstorm).s.Set("InstanceInfo", "old", &legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := dbp.LegacyKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("Expected 1 plain text key, found %d", count)
+	}
+
+	moved, err := dbp.MigrateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 1 {
+		t.Fatalf("Expected 1 key to be moved, %d were", moved)
+	}
+	instance, err := dbp.GetInstance("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(instance.KeySeed, seed) {
+		t.Fatal("The migrated key differs from the plain text one")
+	}
+
+	// the pages freed by the migration still hold the key
+	found, err := HoldsLegacyKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("The plain text key was not found in the database file")
+	}
+	err = dbp.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err = HoldsLegacyKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("The compacted database still holds the plain text key")
+	}
+	instance, err = dbp.GetInstance("old")
+	if err != nil {
+		t.Fatalf("The instance is missing after compacting the database: %v", err)
+	}
+	if !bytes.Equal(instance.KeySeed, seed) {
+		t.Fatal("The key differs after compacting the database")
+	}
+}
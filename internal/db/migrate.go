@@ -0,0 +1,111 @@
+package db
+
+import (
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+)
+
+const (
+	metaBucket       = "meta"
+	schemaVersionKey = "schemaVersion"
+)
+
+// migration upgrades the records of the DB to the next schema version. It runs in a transaction, so a failed migration
+// leaves the DB unchanged
+type migration struct {
+	description string
+	run         func(tx storm.Node) error
+}
+
+// migrations upgrade the DB one schema version at a time: migrations[i] upgrades a DB at version i to version i+1.
+// Changes to the stored structures that need existing records to be updated are done by appending a migration, and
+// existing migrations should never be changed or reordered
+var migrations = []migration{
+	{"set the type of volumes recorded before local volumes were supported", migrateVolumeTypes},
+}
+
+// SchemaVersion returns the schema version used by this version of the client
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// schemaVersion returns the schema version of the DB. DBs created before versioning was introduced are at version 0
+func (db *dbstorm) schemaVersion() (int, error) {
+	version := 0
+	err := db.s.Get(metaBucket, schemaVersionKey, &version)
+	if err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "Failed to read database schema version")
+	}
+	return version, nil
+}
+
+// migrate upgrades the DB to the schema version used by this client. A snapshot is taken before the first migration
+// runs, so that the upgrade can be undone
+func (db *dbstorm) migrate() error {
+	version, err := db.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion() {
+		return errors.Errorf("Database '%s' uses schema version %d, but this client only supports versions up to %d. Please upgrade the client", db.path, version, SchemaVersion())
+	}
+	if version == SchemaVersion() {
+		return nil
+	}
+
+	_, err = db.Snapshot()
+	if err != nil {
+		return errors.Wrap(err, "Failed to snapshot database before migrating it")
+	}
+	for ; version < SchemaVersion(); version++ {
+		err = db.runMigration(version)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to migrate database to schema version %d (%s)", version+1, migrations[version].description)
+		}
+	}
+	return nil
+}
+
+func (db *dbstorm) runMigration(version int) error {
+	tx, err := db.s.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = migrations[version].run(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Set(metaBucket, schemaVersionKey, version+1)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//
+// Migrations
+//
+
+// migrateVolumeTypes sets the type of volumes recorded before the volume type was stored. Only block volumes could be
+// created at the time
+func migrateVolumeTypes(tx storm.Node) error {
+	volumes := []cloud.VolumeInfo{}
+	err := tx.All(&volumes)
+	if err != nil {
+		return err
+	}
+	for _, volume := range volumes {
+		if volume.Type != "" {
+			continue
+		}
+		volume.Type = cloud.BlockVolume
+		err = tx.Save(&volume)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
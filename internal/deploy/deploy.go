@@ -0,0 +1,320 @@
+// Package deploy implements the steps of the operation deploying a Protos instance. The steps run as a saga, so that an
+// interrupted deploy can be resumed or rolled back, and only depend on the CLI through the Hooks, so that they can be
+// tested against the fake cloud provider
+package deploy
+
+import (
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/release"
+	"github.com/protosio/cli/internal/saga"
+	"github.com/protosio/cli/internal/ssh"
+	log "github.com/sirupsen/logrus"
+)
+
+// Operation is the kind of the operations started by 'protos instance deploy'
+const Operation = "deploy"
+
+// dataVolumeSize is the size of the data volume of new instances, in MB
+const dataVolumeSize = 30000
+
+// Store is the part of the database used by the deploy steps
+type Store interface {
+	saga.Store
+	GetInstance(name string) (cloud.InstanceInfo, error)
+	GetAllInstances() ([]cloud.InstanceInfo, error)
+	SaveInstance(instance cloud.InstanceInfo) error
+	DeleteInstance(name string) error
+	GetVolume(id string) (cloud.VolumeInfo, error)
+	SaveVolume(volume cloud.VolumeInfo) error
+	DeleteVolume(id string) error
+	SaveDeployKey(opID string, seed []byte) error
+	GetDeployKey(opID string) ([]byte, error)
+	DeleteDeployKey(opID string) error
+}
+
+// Hooks are the parts of a deploy that depend on the CLI: the release images and the SSH access to the instance
+type Hooks struct {
+	// FindImage returns the ID of the image of a release already in the cloud account, empty if there is none
+	FindImage func(client cloud.Provider, version string, digest string) (string, error)
+	// AddImage adds the image of a release to the cloud account, and returns its ID and how it was added
+	AddImage func(client cloud.Provider, image release.CloudImage, version string, bandwidthLimit int64, stream bool) (string, string, error)
+	// Started is called once the instance is started, before it's saved, e.g. to record its machine ID. It's optional
+	Started func(client cloud.Provider, instance *cloud.InstanceInfo)
+	// AuthorizePersonalKey authorizes the personal key given to the deploy on the instance
+	AuthorizePersonalKey func(instanceName string, key string) error
+}
+
+// ImageProvenance returns the image a deploy operation uses, recorded by its "add image" step. Images already in the
+// cloud account keep the time they were added at, if an earlier deploy recorded it
+func ImageProvenance(store Store, p map[string]string) *cloud.ImageProvenance {
+	provenance := &cloud.ImageProvenance{ID: p["image"], Version: p["version"], Digest: p["image-digest"], Source: p["image-source"], URL: p["image-url"]}
+	provenance.AddedAt, _ = time.Parse(time.RFC3339, p["image-added"])
+	switch provenance.Source {
+	case "snapshot":
+		provenance.URL = p["image-snapshot"]
+	case "existing":
+		provenance.URL = ""
+		instances, err := store.GetAllInstances()
+		if err != nil {
+			log.Debugf("Failed to look up when image '%s' was added: %s", provenance.ID, err.Error())
+			return provenance
+		}
+		for _, instance := range instances {
+			if instance.Image != nil && instance.Image.ID == provenance.ID && instance.Name != p["instance"] {
+				provenance.AddedAt = instance.Image.AddedAt
+				provenance.URL = instance.Image.URL
+				break
+			}
+		}
+	}
+	return provenance
+}
+
+// Key returns the SSH key generated by a deploy operation. Operations started by older clients hold it in their
+// params, until moved to the keystore by 'protos db migrate-keys'
+func Key(store Store, op *saga.Operation) (ssh.Key, error) {
+	if encoded, found := op.Params["key-seed"]; found {
+		seed, err := hex.DecodeString(encoded)
+		if err != nil {
+			return ssh.Key{}, errors.Wrap(err, "Invalid SSH key seed")
+		}
+		return ssh.NewKeyFromSeed(seed)
+	}
+	seed, err := store.GetDeployKey(op.ID)
+	if err != nil {
+		return ssh.Key{}, err
+	}
+	return ssh.NewKeyFromSeed(seed)
+}
+
+// Steps returns the steps of a deploy operation, using a client initialized for the location of the operation. Every
+// step records its outputs in the operation params as soon as it creates a resource, so that a resumed deploy doesn't
+// create it twice and a rollback can remove it
+func Steps(store Store, client cloud.Provider, hooks Hooks, op *saga.Operation) []saga.Step {
+	p := op.Params
+	instanceName := p["instance"]
+	streamImage, _ := strconv.ParseBool(p["stream-image"])
+	ipv6Only, _ := strconv.ParseBool(p["ipv6-only"])
+	bandwidthLimit, _ := strconv.ParseInt(p["bandwidth-limit"], 10, 64)
+	volumeType := cloud.VolumeType(p["volume-type"])
+
+	addImage := func(op *saga.Operation) error {
+		id, err := hooks.FindImage(client, p["version"], p["image-digest"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to initialize Protos")
+		}
+		if id != "" {
+			log.Infof("Found Protos image version 'protos-%s' in your cloud account", p["version"])
+			p["image"] = id
+			p["image-source"] = "existing"
+			return nil
+		}
+		image := release.CloudImage{URL: p["image-url"], Digest: p["image-digest"], Snapshot: p["image-snapshot"]}
+		imageID, source, err := hooks.AddImage(client, image, p["version"], bandwidthLimit, streamImage)
+		if err != nil {
+			return errors.Wrap(err, "Failed to initialize Protos")
+		}
+		p["image"] = imageID
+		p["image-source"] = source
+		p["image-added"] = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	}
+
+	generateKey := func(op *saga.Operation) error {
+		log.Info("Generating SSH key for the new VM instance")
+		key, err := ssh.GenerateKey()
+		if err != nil {
+			return errors.Wrap(err, "Failed to initialize Protos")
+		}
+		err = store.SaveDeployKey(op.ID, key.Seed())
+		if err != nil {
+			return errors.Wrap(err, "Failed to initialize Protos")
+		}
+		return nil
+	}
+	forgetKey := func(op *saga.Operation) error {
+		// the key is stored with the instance once it's created
+		return store.DeleteDeployKey(op.ID)
+	}
+
+	createInstance := func(op *saga.Operation) error {
+		key, err := Key(store, op)
+		if err != nil {
+			return err
+		}
+		if p["vm"] == "" {
+			log.Infof("Deploying Protos instance '%s' using image '%s'", instanceName, p["image"])
+			vmID, err := client.NewInstance(instanceName, p["image"], key.Public(), ipv6Only)
+			if err != nil {
+				return errors.Wrap(err, "Failed to deploy Protos instance")
+			}
+			p["vm"] = vmID
+			log.Infof("Instance with ID '%s' deployed", vmID)
+		}
+
+		// get instance info
+		instanceInfo, err := client.GetInstanceInfo(p["vm"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to get Protos instance info")
+		}
+		instanceInfo.KeySeed = key.Seed()
+		instanceInfo.Version = p["version"]
+		instanceInfo.Image = ImageProvenance(store, p)
+		// save of the instance information
+		err = store.SaveInstance(instanceInfo)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save instance '%s'", instanceName)
+		}
+		return nil
+	}
+	deleteInstance := func(op *saga.Operation) error {
+		if p["vm"] == "" {
+			return nil
+		}
+		log.Infof("Deleting Protos instance '%s' (%s)", instanceName, p["vm"])
+		err := client.DeleteInstance(p["vm"])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to delete instance '%s'", instanceName)
+		}
+		delete(p, "vm")
+		if _, err := store.GetInstance(instanceName); err == nil {
+			return store.DeleteInstance(instanceName)
+		}
+		return nil
+	}
+
+	createVolume := func(op *saga.Operation) error {
+		if p["volume"] != "" {
+			return nil
+		}
+		var volumeID string
+		var err error
+		if p["from-snapshot"] != "" {
+			log.Infof("Creating %s data volume for Protos instance '%s' from snapshot '%s'", volumeType, instanceName, p["from-snapshot"])
+			volumeID, err = client.NewVolumeFromSnapshot(instanceName, p["from-snapshot"], volumeType)
+		} else {
+			log.Infof("Creating %s data volume for Protos instance '%s'", volumeType, instanceName)
+			volumeID, err = client.NewVolume(instanceName, dataVolumeSize, volumeType)
+		}
+		if err != nil {
+			return errors.Wrap(err, "Failed to create data volume")
+		}
+		p["volume"] = volumeID
+		return nil
+	}
+	deleteVolume := func(op *saga.Operation) error {
+		if p["volume"] == "" {
+			return nil
+		}
+		log.Infof("Deleting data volume '%s'", p["volume"])
+		err := client.DeleteVolume(p["volume"])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to delete volume '%s'", p["volume"])
+		}
+		delete(p, "volume")
+		return nil
+	}
+
+	attachVolume := func(op *saga.Operation) error {
+		if p["attached"] == "" {
+			err := client.AttachVolume(p["volume"], p["vm"])
+			if err != nil {
+				return errors.Wrapf(err, "Failed to attach volume to instance '%s'", instanceName)
+			}
+			p["attached"] = "true"
+		}
+
+		// track the data volume
+		volume, err := client.GetVolumeInfo(p["volume"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to get data volume info")
+		}
+		volume.InstanceName = instanceName
+		err = store.SaveVolume(volume)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save volume '%s'", p["volume"])
+		}
+		return nil
+	}
+	detachVolume := func(op *saga.Operation) error {
+		if p["attached"] == "" {
+			return nil
+		}
+		log.Infof("Detaching data volume '%s'", p["volume"])
+		err := client.DettachVolume(p["volume"], p["vm"])
+		if err != nil {
+			return errors.Wrapf(err, "Failed to detach volume '%s'", p["volume"])
+		}
+		delete(p, "attached")
+		if _, err := store.GetVolume(p["volume"]); err == nil {
+			return store.DeleteVolume(p["volume"])
+		}
+		return nil
+	}
+
+	startInstance := func(op *saga.Operation) error {
+		key, err := Key(store, op)
+		if err != nil {
+			return err
+		}
+		// start protos instance
+		log.Infof("Starting Protos instance '%s'", instanceName)
+		err = client.StartInstance(p["vm"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to start Protos instance")
+		}
+		p["started"] = "true"
+
+		// get instance info again
+		instanceInfo, err := client.GetInstanceInfo(p["vm"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to get Protos instance info")
+		}
+		instanceInfo.KeySeed = key.Seed()
+		instanceInfo.Version = p["version"]
+		instanceInfo.Image = ImageProvenance(store, p)
+		if hooks.Started != nil {
+			hooks.Started(client, &instanceInfo)
+		}
+
+		// final save of the instance information
+		err = store.SaveInstance(instanceInfo)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to save instance '%s'", instanceName)
+		}
+		return nil
+	}
+	stopInstance := func(op *saga.Operation) error {
+		if p["started"] == "" {
+			return nil
+		}
+		log.Infof("Stopping Protos instance '%s'", instanceName)
+		err := client.StopInstance(p["vm"])
+		if err != nil {
+			return errors.Wrap(err, "Failed to stop Protos instance")
+		}
+		delete(p, "started")
+		return nil
+	}
+
+	return []saga.Step{
+		{Name: "add image", Run: addImage},
+		{Name: "generate key", Run: generateKey, Rollback: forgetKey},
+		{Name: "create instance", Run: createInstance, Rollback: deleteInstance},
+		{Name: "create volume", Run: createVolume, Rollback: deleteVolume},
+		{Name: "attach volume", Run: attachVolume, Rollback: detachVolume},
+		{Name: "start instance", Run: startInstance, Rollback: stopInstance},
+		{Name: "authorize personal key", Run: func(op *saga.Operation) error {
+			if p["personal-key"] == "" {
+				return nil
+			}
+			return hooks.AuthorizePersonalKey(instanceName, p["personal-key"])
+		}},
+		{Name: "forget deploy key", Run: forgetKey},
+	}
+}
@@ -0,0 +1,262 @@
+package deploy_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/protosio/cli/internal/cloud"
+	"github.com/protosio/cli/internal/deploy"
+	"github.com/protosio/cli/internal/release"
+	"github.com/protosio/cli/internal/saga"
+	"github.com/sirupsen/logrus"
+)
+
+// TestMain serves the SSH endpoints of the fake instances started by the tests, which run the test binary with the
+// FakeEndpointCommand
+func TestMain(m *testing.M) {
+	if len(os.Args) == 4 && os.Args[1] == cloud.FakeEndpointCommand {
+		err := cloud.ServeFakeInstance(os.Args[2], os.Args[3], logrus.New())
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// memoryStore keeps the operations, instances, volumes and deploy keys in memory, instead of the local DB
+type memoryStore struct {
+	ops       map[string]saga.Operation
+	instances map[string]cloud.InstanceInfo
+	volumes   map[string]cloud.VolumeInfo
+	keys      map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		ops:       map[string]saga.Operation{},
+		instances: map[string]cloud.InstanceInfo{},
+		volumes:   map[string]cloud.VolumeInfo{},
+		keys:      map[string][]byte{},
+	}
+}
+
+func (s *memoryStore) SaveOperation(op saga.Operation) error {
+	s.ops[op.ID] = op
+	return nil
+}
+
+func (s *memoryStore) GetInstance(name string) (cloud.InstanceInfo, error) {
+	instance, found := s.instances[name]
+	if !found {
+		return cloud.InstanceInfo{}, errors.Errorf("Instance '%s' not found", name)
+	}
+	return instance, nil
+}
+
+func (s *memoryStore) GetAllInstances() ([]cloud.InstanceInfo, error) {
+	instances := []cloud.InstanceInfo{}
+	for _, instance := range s.instances {
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (s *memoryStore) SaveInstance(instance cloud.InstanceInfo) error {
+	s.instances[instance.Name] = instance
+	return nil
+}
+
+func (s *memoryStore) DeleteInstance(name string) error {
+	delete(s.instances, name)
+	return nil
+}
+
+func (s *memoryStore) GetVolume(id string) (cloud.VolumeInfo, error) {
+	volume, found := s.volumes[id]
+	if !found {
+		return cloud.VolumeInfo{}, errors.Errorf("Volume '%s' not found", id)
+	}
+	return volume, nil
+}
+
+func (s *memoryStore) SaveVolume(volume cloud.VolumeInfo) error {
+	s.volumes[volume.VolumeID] = volume
+	return nil
+}
+
+func (s *memoryStore) DeleteVolume(id string) error {
+	delete(s.volumes, id)
+	return nil
+}
+
+func (s *memoryStore) SaveDeployKey(opID string, seed []byte) error {
+	s.keys[opID] = seed
+	return nil
+}
+
+func (s *memoryStore) GetDeployKey(opID string) ([]byte, error) {
+	seed, found := s.keys[opID]
+	if !found {
+		return nil, errors.Errorf("No deploy key for operation '%s'", opID)
+	}
+	return seed, nil
+}
+
+func (s *memoryStore) DeleteDeployKey(opID string) error {
+	delete(s.keys, opID)
+	return nil
+}
+
+// testHooks add the release image by URL, and don't use SSH
+var testHooks = deploy.Hooks{
+	FindImage: func(client cloud.Provider, version string, digest string) (string, error) {
+		images, err := client.GetImages()
+		if err != nil {
+			return "", err
+		}
+		return images["protos-"+version], nil
+	},
+	AddImage: func(client cloud.Provider, image release.CloudImage, version string, bandwidthLimit int64, stream bool) (string, string, error) {
+		id, err := client.AddImage(image.URL, image.Digest, version, bandwidthLimit)
+		return id, "url", err
+	},
+	AuthorizePersonalKey: func(instanceName string, key string) error {
+		return nil
+	},
+}
+
+// newFakeClients returns a provider whose AttachVolume times out, and a healthy one sharing its resources
+func newFakeClients(t *testing.T, dir string) (cloud.Provider, cloud.Provider) {
+	failing := cloud.NewFakeClient("test", cloud.FakeOptions{Dir: dir, Failures: map[string]error{"AttachVolume": cloud.ErrFakeTimeout}})
+	healthy := cloud.NewFakeClient("test", cloud.FakeOptions{Dir: dir})
+	for _, client := range []cloud.Provider{failing, healthy} {
+		err := client.Init(map[string]string{}, "local-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return failing, healthy
+}
+
+func runFailingDeploy(t *testing.T, store *memoryStore, client cloud.Provider) *saga.Operation {
+	params := map[string]string{"instance": "test", "cloud": "test", "version": "1.0.0", "image-url": "https://example.com/protos.qcow2", "volume-type": string(cloud.BlockVolume)}
+	op, err := saga.New(deploy.Operation, "test deploy", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saga.Run(store, op, deploy.Steps(store, client, testHooks, op))
+	if errors.Cause(err) != cloud.ErrFakeTimeout {
+		t.Fatalf("Expected the scripted timeout, got: %v", err)
+	}
+	if op.Status != saga.Failed || op.FailedStep != "attach volume" || len(op.Completed) != 4 {
+		t.Fatalf("Unexpected operation state after the failure: status '%s', failed step '%s', completed %v", op.Status, op.FailedStep, op.Completed)
+	}
+	if store.ops[op.ID].Status != saga.Failed {
+		t.Fatalf("The failure was not saved, stored status is '%s'", store.ops[op.ID].Status)
+	}
+	if _, found := store.instances["test"]; !found {
+		t.Fatal("The created instance was not saved")
+	}
+	if _, found := store.keys[op.ID]; !found {
+		t.Fatal("The deploy key should be kept until the deploy completes")
+	}
+	return op
+}
+
+func TestDeployResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protos-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newMemoryStore()
+	failing, healthy := newFakeClients(t, dir)
+
+	op := runFailingDeploy(t, store, failing)
+	vol, err := healthy.GetVolumeInfo(op.Params["volume"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.InstanceName != "" {
+		t.Fatalf("The failed attach left volume '%s' attached to instance '%s'", vol.VolumeID, vol.InstanceName)
+	}
+
+	err = saga.Run(store, op, deploy.Steps(store, healthy, testHooks, op))
+	// the endpoint of the started instance exits once it's stopped
+	defer healthy.StopInstance(op.Params["vm"])
+	if err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if op.Status != saga.Succeeded {
+		t.Fatalf("Expected the resumed operation to succeed, status is '%s'", op.Status)
+	}
+	instances, err := healthy.ListInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 {
+		t.Fatalf("Expected the completed steps to be skipped on resume, found %d instances", len(instances))
+	}
+	vol, err = healthy.GetVolumeInfo(op.Params["volume"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vol.InstanceName != "test" {
+		t.Fatalf("Expected volume '%s' to be attached to instance 'test', it is attached to '%s'", vol.VolumeID, vol.InstanceName)
+	}
+	if _, found := store.volumes[op.Params["volume"]]; !found {
+		t.Fatalf("Volume '%s' was not saved", op.Params["volume"])
+	}
+	instance := store.instances["test"]
+	if len(instance.KeySeed) == 0 || instance.Image == nil || instance.Image.ID != op.Params["image"] {
+		t.Fatalf("The saved instance is missing its key or image: %+v", instance)
+	}
+	if _, found := store.keys[op.ID]; found {
+		t.Fatal("The deploy key should be forgotten once the instance holds it")
+	}
+}
+
+func TestDeployRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protos-deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newMemoryStore()
+	failing, healthy := newFakeClients(t, dir)
+
+	op := runFailingDeploy(t, store, failing)
+	volumeID := op.Params["volume"]
+	err = saga.Rollback(store, op, deploy.Steps(store, healthy, testHooks, op))
+	if err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+	if op.Status != saga.RolledBack || op.FailedStep != "" || len(op.Completed) != 0 {
+		t.Fatalf("Unexpected operation state after the rollback: status '%s', failed step '%s', completed %v", op.Status, op.FailedStep, op.Completed)
+	}
+	instances, err := healthy.ListInstances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("Expected the instance to be deleted, found %d instances", len(instances))
+	}
+	_, err = healthy.GetVolumeInfo(volumeID)
+	if err == nil {
+		t.Fatalf("Expected volume '%s' to be deleted", volumeID)
+	}
+	if len(store.instances) != 0 || len(store.keys) != 0 {
+		t.Fatalf("Expected the instance and the deploy key to be removed from the store, found %d instances and %d keys", len(store.instances), len(store.keys))
+	}
+	images, err := healthy.GetImages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := images["protos-1.0.0"]; !found {
+		t.Fatal("The image should be kept, since adding it has no rollback")
+	}
+}
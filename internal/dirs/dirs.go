@@ -0,0 +1,68 @@
+// Package dirs locates the local files of the CLI following the XDG base directory specification: the database and
+// the other files that can't be recreated are kept in the state directory, while downloads go to the cache directory
+// and logs to their own directory, so that they can be cleaned up and backed up separately
+package dirs
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+)
+
+const (
+	// StateEnv overrides the state directory, e.g. to use another database
+	StateEnv = "PROTOS_STATE_DIR"
+	// CacheEnv overrides the cache directory
+	CacheEnv = "PROTOS_CACHE_DIR"
+	// LogsEnv overrides the log directory
+	LogsEnv = "PROTOS_LOG_DIR"
+)
+
+// State returns the directory holding the database, keys and settings: $XDG_STATE_HOME/protos, ~/.local/state/protos by
+// default. ~/.protos, used by earlier versions, is kept as long as it exists, even if the XDG directory exists too: that
+// one also holds the logs, so its existence doesn't mean the state was moved there
+func State() string {
+	if dir := os.Getenv(StateEnv); dir != "" {
+		return dir
+	}
+	legacy := filepath.Join(home(), ".protos")
+	if info, err := os.Stat(legacy); err == nil && info.IsDir() {
+		return legacy
+	}
+	return filepath.Join(xdgDir("XDG_STATE_HOME", ".local", "state"), "protos")
+}
+
+// Cache returns the directory holding downloads that can be fetched again, like release images and the release index:
+// $XDG_CACHE_HOME/protos, ~/.cache/protos by default
+func Cache() string {
+	if dir := os.Getenv(CacheEnv); dir != "" {
+		return dir
+	}
+	return filepath.Join(xdgDir("XDG_CACHE_HOME", ".cache"), "protos")
+}
+
+// Logs returns the directory holding the log files: $XDG_STATE_HOME/protos/logs, ~/.local/state/protos/logs by default.
+// Unlike State, it doesn't fall back to ~/.protos, so that logs are always found in the same place
+func Logs() string {
+	if dir := os.Getenv(LogsEnv); dir != "" {
+		return dir
+	}
+	return filepath.Join(xdgDir("XDG_STATE_HOME", ".local", "state"), "protos", "logs")
+}
+
+// xdgDir returns the directory in the env variable, or the default path relative to the home directory. Relative paths
+// are ignored, as required by the specification
+func xdgDir(env string, defaultPath ...string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(append([]string{home()}, defaultPath...)...)
+}
+
+func home() string {
+	if usr, err := user.Current(); err == nil {
+		return usr.HomeDir
+	}
+	dir, _ := os.UserHomeDir()
+	return dir
+}
@@ -0,0 +1,48 @@
+package fuzzy
+
+import "strings"
+
+// Distance returns the edit distance between two strings
+func Distance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// Suggest returns the candidates that are similar to value, ignoring case: candidates that contain value, or that are
+// at most maxDistance edits away from it. Suggestions keep the order of candidates
+func Suggest(value string, candidates []string, maxDistance int) []string {
+	lower := strings.ToLower(value)
+	suggestions := []string{}
+	for _, candidate := range candidates {
+		lowerCandidate := strings.ToLower(candidate)
+		if (lower != "" && strings.Contains(lowerCandidate, lower)) || Distance(lower, lowerCandidate) <= maxDistance {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	return suggestions
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,83 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// rootCAs holds the certificates trusted by the clients returned by New. Nil means the system certificates
+var rootCAs *x509.CertPool
+
+// SetCABundle makes the clients returned by New trust the certificates in the PEM file at path, in addition to the
+// system certificates. This is required on networks that intercept TLS connections
+func SetCABundle(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read CA bundle '%s'", path)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return errors.Errorf("Failed to load CA bundle '%s': no PEM encoded certificates found", path)
+	}
+	rootCAs = pool
+	return nil
+}
+
+// New returns an HTTP client that honors the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables and the CA
+// bundle set using SetCABundle. A zero timeout means no timeout, which should be used for large downloads
+func New(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &contextTransport{base: newTransport()},
+	}
+}
+
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		TLSClientConfig:       &tls.Config{RootCAs: rootCAs},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConnsPerHost:   20,
+	}
+}
+
+// SetContext makes the requests of the clients returned by New and NewLimited fail once ctx is done, including the
+// ones in progress, unless they have their own context. It's used to enforce the timeout of a command
+func SetContext(ctx context.Context) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	baseContext = ctx
+}
+
+var (
+	contextMu   sync.Mutex
+	baseContext context.Context
+)
+
+// contextTransport applies the context set using SetContext to the requests that don't have one
+type contextTransport struct {
+	base http.RoundTripper
+}
+
+func (ct *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	contextMu.Lock()
+	ctx := baseContext
+	contextMu.Unlock()
+	if ctx != nil && req.Context() == context.Background() {
+		req = req.WithContext(ctx)
+	}
+	return ct.base.RoundTrip(req)
+}
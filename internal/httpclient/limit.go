@@ -0,0 +1,113 @@
+package httpclient
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxThrottledRetries is the number of times a request rejected with 429 Too Many Requests is retried
+const maxThrottledRetries = 3
+
+// Limiter bounds the number of requests in flight and paces them. A single Limiter should be shared by all the
+// clients talking to the same API account
+type Limiter struct {
+	slots    chan struct{}
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// NewLimiter returns a Limiter that allows at most maxConcurrent requests in flight, started at least interval apart.
+// Zero values disable the corresponding limit
+func NewLimiter(maxConcurrent int, interval time.Duration) *Limiter {
+	l := &Limiter{interval: interval}
+	if maxConcurrent > 0 {
+		l.slots = make(chan struct{}, maxConcurrent)
+	}
+	return l
+}
+
+// acquire blocks until a request can be sent, or req is canceled
+func (l *Limiter) acquire(req *http.Request) error {
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		case <-req.Context().Done():
+			return req.Context().Err()
+		}
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(start)):
+		return nil
+	case <-req.Context().Done():
+		l.release()
+		return req.Context().Err()
+	}
+}
+
+func (l *Limiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// NewLimited returns a client like New, whose requests go through limiter. Requests rejected by the server with 429
+// Too Many Requests are retried after the delay requested by the server
+func NewLimited(timeout time.Duration, limiter *Limiter) *http.Client {
+	client := New(timeout)
+	// the context is applied first, so that requests waiting for the limiter are canceled too
+	client.Transport = &contextTransport{base: &limitedTransport{base: newTransport(), limiter: limiter}}
+	return client
+}
+
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter *Limiter
+}
+
+func (lt *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		err := lt.limiter.acquire(req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := lt.base.RoundTrip(req)
+		lt.limiter.release()
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || retry == maxThrottledRetries {
+			return resp, err
+		}
+		// the body has to be sent again, which is only possible if it can be recreated
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		delay := time.Duration(retry+1) * 5 * time.Second
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 && seconds <= 60 {
+			delay = time.Duration(seconds) * time.Second
+		}
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package job
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status represents the state of a background job
+type Status string
+
+const (
+	// Pending jobs have been recorded but their worker did not start yet
+	Pending = Status("pending")
+	// Running jobs are being executed by a worker
+	Running = Status("running")
+	// Succeeded jobs finished without errors
+	Succeeded = Status("succeeded")
+	// Failed jobs finished with an error
+	Failed = Status("failed")
+	// Lost jobs were running, but their worker exited without recording a result
+	Lost = Status("lost")
+)
+
+// Job is a long running operation executed by a background worker process. Jobs are stored as individual files, and
+// not in the local DB, because the worker keeps the DB locked while running
+type Job struct {
+	ID         string
+	Command    string   // human readable description, e.g. "instance deploy foo"
+	Args       []string // arguments used to start the worker
+	PID        int
+	Status     Status
+	Error      string
+	LogFile    string
+	CreatedAt  time.Time
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Done returns true if the job finished, successfully or not
+func (j Job) Done() bool {
+	return j.Status == Succeeded || j.Status == Failed || j.Status == Lost
+}
+
+// New records a pending job in dir
+func New(dir string, command string, args []string) (Job, error) {
+	idBytes := make([]byte, 4)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return Job{}, errors.Wrap(err, "Failed to generate job ID")
+	}
+	id := hex.EncodeToString(idBytes)
+	j := Job{
+		ID:        id,
+		Command:   command,
+		Args:      args,
+		Status:    Pending,
+		LogFile:   filepath.Join(dir, id+".log"),
+		CreatedAt: time.Now(),
+	}
+	return j, Save(dir, j)
+}
+
+// Save writes the job to dir
+func Save(dir string, j Job) error {
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create jobs directory '%s'", dir)
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to encode job '%s'", j.ID)
+	}
+	// write and rename, so readers never see a partially written job
+	path := filepath.Join(dir, j.ID+".json")
+	err = ioutil.WriteFile(path+".tmp", data, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save job '%s'", j.ID)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Get retrieves a job from dir. Running jobs whose worker process is gone are reported as lost
+func Get(dir string, id string) (Job, error) {
+	j := Job{}
+	data, err := ioutil.ReadFile(filepath.Join(dir, id+".json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return j, errors.Errorf("Job '%s' not found", id)
+		}
+		return j, errors.Wrapf(err, "Failed to read job '%s'", id)
+	}
+	err = json.Unmarshal(data, &j)
+	if err != nil {
+		return j, errors.Wrapf(err, "Failed to decode job '%s'", id)
+	}
+	if j.Status == Running && !ProcessAlive(j.PID) {
+		j.Status = Lost
+	}
+	return j, nil
+}
+
+// List returns all the jobs in dir, oldest first
+func List(dir string) ([]Job, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []Job{}, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read jobs directory '%s'", dir)
+	}
+	jobs := []Job{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		j, err := Get(dir, strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return jobs[i].CreatedAt.Before(jobs[k].CreatedAt) })
+	return jobs, nil
+}
+
+// Start marks a job as running in the current process
+func Start(dir string, id string) error {
+	j, err := Get(dir, id)
+	if err != nil {
+		return err
+	}
+	j.PID = os.Getpid()
+	j.Status = Running
+	j.StartedAt = time.Now()
+	return Save(dir, j)
+}
+
+// Finish records the result of a job
+func Finish(dir string, id string, jobErr error) error {
+	j, err := Get(dir, id)
+	if err != nil {
+		return err
+	}
+	j.Status = Succeeded
+	if jobErr != nil {
+		j.Status = Failed
+		j.Error = jobErr.Error()
+	}
+	j.FinishedAt = time.Now()
+	return Save(dir, j)
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package job
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// ProcessAlive returns true if a process with pid is running
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	return syscall.Kill(pid, 0) == nil
+}
+
+// Detach configures cmd to run in its own session, so it keeps running after the parent process exits
+func Detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
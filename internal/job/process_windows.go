@@ -0,0 +1,18 @@
+package job
+
+import (
+	"os"
+	"os/exec"
+)
+
+// ProcessAlive returns true if a process with pid is running
+func ProcessAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	_, err := os.FindProcess(pid)
+	return err == nil
+}
+
+// Detach configures cmd to run in its own session, so it keeps running after the parent process exits
+func Detach(cmd *exec.Cmd) {}
@@ -0,0 +1,179 @@
+// Package logfile tees the CLI logs into a size rotated file, keeping the full debug detail regardless of the console
+// log level, so that they can be attached to bug reports after the fact
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxSize is the size in bytes after which the log file is rotated, unless another size is given to New
+	DefaultMaxSize = 5 * 1024 * 1024
+	// MaxBackups is the number of rotated log files kept, besides the current one
+	MaxBackups = 5
+	// MaxRate is the maximum number of entries written per second. Entries over it are dropped and counted, so that a
+	// command stuck logging in a loop doesn't fill the disk
+	MaxRate = 200
+)
+
+// Hook is a logrus hook writing all the entries to a rotated log file
+type Hook struct {
+	mu        sync.Mutex
+	path      string
+	maxSize   int64
+	file      *os.File
+	formatter logrus.Formatter
+	window    time.Time // start of the current rate limiting window
+	written   int       // entries written in the current window
+	dropped   int       // entries dropped in the current window
+}
+
+// New opens, or creates, the log file named name in dir, rotated once it reaches maxSize bytes (DefaultMaxSize if 0).
+// Several processes can write to the same file
+func New(dir string, name string, maxSize int64) (*Hook, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	err := os.MkdirAll(dir, os.FileMode(0700))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create log directory '%s'", dir)
+	}
+	hook := &Hook{
+		path:      filepath.Join(dir, name),
+		maxSize:   maxSize,
+		formatter: &logrus.TextFormatter{DisableColors: true, FullTimestamp: true},
+	}
+	err = hook.open()
+	if err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// Path returns the path of the current log file
+func (h *Hook) Path() string {
+	return h.path
+}
+
+// Levels implements logrus.Hook. All levels are written, the logger level permitting
+func (h *Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook
+func (h *Hook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+
+	now := time.Now()
+	if now.Sub(h.window) >= time.Second {
+		h.noteDropped()
+		h.window = now
+		h.written = 0
+		h.dropped = 0
+	}
+	if h.written >= MaxRate {
+		h.dropped++
+		return nil
+	}
+	h.written++
+
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return errors.Wrap(err, "Failed to format log entry")
+	}
+	h.write(line)
+	return nil
+}
+
+// Close closes the log file, noting the entries dropped in the last rate limiting window
+func (h *Hook) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.file == nil {
+		return nil
+	}
+	h.noteDropped()
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+//
+// File methods
+//
+
+func (h *Hook) open() error {
+	file, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open log file '%s'", h.path)
+	}
+	h.file = file
+	return nil
+}
+
+// noteDropped writes the number of entries dropped in the current rate limiting window, if any
+func (h *Hook) noteDropped() {
+	if h.dropped > 0 {
+		h.write([]byte(fmt.Sprintf("time=%q level=warning msg=\"%d log entries dropped, over %d per second\"\n", h.window.Format(time.RFC3339), h.dropped, MaxRate)))
+	}
+}
+
+// write appends data to the log file, rotating it first if it grew over its maximum size. Errors are reported on stderr instead
+// of through the logger, which would call the hook again
+func (h *Hook) write(data []byte) {
+	err := h.rotate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to rotate log file: %s\n", err.Error())
+	}
+	if h.file == nil {
+		return
+	}
+	_, err = h.file.Write(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write log file '%s': %s\n", h.path, err.Error())
+	}
+}
+
+// rotate shifts the log files when the current one is over the maximum size: protos.log becomes protos.log.1, protos.log.1
+// becomes protos.log.2 and so on, dropping the oldest one. The file is checked by path, so that a rotation done by
+// another process is noticed and the new file is used
+func (h *Hook) rotate() error {
+	info, err := os.Stat(h.path)
+	if err == nil && info.Size() < h.maxSize {
+		current, statErr := h.file.Stat()
+		if statErr == nil && os.SameFile(info, current) {
+			return nil
+		}
+		// rotated by another process
+		h.file.Close()
+		h.file = nil
+		return h.open()
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to check log file '%s'", h.path)
+	}
+
+	h.file.Close()
+	h.file = nil
+	if err == nil {
+		for i := MaxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", h.path, i), fmt.Sprintf("%s.%d", h.path, i+1))
+		}
+		err = os.Rename(h.path, h.path+".1")
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to rotate log file '%s'", h.path)
+		}
+	}
+	return h.open()
+}
@@ -0,0 +1,123 @@
+package output
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// evalJSONPath evaluates a simple JSONPath expression against data and returns the matched values as strings.
+// Supported syntax: field access (.Name), array indexes ([0]) and wildcards ([*] or .*). The expression can
+// optionally be wrapped in curly braces, like kubectl does it: {.Volumes[*].Name}
+func evalJSONPath(expr string, data interface{}) ([]string, error) {
+	// round trip through JSON so that field names match the JSON output
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to JSON encode output")
+	}
+	var root interface{}
+	err = json.Unmarshal(raw, &root)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to JSON decode output")
+	}
+
+	steps, err := parseJSONPath(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []interface{}{root}
+	for _, step := range steps {
+		next := []interface{}{}
+		for _, node := range nodes {
+			switch n := node.(type) {
+			case map[string]interface{}:
+				if step == "*" {
+					// sorted, so that the output is the same on every run
+					keys := make([]string, 0, len(n))
+					for k := range n {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					for _, k := range keys {
+						next = append(next, n[k])
+					}
+				} else if v, found := n[step]; found {
+					next = append(next, v)
+				}
+			case []interface{}:
+				if step == "*" {
+					next = append(next, n...)
+				} else if i, err := strconv.Atoi(step); err == nil {
+					if i < 0 {
+						i = len(n) + i
+					}
+					if i >= 0 && i < len(n) {
+						next = append(next, n[i])
+					}
+				}
+			}
+		}
+		nodes = next
+	}
+
+	results := []string{}
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case string:
+			results = append(results, n)
+		case nil:
+			results = append(results, "")
+		default:
+			out, err := json.Marshal(n)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to JSON encode JSONPath result")
+			}
+			results = append(results, string(out))
+		}
+	}
+	return results, nil
+}
+
+// parseJSONPath splits a JSONPath expression into a list of field names, indexes and wildcards
+func parseJSONPath(expr string) ([]string, error) {
+	path := strings.TrimSpace(expr)
+	if strings.HasPrefix(path, "{") && strings.HasSuffix(path, "}") {
+		path = path[1 : len(path)-1]
+	}
+	path = strings.TrimPrefix(path, "$")
+
+	steps := []string{}
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+			end := strings.IndexAny(path, ".[")
+			if end == -1 {
+				end = len(path)
+			}
+			if end == 0 {
+				return nil, errors.Errorf("Invalid JSONPath expression '%s': empty field name", expr)
+			}
+			steps = append(steps, path[:end])
+			path = path[end:]
+		case '[':
+			end := strings.Index(path, "]")
+			if end == -1 {
+				return nil, errors.Errorf("Invalid JSONPath expression '%s': missing ']'", expr)
+			}
+			index := strings.Trim(path[1:end], "'\"")
+			if index == "" {
+				return nil, errors.Errorf("Invalid JSONPath expression '%s': empty index", expr)
+			}
+			steps = append(steps, index)
+			path = path[end+1:]
+		default:
+			return nil, errors.Errorf("Invalid JSONPath expression '%s': unexpected character '%c'", expr, path[0])
+		}
+	}
+	return steps, nil
+}
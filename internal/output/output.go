@@ -0,0 +1,86 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// Table is the default, human readable output format
+	Table = "table"
+	// JSON renders the command result as indented JSON
+	JSON = "json"
+	// Template renders the command result using a Go template, e.g. template='{{.PublicIP}}'
+	Template = "template"
+	// JSONPath extracts fields from the command result using a JSONPath expression, e.g. jsonpath='{.PublicIP}'
+	JSONPath = "jsonpath"
+)
+
+// Format describes how the result of a read command is rendered
+type Format struct {
+	kind string
+	expr string
+}
+
+// Parse takes an output specification as provided on the command line and returns a Format
+func Parse(spec string) (Format, error) {
+	if spec == "" || spec == Table {
+		return Format{kind: Table}, nil
+	}
+	if spec == JSON {
+		return Format{kind: JSON}, nil
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return Format{}, errors.Errorf("Output format '%s' not supported. Use one of: table, json, template=<template>, jsonpath=<expression>", spec)
+	}
+	switch parts[0] {
+	case Template:
+		return Format{kind: Template, expr: parts[1]}, nil
+	case JSONPath:
+		return Format{kind: JSONPath, expr: parts[1]}, nil
+	default:
+		return Format{}, errors.Errorf("Output format '%s' not supported. Use one of: table, json, template=<template>, jsonpath=<expression>", parts[0])
+	}
+}
+
+// IsTable returns true if the default table format was requested
+func (f Format) IsTable() bool {
+	return f.kind == Table
+}
+
+// Write renders data to w according to the format. It should not be called for the table format, which is command specific
+func (f Format) Write(w io.Writer, data interface{}) error {
+	switch f.kind {
+	case JSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	case Template:
+		tmpl, err := template.New("output").Parse(f.expr)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to parse output template '%s'", f.expr)
+		}
+		err = tmpl.Execute(w, data)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to execute output template '%s'", f.expr)
+		}
+		fmt.Fprint(w, "\n")
+		return nil
+	case JSONPath:
+		results, err := evalJSONPath(f.expr, data)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, strings.Join(results, " "))
+		return nil
+	default:
+		return errors.Errorf("Output format '%s' can't be written generically", f.kind)
+	}
+}
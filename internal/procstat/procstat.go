@@ -0,0 +1,96 @@
+package procstat
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CPU are the aggregated CPU time counters of a Linux host, in clock ticks since boot
+type CPU struct {
+	Total uint64
+	Idle  uint64 // including the time waiting for I/O
+}
+
+// Network are the bytes received and sent by a Linux host since boot, over all its interfaces except the loopback
+type Network struct {
+	Received uint64
+	Sent     uint64
+}
+
+// ParseCPU parses the CPU counters from the contents of /proc/stat, whose first line is like
+// "cpu  4705 356 584 3699176 23060 0 277 0 0 0". The guest times are already counted in the user times, so only the
+// first 8 counters are summed
+func ParseCPU(stat string) (CPU, error) {
+	line := strings.SplitN(stat, "\n", 2)[0]
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return CPU{}, errors.Errorf("Unexpected CPU statistics '%s'", strings.TrimSpace(line))
+	}
+	cpu := CPU{}
+	for i, field := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return CPU{}, errors.Errorf("Unexpected CPU statistics '%s'", strings.TrimSpace(line))
+		}
+		cpu.Total += value
+		// idle and iowait
+		if i == 3 || i == 4 {
+			cpu.Idle += value
+		}
+	}
+	return cpu, nil
+}
+
+// Utilization returns the percentage of CPU time spent working between two readings, or -1 if no time passed or the
+// counters were reset by a reboot
+func Utilization(prev CPU, cur CPU) float64 {
+	if cur.Total <= prev.Total || cur.Idle < prev.Idle {
+		return -1
+	}
+	total := cur.Total - prev.Total
+	idle := cur.Idle - prev.Idle
+	if idle > total {
+		idle = total
+	}
+	return float64(total-idle) * 100 / float64(total)
+}
+
+// ParseNetwork sums the bytes received and sent by the interfaces listed in the contents of /proc/net/dev, leaving
+// out the loopback
+func ParseNetwork(netDev string) (Network, error) {
+	network := Network{}
+	found := false
+	for _, line := range strings.Split(netDev, "\n") {
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(line[i+1:])
+		if len(fields) < 9 {
+			continue
+		}
+		received, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		sent, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			continue
+		}
+		found = true
+		if strings.TrimSpace(line[:i]) == "lo" {
+			continue
+		}
+		network.Received += received
+		network.Sent += sent
+	}
+	if !found {
+		return network, errors.New("Unexpected network statistics: no interfaces found")
+	}
+	return network, nil
+}
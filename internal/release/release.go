@@ -1,7 +1,10 @@
 package release
 
 import (
+	"net/url"
+	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/Masterminds/semver"
@@ -9,10 +12,15 @@ import (
 )
 
 type CloudImage struct {
-	Provider    string
-	URL         string
-	Digest      string
+	Provider string
+	URL      string
+	Digest   string
+	// Snapshot is a provider native snapshot of the image, which can be imported faster than the image at URL. For
+	// Scaleway it is the object storage location of a qcow2 file, as '<bucket>/<key>'. Empty if not provided
+	Snapshot    string
 	ReleaseDate time.Time `json:"release-date"`
+	// Size is the size of the image download in bytes, 0 if not provided
+	Size uint64 `json:"size,omitempty"`
 }
 
 type Release struct {
@@ -20,6 +28,9 @@ type Release struct {
 	Version     string
 	Description string
 	ReleaseDate time.Time `json:"release-date"`
+	// MonthlyEgress is the typical traffic in bytes sent to the internet each month by an instance running the release
+	// and its apps, 0 if not provided
+	MonthlyEgress uint64 `json:"monthly-egress,omitempty"`
 }
 
 type Releases struct {
@@ -72,3 +83,73 @@ func (rls Releases) GetVersion(version string) (Release, error) {
 	}
 	return Release{}, errors.Errorf("Failed to find a release with version '%s'", version)
 }
+
+// Between returns the releases newer than from, up to and including to, oldest first
+func (rls Releases) Between(from string, to string) ([]Release, error) {
+	fromVersion, err := semver.NewVersion(from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cant parse version '%s'", from)
+	}
+	toVersion, err := semver.NewVersion(to)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Cant parse version '%s'", to)
+	}
+	type versioned struct {
+		version *semver.Version
+		release Release
+	}
+	found := []versioned{}
+	for version, release := range rls.Releases {
+		v, err := semver.NewVersion(version)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error parsing version from releases list")
+		}
+		if v.GreaterThan(fromVersion) && !v.GreaterThan(toVersion) {
+			found = append(found, versioned{v, release})
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].version.LessThan(found[j].version) })
+	releases := []Release{}
+	for _, f := range found {
+		releases = append(releases, f.release)
+	}
+	return releases, nil
+}
+
+// Newest returns the releases sorted by version, newest first
+func (rls Releases) Newest() ([]Release, error) {
+	type versioned struct {
+		version *semver.Version
+		release Release
+	}
+	found := []versioned{}
+	for version, release := range rls.Releases {
+		v, err := semver.NewVersion(version)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error parsing version from releases list")
+		}
+		found = append(found, versioned{v, release})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].version.GreaterThan(found[j].version) })
+	releases := []Release{}
+	for _, f := range found {
+		releases = append(releases, f.release)
+	}
+	return releases, nil
+}
+
+// UseImageMirror points the images of all releases to mirror, which should serve the same files as the upstream
+// location. The digests are kept, so mirrored images are still verified against the release index
+func (rls Releases) UseImageMirror(mirror string) error {
+	for _, release := range rls.Releases {
+		for provider, image := range release.CloudImages {
+			u, err := url.Parse(image.URL)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to parse image URL '%s'", image.URL)
+			}
+			image.URL = strings.TrimSuffix(mirror, "/") + "/" + path.Base(u.Path)
+			release.CloudImages[provider] = image
+		}
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package saga
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Status represents the state of an operation
+type Status string
+
+const (
+	// Running operations are being executed, or were interrupted before recording a result
+	Running = Status("running")
+	// Failed operations stopped at a step that returned an error. They can be resumed or rolled back
+	Failed = Status("failed")
+	// Succeeded operations completed all their steps
+	Succeeded = Status("succeeded")
+	// RolledBack operations had all their completed steps undone
+	RolledBack = Status("rolled back")
+)
+
+// Operation is a multi-step operation, like deploying an instance. Its progress is saved after every step, so that an
+// interrupted operation can be resumed from the first step that didn't complete, or rolled back step by step
+type Operation struct {
+	ID          string `storm:"id"`
+	Kind        string // selects the steps used to resume or roll back the operation, e.g. "deploy"
+	Description string // human readable description, e.g. "instance deploy foo"
+	// Params holds the inputs of the operation and the outputs of the completed steps, used by later steps and by
+	// rollbacks
+	Params    map[string]string
+	Completed []string // names of the completed steps, in order
+	// FailedStep is the step that returned an error, and might have done part of its work. It's rolled back along
+	// with the completed steps
+	FailedStep string
+	Status     Status
+	Error      string
+	StartedAt  time.Time
+	UpdatedAt  time.Time
+	observer   func(Event)
+}
+
+// Types of the progress events of an operation
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventSkipped   = "skipped" // the step completed before the operation was interrupted, and is not run again
+)
+
+// Event reports the progress of an operation being run, e.g. to render a progress bar. Events without a step are about
+// the operation as a whole
+type Event struct {
+	Type        string
+	Operation   string // ID of the operation
+	Description string
+	Step        string `json:",omitempty"`
+	StepIndex   int    `json:",omitempty"` // position of the step, starting at 1
+	Steps       int    // number of steps of the operation
+	Time        time.Time
+	Error       string `json:",omitempty"`
+}
+
+// Step is a unit of work of an operation. Rollback undoes Run, and is nil for steps that don't need to be undone
+type Step struct {
+	Name     string
+	Run      func(op *Operation) error
+	Rollback func(op *Operation) error
+}
+
+// Store persists operations
+type Store interface {
+	SaveOperation(op Operation) error
+}
+
+// New returns a new operation, which is saved once it's run
+func New(kind string, description string, params map[string]string) (*Operation, error) {
+	idBytes := make([]byte, 4)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate operation ID")
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	return &Operation{
+		ID:          hex.EncodeToString(idBytes),
+		Kind:        kind,
+		Description: description,
+		Params:      params,
+		Completed:   []string{},
+		Status:      Running,
+		StartedAt:   time.Now(),
+	}, nil
+}
+
+// Done returns true if the operation can't be resumed or rolled back anymore
+func (op *Operation) Done() bool {
+	return op.Status == Succeeded || op.Status == RolledBack
+}
+
+// Observe calls fn with the progress events of op while it's run
+func (op *Operation) Observe(fn func(Event)) {
+	op.observer = fn
+}
+
+func (op *Operation) notify(eventType string, step string, index int, steps int, err error) {
+	if op.observer == nil {
+		return
+	}
+	event := Event{Type: eventType, Operation: op.ID, Description: op.Description, Step: step, StepIndex: index, Steps: steps, Time: time.Now()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	op.observer(event)
+}
+
+func (op *Operation) completed(step string) bool {
+	for _, name := range op.Completed {
+		if name == step {
+			return true
+		}
+	}
+	return false
+}
+
+func save(store Store, op *Operation) error {
+	op.UpdatedAt = time.Now()
+	err := store.SaveOperation(*op)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to save progress of operation '%s'", op.ID)
+	}
+	return nil
+}
+
+// Run executes the steps of op that didn't complete yet, in order, saving the progress after each of them
+func Run(store Store, op *Operation, steps []Step) error {
+	if op.Done() {
+		return errors.Errorf("Operation '%s' already %s", op.ID, op.Status)
+	}
+	op.Status = Running
+	op.Error = ""
+	err := save(store, op)
+	if err != nil {
+		return err
+	}
+	op.notify(EventStarted, "", 0, len(steps), nil)
+	for i, step := range steps {
+		if op.completed(step.Name) {
+			op.notify(EventSkipped, step.Name, i+1, len(steps), nil)
+			continue
+		}
+		op.notify(EventStarted, step.Name, i+1, len(steps), nil)
+		err = step.Run(op)
+		if err != nil {
+			op.Status = Failed
+			op.Error = err.Error()
+			op.FailedStep = step.Name
+			op.notify(EventFailed, step.Name, i+1, len(steps), err)
+			op.notify(EventFailed, "", 0, len(steps), err)
+			saveErr := save(store, op)
+			if saveErr != nil {
+				return errors.Wrap(err, saveErr.Error())
+			}
+			return err
+		}
+		op.Completed = append(op.Completed, step.Name)
+		op.FailedStep = ""
+		err = save(store, op)
+		if err != nil {
+			op.notify(EventFailed, "", 0, len(steps), err)
+			return err
+		}
+		op.notify(EventCompleted, step.Name, i+1, len(steps), nil)
+	}
+	op.Status = Succeeded
+	err = save(store, op)
+	if err != nil {
+		op.notify(EventFailed, "", 0, len(steps), err)
+		return err
+	}
+	op.notify(EventCompleted, "", 0, len(steps), nil)
+	return nil
+}
+
+// Rollback undoes the failed step and the completed steps of op, most recent first, saving the progress after each
+// of them. Rollbacks have to cope with steps that only did part of their work. A failed rollback can be retried, and
+// continues with the step that failed
+func Rollback(store Store, op *Operation, steps []Step) error {
+	if op.Done() {
+		return errors.Errorf("Operation '%s' already %s", op.ID, op.Status)
+	}
+	byName := map[string]Step{}
+	for _, step := range steps {
+		byName[step.Name] = step
+	}
+	for op.FailedStep != "" || len(op.Completed) > 0 {
+		name := op.FailedStep
+		if name == "" {
+			name = op.Completed[len(op.Completed)-1]
+		}
+		step, found := byName[name]
+		if !found {
+			return errors.Errorf("Operation '%s' has an unknown step '%s'", op.ID, name)
+		}
+		if step.Rollback != nil {
+			err := step.Rollback(op)
+			if err != nil {
+				err = errors.Wrapf(err, "Failed to roll back step '%s'", name)
+				op.Status = Failed
+				op.Error = err.Error()
+				saveErr := save(store, op)
+				if saveErr != nil {
+					return errors.Wrap(err, saveErr.Error())
+				}
+				return err
+			}
+		}
+		if op.FailedStep != "" {
+			op.FailedStep = ""
+		} else {
+			op.Completed = op.Completed[:len(op.Completed)-1]
+		}
+		err := save(store, op)
+		if err != nil {
+			return err
+		}
+	}
+	op.Status = RolledBack
+	op.Error = ""
+	return save(store, op)
+}
@@ -0,0 +1,44 @@
+package ssh
+
+import (
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+var (
+	forwardedMu sync.Mutex
+	forwarded   = map[*ssh.Client]bool{}
+)
+
+// ForwardAgent serves the agent channels opened by the remote host on client using the local SSH agent, found through
+// SSH_AUTH_SOCK. Forwarding still has to be requested for every session that should use the agent. Calling it again
+// for the same client does nothing
+func ForwardAgent(client *ssh.Client) error {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return errors.New("SSH agent forwarding requires a running ssh-agent, but SSH_AUTH_SOCK is not set")
+	}
+
+	forwardedMu.Lock()
+	defer forwardedMu.Unlock()
+	if forwarded[client] {
+		return nil
+	}
+	err := agent.ForwardToRemote(client, socket)
+	if err != nil {
+		return errors.Wrap(err, "Failed to forward SSH agent")
+	}
+	forwarded[client] = true
+	go func() {
+		// pooled clients are reused until they are closed, after which they are dropped
+		client.Wait()
+		forwardedMu.Lock()
+		delete(forwarded, client)
+		forwardedMu.Unlock()
+	}()
+	return nil
+}
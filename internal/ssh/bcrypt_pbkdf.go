@@ -0,0 +1,96 @@
+package ssh
+
+import (
+	"crypto/sha512"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blowfish"
+)
+
+// bcrypt_pbkdf is the key derivation function used by OpenSSH to encrypt private keys with a passphrase, as described
+// in https://github.com/openssh/openssh-portable/blob/master/openbsd-compat/bcrypt_pbkdf.c
+
+const bcryptBlockSize = 32
+
+var bcryptMagic = []byte("OxychromaticBlowfishSwatDynamite")
+
+// bcryptPBKDF derives a key of keyLen bytes from password and salt, using the given number of rounds
+func bcryptPBKDF(password []byte, salt []byte, rounds int, keyLen int) ([]byte, error) {
+	if rounds < 1 {
+		return nil, errors.New("Invalid number of bcrypt_pbkdf rounds")
+	}
+	if len(password) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	if len(salt) == 0 || len(salt) > 1<<20 {
+		return nil, errors.New("Invalid bcrypt_pbkdf salt length")
+	}
+	if keyLen < 1 || keyLen > 1024 {
+		return nil, errors.New("Invalid bcrypt_pbkdf key length")
+	}
+
+	numBlocks := (keyLen + bcryptBlockSize - 1) / bcryptBlockSize
+	key := make([]byte, numBlocks*bcryptBlockSize)
+
+	h := sha512.New()
+	h.Write(password)
+	shapass := h.Sum(nil)
+
+	shasalt := make([]byte, 0, sha512.Size)
+	cnt, tmp := make([]byte, 4), make([]byte, bcryptBlockSize)
+	for block := 1; block <= numBlocks; block++ {
+		h.Reset()
+		h.Write(salt)
+		cnt[0] = byte(block >> 24)
+		cnt[1] = byte(block >> 16)
+		cnt[2] = byte(block >> 8)
+		cnt[3] = byte(block)
+		h.Write(cnt)
+		err := bcryptHash(tmp, shapass, h.Sum(shasalt))
+		if err != nil {
+			return nil, err
+		}
+
+		out := make([]byte, bcryptBlockSize)
+		copy(out, tmp)
+		for i := 2; i <= rounds; i++ {
+			h.Reset()
+			h.Write(tmp)
+			err = bcryptHash(tmp, shapass, h.Sum(shasalt))
+			if err != nil {
+				return nil, err
+			}
+			for j := 0; j < len(out); j++ {
+				out[j] ^= tmp[j]
+			}
+		}
+
+		// the output is spread over the key, so that every block contributes to all of its parts
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+	return key[:keyLen], nil
+}
+
+func bcryptHash(out []byte, shapass []byte, shasalt []byte) error {
+	c, err := blowfish.NewSaltedCipher(shapass, shasalt)
+	if err != nil {
+		return errors.Wrap(err, "Failed to initialize bcrypt_pbkdf cipher")
+	}
+	for i := 0; i < 64; i++ {
+		blowfish.ExpandKey(shasalt, c)
+		blowfish.ExpandKey(shapass, c)
+	}
+	copy(out, bcryptMagic)
+	for i := 0; i < bcryptBlockSize; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(out[i:i+8], out[i:i+8])
+		}
+	}
+	// the words are written little endian by OpenBSD's implementation
+	for i := 0; i < bcryptBlockSize; i += 4 {
+		out[i+3], out[i+2], out[i+1], out[i] = out[i], out[i+1], out[i+2], out[i+3]
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package ssh
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// bcryptPBKDFVectors are the test vectors of OpenBSD's bcrypt_pbkdf, also used by the other implementations
+var bcryptPBKDFVectors = []struct {
+	password string
+	salt     string
+	rounds   int
+	key      string
+}{
+	{"password", "salt", 4, "5bbf0cc293587f1c3635555c27796598d47e579071bf427e9d8fbe842aba34d9"},
+	{"password", "\x00", 4, "c12b566235eee04c212598970a579a67"},
+	{"\x00", "salt", 4, "6051be18c2f4f82cbf0efee5471b4bb9"},
+	{"password\x00", "salt\x00", 4, "7410e44cf4fa07bfaac8a928b1727fac001375e7bf7384370f48efd121743050"},
+	{"pass\x00wor", "sa\x00l", 4, "c2bffd9db38f6569efef4372f4de83c0"},
+	{"pass\x00word", "sa\x00lt", 4, "4ba4ac3925c0e8d7f0cdb6bb1684a56f"},
+	{"password", "salt", 8, "e1367ec5151a33faac4cc1c144cd23fa15d5548493ecc99b9b5d9c0d3b27bec76227ea66088b849b20ab7aa478010246e74bba51723fefa9f9474d6508845e8d"},
+	{"password", "salt", 42, "833cf0dcf56db65608e8f0dc0ce882bd"},
+}
+
+func TestBcryptPBKDF(t *testing.T) {
+	for _, v := range bcryptPBKDFVectors {
+		expected, err := hex.DecodeString(v.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := bcryptPBKDF([]byte(v.password), []byte(v.salt), v.rounds, len(expected))
+		if err != nil {
+			t.Fatalf("bcrypt_pbkdf(%q, %q, %d) failed: %v", v.password, v.salt, v.rounds, err)
+		}
+		if !bytes.Equal(key, expected) {
+			t.Errorf("bcrypt_pbkdf(%q, %q, %d) = %x, expected %x", v.password, v.salt, v.rounds, key, expected)
+		}
+	}
+}
+
+func TestBcryptPBKDFInvalidParams(t *testing.T) {
+	invalid := []struct {
+		password string
+		salt     string
+		rounds   int
+		keyLen   int
+	}{
+		{"password", "salt", 0, 32},
+		{"", "salt", 4, 32},
+		{"password", "", 4, 32},
+		{"password", "salt", 4, 0},
+		{"password", "salt", 4, 1025},
+	}
+	for _, v := range invalid {
+		_, err := bcryptPBKDF([]byte(v.password), []byte(v.salt), v.rounds, v.keyLen)
+		if err == nil {
+			t.Errorf("bcrypt_pbkdf(%q, %q, %d, %d) should fail", v.password, v.salt, v.rounds, v.keyLen)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package ssh
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/pem"
+	"io/ioutil"
+	"strings"
 
 	"github.com/mikesmitty/edkey"
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -19,6 +27,12 @@ func (k Key) Public() string {
 	return string(ssh.MarshalAuthorizedKey(publicKey))
 }
 
+// Fingerprint returns the SHA256 fingerprint of the public key, in the format printed by ssh-keygen -l
+func (k Key) Fingerprint() string {
+	publicKey, _ := ssh.NewPublicKey(k.public)
+	return ssh.FingerprintSHA256(publicKey)
+}
+
 func (k Key) Seed() []byte {
 	return k.private[:32]
 }
@@ -40,6 +54,78 @@ func (k Key) EncodePrivateKeytoPEM() string {
 	return string(privatePEM)
 }
 
+// keyEncryptionRounds is the number of bcrypt_pbkdf rounds used to encrypt private keys, the default of ssh-keygen
+const keyEncryptionRounds = 16
+
+// EncodeEncryptedPrivateKeytoPEM returns the private key in the OpenSSH format, encrypted with passphrase using
+// aes256-ctr and bcrypt_pbkdf, like the keys written by ssh-keygen
+func (k Key) EncodeEncryptedPrivateKeytoPEM(passphrase []byte) (string, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate salt")
+	}
+	derived, err := bcryptPBKDF(passphrase, salt, keyEncryptionRounds, 32+aes.BlockSize)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to derive encryption key")
+	}
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to initialize cipher")
+	}
+
+	check := make([]byte, 4)
+	_, err = rand.Read(check)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate check bytes")
+	}
+	private := struct {
+		Check1  uint32
+		Check2  uint32
+		Keytype string
+		Pub     []byte
+		Priv    []byte
+		Comment string
+		Pad     []byte `ssh:"rest"`
+	}{
+		Check1:  binary.BigEndian.Uint32(check),
+		Check2:  binary.BigEndian.Uint32(check),
+		Keytype: ssh.KeyAlgoED25519,
+		Pub:     []byte(k.public),
+		Priv:    []byte(k.private),
+	}
+	// the private section is padded to the cipher block size with the bytes 1, 2, 3...
+	padLen := (aes.BlockSize - len(ssh.Marshal(private))%aes.BlockSize) % aes.BlockSize
+	private.Pad = make([]byte, padLen)
+	for i := range private.Pad {
+		private.Pad[i] = byte(i + 1)
+	}
+	privateBlock := ssh.Marshal(private)
+	cipher.NewCTR(block, derived[32:]).XORKeyStream(privateBlock, privateBlock)
+
+	publicKey, _ := ssh.NewPublicKey(k.public)
+	encoded := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{
+		CipherName: "aes256-ctr",
+		KdfName:    "bcrypt",
+		KdfOpts: string(ssh.Marshal(struct {
+			Salt   []byte
+			Rounds uint32
+		}{salt, keyEncryptionRounds})),
+		NumKeys:      1,
+		PubKey:       publicKey.Marshal(),
+		PrivKeyBlock: privateBlock,
+	}
+	data := append([]byte("openssh-key-v1\x00"), ssh.Marshal(encoded)...)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data})), nil
+}
+
 // SSHAuth returns an ssh.AuthMethod that can be used to configure an ssh client
 func (k Key) SSHAuth() ssh.AuthMethod {
 	signer, _ := ssh.NewSignerFromKey(k.private)
@@ -51,3 +137,60 @@ func (k Key) AuthorizedKey() string {
 	publicKey, _ := ssh.NewPublicKey(k.public)
 	return string(ssh.MarshalAuthorizedKey(publicKey))
 }
+
+// KeyFileAuth returns an ssh.AuthMethod using the private key stored in a PEM file, like the ones written by
+// EncodePrivateKeytoPEM
+func KeyFileAuth(path string) (ssh.AuthMethod, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read SSH key '%s'", path)
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse SSH key '%s'", path)
+	}
+	return ssh.PublicKeys(signer), nil
+}
+
+// personalKeyTypes are the public key types accepted as personal keys. The security key types (FIDO2, e.g. YubiKeys)
+// are newer than the SSH library in use, so keys are checked without parsing them fully
+var personalKeyTypes = map[string]bool{
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"ssh-rsa":                            true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// ParsePersonalKey validates a public key in the authorized_keys format, like the .pub files written by ssh-keygen,
+// and returns it as a single normalized line. Options before the key type are not accepted
+func ParsePersonalKey(line string) (string, error) {
+	fields := strings.Fields(strings.TrimSpace(line))
+	if len(fields) < 2 {
+		return "", errors.New("Invalid public key: expected '<type> <base64 key> [comment]'")
+	}
+	if !personalKeyTypes[fields[0]] {
+		return "", errors.Errorf("Unsupported public key type '%s'", fields[0])
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", errors.Wrap(err, "Invalid public key encoding")
+	}
+	// the key blob starts with its type, as a length prefixed string
+	if len(blob) < 4 {
+		return "", errors.New("Invalid public key: truncated key")
+	}
+	typeLen := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)) < 4+uint64(typeLen) || string(blob[4:4+typeLen]) != fields[0] {
+		return "", errors.Errorf("Invalid public key: the key doesn't match its type '%s'", fields[0])
+	}
+	if !strings.HasPrefix(fields[0], "sk-") {
+		_, err = ssh.ParsePublicKey(blob)
+		if err != nil {
+			return "", errors.Wrap(err, "Invalid public key")
+		}
+	}
+	return strings.Join(fields, " "), nil
+}
@@ -0,0 +1,138 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// decryptOpenSSHKey decrypts a private key written by EncodeEncryptedPrivateKeytoPEM and returns it unencrypted, in the
+// same format. The version of x/crypto used here can't parse encrypted OpenSSH keys itself
+func decryptOpenSSHKey(t *testing.T, encoded string, passphrase []byte) []byte {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		t.Fatal("Encrypted key is not an OpenSSH PEM block")
+	}
+	magic := "openssh-key-v1\x00"
+	if !strings.HasPrefix(string(block.Bytes), magic) {
+		t.Fatal("Encrypted key is missing the OpenSSH magic")
+	}
+	container := struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+	}{}
+	err := ssh.Unmarshal(block.Bytes[len(magic):], &container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if container.CipherName != "aes256-ctr" || container.KdfName != "bcrypt" {
+		t.Fatalf("Unexpected cipher '%s' and KDF '%s'", container.CipherName, container.KdfName)
+	}
+	opts := struct {
+		Salt   []byte
+		Rounds uint32
+	}{}
+	err = ssh.Unmarshal([]byte(container.KdfOpts), &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	derived, err := bcryptPBKDF(passphrase, opts.Salt, int(opts.Rounds), 32+aes.BlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aesBlock, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	private := make([]byte, len(container.PrivKeyBlock))
+	cipher.NewCTR(aesBlock, derived[32:]).XORKeyStream(private, container.PrivKeyBlock)
+
+	container.CipherName, container.KdfName, container.KdfOpts = "none", "none", ""
+	container.PrivKeyBlock = private
+	data := append([]byte(magic), ssh.Marshal(container)...)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: data})
+}
+
+func TestEncryptedPrivateKeyRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := []byte("correct horse battery staple")
+	encoded, err := key.EncodeEncryptedPrivateKeytoPEM(passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ssh.ParseRawPrivateKey(decryptOpenSSHKey(t, encoded, passphrase))
+	if err != nil {
+		t.Fatalf("Decrypted key can't be parsed: %v", err)
+	}
+	private, ok := parsed.(*ed25519.PrivateKey)
+	if !ok {
+		t.Fatalf("Decrypted key is a %T, not an ed25519 key", parsed)
+	}
+	if !bytes.Equal(*private, key.private) {
+		t.Fatal("Decrypted key differs from the original one")
+	}
+
+	_, err = ssh.ParseRawPrivateKey(decryptOpenSSHKey(t, encoded, []byte("wrong passphrase")))
+	if err == nil {
+		t.Fatal("Key decrypted with the wrong passphrase should not parse")
+	}
+}
+
+// TestEncryptedPrivateKeySSHKeygen checks that ssh-keygen decrypts the keys, when it's installed
+func TestEncryptedPrivateKeySSHKeygen(t *testing.T) {
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not installed")
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	passphrase := "correct horse battery staple"
+	encoded, err := key.EncodeEncryptedPrivateKeytoPEM([]byte(passphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "protos-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte(encoded), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command(sshKeygen, "-y", "-P", passphrase, "-f", keyFile).CombinedOutput()
+	if err != nil {
+		t.Fatalf("ssh-keygen failed to decrypt the key: %v: %s", err, out)
+	}
+	if strings.TrimSpace(string(out)) != strings.TrimSpace(key.Public()) {
+		t.Fatalf("ssh-keygen returned public key %q, expected %q", strings.TrimSpace(string(out)), strings.TrimSpace(key.Public()))
+	}
+
+	out, err = exec.Command(sshKeygen, "-y", "-P", "wrong passphrase", "-f", keyFile).CombinedOutput()
+	if err == nil {
+		t.Fatalf("ssh-keygen decrypted the key using the wrong passphrase: %s", out)
+	}
+}
@@ -0,0 +1,216 @@
+package ssh
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// KnownHosts is a known_hosts file managed by Protos. The host key of an instance is recorded the first time it is
+// contacted, and verified on every following connection. The file uses the OpenSSH format, so it can be passed to
+// external ssh invocations using the UserKnownHostsFile option
+type KnownHosts struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewKnownHosts returns a KnownHosts that uses the file at path, which is created when the first key is recorded
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+// Path returns the path of the known_hosts file
+func (kh *KnownHosts) Path() string {
+	return kh.path
+}
+
+// Callback returns a host key callback that verifies the key presented for host, or records it if host was never
+// contacted before. The key is always checked against host, even if the connection goes through a control socket
+// or a jump host
+func (kh *KnownHosts) Callback(host string) ssh.HostKeyCallback {
+	addr := sshAddress(host)
+	host = knownHostsEntry(host)
+	return func(_ string, _ net.Addr, key ssh.PublicKey) error {
+		kh.mu.Lock()
+		defer kh.mu.Unlock()
+
+		_, err := os.Stat(kh.path)
+		if err == nil {
+			check, err := knownhosts.New(kh.path)
+			if err != nil {
+				return errors.Wrapf(err, "Failed to read known hosts file '%s'", kh.path)
+			}
+			err = check(addr, &net.TCPAddr{IP: net.IPv4zero, Port: 22}, key)
+			if err == nil {
+				return nil
+			}
+			keyErr, ok := err.(*knownhosts.KeyError)
+			if !ok {
+				return err
+			}
+			if len(keyErr.Want) > 0 {
+				return errors.Errorf("Host key of '%s' does not match the one recorded in '%s'. If the instance was redeployed or its IP reused, remove the old entry from the file and try again", host, kh.path)
+			}
+		} else if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Failed to read known hosts file '%s'", kh.path)
+		}
+
+		f, err := os.OpenFile(kh.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0600))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to open known hosts file '%s'", kh.path)
+		}
+		defer f.Close()
+		// the entry is not written using knownhosts.Line, which brackets IPv6 hosts in a way knownhosts.New can't parse
+		_, err = f.WriteString(host + " " + string(ssh.MarshalAuthorizedKey(key)))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to record host key of '%s'", host)
+		}
+		return nil
+	}
+}
+
+// Entries returns the known_hosts lines for host
+func (kh *KnownHosts) Entries(host string) ([]string, error) {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	entries := []string{}
+	err := kh.scan(func(line string, matches bool) {
+		if matches {
+			entries = append(entries, line)
+		}
+	}, host)
+	return entries, err
+}
+
+// Remove deletes the entries for host, which should be done when the instance using it is deleted, since its IP
+// might be reused by another instance
+func (kh *KnownHosts) Remove(host string) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	lines := []string{}
+	removed := false
+	err := kh.scan(func(line string, matches bool) {
+		if matches {
+			removed = true
+			return
+		}
+		lines = append(lines, line)
+	}, host)
+	if err != nil || !removed {
+		return err
+	}
+	return kh.write(lines)
+}
+
+// Move records the host key of host for newHost instead, replacing the entries newHost had. It should be done when an
+// instance keeps its host key but gets another IP, e.g. after a stop and start, so that the key stays pinned
+func (kh *KnownHosts) Move(host string, newHost string) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	// entries for the new host belong to the machine that used the IP before
+	kept := []string{}
+	changed := false
+	err := kh.scan(func(line string, matches bool) {
+		if matches {
+			changed = true
+			return
+		}
+		kept = append(kept, line)
+	}, newHost)
+	if err != nil {
+		return err
+	}
+	entry := knownHostsEntry(host)
+	newEntry := knownHostsEntry(newHost)
+	lines := []string{}
+	for _, line := range kept {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			hosts := strings.Split(fields[0], ",")
+			for i, h := range hosts {
+				if h == entry {
+					hosts[i] = newEntry
+				}
+			}
+			if joined := strings.Join(hosts, ","); joined != fields[0] {
+				line = joined + strings.TrimPrefix(line, fields[0])
+				changed = true
+			}
+		}
+		lines = append(lines, line)
+	}
+	if !changed {
+		return nil
+	}
+	return kh.write(lines)
+}
+
+// write replaces the content of the known_hosts file with lines
+func (kh *KnownHosts) write(lines []string) error {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	tmpPath := kh.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0600))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update known hosts file '%s'", kh.path)
+	}
+	_, err = f.WriteString(content)
+	f.Close()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to update known hosts file '%s'", kh.path)
+	}
+	return os.Rename(tmpPath, kh.path)
+}
+
+// scan calls fn for every line of the known_hosts file, indicating if the line is an entry for host
+func (kh *KnownHosts) scan(fn func(line string, matches bool), host string) error {
+	f, err := os.Open(kh.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "Failed to read known hosts file '%s'", kh.path)
+	}
+	defer f.Close()
+
+	entry := knownHostsEntry(host)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		fields := strings.Fields(line)
+		matches := false
+		if len(fields) > 0 {
+			for _, h := range strings.Split(fields[0], ",") {
+				if h == entry {
+					matches = true
+				}
+			}
+		}
+		fn(line, matches)
+	}
+	return scanner.Err()
+}
+
+// knownHostsEntry returns the host pattern used in the known_hosts file. Like OpenSSH, the bare host is used for the
+// default port, and "[host]:port" for any other port
+func knownHostsEntry(host string) string {
+	h, port, err := net.SplitHostPort(host)
+	if err != nil {
+		return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if port == "22" {
+		return h
+	}
+	return "[" + h + "]:" + port
+}
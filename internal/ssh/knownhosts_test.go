@@ -0,0 +1,49 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKnownHostsMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "protos-knownhosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+	content := "10.0.0.1 ssh-ed25519 AAAAinstance\n10.0.0.2 ssh-ed25519 AAAAprevious\n10.0.0.3 ssh-ed25519 AAAAother\n"
+	err = ioutil.WriteFile(path, []byte(content), os.FileMode(0600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kh := NewKnownHosts(path)
+	err = kh.Move("10.0.0.1", "10.0.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "10.0.0.2 ssh-ed25519 AAAAinstance\n10.0.0.3 ssh-ed25519 AAAAother\n"
+	if string(data) != expected {
+		t.Fatalf("Expected the key to be moved to the new IP, replacing its previous key. Got:\n%s", data)
+	}
+
+	// nothing is written if neither host has entries
+	err = kh.Move("10.0.0.4", "10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := kh.Entries("10.0.0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected no entries for a host without a key, got %v", entries)
+	}
+}
@@ -0,0 +1,200 @@
+package ssh
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Pool keeps SSH connections open so that several operations on the same host, within the same process, reuse a
+// single connection. If a control socket served by another process (see ServeControlSocket) exists for a host,
+// new connections are established through it, reusing the network connection held by that process.
+type Pool struct {
+	controlDir string
+	knownHosts *KnownHosts
+	mu         sync.Mutex
+	conns      map[string]*ssh.Client
+	ctx        context.Context
+}
+
+// NewPool creates a connection pool which looks for control sockets in controlDir. Host keys are verified using
+// knownHosts, unless it is nil
+func NewPool(controlDir string, knownHosts *KnownHosts) *Pool {
+	return &Pool{controlDir: controlDir, knownHosts: knownHosts, conns: map[string]*ssh.Client{}}
+}
+
+// ControlSocketPath returns the path of the control socket for a specific host
+func (p *Pool) ControlSocketPath(host string) string {
+	return filepath.Join(p.controlDir, host+".sock")
+}
+
+// Get returns an open connection to host, reusing a pooled one if it is still alive. The auth methods are tried in
+// order. If useSSHConfig is true, new connections honor the user's ~/.ssh/config. Returned connections are owned by
+// the pool and should not be closed by the caller
+func (p *Pool) Get(host string, user string, auth []ssh.AuthMethod, maxRetries int, useSSHConfig bool) (*ssh.Client, error) {
+	key := user + "@" + host
+	p.mu.Lock()
+	if err := p.canceled(key); err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	if client, found := p.conns[key]; found {
+		_, _, err := client.SendRequest("keepalive@protos.io", true, nil)
+		if err == nil {
+			p.mu.Unlock()
+			return client, nil
+		}
+		log.Debugf("Pooled SSH connection to '%s' is not alive anymore: %s", key, err.Error())
+		client.Close()
+		delete(p.conns, key)
+	}
+	p.mu.Unlock()
+
+	// the lock is not held while dialing, so connections to different hosts can be opened concurrently
+	var hostKeyCallback ssh.HostKeyCallback
+	if p.knownHosts != nil {
+		hostKeyCallback = p.knownHosts.Callback(host)
+	}
+	client, err := dialControlSocket(p.ControlSocketPath(host), user, auth, hostKeyCallback)
+	if err != nil {
+		client, err = newConnection(host, user, auth, maxRetries, useSSHConfig, hostKeyCallback)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		log.Debugf("Using control socket for SSH connection to '%s'", key)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.canceled(key); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if existing, found := p.conns[key]; found {
+		client.Close()
+		return existing, nil
+	}
+	p.conns[key] = client
+	return client, nil
+}
+
+// Dial opens a connection to host that is not pooled, verifying its host key like Get. Unlike pooled connections, it's
+// not closed once the context set using SetContext is done, so it can be used to clean up after a timeout. The caller
+// should close it
+func (p *Pool) Dial(host string, user string, auth []ssh.AuthMethod, maxRetries int) (*ssh.Client, error) {
+	var hostKeyCallback ssh.HostKeyCallback
+	if p.knownHosts != nil {
+		hostKeyCallback = p.knownHosts.Callback(host)
+	}
+	return newConnection(host, user, auth, maxRetries, false, hostKeyCallback)
+}
+
+// Close closes all the pooled connections
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for key, client := range p.conns {
+		cerr := client.Close()
+		if cerr != nil {
+			err = errors.Wrapf(cerr, "Failed to close SSH connection to '%s'", key)
+		}
+		delete(p.conns, key)
+	}
+	return err
+}
+
+// SetContext closes the pooled connections once ctx is done, interrupting the commands running on them, and makes Get
+// fail from then on. It's used to enforce the timeout of a command
+func (p *Pool) SetContext(ctx context.Context) {
+	p.mu.Lock()
+	p.ctx = ctx
+	p.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		p.Close()
+	}()
+}
+
+// canceled returns the error of the pool context, if it's done. The pool lock should be held
+func (p *Pool) canceled(key string) error {
+	if p.ctx != nil && p.ctx.Err() != nil {
+		return errors.Wrapf(p.ctx.Err(), "Canceled SSH connection to '%s'", key)
+	}
+	return nil
+}
+
+// ServeControlSocket listens on socketPath and forwards every connection to the SSH server of the remote host, using
+// the provided client. Other processes can then open SSH connections through the socket, without creating a new
+// network connection to the remote host. The returned listener should be closed to stop serving
+func ServeControlSocket(client *ssh.Client, socketPath string, logger *log.Logger) (net.Listener, error) {
+	err := os.MkdirAll(filepath.Dir(socketPath), 0700)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create control socket directory '%s'", filepath.Dir(socketPath))
+	}
+	// remove a stale socket left behind by a previous process
+	if _, err := os.Stat(socketPath); err == nil {
+		if conn, err := dialControlSocketConn(socketPath); err == nil {
+			conn.Close()
+			return nil, errors.Errorf("Control socket '%s' is already served by another process", socketPath)
+		}
+		os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to listen on control socket '%s'", socketPath)
+	}
+
+	go func() {
+		for {
+			localConn, err := listener.Accept()
+			if err != nil {
+				logger.Debugf("Control socket '%s' closed. Not accepting any new connections", socketPath)
+				return
+			}
+			remoteConn, err := client.Dial("tcp", "localhost:22")
+			if err != nil {
+				logger.Errorf("Failed to establish remote SSH connection over control socket '%s': %s", socketPath, err)
+				localConn.Close()
+				continue
+			}
+			go func() {
+				defer localConn.Close()
+				defer remoteConn.Close()
+				go io.Copy(remoteConn, localConn)
+				io.Copy(localConn, remoteConn)
+			}()
+		}
+	}()
+
+	return listener, nil
+}
+
+func dialControlSocketConn(socketPath string) (net.Conn, error) {
+	return net.DialTimeout("unix", socketPath, 2*time.Second)
+}
+
+// dialControlSocket opens an SSH connection through a control socket served by ServeControlSocket
+func dialControlSocket(socketPath string, user string, auth []ssh.AuthMethod, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	conn, err := dialControlSocketConn(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, "localhost:22", clientConfig(user, hostKeyCallback, auth...))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
@@ -0,0 +1,356 @@
+package ssh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// proxyDialTimeout is how long the reverse proxy waits for the connections it opens on behalf of the instance
+const proxyDialTimeout = 30 * time.Second
+
+// ProxyPolicy restricts the destinations an instance can reach through a ReverseProxy
+type ProxyPolicy struct {
+	// Hosts are the host names allowed, like "releases.protos.io" or "*.debian.org". Empty allows all hosts
+	Hosts []string
+	// Private allows loopback, private and link-local addresses, which would let the instance reach the services of the
+	// client machine and its network
+	Private bool
+}
+
+// ReverseProxy lets an instance reach the network through the client machine. It listens on the instance using SSH
+// remote forwarding, and serves HTTP and SOCKS5 proxy requests on the same port by connecting from the client side
+type ReverseProxy struct {
+	conn       *ssh.Client
+	remoteAddr string
+	policy     ProxyPolicy
+	listener   net.Listener
+	log        *logrus.Logger
+	mu         sync.Mutex
+	conns      map[net.Conn]bool
+}
+
+// NewReverseProxy creates a proxy listening on remoteAddr on the instance, e.g. "127.0.0.1:3128"
+func NewReverseProxy(conn *ssh.Client, remoteAddr string, policy ProxyPolicy, logger *logrus.Logger) *ReverseProxy {
+	return &ReverseProxy{conn: conn, remoteAddr: remoteAddr, policy: policy, log: logger, conns: map[net.Conn]bool{}}
+}
+
+// Start listens on the instance and serves the proxy requests in the background. It returns the address listened on
+func (p *ReverseProxy) Start() (string, error) {
+	listener, err := p.conn.Listen("tcp", p.remoteAddr)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to listen on '%s' on the instance. Remote forwarding might be disabled in its SSH server", p.remoteAddr)
+	}
+	p.listener = listener
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				p.log.Debugf("Reverse proxy listener closed: %s", err.Error())
+				return
+			}
+			p.track(conn, true)
+			go func() {
+				defer p.track(conn, false)
+				defer conn.Close()
+				p.serve(conn)
+			}()
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Close stops listening on the instance and closes the proxied connections
+func (p *ReverseProxy) Close() error {
+	if p.listener == nil {
+		return nil
+	}
+	err := p.listener.Close()
+	p.mu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "Error while closing the reverse proxy listener")
+	}
+	return nil
+}
+
+func (p *ReverseProxy) track(conn net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.conns[conn] = true
+	} else {
+		delete(p.conns, conn)
+	}
+}
+
+// serve handles a connection from the instance. SOCKS5 clients start with the protocol version, 5, which is not a
+// valid first byte for HTTP requests
+func (p *ReverseProxy) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	first, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == 5 {
+		p.serveSOCKS(conn, reader)
+		return
+	}
+	p.serveHTTP(conn, reader)
+}
+
+func (p *ReverseProxy) serveHTTP(conn net.Conn, reader *bufio.Reader) {
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		p.log.Debugf("Invalid proxy request: %s", err.Error())
+		return
+	}
+	if req.Method == http.MethodConnect {
+		upstream, err := p.dial(req.Host)
+		if err != nil {
+			p.log.Warn(err.Error())
+			fmt.Fprintf(conn, "HTTP/1.1 %s\r\n\r\n", proxyErrorStatus(err))
+			return
+		}
+		defer upstream.Close()
+		_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		if err != nil {
+			return
+		}
+		pipe(conn, reader, upstream)
+		return
+	}
+
+	if req.URL.Host == "" {
+		io.WriteString(conn, "HTTP/1.1 400 Bad Request\r\n\r\nOnly proxy requests are accepted\r\n")
+		return
+	}
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	upstream, err := p.dial(host)
+	if err != nil {
+		p.log.Warn(err.Error())
+		fmt.Fprintf(conn, "HTTP/1.1 %s\r\n\r\n", proxyErrorStatus(err))
+		return
+	}
+	defer upstream.Close()
+	// a single request is forwarded per connection, since the next ones could target other hosts
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+	err = req.Write(upstream)
+	if err != nil {
+		p.log.Debugf("Failed to forward request to '%s': %s", host, err.Error())
+		return
+	}
+	io.Copy(conn, upstream)
+}
+
+// SOCKS5 reply codes, see RFC 1928
+const (
+	socksSucceeded           = 0
+	socksNotAllowed          = 2
+	socksHostUnreachable     = 4
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+func (p *ReverseProxy) serveSOCKS(conn net.Conn, reader *bufio.Reader) {
+	// greeting: version, number of authentication methods and the methods. Only "no authentication" is offered
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(reader, make([]byte, header[1])); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte{5, 0}); err != nil {
+		return
+	}
+
+	// request: version, command, reserved, address type, address and port
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(reader, request); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if request[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		length, err := reader.ReadByte()
+		if err != nil {
+			return
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddressNotSupported)
+		return
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return
+	}
+	if request[1] != 1 {
+		socksReply(conn, socksCommandNotSupported)
+		return
+	}
+
+	upstream, err := p.dial(net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+	if err != nil {
+		p.log.Warn(err.Error())
+		code := byte(socksHostUnreachable)
+		if _, denied := errors.Cause(err).(proxyDeniedError); denied {
+			code = socksNotAllowed
+		}
+		socksReply(conn, code)
+		return
+	}
+	defer upstream.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return
+	}
+	pipe(conn, reader, upstream)
+}
+
+func socksReply(conn net.Conn, code byte) error {
+	// the bound address is not used by clients, so it's left empty
+	_, err := conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// proxyDeniedError is returned for destinations not allowed by the proxy policy
+type proxyDeniedError struct {
+	reason string
+}
+
+func (e proxyDeniedError) Error() string {
+	return e.reason
+}
+
+func proxyErrorStatus(err error) string {
+	if _, denied := errors.Cause(err).(proxyDeniedError); denied {
+		return "403 Forbidden"
+	}
+	return "502 Bad Gateway"
+}
+
+// dial connects to address on behalf of the instance, if the policy allows it. The addresses are checked once
+// resolved, right before connecting, so that a host name can't point the proxy to a private address
+func (p *ReverseProxy) dial(address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid proxy destination '%s'", address)
+	}
+	if !p.policy.allowsHost(host) {
+		return nil, errors.WithStack(proxyDeniedError{fmt.Sprintf("Reverse proxy denied connection to '%s': host not allowed", address)})
+	}
+	dialer := net.Dialer{
+		Timeout: proxyDialTimeout,
+		Control: func(network string, resolved string, c syscall.RawConn) error {
+			ip, _, err := net.SplitHostPort(resolved)
+			if err != nil {
+				return err
+			}
+			if !p.policy.allowsIP(net.ParseIP(ip)) {
+				return proxyDeniedError{fmt.Sprintf("Reverse proxy denied connection to '%s': private address %s", address, ip)}
+			}
+			return nil
+		},
+	}
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok {
+			if denied, ok := opErr.Err.(proxyDeniedError); ok {
+				return nil, errors.WithStack(denied)
+			}
+		}
+		return nil, errors.Wrapf(err, "Reverse proxy failed to connect to '%s'", address)
+	}
+	p.log.Infof("Reverse proxy connected the instance to '%s'", address)
+	return conn, nil
+}
+
+func (policy ProxyPolicy) allowsHost(host string) bool {
+	if len(policy.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range policy.Hosts {
+		pattern = strings.ToLower(pattern)
+		if pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+func (policy ProxyPolicy) allowsIP(ip net.IP) bool {
+	if policy.Private {
+		return true
+	}
+	return ip != nil && !ip.IsLoopback() && !isPrivateIP(ip) && !ip.IsLinkLocalUnicast() && !ip.IsUnspecified()
+}
+
+// privateNetworks are the private IPv4 ranges of RFC 1918 and the IPv6 unique local range of RFC 4193
+var privateNetworks = []*net.IPNet{
+	{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(172, 16, 0, 0), Mask: net.CIDRMask(12, 32)},
+	{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(16, 32)},
+	{IP: net.IP{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, Mask: net.CIDRMask(7, 128)},
+}
+
+// isPrivateIP reports whether an address belongs to one of the private networks
+func isPrivateIP(ip net.IP) bool {
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// pipe copies data both ways between a proxied connection, whose buffered data is read from reader, and upstream,
+// until one of them is closed
+func pipe(conn net.Conn, reader io.Reader, upstream net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, reader)
+		upstream.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.Close()
+		done <- struct{}{}
+	}()
+	<-done
+}
@@ -0,0 +1,329 @@
+package ssh
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server is a minimal SSH server that runs commands as local processes and forwards TCP connections to local
+// addresses, and from local ports back to the client (remote forwarding). It is used to simulate the SSH endpoint of instances deployed on the fake cloud provider, so it trusts a
+// single client key, ignores the user name and doesn't allocate terminals. Agent forwarding is supported, so that
+// commands can use the SSH agent of the client
+type Server struct {
+	config  *ssh.ServerConfig
+	workDir string
+	env     []string
+	log     *logrus.Logger
+}
+
+// NewServer creates a server that identifies itself using hostKey and accepts clients using authorizedKey, which is
+// in the authorized_keys format. Commands are run using 'sh' in workDir, with env as their environment
+func NewServer(hostKey Key, authorizedKey string, workDir string, env []string, logger *logrus.Logger) (*Server, error) {
+	allowed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse authorized key")
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey.private)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load host key")
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), allowed.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.Errorf("Unknown public key for user '%s'", conn.User())
+		},
+	}
+	config.AddHostKey(signer)
+	return &Server{config: config, workDir: workDir, env: env, log: logger}, nil
+}
+
+// Serve accepts SSH connections on listener until it is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		s.log.Debugf("SSH handshake with '%s' failed: %s", conn.RemoteAddr().String(), err.Error())
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	s.log.Debugf("New SSH connection from '%s'", sshConn.RemoteAddr().String())
+
+	go s.handleGlobalRequests(sshConn, requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			go s.handleSession(sshConn, newChannel)
+		case "direct-tcpip":
+			go s.handleForward(newChannel)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "Unsupported channel type")
+		}
+	}
+}
+
+func (s *Server) handleSession(conn *ssh.ServerConn, newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		s.log.Debugf("Failed to accept session: %s", err.Error())
+		return
+	}
+	defer channel.Close()
+
+	env := append([]string{}, s.env...)
+
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			payload := struct{ Command string }{}
+			err := ssh.Unmarshal(req.Payload, &payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			s.run(exec.Command("sh", "-c", payload.Command), env, channel)
+			return
+		case "shell":
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			s.run(exec.Command("sh"), env, channel)
+			return
+		case "auth-agent-req@openssh.com":
+			socket, cleanup, err := s.serveAgent(conn)
+			if err != nil {
+				s.log.Debugf("Failed to forward SSH agent: %s", err.Error())
+				req.Reply(false, nil)
+				continue
+			}
+			defer cleanup()
+			env = append(env, "SSH_AUTH_SOCK="+socket)
+			req.Reply(true, nil)
+		case "pty-req", "env", "window-change":
+			// terminals are not allocated, but clients that request them can still run commands
+			req.Reply(true, nil)
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// run executes cmd using the session channel for its input and output, and reports its exit status to the client
+func (s *Server) run(cmd *exec.Cmd, env []string, channel ssh.Channel) {
+	cmd.Dir = s.workDir
+	cmd.Env = env
+	cmd.Stdout = channel
+	cmd.Stderr = channel.Stderr()
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		s.log.Debugf("Failed to run command: %s", err.Error())
+		return
+	}
+	// the process doesn't wait for its input to be closed by the client, so the input is copied separately
+	go func() {
+		io.Copy(stdin, channel)
+		stdin.Close()
+	}()
+
+	s.log.Debugf("Running command %s", strconv.Quote(cmd.Args[len(cmd.Args)-1]))
+	status := 0
+	err = cmd.Run()
+	if err != nil {
+		status = 255
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		}
+	}
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+}
+
+// serveAgent listens on a new unix socket, and forwards every connection to it to the agent of the client. The returned
+// function stops listening and removes the socket
+func (s *Server) serveAgent(conn *ssh.ServerConn) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "protos-agent")
+	if err != nil {
+		return "", nil, err
+	}
+	socket := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+	go func() {
+		for {
+			local, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			channel, requests, err := conn.OpenChannel("auth-agent@openssh.com", nil)
+			if err != nil {
+				s.log.Debugf("Failed to open agent channel: %s", err.Error())
+				local.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				go func() {
+					io.Copy(channel, local)
+					channel.CloseWrite()
+				}()
+				io.Copy(local, channel)
+				local.Close()
+				channel.Close()
+			}()
+		}
+	}()
+	return socket, func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	}, nil
+}
+
+func (s *Server) handleForward(newChannel ssh.NewChannel) {
+	payload := struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}{}
+	err := ssh.Unmarshal(newChannel.ExtraData(), &payload)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "Invalid forwarding request")
+		return
+	}
+	addr := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	forwardChannel(conn, channel)
+}
+
+// handleGlobalRequests serves the remote forwarding requests of a client, until it disconnects
+func (s *Server) handleGlobalRequests(conn *ssh.ServerConn, requests <-chan *ssh.Request) {
+	listeners := map[string]net.Listener{}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for req := range requests {
+		payload := struct {
+			Addr string
+			Port uint32
+		}{}
+		switch req.Type {
+		case "tcpip-forward":
+			err := ssh.Unmarshal(req.Payload, &payload)
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				s.log.Debugf("Failed to listen for remote forwarding: %s", err.Error())
+				req.Reply(false, nil)
+				continue
+			}
+			port := uint32(listener.Addr().(*net.TCPAddr).Port)
+			listeners[net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))] = listener
+			// the allocated port is only sent back when the client asked for any port
+			var reply []byte
+			if payload.Port == 0 {
+				reply = ssh.Marshal(struct{ Port uint32 }{port})
+			}
+			req.Reply(true, reply)
+			go s.acceptForwarded(conn, listener, payload.Addr, port)
+		case "cancel-tcpip-forward":
+			err := ssh.Unmarshal(req.Payload, &payload)
+			key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+			if listener, found := listeners[key]; err == nil && found {
+				listener.Close()
+				delete(listeners, key)
+				req.Reply(true, nil)
+				continue
+			}
+			req.Reply(false, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// acceptForwarded opens a channel to the client for every connection accepted by a remote forwarding listener
+func (s *Server) acceptForwarded(conn *ssh.ServerConn, listener net.Listener, addr string, port uint32) {
+	for {
+		local, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		origin := local.RemoteAddr().(*net.TCPAddr)
+		payload := ssh.Marshal(struct {
+			Addr       string
+			Port       uint32
+			OriginAddr string
+			OriginPort uint32
+		}{addr, port, origin.IP.String(), uint32(origin.Port)})
+		go func() {
+			channel, requests, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				s.log.Debugf("Client rejected forwarded connection: %s", err.Error())
+				local.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			forwardChannel(local, channel)
+		}()
+	}
+}
+
+// forwardChannel copies data both ways between a TCP connection and an SSH channel, until both are closed
+func forwardChannel(conn net.Conn, channel ssh.Channel) {
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		io.Copy(conn, channel)
+		conn.Close()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(channel, conn)
+		channel.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+}
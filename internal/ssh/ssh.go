@@ -2,12 +2,16 @@ package ssh
 
 import (
 	"crypto/rand"
+	"io"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 // GenerateKey generates a SSH key pair
@@ -64,15 +68,158 @@ func ExecuteCommand(cmd string, client *ssh.Client) (string, error) {
 
 }
 
-func NewConnection(host string, user string, auth ssh.AuthMethod, maxRetries int) (*ssh.Client, error) {
-	sshConfig := &ssh.ClientConfig{
-		User: "root",
-		Auth: []ssh.AuthMethod{
-			auth,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // TODO validate server before?
+// RunCommand opens a session using the provided client and executes the provided command, streaming its output to
+// stdout and stderr. The exit code of the command is returned, and err is only set if the command could not be run
+func RunCommand(cmd string, stdout io.Writer, stderr io.Writer, client *ssh.Client) (int, error) {
+	return runCommand(cmd, stdout, stderr, client, false)
+}
+
+// RunCommandWithAgent is like RunCommand, but forwards the local SSH agent (see ForwardAgent) to the command, so that
+// it can authenticate to other hosts using the keys of the user
+func RunCommandWithAgent(cmd string, stdout io.Writer, stderr io.Writer, client *ssh.Client) (int, error) {
+	return runCommand(cmd, stdout, stderr, client, true)
+}
+
+func runCommand(cmd string, stdout io.Writer, stderr io.Writer, client *ssh.Client, forwardAgent bool) (int, error) {
+	if forwardAgent {
+		err := ForwardAgent(client)
+		if err != nil {
+			return -1, err
+		}
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return -1, errors.Wrap(err, "Failed to create new sessions")
+	}
+	defer session.Close()
+	if forwardAgent {
+		err = agent.RequestAgentForwarding(session)
+		if err != nil {
+			return -1, errors.Wrap(err, "Failed to request SSH agent forwarding")
+		}
+	}
+
+	session.Stdout = stdout
+	session.Stderr = stderr
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	err = session.Run(cmd)
+	if err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			return exitErr.ExitStatus(), nil
+		}
+		return -1, errors.Wrapf(err, "Failed to execute command '%s'", cmd)
+	}
+	return 0, nil
+}
+
+// WriteFile opens a session using the provided client and writes everything read from src to remotePath
+func WriteFile(src io.Reader, remotePath string, client *ssh.Client) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create new sessions")
+	}
+	defer session.Close()
+
+	session.Stdin = src
+	log.Debugf("Writing (SSH) file '%s'", remotePath)
+	output, err := session.CombinedOutput("cat > " + remotePath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write file '%s': %s", remotePath, string(output))
+	}
+	return nil
+}
+
+// commandReader streams the output of a remote command
+type commandReader struct {
+	session *ssh.Session
+	stdout  io.Reader
+	cmd     string
+}
+
+func (cr *commandReader) Read(p []byte) (int, error) {
+	n, err := cr.stdout.Read(p)
+	if err == io.EOF {
+		// report a failed command instead of a successful end of stream
+		werr := cr.session.Wait()
+		if werr != nil {
+			return n, errors.Wrapf(werr, "Failed to execute command '%s'", cr.cmd)
+		}
+	}
+	return n, err
+}
+
+func (cr *commandReader) Close() error {
+	return cr.session.Close()
+}
+
+// NewCommandReader opens a session using the provided client, executes the provided command and returns a reader
+// for its standard output
+func NewCommandReader(cmd string, client *ssh.Client) (io.ReadCloser, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create new sessions")
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, errors.Wrap(err, "Failed to setup command output")
 	}
+	log.Debugf("Executing (SSH) command '%s'", cmd)
+	err = session.Start(cmd)
+	if err != nil {
+		session.Close()
+		return nil, errors.Wrapf(err, "Failed to execute command '%s'", cmd)
+	}
+	return &commandReader{session: session, stdout: stdout, cmd: cmd}, nil
+}
 
+// clientConfig returns the configuration for a client connection. If hostKeyCallback is nil, any host key is accepted
+func clientConfig(user string, hostKeyCallback ssh.HostKeyCallback, auth ...ssh.AuthMethod) *ssh.ClientConfig {
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}
+}
+
+// PasswordAuth returns an ssh.AuthMethod that authenticates using the password returned by prompt
+func PasswordAuth(prompt func() (string, error)) ssh.AuthMethod {
+	return ssh.PasswordCallback(prompt)
+}
+
+// KeyboardInteractiveAuth returns an ssh.AuthMethod that answers the server challenges using prompt. The echo
+// argument indicates if the answer to a question can be displayed while being typed
+func KeyboardInteractiveAuth(prompt func(instruction string, question string, echo bool) (string, error)) ssh.AuthMethod {
+	return ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			answer, err := prompt(instruction, question, echos[i])
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	})
+}
+
+// NewConnection opens an SSH connection to host, retrying up to maxRetries times
+func NewConnection(host string, user string, auth ssh.AuthMethod, maxRetries int) (*ssh.Client, error) {
+	return newConnection(host, user, []ssh.AuthMethod{auth}, maxRetries, false, nil)
+}
+
+// NewConnectionWithSSHConfig opens an SSH connection to host, retrying up to maxRetries times, and honors the
+// ProxyJump, ProxyCommand and algorithm options from the user's ~/.ssh/config
+func NewConnectionWithSSHConfig(host string, user string, auth ssh.AuthMethod, maxRetries int) (*ssh.Client, error) {
+	return newConnection(host, user, []ssh.AuthMethod{auth}, maxRetries, true, nil)
+}
+
+// newConnection opens an SSH connection to host, retrying up to maxRetries times. The auth methods are tried in order
+func newConnection(host string, user string, auth []ssh.AuthMethod, maxRetries int, useSSHConfig bool, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+	sshConfig := clientConfig(user, hostKeyCallback, auth...)
 	tries := 0
 	var client *ssh.Client
 	var err error
@@ -81,7 +228,11 @@ func NewConnection(host string, user string, auth ssh.AuthMethod, maxRetries int
 		if tries > maxRetries {
 			return nil, errors.Wrapf(err, "Failed to open SSH connection to '%s@%s'", user, host)
 		}
-		client, err = ssh.Dial("tcp", host+":22", sshConfig) // TODO remove hardocoded port?
+		if useSSHConfig {
+			client, err = dialWithSSHConfig(host, sshConfig)
+		} else {
+			client, err = ssh.Dial("tcp", sshAddress(host), sshConfig)
+		}
 		if err != nil {
 			time.Sleep(3 * time.Second)
 		} else {
@@ -90,3 +241,12 @@ func NewConnection(host string, user string, auth ssh.AuthMethod, maxRetries int
 	}
 	return client, nil
 }
+
+// sshAddress returns the address used to dial host. Hosts without a port use the default SSH port, and IPv6 literals,
+// with or without brackets, are bracketed as required by the dialer
+func sshAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "22")
+}
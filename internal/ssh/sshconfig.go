@@ -0,0 +1,423 @@
+package ssh
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const maxProxyJumpDepth = 5
+
+// hostConfig holds the ~/.ssh/config options supported by the ssh package, for a specific host
+type hostConfig struct {
+	HostName      string
+	Port          string
+	User          string
+	ProxyJump     string
+	ProxyCommand  string
+	Ciphers       []string
+	MACs          []string
+	KexAlgorithms []string
+	IdentityFiles []string
+}
+
+// sshConfigPath returns the path of the user's OpenSSH client config
+func sshConfigPath() string {
+	usr, _ := user.Current()
+	return filepath.Join(usr.HomeDir, ".ssh", "config")
+}
+
+// loadHostConfig reads the user's ~/.ssh/config and returns the options that apply to host
+func loadHostConfig(host string) (hostConfig, error) {
+	f, err := os.Open(sshConfigPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return hostConfig{}, nil
+		}
+		return hostConfig{}, errors.Wrap(err, "Failed to open SSH config")
+	}
+	defer f.Close()
+	return parseHostConfig(f, host)
+}
+
+// parseHostConfig parses an OpenSSH client config and returns the options that apply to host. Like OpenSSH, the first
+// obtained value of each option is used. Match blocks and Include directives are not supported and are ignored
+func parseHostConfig(r io.Reader, host string) (hostConfig, error) {
+	cfg := hostConfig{}
+	matching := true
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyword, value := splitConfigLine(line)
+		switch strings.ToLower(keyword) {
+		case "host":
+			matching = matchHostPatterns(strings.Fields(value), host)
+		case "match":
+			log.Debugf("SSH config 'Match' blocks are not supported. Ignoring '%s'", line)
+			matching = false
+		case "include":
+			log.Debugf("SSH config 'Include' directives are not supported. Ignoring '%s'", line)
+		}
+		if !matching {
+			continue
+		}
+
+		switch strings.ToLower(keyword) {
+		case "hostname":
+			setIfEmpty(&cfg.HostName, value)
+		case "port":
+			setIfEmpty(&cfg.Port, value)
+		case "user":
+			setIfEmpty(&cfg.User, value)
+		// ProxyJump and ProxyCommand are mutually exclusive, and the first one found is used
+		case "proxyjump":
+			if cfg.ProxyCommand == "" {
+				setIfEmpty(&cfg.ProxyJump, value)
+			}
+		case "proxycommand":
+			if cfg.ProxyJump == "" {
+				setIfEmpty(&cfg.ProxyCommand, value)
+			}
+		case "ciphers":
+			cfg.Ciphers = algorithmList(cfg.Ciphers, value)
+		case "macs":
+			cfg.MACs = algorithmList(cfg.MACs, value)
+		case "kexalgorithms":
+			cfg.KexAlgorithms = algorithmList(cfg.KexAlgorithms, value)
+		case "identityfile":
+			cfg.IdentityFiles = append(cfg.IdentityFiles, expandHome(value))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return cfg, errors.Wrap(err, "Failed to read SSH config")
+	}
+	if cfg.HostName != "" {
+		cfg.HostName = strings.Replace(cfg.HostName, "%h", host, -1)
+	}
+	return cfg, nil
+}
+
+func splitConfigLine(line string) (string, string) {
+	idx := strings.IndexAny(line, " \t=")
+	if idx == -1 {
+		return line, ""
+	}
+	value := strings.TrimLeft(line[idx:], " \t=")
+	return line[:idx], strings.Trim(value, "\"")
+}
+
+func setIfEmpty(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+// algorithmList returns the algorithms in value, unless an earlier value was found. Lists that modify the default
+// algorithms (prefixed with +, - or ^) are ignored, since the defaults are used anyway
+func algorithmList(current []string, value string) []string {
+	if len(current) > 0 || strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-") || strings.HasPrefix(value, "^") {
+		return current
+	}
+	return strings.Split(value, ",")
+}
+
+// matchHostPatterns checks host against a list of Host patterns, which support * and ? wildcards and ! negation
+func matchHostPatterns(patterns []string, host string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+		if ok, _ := filepath.Match(pattern, host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		usr, _ := user.Current()
+		return filepath.Join(usr.HomeDir, path[2:])
+	}
+	return path
+}
+
+// dialWithSSHConfig opens an SSH connection to host (port 22 unless overridden), honoring the ProxyJump, ProxyCommand,
+// and algorithm options from the user's ~/.ssh/config
+func dialWithSSHConfig(host string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	cfg, err := loadHostConfig(host)
+	if err != nil {
+		return nil, err
+	}
+	// the user is not taken from the config, since instances are always accessed using the Protos managed user
+	cfg.User = sshConfig.User
+	applyAlgorithms(sshConfig, cfg)
+
+	conn, addr, err := dialTransport(host, cfg, 0)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func applyAlgorithms(sshConfig *ssh.ClientConfig, cfg hostConfig) {
+	sshConfig.Ciphers = cfg.Ciphers
+	sshConfig.MACs = cfg.MACs
+	sshConfig.KeyExchanges = cfg.KexAlgorithms
+}
+
+// dialTransport opens the network connection used to reach host, either directly, through a proxy command, or
+// through one or more jump hosts
+func dialTransport(host string, cfg hostConfig, depth int) (net.Conn, string, error) {
+	hostname := host
+	if cfg.HostName != "" {
+		hostname = cfg.HostName
+	}
+	port := "22"
+	if cfg.Port != "" {
+		port = cfg.Port
+	}
+	addr := net.JoinHostPort(hostname, port)
+
+	if cfg.ProxyCommand != "" && cfg.ProxyCommand != "none" {
+		conn, err := newProxyCommandConn(cfg.ProxyCommand, hostname, port, cfg.User)
+		return conn, addr, err
+	}
+
+	if cfg.ProxyJump != "" && cfg.ProxyJump != "none" {
+		if depth >= maxProxyJumpDepth {
+			return nil, addr, errors.Errorf("Too many nested ProxyJump hosts while connecting to '%s'", host)
+		}
+		jumpClient, err := dialJumpHosts(strings.Split(cfg.ProxyJump, ","), depth+1)
+		if err != nil {
+			return nil, addr, err
+		}
+		conn, err := jumpClient.Dial("tcp", addr)
+		if err != nil {
+			jumpClient.Close()
+			return nil, addr, errors.Wrapf(err, "Failed to connect to '%s' through jump host", addr)
+		}
+		return &jumpConn{Conn: conn, jumpClient: jumpClient}, addr, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	return conn, addr, err
+}
+
+// dialJumpHosts connects to each of the jump hosts in order, each one through the previous, and returns the client
+// for the last one. Jump hosts are specified as [user@]host[:port] and are authenticated using the user's own keys
+func dialJumpHosts(jumps []string, depth int) (*ssh.Client, error) {
+	var client *ssh.Client
+	for _, jump := range jumps {
+		jumpUser, jumpHost, jumpPort := parseJumpSpec(strings.TrimSpace(jump))
+		cfg, err := loadHostConfig(jumpHost)
+		if err != nil {
+			return nil, err
+		}
+		if jumpUser != "" {
+			cfg.User = jumpUser
+		}
+		if jumpPort != "" {
+			cfg.Port = jumpPort
+		}
+		if cfg.User == "" {
+			usr, _ := user.Current()
+			cfg.User = usr.Username
+		}
+
+		var conn net.Conn
+		var addr string
+		if client == nil {
+			conn, addr, err = dialTransport(jumpHost, cfg, depth)
+		} else {
+			hostname := jumpHost
+			if cfg.HostName != "" {
+				hostname = cfg.HostName
+			}
+			port := "22"
+			if cfg.Port != "" {
+				port = cfg.Port
+			}
+			addr = net.JoinHostPort(hostname, port)
+			conn, err = client.Dial("tcp", addr)
+			if err == nil {
+				conn = &jumpConn{Conn: conn, jumpClient: client}
+			}
+		}
+		if err != nil {
+			if client != nil {
+				client.Close()
+			}
+			return nil, errors.Wrapf(err, "Failed to connect to jump host '%s'", jump)
+		}
+
+		sshConfig := &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            personalAuthMethods(cfg.IdentityFiles),
+			HostKeyCallback: personalHostKeyCallback(),
+		}
+		applyAlgorithms(sshConfig, cfg)
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "Failed to open SSH connection to jump host '%s'", jump)
+		}
+		client = ssh.NewClient(c, chans, reqs)
+	}
+	if client == nil {
+		return nil, errors.New("No jump hosts provided")
+	}
+	return client, nil
+}
+
+func parseJumpSpec(spec string) (string, string, string) {
+	jumpUser := ""
+	if idx := strings.LastIndex(spec, "@"); idx != -1 {
+		jumpUser = spec[:idx]
+		spec = spec[idx+1:]
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		return jumpUser, strings.Trim(spec, "[]"), ""
+	}
+	return jumpUser, host, port
+}
+
+// personalAuthMethods returns the auth methods that use the user's own keys: the SSH agent, if available, and the
+// unencrypted identity files
+func personalAuthMethods(identityFiles []string) []ssh.AuthMethod {
+	methods := []ssh.AuthMethod{}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		} else {
+			log.Debugf("Failed to connect to SSH agent: %s", err.Error())
+		}
+	}
+
+	if len(identityFiles) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identityFiles = append(identityFiles, expandHome("~/.ssh/"+name))
+		}
+	}
+	signers := []ssh.Signer{}
+	for _, file := range identityFiles {
+		pemBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(pemBytes)
+		if err != nil {
+			log.Debugf("Skipping identity file '%s': %s", file, err.Error())
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+// personalHostKeyCallback verifies hosts against the user's ~/.ssh/known_hosts file, if it exists
+func personalHostKeyCallback() ssh.HostKeyCallback {
+	callback, err := knownhosts.New(expandHome("~/.ssh/known_hosts"))
+	if err != nil {
+		log.Debugf("Not verifying jump host keys: %s", err.Error())
+		return ssh.InsecureIgnoreHostKey()
+	}
+	return callback
+}
+
+// jumpConn is a connection established through a jump host, which closes the jump host connection when closed
+type jumpConn struct {
+	net.Conn
+	jumpClient *ssh.Client
+}
+
+func (jc *jumpConn) Close() error {
+	err := jc.Conn.Close()
+	jc.jumpClient.Close()
+	return err
+}
+
+// proxyCommandConn is a net.Conn that uses the stdin and stdout of a ProxyCommand process
+type proxyCommandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   proxyCommandAddr
+}
+
+type proxyCommandAddr string
+
+func (pa proxyCommandAddr) Network() string { return "proxycommand" }
+func (pa proxyCommandAddr) String() string  { return string(pa) }
+
+func newProxyCommandConn(command string, host string, port string, user string) (*proxyCommandConn, error) {
+	command = strings.NewReplacer("%h", host, "%p", port, "%r", user, "%%", "%").Replace(command)
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to setup ProxyCommand")
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to setup ProxyCommand")
+	}
+	log.Debugf("Starting SSH ProxyCommand '%s'", command)
+	err = cmd.Start()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to start ProxyCommand '%s'", command)
+	}
+	return &proxyCommandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: proxyCommandAddr(command)}, nil
+}
+
+func (pc *proxyCommandConn) Read(b []byte) (int, error)  { return pc.stdout.Read(b) }
+func (pc *proxyCommandConn) Write(b []byte) (int, error) { return pc.stdin.Write(b) }
+func (pc *proxyCommandConn) LocalAddr() net.Addr         { return pc.addr }
+func (pc *proxyCommandConn) RemoteAddr() net.Addr        { return pc.addr }
+
+func (pc *proxyCommandConn) Close() error {
+	pc.stdin.Close()
+	pc.cmd.Process.Kill()
+	pc.cmd.Wait()
+	return nil
+}
+
+// deadlines are not supported for proxy commands
+func (pc *proxyCommandConn) SetDeadline(t time.Time) error      { return nil }
+func (pc *proxyCommandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (pc *proxyCommandConn) SetWriteDeadline(t time.Time) error { return nil }
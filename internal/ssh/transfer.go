@@ -0,0 +1,302 @@
+package ssh
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// TransferRetries is the number of times an interrupted transfer is resumed before giving up. Chunked uploads retry
+	// every chunk that many times
+	TransferRetries = 5
+	// uploadChunkSize is the amount of data sent again when a chunk fails, and the unit of work of the upload streams
+	uploadChunkSize = 16 * 1024 * 1024
+	uploadBlockSize = 1024 * 1024
+)
+
+// rateLimitedReader limits the rate at which the underlying reader can be consumed
+type rateLimitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+	start time.Time
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	if rl.limit <= 0 {
+		return rl.r.Read(p)
+	}
+	if int64(len(p)) > rl.limit {
+		p = p[:rl.limit]
+	}
+	n, err := rl.r.Read(p)
+	rl.read += int64(n)
+
+	// sleep until the average rate since the start drops under the limit
+	expected := time.Duration(float64(rl.read) / float64(rl.limit) * float64(time.Second))
+	elapsed := time.Since(rl.start)
+	if expected > elapsed {
+		time.Sleep(expected - elapsed)
+	}
+	return n, err
+}
+
+// NewRateLimitedReader returns a reader that reads from r at a maximum of limit bytes per second. A limit of 0 means unlimited
+func NewRateLimitedReader(r io.Reader, limit int64) io.Reader {
+	return &rateLimitedReader{r: r, limit: limit, start: time.Now()}
+}
+
+// TransferOptions tune the transfer of files over SSH
+type TransferOptions struct {
+	BandwidthLimit int64 // maximum transfer rate in bytes per second, shared by all the streams. 0 means unlimited
+	Streams        int   // number of connections copying chunks of the file in parallel, which helps on high latency links. Defaults to 1
+	Compress       bool  // gzip the chunks before sending them. The remote host needs gzip
+}
+
+// upload is the state of a file upload shared by its streams
+type upload struct {
+	file       *os.File
+	localPath  string
+	remotePath string
+	size       int64
+	opts       TransferOptions
+	dial       func() (*ssh.Client, error)
+	chunks     chan int64
+
+	lock     sync.Mutex
+	uploaded int64
+	err      error
+}
+
+// UploadFileChunked copies the file at localPath to remotePath in chunks. The chunks are spread over opts.Streams
+// connections, opened using dial, and optionally compressed. If a chunk fails, its connection is reopened and the chunk
+// is sent again, up to TransferRetries times per chunk, so that a long upload survives any number of brief outages. The
+// remote file is emptied first, so another call starts over instead of continuing an upload that failed
+func UploadFileChunked(localPath string, remotePath string, opts TransferOptions, dial func() (*ssh.Client, error)) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open file '%s'", localPath)
+	}
+	defer f.Close()
+	fileInfo, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Failed to stat file '%s'", localPath)
+	}
+	size := fileInfo.Size()
+
+	client, err := dial()
+	if err != nil {
+		return err
+	}
+	_, err = ExecuteCommand(": > "+remotePath, client)
+	if err != nil {
+		client.Close()
+		return errors.Wrapf(err, "Failed to create remote file '%s'", remotePath)
+	}
+
+	numChunks := int((size + uploadChunkSize - 1) / uploadChunkSize)
+	u := &upload{file: f, localPath: localPath, remotePath: remotePath, size: size, opts: opts, dial: dial, chunks: make(chan int64, numChunks)}
+	for offset := int64(0); offset < size; offset += uploadChunkSize {
+		u.chunks <- offset
+	}
+	close(u.chunks)
+	streams := opts.Streams
+	if streams > numChunks {
+		streams = numChunks
+	}
+	if streams < 1 {
+		streams = 1
+	}
+	if opts.BandwidthLimit > 0 {
+		// the limit is shared by the streams, without going under 1 byte per second, which means unlimited
+		u.opts.BandwidthLimit = opts.BandwidthLimit / int64(streams)
+		if u.opts.BandwidthLimit < 1 {
+			u.opts.BandwidthLimit = 1
+		}
+	}
+	log.Debugf("Uploading '%s' (%d bytes) in %d chunk(s) over %d stream(s), compression %t", localPath, size, numChunks, streams, opts.Compress)
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func(client *ssh.Client) {
+			defer wg.Done()
+			u.stream(client)
+		}(client)
+		client = nil
+	}
+	wg.Wait()
+	if u.err != nil {
+		return u.err
+	}
+
+	// the chunks are written in place, so a missing one would go unnoticed without checking the final size
+	client, err = dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	remoteSize, err := remoteFileSize(remotePath, client)
+	if err != nil {
+		return err
+	}
+	if remoteSize != size {
+		return errors.Errorf("Failed to upload file '%s': remote file has %d bytes instead of %d", localPath, remoteSize, size)
+	}
+	return nil
+}
+
+// stream uploads chunks until there are none left or the upload failed. A nil client is dialed first
+func (u *upload) stream(client *ssh.Client) {
+	defer func() {
+		if client != nil {
+			client.Close()
+		}
+	}()
+	for offset := range u.chunks {
+		for retries := 0; ; retries++ {
+			if u.failed() {
+				return
+			}
+			var err error
+			if client == nil {
+				client, err = u.dial()
+				if err != nil {
+					u.fail(err)
+					return
+				}
+			}
+			err = u.uploadChunk(offset, client)
+			if err == nil {
+				break
+			}
+			client.Close()
+			client = nil
+			if !u.retry(err, retries) {
+				return
+			}
+		}
+	}
+}
+
+// uploadChunk writes the chunk of the file starting at offset in place in the remote file
+func (u *upload) uploadChunk(offset int64, client *ssh.Client) error {
+	length := u.size - offset
+	if length > uploadChunkSize {
+		length = uploadChunkSize
+	}
+	var src io.Reader = io.NewSectionReader(u.file, offset, length)
+	// chunks start at a multiple of the dd block size, so dd seeks to them without needing GNU extensions
+	cmd := fmt.Sprintf("dd of=%s obs=%d seek=%d conv=notrunc", u.remotePath, uploadBlockSize, offset/uploadBlockSize)
+	if u.opts.Compress {
+		compressed := compressReader(src)
+		defer compressed.Close()
+		src = compressed
+		cmd = "gzip -dc | " + cmd
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.Wrap(err, "Failed to create new sessions")
+	}
+	defer session.Close()
+	session.Stdin = NewRateLimitedReader(src, u.opts.BandwidthLimit)
+	output, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write to file '%s': %s", u.remotePath, strings.TrimSpace(string(output)))
+	}
+	// the exit status of a pipeline is the one of dd, so a failed decompression shows as a short write
+	if written, found := ddBytesCopied(string(output)); found && written != length {
+		return errors.Errorf("Failed to write to file '%s': wrote %d bytes instead of %d: %s", u.remotePath, written, length, strings.TrimSpace(string(output)))
+	}
+
+	u.lock.Lock()
+	u.uploaded += length
+	log.Debugf("Uploaded %d/%d bytes of '%s'", u.uploaded, u.size, u.localPath)
+	u.lock.Unlock()
+	return nil
+}
+
+// retry records a failed chunk, already retried the given number of times, and returns true if it can be sent again
+func (u *upload) retry(err error, retries int) bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.err != nil {
+		return false
+	}
+	if retries >= TransferRetries {
+		u.err = errors.Wrapf(err, "Failed to upload file '%s' after %d retries of the same chunk", u.localPath, TransferRetries)
+		return false
+	}
+	log.Warnf("Upload of '%s' interrupted: %s. Retrying the chunk (%d/%d)", u.localPath, err.Error(), retries+1, TransferRetries)
+	return true
+}
+
+func (u *upload) fail(err error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *upload) failed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.err != nil
+}
+
+// compressReader returns a reader of the gzip compressed content of src. Speed is favored over size, so that the
+// compression doesn't become the bottleneck on fast links
+func compressReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz, err := gzip.NewWriterLevel(pw, gzip.BestSpeed)
+		if err == nil {
+			_, err = io.Copy(gz, src)
+			if closeErr := gz.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// ddBytesCopied returns the number of bytes dd reports as copied, e.g. "16777216 bytes (17 MB, 16 MiB) copied"
+func ddBytesCopied(output string) (int64, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "bytes" {
+			continue
+		}
+		written, err := strconv.ParseInt(fields[0], 10, 64)
+		if err == nil {
+			return written, true
+		}
+	}
+	return 0, false
+}
+
+// remoteFileSize returns the size in bytes of a file on the remote host
+func remoteFileSize(remotePath string, client *ssh.Client) (int64, error) {
+	out, err := ExecuteCommand("stat -c %s "+remotePath, client)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to retrieve size of remote file '%s'", remotePath)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse size of remote file '%s'", remotePath)
+	}
+	return size, nil
+}
@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -17,15 +21,39 @@ type Tunnel struct {
 	sshUser   string
 	sshAuth   ssh.AuthMethod
 	sshConn   *ssh.Client
+	ownConn   bool // true if the SSH connection was opened by the tunnel, and should be closed by it
 	listener  net.Listener
+	listenIP  string // address the local listener is bound to, localhost by default
 	localPort int
+	token     string       // required from the clients of the tunnel, which is served over HTTP, if not empty
+	server    *http.Server // serves the tunnel when a token is required
 	target    string
 	log       *logrus.Logger
 	connMap   []chan bool
+	stats     *tunnelCounters
+}
+
+// TunnelStats are the transfer statistics of a tunnel since it started
+type TunnelStats struct {
+	BytesIn           uint64 // bytes received from the instance
+	BytesOut          uint64 // bytes sent to the instance
+	ActiveConnections int64
+	Connections       int64     // connections accepted since the tunnel started
+	LastActivity      time.Time // zero if no data was transferred yet
+}
+
+// tunnelCounters are updated concurrently by the forwarders of a tunnel
+type tunnelCounters struct {
+	bytesIn      uint64
+	bytesOut     uint64
+	active       int64
+	connections  int64
+	lastActivity int64 // unix time in nanoseconds
 }
 
 type forwarder struct {
 	log    *logrus.Logger
+	stats  *tunnelCounters
 	closed bool
 	errsig chan bool
 	close  chan bool
@@ -47,6 +75,9 @@ func (t *forwarder) pipe(src, dst net.Conn, name string) {
 
 		// write to the other connection
 		n, err = dst.Write(b)
+		if n > 0 {
+			t.count(name, n)
+		}
 		if err != nil {
 			t.errSig(fmt.Sprintf("Write failed to '%s' -> '%s' (%s): ", dst.LocalAddr(), dst.RemoteAddr(), name), err)
 			src.Close()
@@ -55,6 +86,21 @@ func (t *forwarder) pipe(src, dst net.Conn, name string) {
 	}
 }
 
+// count records n bytes forwarded in the direction given by name
+func (t *forwarder) count(name string, n int) {
+	t.stats.count(name == "incoming", n)
+}
+
+// count records n bytes received from the instance if incoming is set, or sent to it otherwise
+func (c *tunnelCounters) count(incoming bool, n int) {
+	if incoming {
+		atomic.AddUint64(&c.bytesIn, uint64(n))
+	} else {
+		atomic.AddUint64(&c.bytesOut, uint64(n))
+	}
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
 func (t *forwarder) errSig(s string, err error) {
 	if t.closed {
 		return
@@ -68,6 +114,9 @@ func (t *forwarder) errSig(s string, err error) {
 
 func (t *forwarder) proxy() {
 	t.log.Debugf("Started forwarder for %p", t.lconn)
+	atomic.AddInt64(&t.stats.active, 1)
+	atomic.AddInt64(&t.stats.connections, 1)
+	defer atomic.AddInt64(&t.stats.active, -1)
 	go t.pipe(t.lconn, t.rconn, "outgoing")
 	go t.pipe(t.rconn, t.lconn, "incoming")
 
@@ -82,8 +131,9 @@ func (t *forwarder) proxy() {
 	}
 }
 
-func newForwarder(lconn, rconn net.Conn, close chan bool, log *logrus.Logger) *forwarder {
+func newForwarder(lconn, rconn net.Conn, close chan bool, stats *tunnelCounters, log *logrus.Logger) *forwarder {
 	return &forwarder{
+		stats:  stats,
 		lconn:  lconn,
 		rconn:  rconn,
 		closed: false,
@@ -97,23 +147,36 @@ func newForwarder(lconn, rconn net.Conn, close chan bool, log *logrus.Logger) *f
 func (t *Tunnel) Start() (int, error) {
 	// setup the local listener using a random port
 	var err error
-	t.listener, err = net.Listen("tcp", "localhost:0")
+	listenIP := t.listenIP
+	if listenIP == "" {
+		listenIP = "localhost"
+	}
+	t.listener, err = net.Listen("tcp", net.JoinHostPort(listenIP, strconv.Itoa(t.localPort)))
 	if err != nil {
 		return 0, err
 	}
 	t.localPort = t.listener.Addr().(*net.TCPAddr).Port
 
-	// setup the SSH connection
-	sshConfig := &ssh.ClientConfig{
-		User: t.sshUser,
-		Auth: []ssh.AuthMethod{t.sshAuth},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// Always accept key.
-			return nil
-		}}
-	t.sshConn, err = ssh.Dial("tcp", t.sshHost, sshConfig)
-	if err != nil {
-		return 0, err
+	// setup the SSH connection, unless an existing one was provided
+	if t.sshConn == nil {
+		sshConfig := &ssh.ClientConfig{
+			User: t.sshUser,
+			Auth: []ssh.AuthMethod{t.sshAuth},
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				// Always accept key.
+				return nil
+			}}
+		t.sshConn, err = ssh.Dial("tcp", sshAddress(t.sshHost), sshConfig)
+		if err != nil {
+			t.listener.Close()
+			return 0, err
+		}
+		t.ownConn = true
+	}
+
+	if t.token != "" {
+		t.serveHTTP()
+		return t.localPort, nil
 	}
 
 	// accept local connections and start the forwarding
@@ -138,7 +201,7 @@ func (t *Tunnel) Start() (int, error) {
 			}
 
 			close := make(chan bool, 1)
-			forwarder := newForwarder(localConn, remoteConn, close, t.log)
+			forwarder := newForwarder(localConn, remoteConn, close, t.stats, t.log)
 			go forwarder.proxy()
 			t.connMap = append(t.connMap, close)
 		}
@@ -147,19 +210,40 @@ func (t *Tunnel) Start() (int, error) {
 	return t.localPort, nil
 }
 
+// Stats returns the transfer statistics of the tunnel. It's safe to call while connections are being forwarded
+func (t *Tunnel) Stats() TunnelStats {
+	stats := TunnelStats{
+		BytesIn:           atomic.LoadUint64(&t.stats.bytesIn),
+		BytesOut:          atomic.LoadUint64(&t.stats.bytesOut),
+		ActiveConnections: atomic.LoadInt64(&t.stats.active),
+		Connections:       atomic.LoadInt64(&t.stats.connections),
+	}
+	if last := atomic.LoadInt64(&t.stats.lastActivity); last > 0 {
+		stats.LastActivity = time.Unix(0, last)
+	}
+	return stats
+}
+
 // Close terminates the SSH tunnel
 func (t *Tunnel) Close() error {
 	// close the listener and the rest of the connections
-	err := t.listener.Close()
+	var err error
+	if t.server != nil {
+		err = t.server.Close()
+	} else {
+		err = t.listener.Close()
+	}
 	if err != nil {
 		return errors.Wrap(err, "Error while closing local tunnel listener")
 	}
 	for _, close := range t.connMap {
 		close <- true
 	}
-	err = t.sshConn.Close()
-	if err != nil {
-		return errors.Wrap(err, "Error while closing ssh tunnel connection")
+	if t.ownConn {
+		err = t.sshConn.Close()
+		if err != nil {
+			return errors.Wrap(err, "Error while closing ssh tunnel connection")
+		}
 	}
 
 	return nil
@@ -167,5 +251,26 @@ func (t *Tunnel) Close() error {
 
 // NewTunnel creates and returns an SSHTunnel
 func NewTunnel(sshHost string, sshUser string, sshAuth ssh.AuthMethod, tunnelTarget string, logger *logrus.Logger) *Tunnel {
-	return &Tunnel{sshHost: sshHost, sshUser: sshUser, sshAuth: sshAuth, target: tunnelTarget, log: logger}
+	return &Tunnel{sshHost: sshHost, sshUser: sshUser, sshAuth: sshAuth, target: tunnelTarget, log: logger, stats: &tunnelCounters{}}
+}
+
+// SetLocalPort sets the local port the tunnel listens on. By default, or if port is 0, a random port is used
+func (t *Tunnel) SetLocalPort(port int) {
+	t.localPort = port
+}
+
+// SetListenAddress sets the local IP address the tunnel listens on, e.g. 127.0.0.1. By default, it listens on localhost
+func (t *Tunnel) SetListenAddress(ip string) {
+	t.listenIP = ip
+}
+
+// RequireToken makes the tunnel only forward the HTTP requests presenting token (see serveHTTP), so that other users of
+// the machine can't use it
+func (t *Tunnel) RequireToken(token string) {
+	t.token = token
+}
+
+// NewTunnelFromConnection creates and returns an SSHTunnel that uses an existing SSH connection. The connection is not closed when the tunnel is closed
+func NewTunnelFromConnection(sshConn *ssh.Client, tunnelTarget string, logger *logrus.Logger) *Tunnel {
+	return &Tunnel{sshHost: sshConn.RemoteAddr().String(), sshConn: sshConn, target: tunnelTarget, log: logger, stats: &tunnelCounters{}}
 }
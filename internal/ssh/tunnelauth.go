@@ -0,0 +1,123 @@
+package ssh
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TokenParam is the query parameter carrying the token of a tunnel, in the URL opened first
+const TokenParam = "protos-token"
+
+// countingConn counts the bytes transferred over a connection to the instance in the statistics of a tunnel
+type countingConn struct {
+	net.Conn
+	stats *tunnelCounters
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.stats.count(true, n)
+	}
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.stats.count(false, n)
+	}
+	return n, err
+}
+
+// serveHTTP forwards the HTTP requests that present the token of the tunnel, including websocket connections. Browsers
+// present it once, in the TokenParam of the first URL opened, and then using a cookie. Other clients can use basic
+// authentication, with the token as password and any user name. The token is removed from the forwarded requests
+func (t *Tunnel) serveHTTP() {
+	cookie := fmt.Sprintf("protos-tunnel-%d", t.localPort) // cookies are shared by all the ports of a host
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = t.target
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				conn, err := t.sshConn.Dial("tcp", t.target)
+				if err != nil {
+					return nil, err
+				}
+				return countingConn{Conn: conn, stats: t.stats}, nil
+			},
+		},
+		ErrorLog: log.New(t.log.WriterLevel(logrus.DebugLevel), "", 0),
+	}
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if token := r.URL.Query().Get(TokenParam); token != "" {
+			if !t.validToken(token) {
+				t.log.Warnf("Rejected request from '%s' to the tunnel on port %d: invalid token", r.RemoteAddr, t.localPort)
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: cookie, Value: t.token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+			query := r.URL.Query()
+			query.Del(TokenParam)
+			r.URL.RawQuery = query.Encode()
+			http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+			return
+		}
+		authorized := false
+		if c, err := r.Cookie(cookie); err == nil && t.validToken(c.Value) {
+			authorized = true
+		}
+		if _, password, ok := r.BasicAuth(); ok && t.validToken(password) {
+			authorized = true
+			r.Header.Del("Authorization")
+		}
+		if !authorized {
+			t.log.Debugf("Rejected request from '%s' to the tunnel on port %d: missing token", r.RemoteAddr, t.localPort)
+			w.Header().Set("WWW-Authenticate", `Basic realm="Protos tunnel, use the token as password"`)
+			http.Error(w, "This tunnel requires a token. Open the URL printed by 'protos instance tunnel'", http.StatusUnauthorized)
+			return
+		}
+		cookies := r.Cookies()
+		r.Header.Del("Cookie")
+		for _, c := range cookies {
+			if c.Name != cookie {
+				r.AddCookie(c)
+			}
+		}
+		proxy.ServeHTTP(w, r)
+	}
+
+	t.server = &http.Server{
+		Handler: http.HandlerFunc(handler),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateNew:
+				atomic.AddInt64(&t.stats.connections, 1)
+				atomic.AddInt64(&t.stats.active, 1)
+			case http.StateClosed, http.StateHijacked:
+				atomic.AddInt64(&t.stats.active, -1)
+			}
+		},
+	}
+	go func() {
+		err := t.server.Serve(t.listener)
+		if err != nil && err != http.ErrServerClosed {
+			t.log.Errorf("Failed to serve the tunnel on port %d: %s", t.localPort, err.Error())
+		}
+	}()
+}
+
+func (t *Tunnel) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1
+}
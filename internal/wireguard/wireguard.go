@@ -0,0 +1,80 @@
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Key is a WireGuard key pair
+type Key struct {
+	private [32]byte
+	public  [32]byte
+}
+
+// GenerateKey creates a new random key pair, like 'wg genkey'
+func GenerateKey() (Key, error) {
+	key := Key{}
+	_, err := rand.Read(key.private[:])
+	if err != nil {
+		return key, errors.Wrap(err, "Failed to generate WireGuard key")
+	}
+	// clamp the private key, as required by Curve25519
+	key.private[0] &= 248
+	key.private[31] &= 127
+	key.private[31] |= 64
+	curve25519.ScalarBaseMult(&key.public, &key.private)
+	return key, nil
+}
+
+// Private returns the base64 encoded private key
+func (k Key) Private() string {
+	return base64.StdEncoding.EncodeToString(k.private[:])
+}
+
+// Public returns the base64 encoded public key
+func (k Key) Public() string {
+	return base64.StdEncoding.EncodeToString(k.public[:])
+}
+
+// Peer is a [Peer] section of a WireGuard configuration
+type Peer struct {
+	PublicKey           string
+	Endpoint            string   // host:port the peer is reached at
+	AllowedIPs          []string // networks routed to the peer
+	PersistentKeepalive int      // interval in seconds, 0 disables keepalives
+}
+
+// Config is a WireGuard interface configuration, in the format used by wg-quick
+type Config struct {
+	PrivateKey string
+	Address    string // address of the interface, in CIDR notation
+	ListenPort int
+	PostUp     []string // commands run by wg-quick after bringing the interface up
+	Peers      []Peer
+}
+
+func (c Config) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "[Interface]\n")
+	fmt.Fprintf(b, "PrivateKey = %s\n", c.PrivateKey)
+	fmt.Fprintf(b, "Address = %s\n", c.Address)
+	fmt.Fprintf(b, "ListenPort = %d\n", c.ListenPort)
+	for _, cmd := range c.PostUp {
+		fmt.Fprintf(b, "PostUp = %s\n", cmd)
+	}
+	for _, peer := range c.Peers {
+		fmt.Fprintf(b, "\n[Peer]\n")
+		fmt.Fprintf(b, "PublicKey = %s\n", peer.PublicKey)
+		fmt.Fprintf(b, "Endpoint = %s\n", peer.Endpoint)
+		fmt.Fprintf(b, "AllowedIPs = %s\n", strings.Join(peer.AllowedIPs, ", "))
+		if peer.PersistentKeepalive > 0 {
+			fmt.Fprintf(b, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+	return b.String()
+}